@@ -5,21 +5,97 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/netip"
 	"os"
+	"strings"
+	"time"
 )
 
 var gArgLogPath string
+var gArgErrorLogPath string
 var gArgAuditPath string
 var gArgAuditBoth bool
 var gArgLogBoth bool
 var gArgNoAuditBool bool
+var gArgAuditFormat string
+var gArgAuditRemote string
+
+var gArgAuditRemoteBuffer int
 
 var gArgConfigPath string
+
+var gArgLenientConfig bool
 var gArgPACPath string
+var gArgPACDNSTimeout time.Duration
+var gArgPACDNSRetries int
+var gArgPACEvalTimeout time.Duration
+var gArgPACCacheSize int
+var gArgPACCacheTTL time.Duration
+var gArgPACSelect string
+var gArgPACAllow string
+var gPACAllowList []string // chains the PAC script may return, parsed from -pac-allow. Any chain is allowed if empty
 
 var gArgQuietBool bool
 var gArgVerboseBool bool
 
+var gArgLogTimeFormat string
+var gArgLogUTCBool bool
+var gArgLogMicroBool bool
+
+var gArgVersionBool bool
+
+var gArgKillActiveBool bool
+
+var gArgExitOnInitialFailureBool bool
+
+var gArgPIDFilePath string
+
+var gArgDebugAddr string
+
+var gArgHealthAddr string
+
+var gArgConnAPIToken string
+
+var gArgReusePortBool bool
+
+var gArgListenBacklog int
+var gArgAcceptLoops int
+
+var gArgOTelEndpoint string
+
+var gArgTarpitDuration time.Duration
+
+var gArgNegotiationTimeout time.Duration
+
+var gArgBindTimeout time.Duration
+
+var gArgPrivateRanges string
+
+var gArgReloadDrain time.Duration
+
+var gArgServerStartInterval time.Duration
+
+var gArgUDPFragPolicy string
+
+var gArgRouteErrorPolicy string
+var gArgRouteErrorDefault string
+
+var gArgSNIPeekTimeout time.Duration
+
+var gArgDNSMaxConcurrent int
+var gArgDNSQueueTimeout time.Duration
+
+var gArgPTRTimeout time.Duration
+var gArgPTRCacheTTL time.Duration
+
+var gArgBanThreshold int
+var gArgBanWindow time.Duration
+var gArgBanDuration time.Duration
+
+var gArgScanThreshold int
+var gArgScanWindow time.Duration
+var gArgScanBan bool
+
 func cmdlineError(a ...interface{}) {
 	fmt.Fprintln(os.Stderr, a...)
 	os.Exit(1)
@@ -29,32 +105,191 @@ func cmdlineError(a ...interface{}) {
 func parseArgs() {
 	flag.BoolVar(&gArgQuietBool, "q", false, "Quiet mode")
 	flag.BoolVar(&gArgVerboseBool, "v", false, "Verbose mode")
+	flag.BoolVar(&gArgVersionBool, "version", false, "Print version and build information, then exit")
 	flag.StringVar(&gArgAuditPath, "audit-file", "", "File to output audit traces. Output to STDOUT if empty")
+	flag.StringVar(&gArgAuditRemote, "audit-remote", "", "Remote collector to send audit traces to, tcp://host:port or udp://host:port. Also output to -audit-file or STDOUT if -audit-both is set")
+	flag.IntVar(&gArgAuditRemoteBuffer, "audit-remote-buffer", 1024, "Number of audit traces buffered while the -audit-remote collector is unreachable, the oldest ones are dropped beyond it")
+	flag.StringVar(&gArgAuditFormat, "audit-format", "text", "Format of audit traces: text or json")
 	flag.BoolVar(&gArgAuditBoth, "audit-both", false, "Output audit traces to both -audit-file and STDOUT.")
 	flag.StringVar(&gArgLogPath, "log-file", "", "File to output logs. Output to STDOUT if empty")
-	flag.BoolVar(&gArgLogBoth, "log-both", false, "Output logs to both -log-file and STDOUT.")
-	flag.StringVar(&gArgConfigPath, "c", "./bbs.json", "JSON configuration file path")
+	flag.StringVar(&gArgErrorLogPath, "error-file", "", "File to output error logs. Output to -log-file if empty, or to STDERR if -log-file is empty too")
+	flag.BoolVar(&gArgLogBoth, "log-both", false, "Output logs to both -log-file and STDOUT, and error logs to both -error-file (or -log-file) and STDERR.")
+	flag.StringVar(&gArgLogTimeFormat, "log-time-format", "", "Go time layout of logs and audit traces timestamps (e.g. 2006-01-02T15:04:05.000000Z07:00). Default date and time format if empty")
+	flag.BoolVar(&gArgLogUTCBool, "log-utc", false, "Use UTC instead of local time in logs and audit traces timestamps")
+	flag.BoolVar(&gArgLogMicroBool, "log-micro", false, "Use microsecond resolution in logs and audit traces timestamps. Ignored if -log-time-format is set")
+	flag.StringVar(&gArgConfigPath, "c", "./bbs.json", "JSON configuration file path, or - to read the configuration from STDIN")
+	flag.BoolVar(&gArgLenientConfig, "lenient-config", false, "Ignore unknown fields of the configuration, logging them as errors, instead of failing the configuration loading")
+	flag.BoolVar(&gArgExitOnInitialFailureBool, "exit-on-initial-failure", false, "Exit with a non-zero status if the initial configuration loading fails, instead of waiting for a valid configuration to be reloaded")
 	flag.BoolVar(&gArgNoAuditBool, "no-audit", false, "No audit traces mode")
+	flag.StringVar(&gArgPIDFilePath, "pidfile", "", "File to write bbs PID to. Removed on clean shutdown (SIGINT/SIGTERM)")
+	flag.BoolVar(&gArgReusePortBool, "reuseport", false, "Set SO_REUSEPORT on servers listening sockets, so that several bbs processes can listen on the same addresses")
+	flag.IntVar(&gArgListenBacklog, "listen-backlog", 0, "Maximum length of the queue of pending connections of servers listening sockets, capped by the system. 0 keeps the system default")
+	flag.IntVar(&gArgAcceptLoops, "accept-loops", 1, "Number of listening sockets, each with its own accept loop, opened by each server (requires -reuseport if greater than 1)")
+	flag.StringVar(&gArgDebugAddr, "debug-addr", "", "Address (host:port) of the debug HTTP server exposing /debug/pprof/ and /debug/vars. Disabled if empty")
+	flag.StringVar(&gArgHealthAddr, "health-addr", "", "Address (host:port) of the health HTTP server exposing /health, answering 200 when bbs is ready and 503 otherwise. Disabled if empty")
+	flag.StringVar(&gArgConnAPIToken, "conn-api-token", "", "Bearer token required by the /connections endpoints of the health server, exposing the active connections and their path through chains, and by its /log-levels endpoint, changing the log and audit levels at runtime. Disabled if empty")
+	flag.BoolVar(&gArgKillActiveBool, "kill-active", false, "Also terminate active connections when the kill switch is engaged (SIGUSR2)")
+	flag.IntVar(&gArgBanThreshold, "ban-threshold", 0, "Number of handshake failures within -ban-window after which a source IP is banned. 0 disables banning")
+	flag.DurationVar(&gArgBanWindow, "ban-window", time.Minute, "Window in which handshake failures of a source IP are counted")
+	flag.DurationVar(&gArgBanDuration, "ban-duration", 10*time.Minute, "Duration of a source IP ban")
+	flag.IntVar(&gArgScanThreshold, "scan-threshold", 0, "Number of distinct destinations requested within -scan-window after which a source IP is reported as scanning. 0 disables scan detection")
+	flag.DurationVar(&gArgScanWindow, "scan-window", 10*time.Second, "Window in which distinct destinations requested by a source IP are counted")
+	flag.BoolVar(&gArgScanBan, "scan-ban", false, "Also ban sources reported as scanning for -ban-duration")
+	flag.DurationVar(&gArgNegotiationTimeout, "negotiation-timeout", 10*time.Second, "Maximum time SOCKS5 and HTTP clients have to complete their handshake and send their request. 0 disables the timeout. Can be overridden per server with the clientHandshakeTimeout option")
+	flag.DurationVar(&gArgServerStartInterval, "server-start-interval", 0, "Delay between the starts of two servers, on startup and on reload, to spread the load of clients reconnecting to many servers at once. 0 starts them all at once")
+	flag.DurationVar(&gArgReloadDrain, "reload-drain", 0, "Maximum time the active connections of servers removed or changed on reload are left to finish before being closed. 0 leaves them until they end")
+	flag.StringVar(&gArgPrivateRanges, "private-ranges", "", "Comma-separated list of ranges (CIDR notation) refused to servers with the blockPrivate option, in addition to the loopback, private, shared, link-local and unspecified ones")
+	flag.DurationVar(&gArgBindTimeout, "bind-timeout", time.Minute, "Maximum time SOCKS5 BIND requests wait for the connection of the peer. 0 disables the timeout")
+	flag.DurationVar(&gArgTarpitDuration, "tarpit-duration", 30*time.Second, "Duration during which connections routed to tarpit are held open before being closed")
+	flag.IntVar(&gArgDNSMaxConcurrent, "dns-max-concurrent", 0, "Maximum number of concurrent local DNS resolutions (chains with proxyDns=false). 0 means unlimited")
+	flag.DurationVar(&gArgDNSQueueTimeout, "dns-queue-timeout", time.Second, "Maximum time a connection waits for a DNS resolution slot when -dns-max-concurrent is reached")
+	flag.DurationVar(&gArgPTRTimeout, "ptr-timeout", 2*time.Second, "Maximum time of the reverse DNS lookups of ptr rules")
+	flag.DurationVar(&gArgPTRCacheTTL, "ptr-cache-ttl", 5*time.Minute, "Duration during which the result of the reverse DNS lookup of an address is cached for ptr rules. 0 disables the cache")
+	if gTransparentCompiled {
+		flag.DurationVar(&gArgSNIPeekTimeout, "sni-peek-timeout", 0, "Maximum time transparent servers wait for a TLS ClientHello to route connections with its server name. 0 disables SNI routing")
+	}
+	flag.StringVar(&gArgRouteErrorPolicy, "route-error-policy", "drop", "Handling of rule evaluation errors in routing tables: skip (the block does not match), drop (the connection fails) or default (use -route-error-default)")
+	flag.StringVar(&gArgRouteErrorDefault, "route-error-default", "", "Route (chain, special route or table:<name>) used on rule evaluation errors if -route-error-policy is default")
+	flag.StringVar(&gArgUDPFragPolicy, "socks5-udp-frag", "drop", "Handling of fragmented SOCKS5 UDP datagrams: drop or reassemble")
 	if gPACcompiled {
 		flag.StringVar(&gArgPACPath, "pac", "", "PAC script file path")
+		flag.DurationVar(&gArgPACDNSTimeout, "pac-dns-timeout", 2*time.Second, "Maximum time of each DNS resolution attempt of the PAC script functions (dnsResolve, isResolvable, isInNet)")
+		flag.StringVar(&gArgPACSelect, "pac-select", "first", "Selection of the chain among the semicolon-separated chains returned by the PAC script: first, random or roundrobin")
+		flag.IntVar(&gArgPACCacheSize, "pac-cache-size", 1024, "Maximum number of destinations whose PAC script result is cached. 0 disables the cache")
+		flag.DurationVar(&gArgPACCacheTTL, "pac-cache-ttl", time.Minute, "Duration during which the PAC script result for a destination is cached")
+		flag.StringVar(&gArgPACAllow, "pac-allow", "", "Comma-separated list of the chains the PAC script may return. Connections for which it returns another chain are dropped. Any declared chain is allowed if empty")
+		flag.IntVar(&gArgPACDNSRetries, "pac-dns-retries", 0, "Number of times failed DNS resolutions of the PAC script functions are attempted again, unless the host does not exist")
+		flag.DurationVar(&gArgPACEvalTimeout, "pac-eval-timeout", 5*time.Second, "Maximum time of an evaluation of the PAC script, including its DNS resolutions. Evaluations exceeding it fail")
+	}
+	if gOTelCompiled {
+		flag.StringVar(&gArgOTelEndpoint, "otel-endpoint", "", "OTLP gRPC endpoint (host:port) to export connection tracing spans to. Tracing disabled if empty")
 	}
 
 	flag.Parse()
 
+	if gArgVersionBool {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+
 	if gArgQuietBool && gArgVerboseBool {
 		cmdlineError("Arguments -q and -v cannot be used together")
 	}
 
-	if gArgAuditBoth && gArgAuditPath == "" {
-		cmdlineError("-audit-file must be defined if -audit-both is set")
+	if gArgAuditBoth && gArgAuditPath == "" && gArgAuditRemote == "" {
+		cmdlineError("-audit-file or -audit-remote must be defined if -audit-both is set")
+	}
+
+	if gArgLogBoth && gArgLogPath == "" && gArgErrorLogPath == "" {
+		cmdlineError("-log-file or -error-file must be defined if -log-both is set")
+	}
+
+	if gArgAuditRemoteBuffer < 1 {
+		cmdlineError("-audit-remote-buffer must be at least 1")
+	}
+
+	if gArgNoAuditBool && (gArgAuditBoth || gArgAuditPath != "" || gArgAuditRemote != "") {
+		cmdlineError("Arguments -no-audit and -audit-file/-audit-both/-audit-remote cannot be used together")
+	}
+
+	if gArgConnAPIToken != "" && gArgHealthAddr == "" {
+		cmdlineError("-conn-api-token requires -health-addr")
+	}
+
+	if gArgReusePortBool && !gReusePortSupported {
+		cmdlineError("-reuseport is not supported on this platform")
+	}
+
+	if gArgListenBacklog < 0 || (gArgListenBacklog > 0 && !gReusePortSupported) {
+		cmdlineError("-listen-backlog must not be negative, and is not supported on this platform")
+	}
+
+	if gArgAcceptLoops < 1 || (gArgAcceptLoops > 1 && !gArgReusePortBool) {
+		cmdlineError("-accept-loops must be at least 1, and requires -reuseport if greater than 1")
+	}
+
+	if gArgAuditFormat != "text" && gArgAuditFormat != "json" {
+		cmdlineError("-audit-format must be text or json")
+	}
+
+	if gArgUDPFragPolicy != "drop" && gArgUDPFragPolicy != "reassemble" {
+		cmdlineError("-socks5-udp-frag must be drop or reassemble")
+	}
+
+	if gArgRouteErrorPolicy != "skip" && gArgRouteErrorPolicy != "drop" && gArgRouteErrorPolicy != "default" {
+		cmdlineError("-route-error-policy must be skip, drop or default")
+	}
+
+	if gArgRouteErrorPolicy == "default" && gArgRouteErrorDefault == "" {
+		cmdlineError("-route-error-default must be defined if -route-error-policy is default")
+	}
+
+	if gArgNegotiationTimeout < 0 {
+		cmdlineError("-negotiation-timeout must not be negative")
+	}
+
+	if gArgReloadDrain < 0 {
+		cmdlineError("-reload-drain must not be negative")
+	}
+
+	if gArgServerStartInterval < 0 {
+		cmdlineError("-server-start-interval must not be negative")
+	}
+
+	if gPACcompiled && (gArgPACDNSTimeout <= 0 || gArgPACDNSRetries < 0 || gArgPACEvalTimeout <= 0) {
+		cmdlineError("-pac-dns-timeout and -pac-eval-timeout must be positive and -pac-dns-retries must not be negative")
+	}
+
+	if gPACcompiled && gArgPACSelect != "first" && gArgPACSelect != "random" && gArgPACSelect != "roundrobin" {
+		cmdlineError("-pac-select must be first, random or roundrobin")
+	}
+
+	if gPACcompiled && gArgPACCacheSize > 0 && gArgPACCacheTTL <= 0 {
+		cmdlineError("-pac-cache-ttl must be positive if -pac-cache-size is set")
+	}
+
+	if gArgPACAllow != "" {
+		for _, chain := range strings.Split(gArgPACAllow, ",") {
+			chain = strings.TrimSpace(chain)
+			if chain == "" {
+				cmdlineError("-pac-allow must not contain empty chain names")
+			}
+			gPACAllowList = append(gPACAllowList, chain)
+		}
+	}
+
+	if gArgPrivateRanges != "" {
+		for _, cidr := range strings.Split(gArgPrivateRanges, ",") {
+			prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+			if err != nil {
+				cmdlineError(fmt.Sprintf("invalid range %q in -private-ranges: %v", cidr, err))
+			}
+			gBlockedRanges = append(gBlockedRanges, prefix.Masked())
+		}
+	}
+
+	if gArgBindTimeout < 0 {
+		cmdlineError("-bind-timeout must not be negative")
+	}
+
+	if gArgBanThreshold > 0 && (gArgBanWindow <= 0 || gArgBanDuration <= 0) {
+		cmdlineError("-ban-window and -ban-duration must be positive if -ban-threshold is set")
+	}
+
+	if gArgDNSMaxConcurrent > 0 && gArgDNSQueueTimeout <= 0 {
+		cmdlineError("-dns-queue-timeout must be positive if -dns-max-concurrent is set")
+	}
+
+	if gArgPTRTimeout <= 0 || gArgPTRCacheTTL < 0 {
+		cmdlineError("-ptr-timeout must be positive and -ptr-cache-ttl must not be negative")
 	}
 
-	if gArgLogBoth && gArgLogPath == "" {
-		cmdlineError("-log-file must be defined if -log-both is set")
+	if gArgScanThreshold > 0 && gArgScanWindow <= 0 {
+		cmdlineError("-scan-window must be positive if -scan-threshold is set")
 	}
 
-	if (gArgNoAuditBool && gArgAuditBoth) || (gArgNoAuditBool && gArgAuditPath != "") {
-		cmdlineError("Arguments -no-audit and -audit-file/-audit-both cannot be used together")
+	if gArgScanBan && (gArgScanThreshold <= 0 || gArgBanDuration <= 0) {
+		cmdlineError("-scan-threshold and -ban-duration must be positive if -scan-ban is set")
 	}
 
 }
@@ -0,0 +1,124 @@
+package main
+
+// Defines the structure used to track client handshake failures and to temporarily ban misbehaving sources (fail2ban-style)
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// banList is the type used to hold per source IP handshake failures and the sources currently banned
+type banList struct {
+	failures  map[string][]time.Time // handshake failure dates, per source IP
+	bans      map[string]time.Time   // ban expiration dates, per source IP
+	lastSweep time.Time              // date of the last removal of the expired failures and bans of all sources
+	mu        sync.Mutex
+}
+
+var gBanList = banList{failures: make(map[string][]time.Time), bans: make(map[string]time.Time)}
+
+// sourceIP returns the IP part of the net.Addr addr, or addr string representation if it has no port
+func sourceIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// fail records a handshake failure for the source of addr.
+// If the source exceeds gArgBanThreshold failures within gArgBanWindow, it is banned for gArgBanDuration.
+func (b *banList) fail(addr net.Addr) {
+	if gArgBanThreshold <= 0 {
+		return
+	}
+
+	ip := sourceIP(addr)
+	now := time.Now()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Forget the failures of the source that happened before the window, and the expired failures and bans of the other sources once per window
+	b.sweepIfDue(now)
+	b.expireFailures(ip, now)
+
+	b.failures[ip] = append(b.failures[ip], now)
+	gMetaLogger.Debugf("handshake failure %v/%v for source %v", len(b.failures[ip]), gArgBanThreshold, ip)
+
+	if len(b.failures[ip]) >= gArgBanThreshold {
+		b.bans[ip] = now.Add(gArgBanDuration)
+		delete(b.failures, ip)
+		gMetaLogger.Infof("source %v failed %v handshakes within %v, banning it for %v", ip, gArgBanThreshold, gArgBanWindow, gArgBanDuration)
+	}
+}
+
+// ban bans the source IP ip for gArgBanDuration, regardless of its handshake failures
+func (b *banList) ban(ip string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.sweepIfDue(now)
+	b.bans[ip] = now.Add(gArgBanDuration)
+	delete(b.failures, ip)
+	gMetaLogger.Infof("banning source %v for %v", ip, gArgBanDuration)
+}
+
+// isBanned reports whether the source of addr is currently banned
+func (b *banList) isBanned(addr net.Addr) bool {
+	ip := sourceIP(addr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.sweepIfDue(now)
+
+	expiration, ok := b.bans[ip]
+	if !ok {
+		return false
+	}
+
+	if now.After(expiration) {
+		gMetaLogger.Infof("ban of source %v expired", ip)
+		delete(b.bans, ip)
+		return false
+	}
+
+	return true
+}
+
+// sweepIfDue forgets the expired failures and bans of all sources, if they were last forgotten more than gArgBanWindow ago. It must be called with b.mu held.
+// Bans of sources which never connect again are otherwise never removed.
+func (b *banList) sweepIfDue(now time.Time) {
+	if now.Sub(b.lastSweep) <= gArgBanWindow {
+		return
+	}
+
+	for source := range b.failures {
+		b.expireFailures(source, now)
+	}
+	for source, expiration := range b.bans {
+		if now.After(expiration) {
+			gMetaLogger.Infof("ban of source %v expired", source)
+			delete(b.bans, source)
+		}
+	}
+	b.lastSweep = now
+}
+
+// expireFailures forgets the failures of the source IP ip that happened before the window. It must be called with b.mu held.
+func (b *banList) expireFailures(ip string, now time.Time) {
+	dates := b.failures[ip]
+	i := 0
+	for i < len(dates) && now.Sub(dates[i]) > gArgBanWindow {
+		i++
+	}
+	if i == len(dates) {
+		delete(b.failures, ip)
+	} else {
+		b.failures[ip] = dates[i:]
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// resetBanList empties the global ban list for the duration of the test
+func resetBanList(t *testing.T) {
+	t.Helper()
+
+	reset := func() {
+		gBanList.mu.Lock()
+		gBanList.failures = make(map[string][]time.Time)
+		gBanList.bans = make(map[string]time.Time)
+		gBanList.lastSweep = time.Time{}
+		gBanList.mu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+func newTestBanList() *banList {
+	return &banList{failures: make(map[string][]time.Time), bans: make(map[string]time.Time)}
+}
+
+func TestBanListBansAfterThreshold(t *testing.T) {
+	setArg(t, &gArgBanThreshold, 3)
+	setArg(t, &gArgBanWindow, time.Minute)
+	setArg(t, &gArgBanDuration, time.Minute)
+
+	b := newTestBanList()
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+
+	for i := 0; i < 2; i++ {
+		b.fail(&net.TCPAddr{IP: source.IP, Port: 1000 + i})
+		if b.isBanned(source) {
+			t.Fatalf("source banned after %v failures, below the threshold", i+1)
+		}
+	}
+
+	// The third failure reaches the threshold, the source is banned whatever its port
+	b.fail(source)
+	if !b.isBanned(&net.TCPAddr{IP: source.IP, Port: 4321}) {
+		t.Fatal("source not banned after reaching the threshold")
+	}
+	if b.isBanned(other) {
+		t.Fatal("other source banned")
+	}
+}
+
+func TestBanListFailuresOutsideWindow(t *testing.T) {
+	setArg(t, &gArgBanThreshold, 2)
+	setArg(t, &gArgBanWindow, 50*time.Millisecond)
+	setArg(t, &gArgBanDuration, time.Minute)
+
+	b := newTestBanList()
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	b.fail(source)
+	time.Sleep(100 * time.Millisecond)
+	b.fail(source)
+	if b.isBanned(source) {
+		t.Fatal("source banned for failures spread over more than the window")
+	}
+}
+
+func TestBanListBanExpires(t *testing.T) {
+	setArg(t, &gArgBanThreshold, 1)
+	setArg(t, &gArgBanWindow, time.Minute)
+	setArg(t, &gArgBanDuration, 100*time.Millisecond)
+
+	b := newTestBanList()
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	b.fail(source)
+	if !b.isBanned(source) {
+		t.Fatal("source not banned")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if b.isBanned(source) {
+		t.Fatal("ban did not expire")
+	}
+}
+
+func TestBanListDisabled(t *testing.T) {
+	setArg(t, &gArgBanThreshold, 0)
+
+	b := newTestBanList()
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	for i := 0; i < 100; i++ {
+		b.fail(source)
+	}
+	if b.isBanned(source) {
+		t.Fatal("source banned with banning disabled")
+	}
+}
+
+func TestBanListSweepsExpiredBans(t *testing.T) {
+	setArg(t, &gArgBanThreshold, 1)
+	setArg(t, &gArgBanWindow, 50*time.Millisecond)
+	setArg(t, &gArgBanDuration, 50*time.Millisecond)
+
+	b := newTestBanList()
+	b.fail(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234})
+	time.Sleep(100 * time.Millisecond)
+
+	// The ban of a source which never connects again is forgotten when another source is checked
+	b.isBanned(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234})
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.bans) != 0 {
+		t.Fatalf("expired bans were not swept: %v", b.bans)
+	}
+}
+
+func TestHandshakeFailuresBanSource(t *testing.T) {
+	resetBanList(t)
+	setArg(t, &gArgBanThreshold, 3)
+	setArg(t, &gArgBanWindow, time.Minute)
+	setArg(t, &gArgBanDuration, 500*time.Millisecond)
+	echo := startEchoServer(t)
+	srv := startDirectServer(t)
+
+	// Clients speaking SOCKS4 fail the handshake
+	for i := 0; i < 3; i++ {
+		conn, err := net.DialTimeout("tcp", srv, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{4, 1})
+		if !isClosed(conn, 2*time.Second) {
+			t.Fatal("connection failing the handshake was not closed")
+		}
+		conn.Close()
+	}
+
+	// The source is banned: its connections are closed at accept, before any negotiation
+	conn, err := net.DialTimeout("tcp", srv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{5, 1, 0})
+	if !isClosed(conn, 2*time.Second) {
+		t.Fatal("connection of a banned source was not closed")
+	}
+
+	// Once the ban expired, the source is served again
+	time.Sleep(600 * time.Millisecond)
+	conn, rep := socks5Connect(t, srv, echo)
+	if rep != 0 {
+		t.Fatalf("connection after the ban expired failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "unbanned")
+}
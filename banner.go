@@ -0,0 +1,65 @@
+package main
+
+// Defines the machine-readable banner describing what bbs is serving, emitted after each successful configuration load
+
+import (
+	"encoding/json"
+)
+
+// bannerServer maps the JSON description of an input server in the banner
+type bannerServer struct {
+	Protocol string `json:"protocol"`
+	Network  string `json:"network"`
+	Address  string `json:"address"`
+	Table    string `json:"table"`
+	Auth     bool   `json:"auth"` // whether clients must authenticate
+}
+
+// banner maps the JSON description of the running state of bbs
+type banner struct {
+	Version     string         `json:"version"`
+	Servers     []bannerServer `json:"servers"`
+	Proxies     int            `json:"proxies"`
+	Chains      int            `json:"chains"`
+	Tables      int            `json:"tables"`
+	Blocks      int            `json:"blocks"`                // number of enabled rule blocks in all routing tables
+	TableBlocks map[string]int `json:"tableBlocks,omitempty"` // number of rule blocks of each routing table
+	PAC         bool           `json:"pac"`
+}
+
+// newBanner returns the banner describing servers, proxies, proxychains and routing
+func newBanner(servers []*server, proxies proxyMap, proxychains map[string]proxyChain, routing routing) banner {
+	b := banner{
+		Version: gVersion,
+		Servers: []bannerServer{},
+		Proxies: len(proxies),
+		Chains:  len(proxychains),
+		PAC:     gArgPACPath != "",
+	}
+
+	for _, s := range servers {
+		b.Servers = append(b.Servers, bannerServer{Protocol: s.prot, Network: s.network, Address: s.address(), Table: s.table, Auth: s.user != ""})
+	}
+
+	// Routing tables are not used when routing with a PAC script
+	if !b.PAC {
+		b.Tables = len(routing)
+		b.TableBlocks = make(map[string]int)
+		for name, table := range routing {
+			b.Blocks += len(table)
+			b.TableBlocks[name] = len(table)
+		}
+	}
+
+	return b
+}
+
+// emitBanner logs the JSON representation of the banner at info level
+func emitBanner(b banner) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		gMetaLogger.Errorf("error marshalling banner: %v", err)
+		return
+	}
+	gMetaLogger.Infof("Serving: %s", data)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBannerWithPAC(t *testing.T) {
+	setArg(t, &gArgPACPath, "/etc/bbs/proxy.pac")
+
+	s, err := newServerFromString("socks5://127.0.0.1:1080:table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := parseRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "drop"}]}`)
+
+	// Routing tables are not used with a PAC script, they are not described
+	b := newBanner([]*server{s}, proxyMap{}, map[string]proxyChain{"direct": testChain("direct")}, r)
+	if !b.PAC || b.Tables != 0 || b.Blocks != 0 || b.TableBlocks != nil {
+		t.Fatalf("banner %+v describes routing tables along with a PAC script", b)
+	}
+	if len(b.Servers) != 1 || b.Servers[0].Address != "127.0.0.1:1080" || b.Chains != 1 {
+		t.Fatalf("banner %+v does not describe the servers and chains", b)
+	}
+}
+
+func TestBannerCounts(t *testing.T) {
+	s, err := newServerFromString("socks5://127.0.0.1:1080:table1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p1, _ := newProxy("socks5", "127.0.0.1", "1337", "", "")
+	p2, _ := newProxy("http", "127.0.0.1", "1338", "", "")
+	r := parseRouting(t, `{
+  "table1": [{"rules": {"rule": "true"}, "route": "direct"}],
+  "table2": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "both"}, {"rules": {"rule": "true"}, "route": "drop"}],
+  "empty": []
+}`)
+
+	// Proxies, chains and rule blocks of each table are counted
+	b := newBanner([]*server{s}, proxyMap{"proxy1": p1, "proxy2": p2}, map[string]proxyChain{"direct": testChain("direct"), "both": testChain("both", p1, p2)}, r)
+	if b.PAC || b.Proxies != 2 || b.Chains != 2 || b.Tables != 3 || b.Blocks != 3 {
+		t.Fatalf("banner %+v does not count the proxies, chains, tables and blocks", b)
+	}
+	want := map[string]int{"table1": 1, "table2": 2, "empty": 0}
+	if !reflect.DeepEqual(b.TableBlocks, want) {
+		t.Errorf("blocks of each table %v instead of %v", b.TableBlocks, want)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+// Defines the global bypass list of the configuration, whose destinations are connected to directly whatever the routing decides, like with NO_PROXY
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// bypassRoute is the name of the direct chain used for the destinations of the bypass list
+const bypassRoute = "bypass"
+
+// bypassList maps the bypass list of the configuration: hostnames matching themselves and their subdomains, and subnets
+type bypassList struct {
+	domains *domainSet
+	cidrs   *cidrSet
+	entries int
+}
+
+// UnmarshalJSON parses the list of entries of the bypass list. Entries are CIDRs, IP addresses, or hostnames matching themselves and their subdomains,
+// unless they start with a dot (or "*."), in which case they only match their subdomains.
+func (b *bypassList) UnmarshalJSON(bytes []byte) error {
+	var entries []string
+	err := json.Unmarshal(bytes, &entries)
+	if err != nil {
+		return err
+	}
+
+	domains := newDomainSet()
+	var ranges []ipRange
+	var malformed []string
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := parsePrefixOrAddr(entry); err == nil {
+			ranges = append(ranges, ipRange{first: prefix.Masked().Addr(), last: lastAddr(prefix)})
+			continue
+		}
+		if !domains.add(entry) {
+			malformed = append(malformed, fmt.Sprintf("%q", entry))
+		}
+	}
+
+	if len(malformed) != 0 {
+		err = fmt.Errorf("bypass entries %v are neither hostnames nor CIDRs", strings.Join(malformed, ", "))
+		return err
+	}
+
+	*b = bypassList{domains: domains, cidrs: newCIDRSet(ranges), entries: len(entries)}
+	return nil
+}
+
+// contains reports whether the destination address addr (format host:port) is in the bypass list. Hostnames are not resolved, so they only match hostname entries.
+func (b *bypassList) contains(addr string) bool {
+	if b == nil || b.entries == 0 {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return b.cidrs.contains(ip.Unmap())
+	}
+	return b.domains.contains(host)
+}
+
+type bypassConf struct {
+	list *bypassList // nil if the configuration defines no bypass list
+	mu   sync.RWMutex
+}
+
+var gBypassConf bypassConf
+
+// bypassed reports whether the destination address addr is in the bypass list of the current configuration
+func bypassed(addr string) bool {
+	gBypassConf.mu.RLock()
+	defer gBypassConf.mu.RUnlock()
+
+	return gBypassConf.list.contains(addr)
+}
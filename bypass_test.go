@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// setBypass replaces the bypass list of the configuration by the JSON list entries for the duration of the test
+func setBypass(t *testing.T, entries string) {
+	t.Helper()
+
+	var list bypassList
+	err := json.Unmarshal([]byte(entries), &list)
+	if err != nil {
+		t.Fatalf("invalid bypass list %v: %v", entries, err)
+	}
+
+	gBypassConf.mu.Lock()
+	previous := gBypassConf.list
+	gBypassConf.list = &list
+	gBypassConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gBypassConf.mu.Lock()
+		gBypassConf.list = previous
+		gBypassConf.mu.Unlock()
+	})
+}
+
+func TestBypassList(t *testing.T) {
+	var list bypassList
+	err := json.Unmarshal([]byte(`["internal.example", ".corp.example", "*.lan", "10.0.0.0/8", "192.0.2.1", "2001:db8::/32", " padded.example "]`), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, expected := range map[string]bool{
+		"internal.example:443":     true,
+		"www.internal.example:443": true,
+		"INTERNAL.example.:443":    true,
+		"corp.example:80":          false,
+		"git.corp.example:80":      true,
+		"printer.lan:631":          true,
+		"padded.example:80":        true,
+		"10.1.2.3:22":              true,
+		"[::ffff:10.1.2.3]:22":     true,
+		"192.0.2.1:80":             true,
+		"192.0.2.2:80":             false,
+		"[2001:db8::1]:443":        true,
+		"[2001:db9::1]:443":        false,
+		"example.com:443":          false,
+		"notinternal.example:443":  false,
+		"internal.example":         false,
+	} {
+		if list.contains(addr) != expected {
+			t.Errorf("%v in bypass list: %v instead of %v", addr, !expected, expected)
+		}
+	}
+
+	// Without bypass list, nothing is bypassed
+	var empty *bypassList
+	if empty.contains("10.1.2.3:22") {
+		t.Error("destination bypassed without bypass list")
+	}
+}
+
+func TestBypassListMalformed(t *testing.T) {
+	var list bypassList
+	err := json.Unmarshal([]byte(`["10.0.0.0/8", "10.0.0.0/33", "bad..example", "*"]`), &list)
+	if err == nil || !strings.Contains(err.Error(), `"10.0.0.0/33", "bad..example", "*"`) {
+		t.Errorf("malformed bypass entries not reported: %v", err)
+	}
+	if err = json.Unmarshal([]byte(`"10.0.0.0/8"`), &list); err == nil {
+		t.Error("bypass list which is not a list accepted")
+	}
+}
+
+func TestBypassConnections(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startEchoServer(t)
+	p, requests := requestRecorder(t, repNotAllowed)
+	setChains(t, testChain(bypassRoute), testChain("proxied", p))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "proxied"}]}`, "")
+	setBypass(t, `["127.0.0.0/8", "localhost"]`)
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table").address()
+
+	// Destinations of the bypass list, by CIDR or hostname, are connected to directly and audited as bypassed
+	_, port, _ := net.SplitHostPort(echo)
+	for _, dest := range []string{echo, "localhost:" + port} {
+		conn, rep := socks5Connect(t, srv, dest)
+		if rep != repSucceeded {
+			t.Fatalf("connection to bypassed destination %v failed with reply %v", dest, rep)
+		}
+		checkEcho(t, conn, "bypassed")
+		if e := findAudit(t, audit, "BYPASS", conn.LocalAddr().String()); e.Dest != dest || e.Chain != bypassRoute {
+			t.Errorf("unexpected BYPASS audit trace %+v", e)
+		}
+		conn.Close()
+	}
+
+	// Other destinations are routed normally
+	conn, rep := socks5Connect(t, srv, "192.0.2.1:80")
+	if rep != repNotAllowed {
+		t.Errorf("connection to routed destination answered with reply %v instead of the proxy's one", rep)
+	}
+	if addr := <-requests; addr != "192.0.2.1:80" {
+		t.Errorf("proxy received a request for %v", addr)
+	}
+	for _, e := range auditEvents(t, audit) {
+		if e.Event == "BYPASS" && e.Client == conn.LocalAddr().String() {
+			t.Errorf("routed destination audited as bypassed: %+v", e)
+		}
+	}
+}
+
+func TestBypassHTTP(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startEchoServer(t)
+	setChains(t, testChain(bypassRoute))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "reject"}]}`, "")
+	setBypass(t, `["127.0.0.1"]`)
+	srv := startServer(t, "http://127.0.0.1:"+freePort(t)+":table").address()
+
+	conn, status := httpProxyConnect(t, srv, echo, "")
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT to bypassed destination answered with status %v", status)
+	}
+	checkEcho(t, conn, "bypassed")
+	if e := findAudit(t, audit, "BYPASS", conn.LocalAddr().String()); e.Handler != "http" || e.Dest != echo {
+		t.Errorf("unexpected BYPASS audit trace %+v", e)
+	}
+}
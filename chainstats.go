@@ -0,0 +1,82 @@
+package main
+
+// Defines the per-chain usage counters, updated when connecting through chains and at the end of relays
+
+import (
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// chainCounters holds the usage counters of a chain, updated concurrently by the handlers
+type chainCounters struct {
+	active    atomic.Int64 // connections established through the chain and not closed yet
+	total     atomic.Int64 // connection attempts through the chain
+	errors    atomic.Int64 // connection attempts through the chain which failed
+	bytesUp   atomic.Int64 // bytes sent from clients to targets through the chain
+	bytesDown atomic.Int64 // bytes sent from targets to clients through the chain
+}
+
+// chainStats is a snapshot of the usage counters of a chain
+type chainStats struct {
+	Active    int64 `json:"active"`
+	Total     int64 `json:"total"`
+	Errors    int64 `json:"errors"`
+	BytesUp   int64 `json:"bytesUp"`
+	BytesDown int64 `json:"bytesDown"`
+}
+
+// chainStatsRegistry is the type used to hold and access the usage counters of all chains, by chain name.
+// Counters are kept across configuration reloads, as long as the chain name is the same.
+type chainStatsRegistry struct {
+	counters map[string]*chainCounters
+	mu       sync.RWMutex
+}
+
+var gChainStats = chainStatsRegistry{counters: make(map[string]*chainCounters)}
+
+// get returns the usage counters of chain name, created on first use
+func (r *chainStatsRegistry) get(name string) *chainCounters {
+	r.mu.RLock()
+	counters, ok := r.counters[name]
+	r.mu.RUnlock()
+	if ok {
+		return counters
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counters, ok = r.counters[name]
+	if !ok {
+		counters = new(chainCounters)
+		r.counters[name] = counters
+	}
+	return counters
+}
+
+// snapshot returns the current value of the usage counters of all chains used since startup
+func (r *chainStatsRegistry) snapshot() map[string]chainStats {
+	r.mu.RLock()
+	counters := maps.Clone(r.counters)
+	r.mu.RUnlock()
+
+	stats := make(map[string]chainStats, len(counters))
+	for name, c := range counters {
+		stats[name] = chainStats{
+			Active:    c.active.Load(),
+			Total:     c.total.Load(),
+			Errors:    c.errors.Load(),
+			BytesUp:   c.bytesUp.Load(),
+			BytesDown: c.bytesDown.Load(),
+		}
+	}
+	return stats
+}
+
+// closed records the end of a connection established through the chain, after up bytes were sent to the target and down bytes to the client
+func (c *chainCounters) closed(up int64, down int64) {
+	c.active.Add(-1)
+	c.bytesUp.Add(up)
+	c.bytesDown.Add(down)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChainStatsRegistry(t *testing.T) {
+	r := chainStatsRegistry{counters: make(map[string]*chainCounters)}
+
+	// Counters are created on first use and shared by the following ones
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := r.get("chain1")
+			c.total.Add(1)
+			c.active.Add(1)
+			c.closed(10, 20)
+		}()
+	}
+	wg.Wait()
+	r.get("chain2").errors.Add(1)
+
+	stats := r.snapshot()
+	expected := map[string]chainStats{
+		"chain1": {Total: 10, BytesUp: 100, BytesDown: 200},
+		"chain2": {Errors: 1},
+	}
+	if len(stats) != len(expected) || stats["chain1"] != expected["chain1"] || stats["chain2"] != expected["chain2"] {
+		t.Errorf("snapshot %+v instead of %+v", stats, expected)
+	}
+}
+
+// startCountedServer starts a server of protocol prot relaying through a direct chain named name, and returns its address
+func startCountedServer(t *testing.T, prot string, name string) string {
+	t.Helper()
+
+	setChains(t, testChain(name))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "`+name+`"}]}`, "")
+	return startServer(t, prot+"://127.0.0.1:"+freePort(t)+":table").address()
+}
+
+func TestChainStatsSocks5(t *testing.T) {
+	echo := startEchoServer(t)
+	srv := startCountedServer(t, "socks5", "counted-socks5")
+	before := gChainStats.snapshot()["counted-socks5"]
+
+	conn, rep := socks5Connect(t, srv, echo)
+	if rep != 0 {
+		t.Fatalf("connection failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "counted")
+
+	stats := gChainStats.snapshot()["counted-socks5"]
+	if stats.Active != before.Active+1 || stats.Total != before.Total+1 {
+		t.Errorf("established connection not counted: %+v", stats)
+	}
+
+	conn.Close()
+	waitFor(t, time.Second, "connection end counted", func() bool {
+		return gChainStats.snapshot()["counted-socks5"].Active == before.Active
+	})
+	stats = gChainStats.snapshot()["counted-socks5"]
+	if stats.BytesUp != before.BytesUp+7 || stats.BytesDown != before.BytesDown+7 || stats.Errors != before.Errors {
+		t.Errorf("relayed bytes not counted: %+v", stats)
+	}
+
+	// Failed connections are counted as errors
+	_, rep = socks5Connect(t, srv, "127.0.0.1:"+freePort(t))
+	if rep == 0 {
+		t.Fatal("connection to a closed port succeeded")
+	}
+	stats = gChainStats.snapshot()["counted-socks5"]
+	if stats.Total != before.Total+2 || stats.Errors != before.Errors+1 || stats.Active != before.Active {
+		t.Errorf("failed connection not counted: %+v", stats)
+	}
+}
+
+func TestChainStatsHTTP(t *testing.T) {
+	echo := startEchoServer(t)
+	srv := startCountedServer(t, "http", "counted-http")
+	before := gChainStats.snapshot()["counted-http"]
+
+	conn, status := httpProxyConnect(t, srv, echo, "")
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT answered with status %v", status)
+	}
+	checkEcho(t, conn, "counted")
+	conn.Close()
+
+	waitFor(t, time.Second, "connection end counted", func() bool {
+		stats := gChainStats.snapshot()["counted-http"]
+		return stats.Total == before.Total+1 && stats.Active == before.Active && stats.BytesUp == before.BytesUp+7 && stats.BytesDown == before.BytesDown+7
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+// Defines the set of subnets loaded from a file by cidrfile rules, sorted to match addresses with a binary search
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ipRange is a range of IP addresses of the same family, from first to last included
+type ipRange struct {
+	first netip.Addr
+	last  netip.Addr
+}
+
+// cidrSet holds sorted and non-overlapping IP address ranges, IPv4 ranges first
+type cidrSet struct {
+	ranges []ipRange
+}
+
+// loadCIDRFile returns the set of the subnets listed in the file at path, with one CIDR (or IP address) per line.
+// Empty lines and comments, starting with #, are ignored. Malformed lines make the loading fail, and are all reported in the returned error.
+func loadCIDRFile(path string) (*cidrSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var ranges []ipRange
+	var malformed []string
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		prefix, err := parsePrefixOrAddr(line)
+		if err != nil {
+			malformed = append(malformed, fmt.Sprintf("line %v: %v", lineNum, err))
+			continue
+		}
+		ranges = append(ranges, ipRange{first: prefix.Masked().Addr(), last: lastAddr(prefix)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(malformed) != 0 {
+		err = fmt.Errorf("malformed lines in %v: %v", path, strings.Join(malformed, ", "))
+		return nil, err
+	}
+
+	return newCIDRSet(ranges), nil
+}
+
+// parsePrefixOrAddr parses s as a CIDR, or as an IP address representing a single address subnet
+func parsePrefixOrAddr(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		if !prefix.IsValid() {
+			err = fmt.Errorf("netip.ParsePrefix(%q): IPv4-mapped prefix length too small", s)
+			return netip.Prefix{}, err
+		}
+	}
+	return prefix, nil
+}
+
+// lastAddr returns the last address of prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	bytes := prefix.Masked().Addr().AsSlice()
+	for i := prefix.Bits(); i < len(bytes)*8; i++ {
+		bytes[i/8] |= 0x80 >> (i % 8)
+	}
+	last, _ := netip.AddrFromSlice(bytes)
+	return last
+}
+
+// newCIDRSet returns the set of ranges, sorted, with overlapping and adjacent ranges merged
+func newCIDRSet(ranges []ipRange) *cidrSet {
+	slices.SortFunc(ranges, func(a, b ipRange) int { return a.first.Compare(b.first) })
+
+	var merged []ipRange
+	for _, r := range ranges {
+		if n := len(merged); n != 0 {
+			last := &merged[n-1]
+			next := last.last.Next()
+			if r.first.Compare(last.last) <= 0 || (next.IsValid() && r.first == next) {
+				if r.last.Compare(last.last) > 0 {
+					last.last = r.last
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	return &cidrSet{ranges: merged}
+}
+
+// contains reports whether ip belongs to one of the subnets of the set
+func (s *cidrSet) contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	i := sort.Search(len(s.ranges), func(i int) bool { return s.ranges[i].last.Compare(ip) >= 0 })
+	return i < len(s.ranges) && s.ranges[i].first.Compare(ip) <= 0
+}
+
+// size returns the number of ranges of the set, after merging
+func (s *cidrSet) size() int {
+	return len(s.ranges)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeListFile writes content to a new file of the test temporary directory, and returns its path
+func writeListFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "list.txt")
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadCIDRFile(t *testing.T) {
+	path := writeListFile(t, `# corporate subnets
+10.0.0.0/8
+10.1.0.0/16       # contained in 10.0.0.0/8
+192.168.0.0/24
+192.168.1.0/24    # adjacent to 192.168.0.0/24
+198.51.100.7
+
+2001:db8::/32
+fd00::1
+::ffff:172.16.0.0/108
+`)
+	set, err := loadCIDRFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Contained and adjacent subnets are merged
+	if set.size() != 6 {
+		t.Errorf("%v ranges instead of 6", set.size())
+	}
+
+	tests := map[string]bool{
+		"10.0.0.0":         true,
+		"10.255.255.255":   true,
+		"11.0.0.0":         false,
+		"192.168.1.255":    true,
+		"192.168.2.0":      false,
+		"198.51.100.7":     true,
+		"198.51.100.8":     false,
+		"172.16.5.1":       true,
+		"::ffff:10.1.2.3":  true,
+		"2001:db8:ffff::1": true,
+		"2001:db9::1":      false,
+		"fd00::1":          true,
+		"fd00::2":          false,
+		"::a00:1":          false,
+	}
+	for addr, want := range tests {
+		if set.contains(netip.MustParseAddr(addr)) != want {
+			t.Errorf("%v in set: %v instead of %v", addr, !want, want)
+		}
+	}
+}
+
+func TestLoadCIDRFileMalformed(t *testing.T) {
+	path := writeListFile(t, `10.0.0.0/8
+10.0.0.0/33
+# comment
+example.com
+2001:db8::/32
+`)
+
+	// Every malformed line is reported
+	_, err := loadCIDRFile(path)
+	if err == nil {
+		t.Fatal("file with malformed lines loaded")
+	}
+	if !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "line 4") || strings.Contains(err.Error(), "line 5") {
+		t.Errorf("malformed lines not reported: %v", err)
+	}
+
+	_, err = loadCIDRFile(filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestCIDRFileRule(t *testing.T) {
+	path := writeListFile(t, "10.0.0.0/8\n2001:db8::/32\n")
+	routes := `{"table": [
+  {"rules": {"rule": "cidrfile", "content": ` + strconv.Quote(path) + `}, "route": "listed"},
+  {"rules": {"rule": "true"}, "route": "other"}
+]}`
+
+	// Hostnames are not resolved, they match no cidrfile rule
+	checkRoutes(t, parseRouting(t, routes), "table", map[string]string{
+		"10.1.2.3:443":      "listed",
+		"[2001:db8::1]:443": "listed",
+		"192.0.2.1:443":     "other",
+		"10.example.com:80": "other",
+	})
+
+	// The file is read again on each loading
+	err := os.WriteFile(path, []byte("192.0.2.0/24\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoutes(t, parseRouting(t, routes), "table", map[string]string{
+		"10.1.2.3:443":  "other",
+		"192.0.2.1:443": "listed",
+	})
+
+	// Malformed or missing files fail the loading
+	err = os.WriteFile(path, []byte("10.0.0.0/8\nnot a cidr\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r routing
+	if err := json.Unmarshal([]byte(routes), &r); err == nil {
+		t.Error("cidrfile rule loaded from a malformed file")
+	}
+	os.Remove(path)
+	if err := json.Unmarshal([]byte(routes), &r); err == nil {
+		t.Error("cidrfile rule loaded from a missing file")
+	}
+}
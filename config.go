@@ -5,8 +5,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"sync"
 )
 
@@ -17,32 +24,450 @@ type chainsConf struct {
 }
 
 type mainConfig struct {
-	Proxies proxyMap
-	Chains  chainMap
-	Routes  routing
-	Servers []server
-	Hosts   hostMap
+	Defaults     chainDefaults
+	Credentials  map[string]credential
+	Proxies      proxyMap
+	Chains       chainMap
+	Ruledefs     ruleDefs
+	Routes       routing
+	DefaultRoute string      // route used when no block of the routing tables matches
+	Bypass       *bypassList // destinations connected to directly, before any routing decision
+	Services     serviceMap  // services matched by service rules, replacing the built-in services of the same name
+	Servers      []server
+	Hosts        hostMap
+	Users        userGroups
+
+	DefinitionsDir string // directory of files defining additional proxies and chains, merged with those of the configuration file
+
+	disabledRoutes []string // routing tables disabled as a whole, left out of Routes
 }
 
 func parseMainConfig(configPath string) (mainConfig, error) {
 
 	var config mainConfig
 
-	fileBytes, err := os.ReadFile(configPath)
+	fileBytes, err := readConfigFile(configPath)
+	if err != nil {
+		err := fmt.Errorf("error reading file %v : %w", configPath, err)
+		return config, err
+	}
+
+	fileBytes, err = stripJSONComments(fileBytes)
+	if err != nil {
+		err = fmt.Errorf("error stripping comments of file %v : %v", configPath, err)
+		return config, err
+	}
+
+	// The defaults, credentials and services sections apply to the chains, proxies and routes sections wherever they appear in the file, so they are decoded first
+	var defaultsOnly struct {
+		Defaults    *chainDefaults
+		Credentials map[string]credential
+		Services    serviceMap
+	}
+	gChainDefaults = builtinChainDefaults()
+	err = json.Unmarshal(fileBytes, &defaultsOnly)
+	if err != nil {
+		err = fmt.Errorf("error unmarshalling defaults, credentials and services of server config file%v : %v", errorLocation(fileBytes, err), err)
+		return config, err
+	}
+	if defaultsOnly.Defaults != nil {
+		gChainDefaults = *defaultsOnly.Defaults
+	}
+	gCredentials = defaultsOnly.Credentials
+	gServices = defaultsOnly.Services.withBuiltins()
+
+	if gArgLenientConfig {
+		warnUnknownFields(fileBytes, &config, configPath)
+	}
+
+	err = decodeJSON(fileBytes, &config)
 	if err != nil {
-		err := fmt.Errorf("error reading file %v : %v", configPath, err)
+		err = fmt.Errorf("error unmarshalling server config file%v : %v", errorLocation(fileBytes, err), err)
 		return config, err
 	}
+	config.Defaults = gChainDefaults
 
-	dec := json.NewDecoder(bytes.NewReader(fileBytes))
-	dec.DisallowUnknownFields()
+	var routesOnly struct {
+		Routes map[string]json.RawMessage
+	}
+	json.Unmarshal(fileBytes, &routesOnly)
+	for name, table := range routesOnly.Routes {
+		if tableDisabled(table) {
+			config.disabledRoutes = append(config.disabledRoutes, name)
+		}
+	}
+
+	if config.DefinitionsDir != "" {
+		err = mergeDefinitionsDir(&config, configPath)
+		if err != nil {
+			err = fmt.Errorf("error merging definitions directory %v : %v", config.DefinitionsDir, err)
+			return config, err
+		}
+	}
 
-	err = dec.Decode(&config)
+	// Replace the references to rule definitions of the ruledefs section, so that rules can be evaluated as is
+	err = config.Routes.resolveRefs(config.Ruledefs)
 	if err != nil {
-		err = fmt.Errorf("error unmarshalling server config file : %v", err)
+		err = fmt.Errorf("error resolving rule definitions : %v", err)
 		return config, err
 	}
 
 	return config, nil
 
 }
+
+// definitionsFile maps the content of a file of the definitions directory
+type definitionsFile struct {
+	Proxies proxyMap
+	Chains  chainMap
+}
+
+// mergeDefinitionsDir adds to config the proxies and chains defined in the .json and .jsonc files of config.DefinitionsDir, read in lexical order.
+// A relative directory is relative to the directory of the configuration file configPath. A name defined in several files (including the configuration file) is a conflict, which fails the merge.
+func mergeDefinitionsDir(config *mainConfig, configPath string) error {
+	dir := config.DefinitionsDir
+	if !filepath.IsAbs(dir) && configPath != "-" {
+		dir = filepath.Join(filepath.Dir(configPath), dir)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	if config.Proxies == nil {
+		config.Proxies = make(proxyMap)
+	}
+	if config.Chains == nil {
+		config.Chains = make(chainMap)
+	}
+
+	// File defining each proxy and chain name, to report conflicts
+	proxiesOrigin := make(map[string]string)
+	for name := range config.Proxies {
+		proxiesOrigin[name] = configPath
+	}
+	chainsOrigin := make(map[string]string)
+	for name := range config.Chains {
+		chainsOrigin[name] = configPath
+	}
+
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".json" && ext != ".jsonc") {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+
+		fileBytes, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		fileBytes, err = stripJSONComments(fileBytes)
+		if err != nil {
+			err = fmt.Errorf("error stripping comments of file %v : %v", path, err)
+			return err
+		}
+
+		var definitions definitionsFile
+		if gArgLenientConfig {
+			warnUnknownFields(fileBytes, &definitions, path)
+		}
+		err = decodeJSON(fileBytes, &definitions)
+		if err != nil {
+			err = fmt.Errorf("error unmarshalling file %v%v : %v", path, errorLocation(fileBytes, err), err)
+			return err
+		}
+
+		for name, p := range definitions.Proxies {
+			if origin, ok := proxiesOrigin[name]; ok {
+				err = fmt.Errorf("proxy %v is defined in both %v and %v", name, origin, path)
+				return err
+			}
+			proxiesOrigin[name] = path
+			config.Proxies[name] = p
+		}
+		for name, c := range definitions.Chains {
+			if origin, ok := chainsOrigin[name]; ok {
+				err = fmt.Errorf("chain %v is defined in both %v and %v", name, origin, path)
+				return err
+			}
+			chainsOrigin[name] = path
+			config.Chains[name] = c
+		}
+		gMetaLogger.Debugf("merged %v proxies and %v chains from %v", len(definitions.Proxies), len(definitions.Chains), path)
+	}
+
+	return nil
+}
+
+// stdinConfig caches the configuration read from STDIN, which can only be read once
+var stdinConfig struct {
+	once  sync.Once
+	bytes []byte
+	err   error
+}
+
+// readConfigFile returns the content of the configuration file configPath, or of STDIN if configPath is "-".
+// STDIN is read until EOF on the first call only, the following calls (on reload) return the same content.
+func readConfigFile(configPath string) ([]byte, error) {
+	if configPath != "-" {
+		return os.ReadFile(configPath)
+	}
+
+	first := false
+	stdinConfig.once.Do(func() {
+		first = true
+		stdinConfig.bytes, stdinConfig.err = io.ReadAll(os.Stdin)
+	})
+	if !first {
+		gMetaLogger.Info("Configuration was read from STDIN, reloading the same configuration")
+	}
+
+	return stdinConfig.bytes, stdinConfig.err
+}
+
+// stripJSONComments returns b with its // line comments and /* */ block comments replaced by spaces (JSONC), so that it can be parsed as JSON.
+// Comment markers inside strings are kept, and line breaks are kept so that decoding errors offsets still match the original file.
+func stripJSONComments(b []byte) ([]byte, error) {
+	out := bytes.Clone(b)
+
+	inString := false
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+
+		if inString {
+			switch c {
+			case '\\':
+				// Skip the escaped character, which may be a quote
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			// Line comment, until the end of the line
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			// Block comment, until the closing */
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end == -1 {
+				return nil, fmt.Errorf("unterminated comment at offset %v", i)
+			}
+			end = i + 2 + end + 2
+			for ; i < end; i++ {
+				if out[i] != '\n' && out[i] != '\r' {
+					out[i] = ' '
+				}
+			}
+			i--
+		}
+	}
+
+	return out, nil
+}
+
+// decodeJSON decodes b into v. Unknown fields make the decoding fail, unless -lenient-config is set, in which case they are ignored (see warnUnknownFields).
+func decodeJSON(b []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if !gArgLenientConfig {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// warnUnknownFields logs the JSON path of each field of b unknown to the type of v, which the decoding of b ignores with -lenient-config.
+// Only the parts of the configuration decoded with decodeJSON are checked, as the others already ignore unknown fields.
+func warnUnknownFields(b []byte, v any, origin string) {
+	for _, path := range unknownFields(b, reflect.TypeOf(v), "") {
+		gMetaLogger.Errorf("ignoring unknown field %v in %v", path, origin)
+	}
+}
+
+// strictTypes are the types with a custom unmarshaller decoding their fields with decodeJSON, whose fields are checked by unknownFields
+var strictTypes = []reflect.Type{
+	reflect.TypeFor[routing](),
+	reflect.TypeFor[routingTable](),
+	reflect.TypeFor[ruleBlock](),
+	reflect.TypeFor[rule](),
+	reflect.TypeFor[ruleCombo](),
+	reflect.TypeFor[ruleDefs](),
+}
+
+// unknownFields returns the JSON paths, starting with path, of the fields of the JSON value b unknown to type t.
+// Rule definitions and rules of rule blocks (evaluater) are checked as rule combos if they have a rule1, op or rule2 field, and as rules otherwise.
+func unknownFields(b []byte, t reflect.Type, path string) []string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeFor[routingTable]() && isObject(b) {
+		t = reflect.TypeFor[routingTableObject]()
+	}
+
+	if t == reflect.TypeFor[evaluater]() {
+		var object map[string]json.RawMessage
+		if json.Unmarshal(b, &object) != nil {
+			return nil
+		}
+		t = reflect.TypeFor[rule]()
+		for key := range object {
+			if strings.EqualFold(key, "rule1") || strings.EqualFold(key, "op") || strings.EqualFold(key, "rule2") {
+				t = reflect.TypeFor[ruleCombo]()
+			}
+		}
+	}
+
+	if reflect.PointerTo(t).Implements(reflect.TypeFor[json.Unmarshaler]()) && !slices.Contains(strictTypes, t) {
+		return nil
+	}
+
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(b, &object) != nil {
+			return nil
+		}
+		for _, key := range slices.Sorted(maps.Keys(object)) {
+			field, ok := jsonField(t, key)
+			if !ok {
+				unknown = append(unknown, strings.TrimPrefix(path+"."+key, "."))
+				continue
+			}
+			unknown = append(unknown, unknownFields(object[key], field.Type, path+"."+key)...)
+		}
+
+	case reflect.Map:
+		var object map[string]json.RawMessage
+		if json.Unmarshal(b, &object) != nil {
+			return nil
+		}
+		for _, key := range slices.Sorted(maps.Keys(object)) {
+			unknown = append(unknown, unknownFields(object[key], t.Elem(), path+"."+key)...)
+		}
+
+	case reflect.Slice:
+		var array []json.RawMessage
+		if json.Unmarshal(b, &array) != nil {
+			return nil
+		}
+		for i, element := range array {
+			unknown = append(unknown, unknownFields(element, t.Elem(), fmt.Sprintf("%v[%v]", path, i))...)
+		}
+	}
+
+	return unknown
+}
+
+// jsonField returns the exported field of struct type t which the JSON key key is decoded into, matching names case-insensitively like encoding/json
+func jsonField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// errorLocation returns the location in the JSON document b of the error err of its unmarshalling, formatted as " at line N", or an empty string if it is unknown
+func errorLocation(b []byte, err error) string {
+	var blockErr *ruleBlockError
+	if errors.As(err, &blockErr) {
+		line, ok := jsonLine(b, "routes", blockErr.table, blockErr.index)
+		if !ok {
+			line, ok = jsonLine(b, "routes", blockErr.table, "blocks", blockErr.index)
+		}
+		if ok {
+			return fmt.Sprintf(" at line %v", line)
+		}
+	}
+
+	// The offsets of syntax errors are relative to the whole document, as it is checked before being decoded
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Sprintf(" at line %v", offsetLine(b, int(syntaxErr.Offset)))
+	}
+
+	return ""
+}
+
+// jsonLine returns the line, starting at 1, at which the value designated by path begins in the JSON document b.
+// The elements of path are object keys, matched case-insensitively as encoding/json does, or array indexes. It returns false if the value is not found.
+func jsonLine(b []byte, path ...any) (int, bool) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+
+	for _, step := range path {
+		token, err := decoder.Token()
+		if err != nil {
+			return 0, false
+		}
+
+		switch step := step.(type) {
+		case string:
+			if token != json.Delim('{') {
+				return 0, false
+			}
+			for {
+				key, err := decoder.Token()
+				if err != nil || key == json.Delim('}') {
+					return 0, false
+				}
+				if name, ok := key.(string); ok && strings.EqualFold(name, step) {
+					break
+				}
+				var skipped json.RawMessage
+				if decoder.Decode(&skipped) != nil {
+					return 0, false
+				}
+			}
+		case int:
+			if token != json.Delim('[') {
+				return 0, false
+			}
+			for range step {
+				var skipped json.RawMessage
+				if !decoder.More() || decoder.Decode(&skipped) != nil {
+					return 0, false
+				}
+			}
+			if !decoder.More() {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+	}
+
+	// The offset of the decoder is right after the previous token, skip the separators to reach the value
+	offset := int(decoder.InputOffset())
+	for offset < len(b) && strings.ContainsRune(" \t\r\n,:", rune(b[offset])) {
+		offset++
+	}
+	return offsetLine(b, offset), true
+}
+
+// offsetLine returns the line, starting at 1, of the byte at offset in b
+func offsetLine(b []byte, offset int) int {
+	return bytes.Count(b[:min(offset, len(b))], []byte("\n")) + 1
+}
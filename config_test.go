@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestStripJSONComments(t *testing.T) {
+	// Comments are replaced by spaces, except line breaks
+	tests := []struct {
+		input, comment string
+	}{
+		{`{"a": 1} // comment`, `// comment`},
+		{`{"a": /* inline */ 1}`, `/* inline */`},
+		{"{\"a\": 1, /* multi\nline */ \"b\": 2}", "/* multi\nline */"},
+		{"// only a comment", "// only a comment"},
+		{`{"re": "^a//b$"} // "quoted"`, `// "quoted"`},
+		{`{"s": "backslash \\"} // comment`, `// comment`},
+		{`{"url": "http://example.com/*x*/"}`, ""},
+		{`{"s": "escaped \" // quote"}`, ""},
+	}
+	for _, test := range tests {
+		blank := strings.Map(func(r rune) rune {
+			if r == '\n' {
+				return r
+			}
+			return ' '
+		}, test.comment)
+		expected := strings.Replace(test.input, test.comment, blank, 1)
+
+		out, err := stripJSONComments([]byte(test.input))
+		if err != nil || string(out) != expected {
+			t.Errorf("stripJSONComments(%q) = %q (%v) instead of %q", test.input, out, err, expected)
+		}
+	}
+
+	_, err := stripJSONComments([]byte(`{"a": 1} /* unterminated`))
+	if err == nil {
+		t.Error("unterminated comment accepted")
+	}
+}
+
+func TestCommentedConfig(t *testing.T) {
+	config, err := parseConfig(t, `// bbs configuration
+{
+  /* chains */
+  "chains": {
+    "direct": {"proxies": []} // no proxies
+  },
+  "routes": {"table": [
+    // slashes in regexps are not comments
+    {"rules": {"rule": "regexp", "variable": "host", "content": "^a//b\\.example\\.com$"}, "route": "drop"},
+    {"rules": {"rule": "regexp", "variable": "addr", "content": "/\\*.*\\*/"}, "route": "reject"}, /* block
+    comment between blocks */
+    {"rules": {"rule": "true"}, "route": "direct", "comment": "everything else // direct"}
+  ]}
+}
+// trailing comment`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRoutes(t, config.Routes, "table", map[string]string{
+		"a//b.example.com:443": "drop",
+		"/*x*/:80":             "reject",
+		"example.com:443":      "direct",
+	})
+	if comment := config.Routes["table"][2].Comment; comment != "everything else // direct" {
+		t.Errorf("comment field %q altered", comment)
+	}
+}
+
+func TestCommentedConfigErrors(t *testing.T) {
+	_, err := parseConfig(t, `{"chains": {"direct": {"proxies": []}} /* unterminated`)
+	if err == nil {
+		t.Error("configuration with unterminated comment accepted")
+	}
+}
+
+// setStdin replaces STDIN by a pipe providing content for the duration of the test, and empties the cache of the configuration read from STDIN
+func setStdin(t *testing.T, content string) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.WriteString(content)
+		w.Close()
+	}()
+
+	previous := os.Stdin
+	os.Stdin = r
+	resetStdinConfig := func() {
+		stdinConfig.once = sync.Once{}
+		stdinConfig.bytes, stdinConfig.err = nil, nil
+	}
+	resetStdinConfig()
+	t.Cleanup(func() {
+		os.Stdin = previous
+		r.Close()
+		resetStdinConfig()
+	})
+}
+
+func TestStdinConfig(t *testing.T) {
+	setStdin(t, `{
+  // read from STDIN
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "direct"}]}
+}`)
+
+	config, err := parseMainConfig("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoutes(t, config.Routes, "table", map[string]string{"example.com:443": "direct"})
+
+	// STDIN is read once, reloading parses the same configuration again
+	config, err = parseMainConfig("-")
+	if err != nil {
+		t.Fatalf("reloading configuration from STDIN failed: %v", err)
+	}
+	checkRoutes(t, config.Routes, "table", map[string]string{"example.com:443": "direct"})
+}
+
+func TestStdinConfigInvalid(t *testing.T) {
+	setStdin(t, `{"chains": `)
+
+	_, err := parseMainConfig("-")
+	if err == nil {
+		t.Fatal("truncated configuration from STDIN accepted")
+	}
+	_, err = parseMainConfig("-")
+	if err == nil {
+		t.Fatal("truncated configuration from STDIN accepted on reload")
+	}
+}
+
+func TestStdinConfigDefinitionsDir(t *testing.T) {
+	// With the configuration read from STDIN, a relative definitions directory is relative to the working directory
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "chains.jsonc"), []byte(`{"chains": {"defined": {"proxies": []}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(filepath.Dir(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	setStdin(t, `{"definitionsDir": "`+filepath.Base(dir)+`", "chains": {"direct": {"proxies": []}}, "routes": {"table": [{"rules": {"rule": "true"}, "route": "defined"}]}}`)
+	config, err := parseMainConfig("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.Chains["defined"]; !ok {
+		t.Errorf("chain of the definitions directory not merged: %v", config.Chains)
+	}
+}
+
+func TestChainDefaults(t *testing.T) {
+	setArg(t, &gChainDefaults, builtinChainDefaults())
+
+	// The defaults section applies to the chains omitting parameters, wherever it appears in the file
+	config, err := parseConfig(t, `{
+  "chains": {
+    "omitting": {"proxies": []},
+    "explicit": {"proxies": [], "proxyDns": true, "tcpReadTimeout": 500}
+  },
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "omitting"}]},
+  "defaults": {"proxyDns": false, "tcpConnectTimeout": 3000, "tcpReadTimeout": 8000}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := chainDefaults{ProxyDns: false, TcpConnectTimeout: 3000, TcpReadTimeout: 8000, ImplicitChains: true}
+	if config.Defaults != want {
+		t.Errorf("defaults %+v instead of %+v", config.Defaults, want)
+	}
+	omitting := config.Chains["omitting"]
+	if omitting.ProxyDns || omitting.TcpConnectTimeout != 3000 || omitting.TcpReadTimeout != 8000 {
+		t.Errorf("chain omitting parameters %+v does not use the defaults", omitting)
+	}
+	explicit := config.Chains["explicit"]
+	if !explicit.ProxyDns || explicit.TcpConnectTimeout != 3000 || explicit.TcpReadTimeout != 500 {
+		t.Errorf("chain setting parameters %+v does not override the defaults", explicit)
+	}
+
+	// Implicit chains are built from the defaults
+	implicit := config.Defaults.chainDesc()
+	if implicit.ProxyDns || implicit.TcpConnectTimeout != 3000 || implicit.TcpReadTimeout != 8000 || implicit.Order != "fixed" || !implicit.NoDelay {
+		t.Errorf("implicit chain %+v does not use the defaults", implicit)
+	}
+
+	// Without defaults section, the builtin defaults are used, also after a configuration with one
+	config, err = parseConfig(t, `{
+  "chains": {"omitting": {"proxies": []}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "omitting"}]}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Defaults != builtinChainDefaults() || config.Chains["omitting"].TcpReadTimeout != 2000 || !config.Chains["omitting"].ProxyDns {
+		t.Errorf("defaults %+v and chain %+v instead of the builtin defaults", config.Defaults, config.Chains["omitting"])
+	}
+}
+
+func TestChainDefaultsInvalid(t *testing.T) {
+	setArg(t, &gChainDefaults, builtinChainDefaults())
+
+	for _, defaults := range []string{`{"tcpReadTimeout": 0}`, `{"tcpConnectTimeout": -1}`, `{"tcpReadTimeout": "1s"}`, `[]`} {
+		_, err := parseConfig(t, `{
+  "defaults": `+defaults+`,
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "direct"}]}
+}`)
+		if err == nil {
+			t.Errorf("defaults %v accepted", defaults)
+		}
+	}
+}
+
+// writeConfigDir writes the configuration config and files, by path relative to it, in a temporary directory, and returns the path of the configuration
+func writeConfigDir(t *testing.T, config string, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	files["bbs.json"] = config
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "bbs.json")
+}
+
+func TestDefinitionsDir(t *testing.T) {
+	path := writeConfigDir(t, `{
+  "definitionsDir": "bbs.d",
+  "proxies": {"main": {"connstring": "socks5://10.0.0.1:1080"}},
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "both"}]}
+}`, map[string]string{
+		"bbs.d/proxy1.json":   `{"proxies": {"proxy1": {"connstring": "socks5://10.0.0.2:1080"}}}`,
+		"bbs.d/proxy2.jsonc":  "// second proxy\n" + `{"proxies": {"proxy2": {"connstring": "http://10.0.0.3:8080"}}}`,
+		"bbs.d/chains.json":   `{"chains": {"both": {"proxies": ["proxy1", "proxy2"]}}}`,
+		"bbs.d/README.md":     "not a definitions file",
+		"bbs.d/sub/more.json": `{"proxies": {"ignored": {"connstring": "socks5://10.0.0.4:1080"}}}`,
+	})
+
+	// The proxies and chains of the .json and .jsonc files are merged with those of the configuration file, subdirectories are ignored
+	config, err := parseMainConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"main", "proxy1", "proxy2"} {
+		if _, ok := config.Proxies[name]; !ok {
+			t.Errorf("proxy %v not defined", name)
+		}
+	}
+	if len(config.Proxies) != 3 {
+		t.Errorf("%v proxies defined instead of 3", len(config.Proxies))
+	}
+	if chain, ok := config.Chains["both"]; !ok || !slices.Equal(chain.Proxies, []string{"proxy1", "proxy2"}) {
+		t.Errorf("chain of the definitions directory not merged: %v", config.Chains)
+	}
+	if _, ok := config.Chains["direct"]; !ok {
+		t.Error("chain of the configuration file not kept")
+	}
+}
+
+func TestDefinitionsDirConflicts(t *testing.T) {
+	tests := []struct {
+		describe string
+		config   string
+		files    map[string]string
+		err      string
+	}{
+		{
+			"proxy defined in two files",
+			`{"definitionsDir": "bbs.d"}`,
+			map[string]string{
+				"bbs.d/a.json": `{"proxies": {"proxy1": {"connstring": "socks5://10.0.0.1:1080"}}}`,
+				"bbs.d/b.json": `{"proxies": {"proxy1": {"connstring": "socks5://10.0.0.2:1080"}}}`,
+			},
+			"proxy proxy1 is defined in both %[1]v/bbs.d/a.json and %[1]v/bbs.d/b.json",
+		},
+		{
+			"chain defined in a file and the configuration file",
+			`{"definitionsDir": "bbs.d", "chains": {"chain1": {"proxies": []}}}`,
+			map[string]string{"bbs.d/a.json": `{"chains": {"chain1": {"proxies": []}}}`},
+			"chain chain1 is defined in both %[1]v/bbs.json and %[1]v/bbs.d/a.json",
+		},
+		{
+			"unknown section",
+			`{"definitionsDir": "bbs.d"}`,
+			map[string]string{"bbs.d/a.json": `{"routes": {}}`},
+			"error unmarshalling file %[1]v/bbs.d/a.json",
+		},
+		{
+			"missing directory",
+			`{"definitionsDir": "missing"}`,
+			map[string]string{},
+			"error merging definitions directory missing : open %[1]v/missing",
+		},
+	}
+
+	for _, test := range tests {
+		path := writeConfigDir(t, test.config, test.files)
+		_, err := parseMainConfig(path)
+		if want := fmt.Sprintf(test.err, filepath.Dir(path)); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%v: error %v instead of %q", test.describe, err, want)
+		}
+	}
+}
+
+func TestLenientConfig(t *testing.T) {
+	path := writeConfigDir(t, `{
+  "definitionsDir": "bbs.d",
+  "legacy": true,
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [
+    {"rules": {"rule": "true", "comment": "any"}, "route": "direct", "priority": 1},
+    {"rules": {"rule1": {"rule": "true"}, "op": "and", "rule2": {"rule": "true", "note": 2}}, "route": "drop"}
+  ]}
+}`, map[string]string{
+		"bbs.d/a.json": `{"proxies": {"proxy1": {"connstring": "socks5://10.0.0.1:1080"}}, "version": 2}`,
+	})
+
+	// Unknown fields fail the configuration by default
+	_, err := parseMainConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("unknown fields accepted in strict mode: %v", err)
+	}
+
+	// With -lenient-config, they are ignored and logged with their JSON path
+	setArg(t, &gArgLenientConfig, true)
+	logs, _ := captureLogs(t)
+	config, err := parseMainConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := config.Proxies["proxy1"]; !ok {
+		t.Error("proxy of the definitions directory not merged")
+	}
+	if len(config.Routes["table"]) != 2 {
+		t.Errorf("routing table not parsed: %v", config.Routes["table"])
+	}
+
+	dir := filepath.Dir(path)
+	for _, warning := range []string{
+		"ignoring unknown field legacy in " + path,
+		"ignoring unknown field routes.table[0].rules.comment in " + path,
+		"ignoring unknown field routes.table[0].priority in " + path,
+		"ignoring unknown field routes.table[1].rules.rule2.note in " + path,
+		"ignoring unknown field version in " + filepath.Join(dir, "bbs.d", "a.json"),
+	} {
+		if !strings.Contains(logs.String(), warning) {
+			t.Errorf("%q not logged in %q", warning, logs.String())
+		}
+	}
+	if n := strings.Count(logs.String(), "ignoring unknown field"); n != 5 {
+		t.Errorf("%v unknown fields logged instead of 5", n)
+	}
+}
+
+func TestConfigErrorLocation(t *testing.T) {
+	tests := []struct {
+		describe string
+		config   string
+		err      string
+	}{
+		{
+			"invalid rule block",
+			`{
+  "chains": {"direct": {"proxies": []}},
+  "routes": {
+    "first": [{"rules": {"rule": "true"}, "route": "direct"}],
+    "second": [
+      {"rules": {"rule": "true"}, "route": "direct", "disable": true},
+      {
+        "rules": {"rule1": {"rule": "true"}, "op": "and"},
+        "route": "direct"
+      }
+    ]
+  }
+}`,
+			"error unmarshalling server config file at line 7 : error unmarshalling ruleBlock number 1 of routingTable second : ",
+		},
+		{
+			"unknown field of a rule block",
+			`{"routes": {"table": [
+  {"rules": {"rule": "true"}, "route": "direct"},
+  {"rules": {"rule": "true"}, "route": "direct"},
+  {"rules": {"rule": "true"}, "rute": "direct"}
+]}}`,
+			"at line 4 : error unmarshalling ruleBlock number 2 of routingTable table : ",
+		},
+		{
+			"syntax error",
+			"{\n  \"chains\": {\n    \"direct\": {\"proxies\": [],}\n  }\n}",
+			"server config file at line 3 : invalid character '}'",
+		},
+	}
+
+	for _, test := range tests {
+		path := writeConfigDir(t, test.config, map[string]string{})
+		_, err := parseMainConfig(path)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: error %v instead of %q", test.describe, err, test.err)
+		}
+	}
+
+	// Errors in definitions files are located in the file
+	path := writeConfigDir(t, `{"definitionsDir": "bbs.d"}`, map[string]string{
+		"bbs.d/a.json": "{\n  \"proxies\": {\n    \"proxy1\": {\"connstring\": \"socks5://10.0.0.1:1080\"}\n  },\n  \"chains\": {\"chain1\": {\"proxies\": [}}\n}",
+	})
+	_, err := parseMainConfig(path)
+	if want := filepath.Join(filepath.Dir(path), "bbs.d", "a.json") + " at line 5 : "; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("error %v instead of %q", err, want)
+	}
+}
+
+func TestJSONLine(t *testing.T) {
+	b := []byte("{\n  \"Routes\": {\n    \"a\": [\n      {},\n\n      {\"x\": 1}\n    ]\n  }\n}")
+	tests := []struct {
+		path []any
+		line int
+		ok   bool
+	}{
+		{[]any{"routes"}, 2, true},
+		{[]any{"routes", "a"}, 3, true},
+		{[]any{"routes", "a", 0}, 4, true},
+		{[]any{"routes", "a", 1}, 6, true},
+		{[]any{"routes", "a", 2}, 0, false},
+		{[]any{"routes", "b"}, 0, false},
+		{[]any{"routes", 0}, 0, false},
+	}
+
+	for _, test := range tests {
+		line, ok := jsonLine(b, test.path...)
+		if line != test.line || ok != test.ok {
+			t.Errorf("jsonLine(%v) = %v, %v instead of %v, %v", test.path, line, ok, test.line, test.ok)
+		}
+	}
+}
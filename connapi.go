@@ -0,0 +1,89 @@
+package main
+
+// Defines the connections endpoints of the health server, exposing the active connections and the path they took through their chain, served only if -conn-api-token is set
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// connView is the JSON description of an active connection returned by the connections endpoints
+type connView struct {
+	ID          uint64            `json:"id"`
+	Client      string            `json:"client"`
+	Server      string            `json:"server"`
+	Start       time.Time         `json:"start"`
+	Chain       string            `json:"chain,omitempty"`
+	Path        string            `json:"path,omitempty"` // representation of the path taken through the chain, as in audit traces
+	Annotations map[string]string `json:"annotations"`
+}
+
+// view returns the JSON description of the connection
+func (c *connInfo) view() connView {
+	annotations := c.getAnnotations()
+	return connView{
+		ID:          c.id,
+		Client:      c.client.String(),
+		Server:      c.server,
+		Start:       c.start,
+		Chain:       annotations["chain"],
+		Path:        annotations["path"],
+		Annotations: annotations,
+	}
+}
+
+// authorized reports whether r carries the -conn-api-token bearer token
+func authorized(r *http.Request) bool {
+	expected := []byte("Bearer " + gArgConnAPIToken)
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+// writeJSON answers with status and v encoded as JSON, without escaping the arrows of chain representations
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+}
+
+// connectionsHandler answers with the list of the active connections, restricted to the connections of the client address given by the client query parameter if any
+func connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	client := r.URL.Query().Get("client")
+	views := []connView{}
+	for _, info := range gConnRegistry.list() {
+		if client == "" || info.client.String() == client {
+			views = append(views, info.view())
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+// connectionHandler answers with the active connection whose id is given in the path, or with status 404 if there is none
+func connectionHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid connection id"})
+		return
+	}
+
+	info, ok := gConnRegistry.get(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no active connection with this id"})
+		return
+	}
+	writeJSON(w, http.StatusOK, info.view())
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getConnAPI sends a GET request for path with token as bearer token to the health server handler, and returns the status code and the decoded JSON response
+func getConnAPI(t *testing.T, path string, token string, response any) int {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	healthMux().ServeHTTP(rec, req)
+
+	if rec.Code == http.StatusOK && response != nil {
+		err := json.Unmarshal(rec.Body.Bytes(), response)
+		if err != nil {
+			t.Fatalf("invalid response %q: %v", rec.Body, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestConnAPI(t *testing.T) {
+	setArg(t, &gArgConnAPIToken, "s3cret")
+	echo := startEchoServer(t)
+	host, port, _ := net.SplitHostPort(startServer(t, "socks5://127.0.0.1:"+freePort(t)+":upstream").address())
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setChains(t, testChain("direct"), testChain("proxied", p))
+	setRouting(t, `{
+  "front": [{"rules": {"rule": "true"}, "route": "proxied"}],
+  "upstream": [{"rules": {"rule": "true"}, "route": "direct"}]
+}`, "")
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":front").address()
+
+	conn, rep := socks5Connect(t, srv, echo)
+	if rep != repSucceeded {
+		t.Fatalf("connection failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "active")
+
+	// The active connection of the client is listed with the path it took through the chain
+	var views []connView
+	waitFor(t, time.Second, "connection path to be annotated", func() bool {
+		views = nil
+		getConnAPI(t, "/connections?client="+conn.LocalAddr().String(), "s3cret", &views)
+		return len(views) == 1 && views[0].Path != ""
+	})
+	view := views[0]
+	if want := fmt.Sprintf("---> %v ===> %v", p.address(), echo); view.Path != want || view.Chain != "proxied" || view.Client != conn.LocalAddr().String() || view.Server != srv {
+		t.Errorf("unexpected connection %+v, with path instead of %q", view, want)
+	}
+
+	// It can be retrieved by id, until it is closed
+	var byID connView
+	if status := getConnAPI(t, fmt.Sprint("/connections/", view.ID), "s3cret", &byID); status != http.StatusOK || byID.Path != view.Path {
+		t.Errorf("connection %v answered with status %v and path %q", view.ID, status, byID.Path)
+	}
+	conn.Close()
+	waitFor(t, time.Second, "closed connection to be unregistered", func() bool {
+		return getConnAPI(t, fmt.Sprint("/connections/", view.ID), "s3cret", nil) == http.StatusNotFound
+	})
+	if status := getConnAPI(t, "/connections/abc", "s3cret", nil); status != http.StatusBadRequest {
+		t.Errorf("invalid connection id answered with status %v", status)
+	}
+}
+
+func TestConnAPIAccess(t *testing.T) {
+	// Without token, the endpoints are not served
+	setArg(t, &gArgConnAPIToken, "")
+	if status := getConnAPI(t, "/connections", "", nil); status != http.StatusNotFound {
+		t.Errorf("connections endpoint answered with status %v without -conn-api-token", status)
+	}
+
+	// With a token, requests must carry it
+	setArg(t, &gArgConnAPIToken, "s3cret")
+	for _, token := range []string{"", "wrong", "s3cret2", strings.ToUpper("s3cret")} {
+		for _, path := range []string{"/connections", "/connections/1"} {
+			if status := getConnAPI(t, path, token, nil); status != http.StatusUnauthorized {
+				t.Errorf("%v with token %q answered with status %v", path, token, status)
+			}
+		}
+	}
+	if status := getConnAPI(t, "/connections", "s3cret", nil); status != http.StatusOK {
+		t.Errorf("connections endpoint answered with status %v with the token", status)
+	}
+	if status := getConnAPI(t, "/health", "", nil); status == http.StatusNotFound || status == http.StatusUnauthorized {
+		t.Errorf("health endpoint answered with status %v", status)
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+// Defines the debug HTTP server exposing net/http/pprof profiles and expvar counters, started only if -debug-addr is set
+
+import (
+	"expvar"
+	"net/http"
+	_ "net/http/pprof" // registers the profiling handlers on http.DefaultServeMux
+)
+
+func init() {
+	expvar.Publish("activeConnections", expvar.Func(func() any { return len(gConnRegistry.list()) }))
+	expvar.Publish("totalConnections", expvar.Func(func() any { return gConnRegistry.total() }))
+	expvar.Publish("chains", expvar.Func(func() any { return gChainStats.snapshot() }))
+	expvar.Publish("hopLatencies", expvar.Func(func() any { return gHopLatencies.snapshot() }))
+	expvar.Publish("routeMatches", expvar.Func(func() any { return routeMatchesSnapshot() }))
+	expvar.Publish("configGeneration", expvar.Func(func() any { return gConfigGeneration.Load() }))
+}
+
+// runDebugServer serves the profiling handlers under /debug/pprof/ and the expvar counters under /debug/vars on address
+func runDebugServer(address string) {
+	gMetaLogger.Infof("debug server started on %v", address)
+	err := http.ListenAndServe(address, http.DefaultServeMux)
+	gMetaLogger.Errorf("debug server on %v stopped: %v", address, err)
+}
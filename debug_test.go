@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// debugVars returns the expvar counters served by the debug server at url
+func debugVars(t *testing.T, url string) map[string]json.RawMessage {
+	t.Helper()
+
+	resp, err := http.Get(url + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/debug/vars answered with status %v", resp.StatusCode)
+	}
+
+	vars := make(map[string]json.RawMessage)
+	err = json.NewDecoder(resp.Body).Decode(&vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vars
+}
+
+func TestDebugEndpoints(t *testing.T) {
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+
+	for _, path := range []string{"/debug/pprof/", "/debug/pprof/goroutine?debug=1", "/debug/pprof/heap"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%v answered with status %v", path, resp.StatusCode)
+		}
+	}
+
+	vars := debugVars(t, srv.URL)
+	for _, name := range []string{"activeConnections", "totalConnections", "chains", "hopLatencies", "routeMatches", "configGeneration"} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("expvar counter %v not published", name)
+		}
+	}
+}
+
+func TestDebugConnectionCounters(t *testing.T) {
+	srv := httptest.NewServer(http.DefaultServeMux)
+	defer srv.Close()
+
+	counter := func(name string) int {
+		var value int
+		err := json.Unmarshal(debugVars(t, srv.URL)[name], &value)
+		if err != nil {
+			t.Fatalf("error parsing expvar counter %v: %v", name, err)
+		}
+		return value
+	}
+	active := counter("activeConnections")
+	total := counter("totalConnections")
+
+	echo := startEchoServer(t)
+	conn, rep := socks5Connect(t, startDirectServer(t), echo)
+	if rep != 0 {
+		t.Fatalf("connection failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "counted")
+
+	if counter("activeConnections") != active+1 || counter("totalConnections") != total+1 {
+		t.Errorf("relayed connection not counted")
+	}
+
+	conn.Close()
+	waitFor(t, time.Second, "closed connection uncounted", func() bool { return counter("activeConnections") == active })
+	if counter("totalConnections") != total+1 {
+		t.Errorf("closed connection uncounted from total connections")
+	}
+}
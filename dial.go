@@ -0,0 +1,93 @@
+package main
+
+// Defines the routing and connection functions usable without going through a server, e.g. when embedding bbs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrRouteRefused is returned by Dial for destinations routed to the reject, drop or tarpit special routes
+var ErrRouteRefused = errors.New("destination refused by routing")
+
+// Route returns the name of the chain selected for the destination address (format host:port) by the PAC script if -pac is defined,
+// and by the routing table table otherwise, along with the address to connect to, which differs from address if the matching block rewrites destinations.
+// The returned chain name can be one of the reject, drop and tarpit special routes.
+func Route(table string, address string) (chainName string, dest string, err error) {
+	chainName, rewrite, err := getRouteFor(table, address, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	dest = address
+	if rewrite != "" && !isSpecialRoute(chainName) {
+		dest, err = rewriteAddress(address, rewrite)
+		if err != nil {
+			err = fmt.Errorf("error rewriting destination %v: %v", address, err)
+			return chainName, "", err
+		}
+	}
+
+	return chainName, dest, nil
+}
+
+// Dial connects to the destination address (format host:port) through the chain selected by Route, and returns the connection along with the chain name.
+// Destinations routed to the special routes are not connected to, and ErrRouteRefused is returned. Cancelling ctx aborts the connection establishment.
+// The connection is accounted in the usage counters of the chain until it is closed.
+func Dial(ctx context.Context, table string, address string) (conn net.Conn, chainName string, err error) {
+	chainName, dest, err := Route(table, address)
+	if err != nil {
+		return nil, chainName, err
+	}
+
+	if isSpecialRoute(chainName) {
+		err = fmt.Errorf("%w: %v routed to %v", ErrRouteRefused, address, chainName)
+		return nil, chainName, err
+	}
+
+	gChainsConf.mu.RLock()
+	chain, ok := gChainsConf.proxychains[chainName]
+	gChainsConf.mu.RUnlock()
+
+	if !ok {
+		err = fmt.Errorf("chain '%v' is not declared in configuration", chainName)
+		return nil, chainName, err
+	}
+
+	conn, _, err = chain.connect(ctx, dest)
+	if err != nil {
+		return nil, chainName, err
+	}
+
+	return &countedConn{Conn: conn, counters: chain.stats()}, chainName, nil
+}
+
+// countedConn is a connection established through a chain, which counts the bytes transferred and records them in the chain's usage counters when closed
+type countedConn struct {
+	net.Conn
+	counters *chainCounters
+	up       atomic.Int64
+	down     atomic.Int64
+	once     sync.Once
+}
+
+func (c *countedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.down.Add(int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.up.Add(int64(n))
+	return n, err
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.counters.closed(c.up.Load(), c.down.Load()) })
+	return c.Conn.Close()
+}
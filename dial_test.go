@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	setRouting(t, `{
+  "table": [
+    {"rules": {"rule": "subnet", "content": "192.0.2.0/24"}, "route": "direct", "rewrite": "127.0.0.1:8080"},
+    {"rules": {"rule": "subnet", "content": "198.51.100.0/24"}, "route": "reject", "rewrite": "127.0.0.1:8081"},
+    {"rules": {"rule": "regexp", "variable": "host", "content": "\\.internal$"}, "route": "table:internal"},
+    {"rules": {"rule": "true"}, "route": "via"}
+  ],
+  "internal": [{"rules": {"rule": "true"}, "route": "lab"}]
+}`, "")
+
+	tests := []struct {
+		address, chain, dest string
+	}{
+		{"192.0.2.1:80", "direct", "127.0.0.1:8080"},
+		{"198.51.100.1:80", "reject", "198.51.100.1:80"},
+		{"db.internal:5432", "lab", "db.internal:5432"},
+		{"example.com:443", "via", "example.com:443"},
+	}
+	for _, test := range tests {
+		chain, dest, err := Route("table", test.address)
+		if err != nil || chain != test.chain || dest != test.dest {
+			t.Errorf("%v routed to %v with destination %v (%v) instead of %v with destination %v", test.address, chain, dest, err, test.chain, test.dest)
+		}
+	}
+
+	if _, _, err := Route("missing", "example.com:443"); err == nil {
+		t.Error("destination routed with a missing routing table")
+	}
+}
+
+func TestDial(t *testing.T) {
+	echo := startEchoServer(t)
+	setChains(t, testChain("dialed"))
+	setRouting(t, `{"table": [
+  {"rules": {"rule": "regexp", "variable": "host", "content": "^refused\\.example\\.com$"}, "route": "drop"},
+  {"rules": {"rule": "regexp", "variable": "host", "content": "^undeclared\\.example\\.com$"}, "route": "undeclared"},
+  {"rules": {"rule": "true"}, "route": "dialed"}
+]}`, "")
+	before := gChainStats.snapshot()["dialed"]
+
+	conn, chain, err := Dial(context.Background(), "table", echo)
+	if err != nil || chain != "dialed" {
+		t.Fatalf("dial of %v through %v failed: %v", echo, chain, err)
+	}
+	checkEcho(t, conn, "dialed")
+
+	// The connection is accounted in the chain's counters until closed
+	if stats := gChainStats.snapshot()["dialed"]; stats.Active != before.Active+1 || stats.Total != before.Total+1 {
+		t.Errorf("chain counters %+v after dial, from %+v", stats, before)
+	}
+	conn.Close()
+	conn.Close()
+	stats := gChainStats.snapshot()["dialed"]
+	if stats.Active != before.Active || stats.BytesUp != before.BytesUp+6 || stats.BytesDown != before.BytesDown+6 {
+		t.Errorf("chain counters %+v after close, from %+v", stats, before)
+	}
+
+	// Special routes are not connected to
+	_, chain, err = Dial(context.Background(), "table", "refused.example.com:80")
+	if !errors.Is(err, ErrRouteRefused) || chain != "drop" {
+		t.Errorf("dial of a refused destination through %v returned %v", chain, err)
+	}
+
+	_, chain, err = Dial(context.Background(), "table", "undeclared.example.com:80")
+	if err == nil || chain != "undeclared" {
+		t.Errorf("dial through the undeclared chain %v returned %v", chain, err)
+	}
+
+	// Cancelling the context aborts the connection establishment
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if conn, _, err := Dial(ctx, "table", echo); err == nil {
+		conn.Close()
+		t.Error("dial succeeded with a cancelled context")
+	}
+
+	if _, _, err := Dial(context.Background(), "table", "127.0.0.1:"+freePort(t)); err == nil {
+		t.Error("dial of a closed port succeeded")
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+// Defines the limiter bounding the number of concurrent local DNS resolutions performed for chains with proxyDns=false
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// dnsLimiter is the type used to hold the slots of in-flight DNS resolutions
+type dnsLimiter struct {
+	slots chan struct{} // one element per in-flight resolution, created with gArgDNSMaxConcurrent capacity on first use
+	once  sync.Once
+}
+
+var gDNSLimiter dnsLimiter
+
+// acquire waits for a free resolution slot during at most gArgDNSQueueTimeout, or until ctx is done.
+// It does nothing if gArgDNSMaxConcurrent is 0. A successful acquire must be followed by a call to release.
+func (l *dnsLimiter) acquire(ctx context.Context) error {
+	if gArgDNSMaxConcurrent <= 0 {
+		return nil
+	}
+
+	l.once.Do(func() { l.slots = make(chan struct{}, gArgDNSMaxConcurrent) })
+
+	timer := time.NewTimer(gArgDNSQueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		err := fmt.Errorf("no DNS resolution slot available within %v (%v concurrent resolutions)", gArgDNSQueueTimeout, gArgDNSMaxConcurrent)
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release frees the resolution slot obtained with acquire
+func (l *dnsLimiter) release() {
+	if gArgDNSMaxConcurrent <= 0 {
+		return
+	}
+
+	<-l.slots
+}
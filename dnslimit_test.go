@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSLimiterConcurrency(t *testing.T) {
+	setArg(t, &gArgDNSMaxConcurrent, 3)
+	setArg(t, &gArgDNSQueueTimeout, 5*time.Second)
+
+	var l dnsLimiter
+	var inFlight, maxInFlight atomic.Int64
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := l.acquire(context.Background())
+			if err != nil {
+				errs <- err
+				return
+			}
+			n := inFlight.Add(1)
+			for {
+				m := maxInFlight.Load()
+				if n <= m || maxInFlight.CompareAndSwap(m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			inFlight.Add(-1)
+			l.release()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Errorf("queued resolution failed: %v", err)
+	}
+	if maxInFlight.Load() > 3 {
+		t.Fatalf("%v concurrent resolutions, above the limit of 3", maxInFlight.Load())
+	}
+	if maxInFlight.Load() < 2 {
+		t.Fatalf("resolutions were serialized (%v concurrent at most)", maxInFlight.Load())
+	}
+}
+
+func TestDNSLimiterQueueTimeout(t *testing.T) {
+	setArg(t, &gArgDNSMaxConcurrent, 1)
+	setArg(t, &gArgDNSQueueTimeout, 100*time.Millisecond)
+
+	var l dnsLimiter
+	err := l.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued connections wait at most the queue timeout for a slot
+	start := time.Now()
+	err = l.acquire(context.Background())
+	if err == nil {
+		t.Fatal("slot acquired above the limit")
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("queued resolution failed after %v, before the queue timeout", elapsed)
+	}
+
+	// Or until their context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = l.acquire(ctx)
+	if err != context.Canceled {
+		t.Fatalf("queued resolution with a cancelled context failed with %v", err)
+	}
+
+	// A released slot can be acquired again
+	l.release()
+	err = l.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("released slot not acquired: %v", err)
+	}
+	l.release()
+}
+
+func TestDNSLimiterDisabled(t *testing.T) {
+	setArg(t, &gArgDNSMaxConcurrent, 0)
+
+	var l dnsLimiter
+	for i := 0; i < 100; i++ {
+		err := l.acquire(context.Background())
+		if err != nil {
+			t.Fatalf("resolution limited with the limiter disabled: %v", err)
+		}
+	}
+}
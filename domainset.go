@@ -0,0 +1,118 @@
+package main
+
+// Defines the set of domains loaded from a file by domainfile rules, matching hosts by suffix
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// domainSet holds domains matching themselves and their subdomains, and domains matching only their subdomains (leading dot entries)
+type domainSet struct {
+	domains    map[string]struct{}
+	subdomains map[string]struct{}
+}
+
+// loadDomainFile returns the set of the domains listed in the file at path, with one domain per line. A domain matches itself and its subdomains,
+// unless it starts with a dot (or "*."), in which case it only matches its subdomains. Lines in hosts file format ("0.0.0.0 example.com") are accepted.
+// Empty lines and comments, starting with # or !, are ignored. Malformed lines make the loading fail, and are all reported in the returned error.
+func loadDomainFile(path string) (*domainSet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	set := newDomainSet()
+	var malformed []string
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "!") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 2 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		if len(fields) != 1 || !set.add(fields[0]) {
+			malformed = append(malformed, fmt.Sprintf("line %v: %q is not a domain", lineNum, line))
+			continue
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(malformed) != 0 {
+		err = fmt.Errorf("malformed lines in %v: %v", path, strings.Join(malformed, ", "))
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// newDomainSet returns an empty set of domains
+func newDomainSet() *domainSet {
+	return &domainSet{domains: make(map[string]struct{}), subdomains: make(map[string]struct{})}
+}
+
+// add adds domain to the set, as a domain matching only its subdomains if it starts with a dot or "*.". It reports whether domain is a valid domain.
+func (s *domainSet) add(domain string) bool {
+	domain = normalizeDomain(domain)
+	subOnly := false
+	if after, ok := strings.CutPrefix(domain, "*."); ok {
+		domain, subOnly = after, true
+	} else if after, ok := strings.CutPrefix(domain, "."); ok {
+		domain, subOnly = after, true
+	}
+
+	if domain == "" || strings.ContainsAny(domain, "*/:") || strings.Contains(domain, "..") {
+		return false
+	}
+
+	if subOnly {
+		s.subdomains[domain] = struct{}{}
+	} else {
+		s.domains[domain] = struct{}{}
+	}
+	return true
+}
+
+// normalizeDomain returns domain in lower case and without trailing dot
+func normalizeDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(domain), ".")
+}
+
+// contains reports whether host is one of the domains of the set, or a subdomain of one of them
+func (s *domainSet) contains(host string) bool {
+	host = normalizeDomain(host)
+
+	if _, ok := s.domains[host]; ok {
+		return true
+	}
+
+	// Look up each parent domain of host
+	for i := strings.IndexByte(host, '.'); i != -1; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if _, ok := s.domains[host]; ok {
+			return true
+		}
+		if _, ok := s.subdomains[host]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// size returns the number of domains of the set
+func (s *domainSet) size() int {
+	return len(s.domains) + len(s.subdomains)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestLoadDomainFile(t *testing.T) {
+	path := writeListFile(t, `# allowlist
+! ad-block style comment
+example.com
+.suffix.org         # subdomains only
+*.wildcard.net
+0.0.0.0 ads.example.net
+Upper.Case.IO.
+
+`)
+	set, err := loadDomainFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.size() != 5 {
+		t.Errorf("%v domains instead of 5", set.size())
+	}
+
+	tests := map[string]bool{
+		"example.com":         true,
+		"www.example.com":     true,
+		"a.b.example.com":     true,
+		"EXAMPLE.COM.":        true,
+		"notexample.com":      false,
+		"example.com.evil.io": false,
+		"suffix.org":          false,
+		"www.suffix.org":      true,
+		"wildcard.net":        false,
+		"cdn.wildcard.net":    true,
+		"ads.example.net":     true,
+		"example.net":         false,
+		"upper.case.io":       true,
+		"com":                 false,
+	}
+	for host, want := range tests {
+		if set.contains(host) != want {
+			t.Errorf("%v in set: %v instead of %v", host, !want, want)
+		}
+	}
+}
+
+func TestLoadDomainFileMalformed(t *testing.T) {
+	path := writeListFile(t, `example.com
+two domains.com
+*.
+www.*.example.org
+example..org
+http://example.net/
+`)
+
+	// Every malformed line is reported
+	_, err := loadDomainFile(path)
+	if err == nil {
+		t.Fatal("file with malformed lines loaded")
+	}
+	for _, line := range []string{"line 2", "line 3", "line 4", "line 5", "line 6"} {
+		if !strings.Contains(err.Error(), line) {
+			t.Errorf("malformed %v not reported: %v", line, err)
+		}
+	}
+	if strings.Contains(err.Error(), "line 1:") {
+		t.Errorf("valid line reported: %v", err)
+	}
+
+	_, err = loadDomainFile(filepath.Join(t.TempDir(), "missing.txt"))
+	if err == nil {
+		t.Error("missing file loaded")
+	}
+}
+
+func TestDomainFileRule(t *testing.T) {
+	path := writeListFile(t, "example.com\n.internal\n")
+	routes := `{"table": [
+  {"rules": {"rule": "domainfile", "content": ` + strconv.Quote(path) + `}, "route": "listed"},
+  {"rules": {"rule": "true"}, "route": "other"}
+]}`
+
+	// IP addresses are not reverse resolved, they match no domainfile rule
+	checkRoutes(t, parseRouting(t, routes), "table", map[string]string{
+		"example.com:443":     "listed",
+		"www.example.com:443": "listed",
+		"db.internal:5432":    "listed",
+		"internal:80":         "other",
+		"example.org:443":     "other",
+		"10.0.0.1:443":        "other",
+	})
+
+	// The file is read again on each loading
+	err := os.WriteFile(path, []byte("example.org\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoutes(t, parseRouting(t, routes), "table", map[string]string{
+		"example.com:443": "other",
+		"example.org:443": "listed",
+	})
+
+	// Malformed or missing files fail the loading
+	err = os.WriteFile(path, []byte("example.com\nnot a domain\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r routing
+	if err := json.Unmarshal([]byte(routes), &r); err == nil {
+		t.Error("domainfile rule loaded from a malformed file")
+	}
+	os.Remove(path)
+	if err := json.Unmarshal([]byte(routes), &r); err == nil {
+		t.Error("domainfile rule loaded from a missing file")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"syscall"
+)
+
+var gFwmarkSupported bool = true
+
+// fwmarkControl returns a net.Dialer Control function setting the firewall mark mark (SO_MARK) on outbound sockets.
+// Setting SO_MARK requires the CAP_NET_ADMIN capability.
+func fwmarkControl(mark uint32) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		var sockErr error
+
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, int(mark))
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
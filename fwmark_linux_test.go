@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// socketMark returns the firewall mark (SO_MARK) of the socket of conn
+func socketMark(t *testing.T, conn net.Conn) int {
+	t.Helper()
+
+	c, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mark int
+	var sockErr error
+	err = c.Control(func(fd uintptr) {
+		mark, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return mark
+}
+
+func TestFwmark(t *testing.T) {
+	echo := startEchoServer(t)
+
+	chain := testChain("marked")
+	chain.fwmark = 42
+	d := chain.dialer()
+	conn, err := d.DialContext(context.Background(), "tcp", echo)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting firewall marks requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if mark := socketMark(t, conn); mark != 42 {
+		t.Errorf("outbound socket marked %v instead of 42", mark)
+	}
+
+	// Sockets of chains without fwmark are not marked
+	d = testChain("direct").dialer()
+	conn2, err := d.DialContext(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if mark := socketMark(t, conn2); mark != 0 {
+		t.Errorf("outbound socket of chain without fwmark marked %v", mark)
+	}
+}
+
+func TestFwmarkConnect(t *testing.T) {
+	echo := startEchoServer(t)
+
+	chain := testChain("marked")
+	chain.fwmark = 7
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, _, err := chain.connect(ctx, echo)
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("setting firewall marks requires CAP_NET_ADMIN")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if mark := socketMark(t, conn); mark != 7 {
+		t.Errorf("outbound socket marked %v instead of 7", mark)
+	}
+}
+
+func TestChainDescFwmark(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"fwmark": 42}`), &desc)
+	if err != nil || desc.Fwmark != 42 {
+		t.Fatalf("fwmark not parsed: %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+// Defines the health HTTP server exposing the readiness of bbs to supervisors and container orchestrators, started only if -health-addr is set
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// healthStatus describes the readiness of bbs: whether a valid configuration is loaded and all its servers are running
+type healthStatus struct {
+	Ready    bool     `json:"ready"`
+	NotReady []string `json:"notReady,omitempty"` // what is not ready, if any
+}
+
+// currentHealth returns the readiness of bbs, read from the global configurations
+func currentHealth() healthStatus {
+	var notReady []string
+
+	gChainsConf.mu.RLock()
+	if !gChainsConf.valid {
+		notReady = append(notReady, "chains configuration not loaded")
+	}
+	gChainsConf.mu.RUnlock()
+
+	if gArgPACPath == "" {
+		gRoutingConf.mu.RLock()
+		if !gRoutingConf.valid {
+			notReady = append(notReady, "routing configuration not loaded")
+		}
+		gRoutingConf.mu.RUnlock()
+	}
+
+	gServerConf.mu.RLock()
+	for _, s := range gServerConf.servers {
+		if s.bindErr != nil {
+			notReady = append(notReady, fmt.Sprintf("%v server on %v failed to start: %v", s.prot, s.address(), s.bindErr))
+		} else if !s.running {
+			notReady = append(notReady, fmt.Sprintf("%v server on %v not running", s.prot, s.address()))
+		}
+	}
+	gServerConf.mu.RUnlock()
+
+	return healthStatus{Ready: len(notReady) == 0, NotReady: notReady}
+}
+
+// healthHandler answers with the readiness of bbs as JSON, with status 200 if bbs is ready and 503 otherwise
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	status := currentHealth()
+
+	w.Header().Set("Content-Type", "application/json")
+	if status.Ready {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+// healthMux returns the handler of the health server: the readiness of bbs under /health, and if -conn-api-token is set, the active connections under /connections
+// and the log levels under /log-levels
+func healthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthHandler)
+	if gArgConnAPIToken != "" {
+		mux.HandleFunc("GET /connections", connectionsHandler)
+		mux.HandleFunc("GET /connections/{id}", connectionHandler)
+		mux.HandleFunc("GET /log-levels", logLevelsHandler)
+		mux.HandleFunc("PUT /log-levels", logLevelsHandler)
+	}
+	return mux
+}
+
+// runHealthServer serves the endpoints of healthMux on address
+func runHealthServer(address string) {
+	gMetaLogger.Infof("health server started on %v", address)
+	err := http.ListenAndServe(address, healthMux())
+	gMetaLogger.Errorf("health server on %v stopped: %v", address, err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setValidity marks the chains and routing configurations as valid or not for the duration of the test
+func setValidity(t *testing.T, chains bool, routing bool) {
+	t.Helper()
+
+	gChainsConf.mu.Lock()
+	previousChains := gChainsConf.valid
+	gChainsConf.valid = chains
+	gChainsConf.mu.Unlock()
+
+	gRoutingConf.mu.Lock()
+	previousRouting := gRoutingConf.valid
+	gRoutingConf.valid = routing
+	gRoutingConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gChainsConf.mu.Lock()
+		gChainsConf.valid = previousChains
+		gChainsConf.mu.Unlock()
+
+		gRoutingConf.mu.Lock()
+		gRoutingConf.valid = previousRouting
+		gRoutingConf.mu.Unlock()
+	})
+}
+
+// setServers replaces the servers of the current configuration by servers for the duration of the test
+func setServers(t *testing.T, servers ...*server) {
+	t.Helper()
+
+	gServerConf.mu.Lock()
+	previous := gServerConf.servers
+	gServerConf.servers = servers
+	gServerConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gServerConf.mu.Lock()
+		gServerConf.servers = previous
+		gServerConf.mu.Unlock()
+	})
+}
+
+// getHealth returns the status code and the readiness answered by the health handler
+func getHealth(t *testing.T) (int, healthStatus) {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest("GET", "/health", nil))
+
+	var status healthStatus
+	err := json.Unmarshal(rec.Body.Bytes(), &status)
+	if err != nil {
+		t.Fatalf("invalid health status %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, status
+}
+
+func TestHealthNotLoaded(t *testing.T) {
+	setValidity(t, false, false)
+	setServers(t)
+
+	code, status := getHealth(t)
+	if code != http.StatusServiceUnavailable || status.Ready {
+		t.Errorf("health status %v (ready %v) without configuration", code, status.Ready)
+	}
+	want := []string{"chains configuration not loaded", "routing configuration not loaded"}
+	if strings.Join(status.NotReady, ",") != strings.Join(want, ",") {
+		t.Errorf("not ready %v instead of %v", status.NotReady, want)
+	}
+
+	// With a PAC script, routing tables are not used
+	setArg(t, &gArgPACPath, "proxy.pac")
+	_, status = getHealth(t)
+	if len(status.NotReady) != 1 {
+		t.Errorf("not ready %v with a PAC script", status.NotReady)
+	}
+}
+
+func TestHealthReady(t *testing.T) {
+	setValidity(t, true, true)
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table")
+	setServers(t, srv)
+
+	code, status := getHealth(t)
+	if code != http.StatusOK || !status.Ready || len(status.NotReady) != 0 {
+		t.Errorf("health status %v (ready %v, not ready %v) with a loaded configuration", code, status.Ready, status.NotReady)
+	}
+}
+
+func TestHealthServersNotRunning(t *testing.T) {
+	setValidity(t, true, true)
+
+	stopped, err := newServerFromString("socks5://127.0.0.1:" + freePort(t) + ":table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicting, err := newServerFromString("socks5://127.0.0.1:" + freePort(t) + ":table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conflicting.bindErr = errors.New("address already in use")
+	setServers(t, stopped, conflicting)
+
+	code, status := getHealth(t)
+	if code != http.StatusServiceUnavailable || len(status.NotReady) != 2 {
+		t.Fatalf("health status %v (not ready %v) with servers not running", code, status.NotReady)
+	}
+	if !strings.Contains(status.NotReady[0], "not running") || !strings.Contains(status.NotReady[1], "failed to start: address already in use") {
+		t.Errorf("not ready %v", status.NotReady)
+	}
+}
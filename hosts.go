@@ -1,3 +1,23 @@
 package main
 
+import (
+	"sync"
+)
+
 type hostMap map[string]string
+
+// hostsConf holds the custom hosts of the current configuration. The map is replaced on reload, never modified, so that it can be read without the lock once returned by currentHosts.
+type hostsConf struct {
+	hosts hostMap
+	mu    sync.RWMutex
+}
+
+var gHostsConf hostsConf
+
+// currentHosts returns the custom hosts of the current configuration
+func currentHosts() hostMap {
+	gHostsConf.mu.RLock()
+	defer gHostsConf.mu.RUnlock()
+
+	return gHostsConf.hosts
+}
@@ -16,7 +16,7 @@ type httpConnect struct {
 
 // address returns the address where the HTTP CONNECT proxy is exposed, i.e. proxy.host:proxy.port
 func (p httpConnect) address() string {
-	return fmt.Sprintf("%s:%s", p.host, p.port)
+	return net.JoinHostPort(p.host, p.port)
 }
 
 // handshake takes net.Conn (representing a TCP socket) and an address and returns the same net.Conn connected to the provided address through the HTTP CONNECT proxy
@@ -61,6 +61,11 @@ func (p httpConnect) handshake(conn net.Conn, address string) (err error) {
 	gMetaLogger.Debugf("proxy answer: %v", response_line)
 	if !(strings.HasPrefix(response_line, "HTTP/1.0 2") || strings.HasPrefix(response_line, "HTTP/1.1 2") || strings.HasPrefix(response_line, "HTTP/2 2")) {
 		err = fmt.Errorf("the proxy did not accept the connection and returned '%v'", response_line)
+		// Client errors (e.g. 403 Forbidden, 407 Proxy Authentication Required) are explicit refusals
+		_, status, _ := strings.Cut(response_line, " ")
+		if strings.HasPrefix(status, "4") {
+			err = refusalError{err.Error()}
+		}
 		return
 	}
 
@@ -3,11 +3,24 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"time"
+
+	"github.com/synacktiv/bbs/logger"
 )
 
-type httpHandler struct{}
+type httpHandler struct {
+	handshakeTimeout time.Duration // maximum time clients have to send their request, 0 to disable
+	proxyDns         string        // if "true" or "false", overrides the proxyDns parameter of the chains used
+	blockPrivate     bool          // if true, connections to destinations in private or reserved ranges are refused
+}
+
+func (h httpHandler) String() string {
+	return fmt.Sprintf("httpHandler{handshakeTimeout:%v, proxyDns:%v, blockPrivate:%v}", h.handshakeTimeout, h.proxyDns, h.blockPrivate)
+}
 
 // connHandle handles the connection of a client on the input HTTP CONNECT listener.
 // It parses the CONNECT request, establishes a connection to the requested host through the right chain (found in routingtable table),
@@ -18,31 +31,44 @@ func (h httpHandler) connHandle(client net.Conn, table string, ctx context.Conte
 
 	defer client.Close()
 
+	// Span covering the whole session, parent of the routing decision and proxy handshakes spans
+	ctx, span := startSpan(ctx, "http.session")
+	defer span.end()
+	span.setAttribute("client", client.RemoteAddr().String())
+
 	// ***** BEGIN HTTP CONNECT input parsing *****
 
 	// Parse CONNECT request to retrieve target host and target port
 
+	// Clients must send their request within the server's clientHandshakeTimeout
+	setNegotiationDeadline(client, h.handshakeTimeout)
+
 	reader := bufio.NewReader(client)
 
 	request, err := http.ReadRequest(reader)
 
 	if err != nil {
 		gMetaLogger.Error(err)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
+	clearNegotiationDeadline(client, h.handshakeTimeout)
+
 	gMetaLogger.Debug(request)
 	gMetaLogger.Debugf("METHOD: %v\nURL: %v", request.Method, request.URL.Host)
 
 	if request.Method != "CONNECT" {
 		gMetaLogger.Errorf("only HTTP CONNECT method is supported")
 		(&http.Response{StatusCode: 405, ProtoMajor: 1}).Write(client)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
 	if request.Host != request.URL.Host {
 		gMetaLogger.Error("host and URL do not match")
 		(&http.Response{StatusCode: 400, ProtoMajor: 1}).Write(client)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
@@ -50,79 +76,127 @@ func (h httpHandler) connHandle(client net.Conn, table string, ctx context.Conte
 
 	// ***** END HTTP CONNECT input parsing *****
 
+	annotateConn(ctx, "target", addr)
+	span.setAttribute("target", addr)
+	gScanDetector.record(client.RemoteAddr(), addr)
+
 	// ***** BEGIN Routing decision *****
 
-	var chainStr string
+	_, routeSpan := startSpan(ctx, "route")
+	routeSpan.setAttribute("target", addr)
 
-	if gArgPACPath != "" {
-		// -pac flag defined, use PAC to find the chain
-		chainStr, err = getRouteWithPAC(addr)
+	// use the PAC script if -pac is defined, and the JSON config starting with routing table table otherwise
+	chainStr, rewrite, err := getRouteFor(table, addr, listenerOf(ctx))
 
-		if err != nil {
-			gMetaLogger.Errorf("error getting route PAC: %v", err)
-			(&http.Response{StatusCode: 400, ProtoMajor: 1}).Write(client)
-			return
-		}
-
-	} else {
-		// use JSON config to find the chain
-		gRoutingConf.mu.RLock()
-		table, ok := gRoutingConf.routing[table]
-		if !ok {
-			gMetaLogger.Errorf("table %v not defined in routing configuration", table)
-			(&http.Response{StatusCode: 400, ProtoMajor: 1}).Write(client)
-			gRoutingConf.mu.RUnlock()
-			return
-		}
-		chainStr, err = table.getRoute(addr)
-		gRoutingConf.mu.RUnlock()
-
-		if err != nil {
-			gMetaLogger.Errorf("error getting route with JSON conf: %v", err)
-			(&http.Response{StatusCode: 400, ProtoMajor: 1}).Write(client)
-			return
-		}
+	if err != nil {
+		gMetaLogger.Errorf("error getting route: %v", err)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "http", Client: client.RemoteAddr().String(), Dest: addr, Detail: err.Error()})
+		(&http.Response{StatusCode: 400, ProtoMajor: 1}).Write(client)
+		routeSpan.recordError(err)
+		routeSpan.end()
+		span.recordError(err)
+		return
 	}
 
 	gMetaLogger.Debugf("chain to use for %v: %v\n", addr, chainStr)
+	annotateConn(ctx, "chain", chainStr)
+	routeSpan.setAttribute("chain", chainStr)
+	routeSpan.end()
+	span.setAttribute("chain", chainStr)
+
+	if chainStr == bypassRoute {
+		gMetaLogger.Debugf("%v is in the bypass list, connecting directly", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "BYPASS", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+	}
+
+	if chainStr == "reject" {
+		gMetaLogger.Debugf("rejecting connection to %v", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "REJECTED", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+		(&http.Response{StatusCode: 403, ProtoMajor: 1}).Write(client)
+		return
+	}
 
 	if chainStr == "drop" {
 		gMetaLogger.Debugf("dropping connection to %v", addr)
-		gMetaLogger.Auditf("| DROPPED\t| %v\t| %v\t| %v\n", &client, chainStr, addr)
-		(&http.Response{StatusCode: 403, ProtoMajor: 1}).Write(client)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "DROPPED", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
 		return
 	}
 
+	if chainStr == "tarpit" {
+		gMetaLogger.Debugf("tarpitting connection to %v", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "TARPIT", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+		tarpit(ctx, client)
+		return
+	}
+
+	// Rewrite the destination address if required by the matching block, the rewritten address is not routed again
+	if rewrite != "" {
+		rewritten, err := rewriteAddress(addr, rewrite)
+		if err != nil {
+			gMetaLogger.Errorf("error rewriting destination %v: %v", addr, err)
+			gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: err.Error()})
+			(&http.Response{StatusCode: 400, ProtoMajor: 1}).Write(client)
+			return
+		}
+		gMetaLogger.Debugf("rewriting destination %v to %v", addr, rewritten)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "REWRITE", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: rewritten})
+		annotateConn(ctx, "rewritten", rewritten)
+		addr = rewritten
+	}
+
 	gChainsConf.mu.RLock()
 	chain, ok := gChainsConf.proxychains[chainStr]
 	gChainsConf.mu.RUnlock()
 
 	if !ok {
 		gMetaLogger.Errorf("chain '%v' returned by PAC script is not declared in configuration", chainStr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: "chain not declared"})
 		(&http.Response{StatusCode: 500, ProtoMajor: 1}).Write(client)
 		return
 	}
 
+	// The server's proxyDns option takes precedence over the chain's one
+	chain = overrideProxyDns(chain, h.proxyDns)
+	chain = guardPrivate(chain, h.blockPrivate)
+
 	// ***** END Routing decision *****
 
 	// ***** BEGIN Connection to target host  *****
 
-	//Connect to chain
+	//Connect to chain. A client hanging up meanwhile aborts the connection establishment
+	stopWatch := watchClient(client, cancel)
 	target, chainRepresentation, err := chain.connect(ctx, addr)
+	client = stopWatch()
+	annotateConn(ctx, "path", chainRepresentation)
+	// Address the requested hostname was resolved to locally (proxyDns=false or custom hosts), if any, recorded along with it in audit traces
+	resolved := annotationOf(ctx, "resolved")
 
 	if err != nil {
 		gMetaLogger.Error(err)
-		gMetaLogger.Auditf("| ERROR\t| %v\t| %v\t| %v\t| %v\n", &client, chainStr, addr, chainRepresentation)
-		(&http.Response{StatusCode: 502, ProtoMajor: 1}).Write(client)
+		span.recordError(err)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: connectErrorEvent(err), Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation, Detail: err.Error()})
+		// Refused destinations are answered as forbidden, failures as a bad gateway
+		statusCode := 502
+		if errors.Is(err, errPrivateDestination) {
+			statusCode = 403
+		}
+		(&http.Response{StatusCode: statusCode, ProtoMajor: 1}).Write(client)
 		return
 	}
 	defer target.Close()
 
-	gMetaLogger.Debugf("Client %v connected to host %v through chain %v", client, addr, chainStr)
+	gMetaLogger.Debugf("Client %v connected to host %v through chain %v", client.RemoteAddr(), addr, chainStr)
 
 	// Create auditing trace for connection opening and defering closing trace
-	gMetaLogger.Auditf("| OPEN\t| %v\t| %v\t| %v\t| %v\n", &client, chainStr, addr, chainRepresentation)
-	defer gMetaLogger.Auditf("| CLOSE\t| %v\t| %v\t| %v\t| %v\n", &client, chainStr, addr, chainRepresentation)
+	gMetaLogger.AuditEvent(logger.AuditEvent{Event: "OPEN", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation})
+	start := time.Now()
+	var bytesUp, bytesDown int64
+	defer func() {
+		span.setAttribute("bytesUp", bytesUp)
+		span.setAttribute("bytesDown", bytesDown)
+		chain.stats().closed(bytesUp, bytesDown)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "CLOSE", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation, BytesUp: bytesUp, BytesDown: bytesDown, DurationMs: time.Since(start).Milliseconds()})
+	}()
 
 	// Send HTTP Success
 
@@ -135,6 +209,16 @@ func (h httpHandler) connHandle(client net.Conn, table string, ctx context.Conte
 
 	// ***** END Connection to target host  *****
 
-	relay(client, target)
+	// Apply the chain's TCP options to both ends of the relay
+	chain.setSocketOptions(client, target)
+
+	// Tear down the connection once the chain's maximum lifetime is reached, whatever its activity
+	relayCtx, lifetimeReached := lifetimeContext(ctx, time.Duration(chain.maxLifetime)*time.Millisecond)
+
+	bytesUp, bytesDown = relay(relayCtx, client, target, time.Duration(chain.firstDataTimeout)*time.Millisecond, time.Duration(chain.idleTimeout)*time.Millisecond)
+
+	if lifetimeReached() {
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "LIFETIME", Handler: "http", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, ChainRepr: chainRepresentation, Detail: fmt.Sprintf("maximum lifetime of %vms reached", chain.maxLifetime)})
+	}
 
 }
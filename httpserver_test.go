@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// httpProxyConnect connects to the HTTP proxy server at serverAddr, sends a CONNECT request for address,
+// and returns the connection to the server along with the status code of the response
+func httpProxyConnect(t *testing.T, serverAddr string, address string, header string) (net.Conn, int) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", serverAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("CONNECT " + address + " HTTP/1.1\r\nHost: " + address + "\r\n" + header + "\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The response has no body, the reader does not buffer any relayed data
+	resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 16), nil)
+	if err != nil {
+		t.Fatalf("error reading CONNECT response: %v", err)
+	}
+	return conn, resp.StatusCode
+}
+
+func TestHTTPAuditEvents(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startEchoServer(t)
+	srv := startRouteServer(t, "http", "direct")
+
+	conn, status := httpProxyConnect(t, srv, echo, "")
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT answered with status %v", status)
+	}
+	checkEcho(t, conn, "audited")
+	conn.Close()
+
+	open := findAudit(t, audit, "OPEN", conn.LocalAddr().String())
+	if open.Handler != "http" || open.Chain != "direct" || open.Dest != echo || open.ChainRepr == "" {
+		t.Errorf("unexpected OPEN audit trace %+v", open)
+	}
+
+	close := findAudit(t, audit, "CLOSE", conn.LocalAddr().String())
+	if close.Handler != "http" || close.Dest != echo || close.BytesUp != 7 || close.BytesDown != 7 {
+		t.Errorf("unexpected CLOSE audit trace %+v", close)
+	}
+}
+
+func TestHTTPHandshakeTimeout(t *testing.T) {
+	srv := startHandshakeTimeoutServer(t, "http", "200ms")
+
+	// Client stalling in the middle of its request headers
+	conn, err := net.DialTimeout("tcp", srv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("CONNECT 127.0.0.1:80 HTTP/1.1\r\nHost: 127.0.0.1:80\r\n"))
+	checkReaped(t, srv, conn)
+}
+
+func TestHTTPHandshakeTimeoutCleared(t *testing.T) {
+	echo := startEchoServer(t)
+	srv := startHandshakeTimeoutServer(t, "http", "200ms")
+
+	conn, status := httpProxyConnect(t, srv, echo, "")
+	if status != http.StatusOK {
+		t.Fatalf("CONNECT answered with status %v", status)
+	}
+	time.Sleep(400 * time.Millisecond)
+	checkEcho(t, conn, "idle")
+}
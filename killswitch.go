@@ -0,0 +1,67 @@
+package main
+
+// Defines the global kill switch, used as an emergency stop for all input servers
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// killSwitch is the type used to hold the global kill switch state.
+// When engaged, input servers drop new connections and, if requested, active relays are terminated.
+type killSwitch struct {
+	engaged    atomic.Bool
+	terminated bool          // whether kill has been closed
+	kill       chan struct{} // closed when active connections must be terminated
+	mu         sync.Mutex
+}
+
+var gKillSwitch = killSwitch{kill: make(chan struct{})}
+
+// engage engages the kill switch. If terminate is true, all active relays are terminated as well.
+func (k *killSwitch) engage(terminate bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.engaged.Store(true)
+	if terminate && !k.terminated {
+		close(k.kill)
+		k.terminated = true
+	}
+}
+
+// release releases the kill switch, input servers accept new connections again
+func (k *killSwitch) release() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.engaged.Store(false)
+	if k.terminated {
+		k.kill = make(chan struct{})
+		k.terminated = false
+	}
+}
+
+// toggle engages the kill switch if it is released, and releases it otherwise
+func (k *killSwitch) toggle(terminate bool) {
+	if k.isEngaged() {
+		k.release()
+		gMetaLogger.Info("Kill switch released, accepting new connections")
+	} else {
+		k.engage(terminate)
+		gMetaLogger.Infof("Kill switch engaged, dropping new connections (terminating active ones: %v)", terminate)
+	}
+}
+
+// isEngaged reports whether the kill switch is currently engaged
+func (k *killSwitch) isEngaged() bool {
+	return k.engaged.Load()
+}
+
+// done returns a channel that is closed when active connections must be terminated.
+func (k *killSwitch) done() <-chan struct{} {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	return k.kill
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKillSwitchDropsNewConnections(t *testing.T) {
+	t.Cleanup(gKillSwitch.release)
+	echo := startEchoServer(t)
+	srv := startDirectServer(t)
+
+	conn, rep := socks5Connect(t, srv, echo)
+	if rep != 0 {
+		t.Fatalf("connection before the kill switch is engaged failed with reply %v", rep)
+	}
+
+	gKillSwitch.engage(false)
+
+	// Connections accepted after the kill switch is engaged are closed at once
+	newConn, err := net.DialTimeout("tcp", srv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newConn.Close()
+	if !isClosed(newConn, 2*time.Second) {
+		t.Fatal("connection accepted while the kill switch is engaged was not closed")
+	}
+
+	// Active relays are kept when termination is not requested
+	checkEcho(t, conn, "still relayed")
+
+	gKillSwitch.release()
+	conn, rep = socks5Connect(t, srv, echo)
+	if rep != 0 {
+		t.Fatalf("connection after the kill switch is released failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "accepted again")
+}
+
+func TestKillSwitchTerminatesActiveConnections(t *testing.T) {
+	t.Cleanup(gKillSwitch.release)
+	echo := startEchoServer(t)
+	srv := startDirectServer(t)
+
+	conn, rep := socks5Connect(t, srv, echo)
+	if rep != 0 {
+		t.Fatalf("connection failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "relayed")
+
+	gKillSwitch.engage(true)
+	if !isClosed(conn, 2*time.Second) {
+		t.Fatal("active relay was not terminated by the kill switch")
+	}
+
+	// Releasing the kill switch rearms termination for the connections relayed afterwards
+	gKillSwitch.release()
+	conn, rep = socks5Connect(t, srv, echo)
+	if rep != 0 {
+		t.Fatalf("connection after the kill switch is released failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "relayed again")
+	if isClosed(conn, 100*time.Millisecond) {
+		t.Fatal("relay started after the kill switch was released was terminated")
+	}
+}
+
+func TestKillSwitchToggle(t *testing.T) {
+	t.Cleanup(gKillSwitch.release)
+
+	gKillSwitch.toggle(false)
+	if !gKillSwitch.isEngaged() {
+		t.Fatal("toggle did not engage the released kill switch")
+	}
+	select {
+	case <-gKillSwitch.done():
+		t.Fatal("active connections are terminated although termination was not requested")
+	default:
+	}
+
+	gKillSwitch.toggle(false)
+	if gKillSwitch.isEngaged() {
+		t.Fatal("toggle did not release the engaged kill switch")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+// Defines the latency histograms of the hops of chains, separating the TCP dial durations from the proxy handshake durations, per chain and proxy
+
+import (
+	"fmt"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBounds are the upper bounds of the buckets of latency histograms, a last bucket holding the longer durations
+var latencyBounds = [...]time.Duration{
+	1 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// latencyHistogram counts durations in the buckets defined by latencyBounds, updated concurrently by the handlers
+type latencyHistogram struct {
+	buckets [len(latencyBounds) + 1]atomic.Int64 // one per bound of latencyBounds, and one for the longer durations
+	count   atomic.Int64
+	sum     atomic.Int64 // sum of the durations, in microseconds
+}
+
+// observe counts the duration d in its bucket
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(latencyBounds) && d > latencyBounds[i] {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(d.Microseconds())
+}
+
+// latencyBucket is a snapshot of a bucket of a latency histogram: the number of durations longer than the bound of the previous bucket and at most Le
+type latencyBucket struct {
+	Le    string `json:"le"` // upper bound of the bucket, "+Inf" for the last one
+	Count int64  `json:"count"`
+}
+
+// latencyStats is a snapshot of a latency histogram
+type latencyStats struct {
+	Count   int64           `json:"count"`
+	AvgMs   float64         `json:"avgMs"`
+	Buckets []latencyBucket `json:"buckets"`
+}
+
+// snapshot returns the current value of the histogram
+func (h *latencyHistogram) snapshot() latencyStats {
+	stats := latencyStats{Count: h.count.Load()}
+	if stats.Count > 0 {
+		stats.AvgMs = float64(h.sum.Load()) / float64(stats.Count) / 1000
+	}
+	for i := range h.buckets {
+		le := "+Inf"
+		if i < len(latencyBounds) {
+			le = fmt.Sprint(latencyBounds[i])
+		}
+		stats.Buckets = append(stats.Buckets, latencyBucket{Le: le, Count: h.buckets[i].Load()})
+	}
+	return stats
+}
+
+// hopLatencies holds the latency histograms of a hop of a chain: the successful TCP dials to the proxy, and the successful handshakes of the proxy
+type hopLatencies struct {
+	dial      latencyHistogram
+	handshake latencyHistogram
+}
+
+// hopLatencyStats is a snapshot of the latency histograms of a hop
+type hopLatencyStats struct {
+	Dial      latencyStats `json:"dial"`
+	Handshake latencyStats `json:"handshake"`
+}
+
+// hopKey identifies a hop: a proxy of a chain, or the destination of a chain without proxies, reported as "direct"
+type hopKey struct {
+	chain string
+	proxy string
+}
+
+// hopLatencyRegistry is the type used to hold and access the latency histograms of all hops.
+// Like the usage counters of chains, histograms are kept across configuration reloads.
+type hopLatencyRegistry struct {
+	hops map[hopKey]*hopLatencies
+	mu   sync.RWMutex
+}
+
+var gHopLatencies = hopLatencyRegistry{hops: make(map[hopKey]*hopLatencies)}
+
+// get returns the latency histograms of proxy in chain, created on first use
+func (r *hopLatencyRegistry) get(chain string, proxy string) *hopLatencies {
+	key := hopKey{chain: chain, proxy: proxy}
+
+	r.mu.RLock()
+	hop, ok := r.hops[key]
+	r.mu.RUnlock()
+	if ok {
+		return hop
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	hop, ok = r.hops[key]
+	if !ok {
+		hop = new(hopLatencies)
+		r.hops[key] = hop
+	}
+	return hop
+}
+
+// snapshot returns the current value of the latency histograms of all hops used since startup, by chain name and proxy address
+func (r *hopLatencyRegistry) snapshot() map[string]map[string]hopLatencyStats {
+	r.mu.RLock()
+	hops := maps.Clone(r.hops)
+	r.mu.RUnlock()
+
+	stats := make(map[string]map[string]hopLatencyStats)
+	for key, hop := range hops {
+		if stats[key.chain] == nil {
+			stats[key.chain] = make(map[string]hopLatencyStats)
+		}
+		stats[key.chain][key.proxy] = hopLatencyStats{
+			Dial:      hop.dial.snapshot(),
+			Handshake: hop.handshake.snapshot(),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	for _, d := range []time.Duration{500 * time.Microsecond, time.Millisecond, 7 * time.Millisecond, 300 * time.Millisecond, 20 * time.Second} {
+		h.observe(d)
+	}
+
+	// Durations are counted in the bucket of the lowest bound they do not exceed
+	stats := h.snapshot()
+	expected := map[string]int64{"1ms": 2, "10ms": 1, "500ms": 1, "+Inf": 1}
+	if len(stats.Buckets) != len(latencyBounds)+1 || stats.Buckets[len(latencyBounds)].Le != "+Inf" {
+		t.Fatalf("buckets %v", stats.Buckets)
+	}
+	for _, b := range stats.Buckets {
+		if b.Count != expected[b.Le] {
+			t.Errorf("%v durations in bucket %v instead of %v", b.Count, b.Le, expected[b.Le])
+		}
+	}
+	if avg := (0.5 + 1 + 7 + 300 + 20000) / 5.0; stats.Count != 5 || stats.AvgMs != avg {
+		t.Errorf("%v durations of average %vms instead of 5 of average %vms", stats.Count, stats.AvgMs, avg)
+	}
+
+	var empty latencyHistogram
+	if stats := empty.snapshot(); stats.Count != 0 || stats.AvgMs != 0 {
+		t.Errorf("empty histogram with %v durations of average %vms", stats.Count, stats.AvgMs)
+	}
+}
+
+func TestHopLatencies(t *testing.T) {
+	echo := startEchoServer(t)
+	// The handshake of the first proxy for the second one is delayed by the relay, the second one answers at once
+	first, _ := slowProxy(t, startDirectServer(t), 200*time.Millisecond)
+	second, _ := slowProxy(t, startDirectServer(t), 0)
+
+	chain := testChain("latency-"+t.Name(), first, second)
+	conn, _, err := chain.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn, "latency")
+	conn.Close()
+
+	stats := gHopLatencies.snapshot()[chain.name]
+	if len(stats) != 2 {
+		t.Fatalf("latencies of hops %v instead of the 2 proxies", stats)
+	}
+	firstHop, secondHop := stats[first.address()], stats[second.address()]
+
+	// The delay is attributed to the handshake of the first proxy, not to its dial nor to the second proxy.
+	// It starts when the first proxy accepts the connection, slightly before the handshake starts
+	if h := firstHop.Handshake; h.Count != 1 || h.AvgMs < 150 || h.AvgMs > 500 {
+		t.Errorf("handshake of the first proxy: %v of average %vms instead of 1 of about 200ms", h.Count, h.AvgMs)
+	}
+	if d := firstHop.Dial; d.Count != 1 || d.AvgMs > 100 {
+		t.Errorf("dial of the first proxy: %v of average %vms instead of 1 immediate", d.Count, d.AvgMs)
+	}
+	if h := secondHop.Handshake; h.Count != 1 || h.AvgMs > 100 {
+		t.Errorf("handshake of the second proxy: %v of average %vms instead of 1 immediate", h.Count, h.AvgMs)
+	}
+	if d := secondHop.Dial; d.Count != 0 {
+		t.Errorf("%v dials of the second proxy, reached through the first one", d.Count)
+	}
+	for _, b := range firstHop.Handshake.Buckets {
+		if b.Le == "250ms" && b.Count != 1 {
+			t.Errorf("handshake of the first proxy not in the 250ms bucket: %v", firstHop.Handshake.Buckets)
+		}
+	}
+}
+
+func TestHopLatenciesFailures(t *testing.T) {
+	echo := startEchoServer(t)
+	first, _ := slowProxy(t, startDirectServer(t), 0)
+	stalled, _ := slowProxy(t, "", 0)
+
+	// Failed handshakes are not measured, so that timeouts do not skew the histograms
+	chain := testChain("latency-"+t.Name(), first, stalled)
+	chain.hopTimeout = 100
+	_, _, err := chain.connect(context.Background(), echo)
+	if err == nil {
+		t.Fatal("connection through a stalled proxy succeeded")
+	}
+	stats := gHopLatencies.snapshot()[chain.name]
+	if h := stats[stalled.address()].Handshake; h.Count != 0 {
+		t.Errorf("%v failed handshakes measured", h.Count)
+	}
+	if h := stats[first.address()].Handshake; h.Count != 1 {
+		t.Errorf("%v handshakes of the first proxy measured instead of 1", h.Count)
+	}
+
+	// Dials of chains without proxies are measured as the direct hop
+	direct := testChain("latency-" + t.Name() + "-direct")
+	conn, _, err := direct.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if d := gHopLatencies.snapshot()[direct.name]["direct"].Dial; d.Count != 1 {
+		t.Errorf("%v direct dials measured instead of 1", d.Count)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+// Defines the log levels endpoint of the health server, reading and changing the log and audit levels at runtime, served only if -conn-api-token is set
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/synacktiv/bbs/logger"
+)
+
+// logLevelNames are the names of the log levels, as used by the log levels endpoint
+var logLevelNames = map[logger.LogLevel]string{
+	logger.LogLevelQuiet:   "quiet",
+	logger.LogLevelNormal:  "normal",
+	logger.LogLevelVerbose: "verbose",
+}
+
+// parseLogLevel returns the log level named name, and false if there is none
+func parseLogLevel(name string) (logger.LogLevel, bool) {
+	for level, levelName := range logLevelNames {
+		if levelName == name {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// logLevelsView is the JSON description of the current levels returned by the log levels endpoint, and of the levels to change in PUT requests
+type logLevelsView struct {
+	Log   *string `json:"log,omitempty"`   // quiet, normal or verbose
+	Audit *bool   `json:"audit,omitempty"` // whether audit traces are logged
+}
+
+// currentLogLevels returns the description of the current levels of gMetaLogger
+func currentLogLevels() logLevelsView {
+	name := logLevelNames[gMetaLogger.LogLevel()]
+	audit := gMetaLogger.AuditLevel() == logger.AuditLevelYes
+	return logLevelsView{Log: &name, Audit: &audit}
+}
+
+// logLevelsHandler answers with the current log and audit levels, after changing the levels given in the JSON body of PUT requests, e.g. {"log": "verbose"}.
+// Levels omitted in the body are kept.
+func logLevelsHandler(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var view logLevelsView
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&view)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid log levels: %v", err)})
+			return
+		}
+
+		// The levels are validated before being changed, so that invalid requests change nothing
+		var level logger.LogLevel
+		if view.Log != nil {
+			var ok bool
+			level, ok = parseLogLevel(*view.Log)
+			if !ok {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("unknown log level %v, must be quiet, normal or verbose", *view.Log)})
+				return
+			}
+		}
+
+		if view.Log != nil {
+			gMetaLogger.SetLogLevel(level)
+		}
+		if view.Audit != nil {
+			if *view.Audit {
+				gMetaLogger.SetAuditLevel(logger.AuditLevelYes)
+			} else {
+				gMetaLogger.SetAuditLevel(logger.AuditLevelNo)
+			}
+		}
+
+		current := currentLogLevels()
+		gMetaLogger.Infof("log levels changed by %v: log %v, audit %v", r.RemoteAddr, *current.Log, *current.Audit)
+	}
+
+	writeJSON(w, http.StatusOK, currentLogLevels())
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/synacktiv/bbs/logger"
+)
+
+// putLogLevels sends a PUT request of body to /log-levels with token as bearer token to the health server handler, and returns the status code and the levels answered
+func putLogLevels(t *testing.T, body string, token string) (int, logLevelsView) {
+	t.Helper()
+
+	req := httptest.NewRequest("PUT", "/log-levels", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	healthMux().ServeHTTP(rec, req)
+
+	var view logLevelsView
+	if rec.Code == http.StatusOK {
+		err := json.Unmarshal(rec.Body.Bytes(), &view)
+		if err != nil {
+			t.Fatalf("invalid response %q: %v", rec.Body, err)
+		}
+	}
+	return rec.Code, view
+}
+
+// keepLogLevels restores the log and audit levels of the global logger at the end of the test
+func keepLogLevels(t *testing.T) {
+	logLevel, auditLevel := gMetaLogger.LogLevel(), gMetaLogger.AuditLevel()
+	t.Cleanup(func() {
+		gMetaLogger.SetLogLevel(logLevel)
+		gMetaLogger.SetAuditLevel(auditLevel)
+	})
+}
+
+func TestLogLevelsAPI(t *testing.T) {
+	setArg(t, &gArgConnAPIToken, "s3cret")
+	keepLogLevels(t)
+	logs, audit := captureLogs(t)
+	gMetaLogger.SetLogLevel(logger.LogLevelNormal)
+
+	var view logLevelsView
+	if status := getConnAPI(t, "/log-levels", "s3cret", &view); status != http.StatusOK || *view.Log != "normal" || !*view.Audit {
+		t.Fatalf("levels %+v answered with status %v", view, status)
+	}
+
+	// Debug logs appear once the log level is verbose
+	gMetaLogger.Debug("hidden")
+	status, view := putLogLevels(t, `{"log": "verbose"}`, "s3cret")
+	if status != http.StatusOK || *view.Log != "verbose" || !*view.Audit {
+		t.Fatalf("levels %+v answered with status %v", view, status)
+	}
+	gMetaLogger.Debug("shown")
+	if strings.Contains(logs.String(), "hidden") || !regexp.MustCompile(`\[DEBUG\] [\d/: ]+ shown`).MatchString(logs.String()) {
+		t.Errorf("debug logs not enabled: %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), "log levels changed by") {
+		t.Error("change of the log levels not logged")
+	}
+
+	// They disappear when it is back to normal, and audit traces can be disabled independently
+	status, view = putLogLevels(t, `{"log": "normal", "audit": false}`, "s3cret")
+	if status != http.StatusOK || *view.Log != "normal" || *view.Audit {
+		t.Fatalf("levels %+v answered with status %v", view, status)
+	}
+	gMetaLogger.Debug("disabled again")
+	gMetaLogger.Audit("trace")
+	if strings.Contains(logs.String(), "disabled again") || strings.Contains(audit.String(), "trace") {
+		t.Errorf("debug logs or audit traces not disabled: %q, %q", logs.String(), audit.String())
+	}
+
+	// Omitted levels are kept
+	status, view = putLogLevels(t, `{"audit": true}`, "s3cret")
+	if status != http.StatusOK || *view.Log != "normal" || !*view.Audit {
+		t.Errorf("levels %+v answered with status %v", view, status)
+	}
+}
+
+func TestLogLevelsAPIErrors(t *testing.T) {
+	setArg(t, &gArgConnAPIToken, "s3cret")
+	keepLogLevels(t)
+	gMetaLogger.SetLogLevel(logger.LogLevelNormal)
+
+	// Invalid requests change nothing
+	for _, body := range []string{`{"log": "debug", "audit": false}`, `{"level": "verbose"}`, `verbose`} {
+		if status, _ := putLogLevels(t, body, "s3cret"); status != http.StatusBadRequest {
+			t.Errorf("invalid levels %v answered with status %v", body, status)
+		}
+	}
+	if status, _ := putLogLevels(t, `{"log": "verbose"}`, "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("request with a wrong token answered with status %v", status)
+	}
+	if gMetaLogger.LogLevel() != logger.LogLevelNormal || gMetaLogger.AuditLevel() != logger.AuditLevelYes {
+		t.Error("levels changed by invalid requests")
+	}
+
+	// The endpoint is only served with a token
+	setArg(t, &gArgConnAPIToken, "")
+	if status, _ := putLogLevels(t, `{"log": "verbose"}`, ""); status != http.StatusNotFound {
+		t.Errorf("request without -conn-api-token answered with status %v", status)
+	}
+}
@@ -0,0 +1,71 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+type AuditFormat byte
+
+const (
+	AuditFormatText AuditFormat = iota
+	AuditFormatJSON
+)
+
+// AuditEvent holds the fields of an audit trace. Fields which do not apply to an event are left empty.
+type AuditEvent struct {
+	Event      string `json:"event"`               // OPEN, CLOSE, ERROR, REJECTED, DROPPED, TARPIT, REWRITE, RELAY, SCAN, DENIED
+	Handler    string `json:"handler"`             // input server handler type (socks5, http, socks5udp)
+	Client     string `json:"client"`              // address of the client
+	Chain      string `json:"chain,omitempty"`     // route chosen for the destination
+	Dest       string `json:"dest,omitempty"`      // destination requested by the client
+	Resolved   string `json:"resolved,omitempty"`  // address the hostname of Dest was resolved to by bbs, if it was resolved locally
+	ChainRepr  string `json:"chainRepr,omitempty"` // path followed through the chain
+	BytesUp    int64  `json:"bytesUp"`             // bytes sent from the client to the destination
+	BytesDown  int64  `json:"bytesDown"`           // bytes sent from the destination to the client
+	DurationMs int64  `json:"durationMs"`          // duration of the connection, in milliseconds
+	Detail     string `json:"detail,omitempty"`    // event specific information
+}
+
+// orDash returns s, or "-" if s is empty, to keep text columns aligned
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// String returns the text representation of the event, with one tab separated column per field.
+// The resolved address, if any, follows the destination in its column, e.g. "example.com:443 (93.184.216.34)".
+func (e AuditEvent) String() string {
+	dest := orDash(e.Dest)
+	if e.Resolved != "" {
+		dest = fmt.Sprintf("%v (%v)", dest, e.Resolved)
+	}
+	return fmt.Sprintf("| %v\t| %v\t| %v\t| %v\t| %v\t| %v\t| %v\t| %v\t| %v\t| %v",
+		e.Event, orDash(e.Handler), orDash(e.Client), orDash(e.Chain), dest, orDash(e.ChainRepr), e.BytesUp, e.BytesDown, e.DurationMs, orDash(e.Detail))
+}
+
+// SetAuditFormat sets the representation of the audit events logged with AuditEvent
+func (l *MetaLogger) SetAuditFormat(format AuditFormat) {
+	l.auditFormat = format
+}
+
+// AuditEvent logs the audit event e, as text or JSON according to the audit format
+func (l *MetaLogger) AuditEvent(e AuditEvent) {
+	if l.auditFormat == AuditFormatJSON {
+		// Chain representations contain arrows, which must not be escaped as HTML
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		err := enc.Encode(e)
+		if err != nil {
+			l.Errorf("error marshalling audit event %v: %v", e, err)
+			return
+		}
+		l._audit.Print(buf.String())
+		return
+	}
+	l._audit.Println(e.String())
+}
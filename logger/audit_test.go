@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestAuditEventText(t *testing.T) {
+	e := AuditEvent{Event: "CLOSE", Handler: "socks5", Client: "127.0.0.1:1234", Chain: "chain1", Dest: "example.com:443", Resolved: "93.184.216.34",
+		ChainRepr: "---> 127.0.0.1:1080 ---> example.com:443", BytesUp: 10, BytesDown: 20, DurationMs: 30}
+
+	expected := "| CLOSE\t| socks5\t| 127.0.0.1:1234\t| chain1\t| example.com:443 (93.184.216.34)\t| ---> 127.0.0.1:1080 ---> example.com:443\t| 10\t| 20\t| 30\t| -"
+	if e.String() != expected {
+		t.Fatalf("text audit event %q instead of %q", e.String(), expected)
+	}
+
+	// Empty fields are rendered as dashes, so that columns are kept
+	e = AuditEvent{Event: "SCAN", Client: "127.0.0.1", Detail: "5 destinations"}
+	expected = "| SCAN\t| -\t| 127.0.0.1\t| -\t| -\t| -\t| 0\t| 0\t| 0\t| 5 destinations"
+	if e.String() != expected {
+		t.Fatalf("text audit event %q instead of %q", e.String(), expected)
+	}
+}
+
+func TestAuditEventJSON(t *testing.T) {
+	var audit bytes.Buffer
+	l := NewMetaLogger(&bytes.Buffer{}, &bytes.Buffer{}, &audit)
+	l.SetAuditFormat(AuditFormatJSON)
+
+	e := AuditEvent{Event: "OPEN", Handler: "http", Client: "127.0.0.1:1234", Chain: "chain1", Dest: "example.com:443", ChainRepr: "---> example.com:443"}
+	l.AuditEvent(e)
+
+	line := audit.String()
+	if !strings.HasPrefix(line, "[AUDIT] ") || strings.Count(line, "\n") != 1 {
+		t.Fatalf("unexpected JSON audit line %q", line)
+	}
+
+	// Arrows are not escaped, and fields which do not apply are left out except byte counts and duration
+	_, trace, _ := strings.Cut(line, "{")
+	trace = "{" + trace
+	if !strings.Contains(trace, `"chainRepr":"---> example.com:443"`) {
+		t.Fatalf("chain representation escaped in %v", trace)
+	}
+	var fields map[string]any
+	err := json.Unmarshal([]byte(trace), &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"event", "handler", "client", "chain", "dest", "chainRepr", "bytesUp", "bytesDown", "durationMs"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("field %v missing from %v", field, trace)
+		}
+	}
+	for _, field := range []string{"resolved", "detail"} {
+		if _, ok := fields[field]; ok {
+			t.Errorf("empty field %v present in %v", field, trace)
+		}
+	}
+
+	var decoded AuditEvent
+	json.Unmarshal([]byte(trace), &decoded)
+	if decoded != e {
+		t.Fatalf("decoded audit event %+v instead of %+v", decoded, e)
+	}
+}
+
+func TestAuditLevelNo(t *testing.T) {
+	var audit bytes.Buffer
+	l := NewMetaLogger(&bytes.Buffer{}, &bytes.Buffer{}, &audit)
+	l.SetAuditLevel(AuditLevelNo)
+
+	l.AuditEvent(AuditEvent{Event: "OPEN"})
+	if audit.Len() != 0 {
+		t.Fatalf("audit event written with audit disabled: %q", audit.String())
+	}
+}
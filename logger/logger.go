@@ -3,6 +3,8 @@ package logger
 import (
 	"io"
 	"log"
+	"sync"
+	"time"
 )
 
 type LogLevel byte
@@ -20,53 +22,115 @@ const (
 	AuditLevelYes
 )
 
+const (
+	prefixDebug = "[DEBUG] "
+	prefixAudit = "[AUDIT] "
+	prefixInfo  = "[INFO] "
+	prefixError = "[ERROR] "
+	prefixFatal = "[FATAL] "
+	prefixPanic = "[PANIC] "
+)
+
 type MetaLogger struct {
-	logWriter   io.Writer
+	logWriter   io.Writer // destination of debug and info logs
+	errorWriter io.Writer // destination of error, fatal and panic logs
 	auditWriter io.Writer
 
+	logLevel    LogLevel
+	auditLevel  AuditLevel
+	auditFormat AuditFormat
+
+	timeLayout   string // if not empty, time.Format layout of the timestamps, replacing the log package date and time
+	utc          bool   // whether timestamps are in UTC instead of local time
+	microseconds bool   // whether the log package timestamps have microsecond resolution, ignored if timeLayout is set
+
 	_debug *log.Logger
 	_audit *log.Logger
 	_info  *log.Logger
 	_error *log.Logger
 	_fatal *log.Logger
 	_panic *log.Logger
+
+	// mu serializes the changes of levels and timestamps, which can happen at runtime. Concurrent logging is safe, as log.Logger outputs are changed atomically
+	mu sync.Mutex
 }
 
-func NewMetaLogger(logWriter io.Writer, auditWriter io.Writer) *MetaLogger {
+func NewMetaLogger(logWriter io.Writer, errorWriter io.Writer, auditWriter io.Writer) *MetaLogger {
 	l := MetaLogger{
 		logWriter:   logWriter,
+		errorWriter: errorWriter,
 		auditWriter: auditWriter,
 	}
 
-	flags := log.LstdFlags
-	l._debug = log.New(io.Discard, "[DEBUG] ", 0)
-	l._audit = log.New(l.auditWriter, "[AUDIT] ", flags)
-	l._info = log.New(l.logWriter, "[INFO] ", flags)
-	l._error = log.New(l.logWriter, "[ERROR] ", flags)
-	l._fatal = log.New(l.logWriter, "[FATAL] ", flags)
-	l._panic = log.New(l.logWriter, "[PANIC] ", flags)
+	l._debug = log.New(io.Discard, prefixDebug, 0)
+	l._audit = log.New(io.Discard, prefixAudit, 0)
+	l._info = log.New(io.Discard, prefixInfo, 0)
+	l._error = log.New(io.Discard, prefixError, 0)
+	l._fatal = log.New(io.Discard, prefixFatal, 0)
+	l._panic = log.New(io.Discard, prefixPanic, 0)
+
+	l.setLogLevel(LogLevelNormal)
+	l.setAuditLevel(AuditLevelYes)
 
 	return &l
 }
 
-func (l *MetaLogger) disableLogger(logger *log.Logger) {
-	logger.SetOutput(io.Discard)
-	logger.SetFlags(0)
+// stampWriter writes lines prefixed with prefix and with the current time formatted with layout
+type stampWriter struct {
+	writer io.Writer
+	prefix string
+	layout string
+	utc    bool
 }
 
-func (l *MetaLogger) enableLogger(logger *log.Logger, flags int) {
-	logger.SetOutput(l.logWriter)
-	logger.SetFlags(flags)
+func (w stampWriter) Write(p []byte) (int, error) {
+	now := time.Now()
+	if w.utc {
+		now = now.UTC()
+	}
+
+	line := make([]byte, 0, len(w.prefix)+len(w.layout)+1+len(p))
+	line = append(line, w.prefix...)
+	line = now.AppendFormat(line, w.layout)
+	line = append(line, ' ')
+	line = append(line, p...)
+
+	_, err := w.writer.Write(line)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func (l *MetaLogger) enableAudit(flags int) {
-	l._audit.SetOutput(l.auditWriter)
-	l._audit.SetFlags(flags)
+// flags returns the log package flags producing the timestamps when no custom layout is set
+func (l *MetaLogger) flags() int {
+	flags := log.LstdFlags
+	if l.utc {
+		flags |= log.LUTC
+	}
+	if l.microseconds {
+		flags |= log.Lmicroseconds
+	}
+	return flags
 }
 
-func (l *MetaLogger) disableAudit() {
-	l._audit.SetOutput(io.Discard)
-	l._audit.SetFlags(0)
+func (l *MetaLogger) disableLogger(logger *log.Logger) {
+	logger.SetOutput(io.Discard)
+	logger.SetFlags(0)
+}
+
+// enableLogger makes logger write lines prefixed with prefix to writer, timestamped according to the timestamp settings
+func (l *MetaLogger) enableLogger(logger *log.Logger, prefix string, writer io.Writer) {
+	if l.timeLayout != "" {
+		logger.SetOutput(stampWriter{writer: writer, prefix: prefix, layout: l.timeLayout, utc: l.utc})
+		logger.SetPrefix("")
+		logger.SetFlags(0)
+		return
+	}
+
+	logger.SetOutput(writer)
+	logger.SetPrefix(prefix)
+	logger.SetFlags(l.flags())
 }
 
 func (l *MetaLogger) Debug(v ...interface{}) {
@@ -117,7 +181,25 @@ func (l *MetaLogger) Panicf(format string, v ...interface{}) {
 	l._panic.Panicf(format, v...)
 }
 
+// SetLogLevel sets the level of the logs, it can be called while logging
 func (l *MetaLogger) SetLogLevel(level LogLevel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.setLogLevel(level)
+}
+
+// LogLevel returns the current level of the logs
+func (l *MetaLogger) LogLevel() LogLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.logLevel
+}
+
+func (l *MetaLogger) setLogLevel(level LogLevel) {
+	l.logLevel = level
+
 	switch level {
 	case LogLevelQuiet:
 		l.disableLogger(l._debug)
@@ -127,24 +209,58 @@ func (l *MetaLogger) SetLogLevel(level LogLevel) {
 		l.disableLogger(l._panic)
 	case LogLevelNormal:
 		l.disableLogger(l._debug)
-		l.enableLogger(l._info, log.LstdFlags)
-		l.enableLogger(l._error, log.LstdFlags)
-		l.enableLogger(l._fatal, log.LstdFlags)
-		l.enableLogger(l._panic, log.LstdFlags)
+		l.enableLogger(l._info, prefixInfo, l.logWriter)
+		l.enableLogger(l._error, prefixError, l.errorWriter)
+		l.enableLogger(l._fatal, prefixFatal, l.errorWriter)
+		l.enableLogger(l._panic, prefixPanic, l.errorWriter)
 	case LogLevelVerbose:
-		l.enableLogger(l._debug, log.LstdFlags)
-		l.enableLogger(l._info, log.LstdFlags)
-		l.enableLogger(l._error, log.LstdFlags)
-		l.enableLogger(l._fatal, log.LstdFlags)
-		l.enableLogger(l._panic, log.LstdFlags)
+		l.enableLogger(l._debug, prefixDebug, l.logWriter)
+		l.enableLogger(l._info, prefixInfo, l.logWriter)
+		l.enableLogger(l._error, prefixError, l.errorWriter)
+		l.enableLogger(l._fatal, prefixFatal, l.errorWriter)
+		l.enableLogger(l._panic, prefixPanic, l.errorWriter)
 	}
 }
 
+// SetAuditLevel sets the level of the audit traces, it can be called while logging
 func (l *MetaLogger) SetAuditLevel(level AuditLevel) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.setAuditLevel(level)
+}
+
+// AuditLevel returns the current level of the audit traces
+func (l *MetaLogger) AuditLevel() AuditLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.auditLevel
+}
+
+func (l *MetaLogger) setAuditLevel(level AuditLevel) {
+	l.auditLevel = level
+
 	switch level {
 	case AuditLevelYes:
-		l.enableAudit(log.LstdFlags)
+		l.enableLogger(l._audit, prefixAudit, l.auditWriter)
 	case AuditLevelNo:
-		l.disableAudit()
+		l.disableLogger(l._audit)
 	}
 }
+
+// SetTimestampFormat sets the timestamps of all logs and audit traces. If layout is not empty, it is used as time.Format layout,
+// otherwise the default date and time format is kept, with microsecond resolution if microseconds is true.
+// If utc is true, timestamps are in UTC instead of local time.
+func (l *MetaLogger) SetTimestampFormat(layout string, utc bool, microseconds bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.timeLayout = layout
+	l.utc = utc
+	l.microseconds = microseconds
+
+	// Apply the new settings to the enabled loggers
+	l.setLogLevel(l.logLevel)
+	l.setAuditLevel(l.auditLevel)
+}
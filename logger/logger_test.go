@@ -0,0 +1,171 @@
+package logger
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setLocalZone sets the local time zone to a zone 5 hours ahead of UTC for the duration of the test, so that local and UTC timestamps differ
+func setLocalZone(t *testing.T) {
+	t.Helper()
+
+	previous := time.Local
+	time.Local = time.FixedZone("TEST", 5*3600)
+	t.Cleanup(func() { time.Local = previous })
+}
+
+// checkLine checks that output is a single line matching the regexp pattern
+func checkLine(t *testing.T, output string, pattern string) {
+	t.Helper()
+
+	if !regexp.MustCompile(`^` + pattern + `\n$`).MatchString(output) {
+		t.Fatalf("log line %q does not match %q", output, pattern)
+	}
+}
+
+// checkStamp checks that the timestamp stamp, formatted with layout, is the current time in zone
+func checkStamp(t *testing.T, stamp string, layout string, zone *time.Location) {
+	t.Helper()
+
+	date, err := time.ParseInLocation(layout, stamp, zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(date); d < -time.Minute || d > time.Minute {
+		t.Fatalf("timestamp %v is %v away from the current time", stamp, d)
+	}
+}
+
+func TestDefaultTimestamps(t *testing.T) {
+	setLocalZone(t)
+	var logs, audit bytes.Buffer
+	l := NewMetaLogger(&logs, &logs, &audit)
+
+	l.Info("message")
+	checkLine(t, logs.String(), `\[INFO\] \d{4}/\d\d/\d\d \d\d:\d\d:\d\d message`)
+	checkStamp(t, logs.String()[len("[INFO] "):len("[INFO] 2006/01/02 15:04:05")], "2006/01/02 15:04:05", time.Local)
+
+	l.Audit("trace")
+	checkLine(t, audit.String(), `\[AUDIT\] \d{4}/\d\d/\d\d \d\d:\d\d:\d\d trace`)
+}
+
+func TestUTCMicrosecondTimestamps(t *testing.T) {
+	setLocalZone(t)
+	var logs, audit bytes.Buffer
+	l := NewMetaLogger(&logs, &logs, &audit)
+	l.SetTimestampFormat("", true, true)
+
+	l.Error("message")
+	checkLine(t, logs.String(), `\[ERROR\] \d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} message`)
+	checkStamp(t, logs.String()[len("[ERROR] "):len("[ERROR] 2006/01/02 15:04:05.000000")], "2006/01/02 15:04:05.000000", time.UTC)
+
+	l.Audit("trace")
+	checkLine(t, audit.String(), `\[AUDIT\] \d{4}/\d\d/\d\d \d\d:\d\d:\d\d\.\d{6} trace`)
+}
+
+func TestCustomTimestamps(t *testing.T) {
+	setLocalZone(t)
+	var logs, audit bytes.Buffer
+	l := NewMetaLogger(&logs, &logs, &audit)
+	l.SetLogLevel(LogLevelVerbose)
+	l.SetTimestampFormat(time.RFC3339Nano, true, false)
+
+	l.Debugf("message %v", 1)
+	checkLine(t, logs.String(), `\[DEBUG\] \S+Z message 1`)
+	stamp, _, _ := strings.Cut(strings.TrimPrefix(logs.String(), "[DEBUG] "), " ")
+	checkStamp(t, stamp, time.RFC3339Nano, time.UTC)
+
+	// Audit traces use the same layout, in local time without the UTC option
+	l.SetTimestampFormat(time.RFC3339, false, false)
+	l.AuditEvent(AuditEvent{Event: "OPEN", Handler: "socks5", Client: "127.0.0.1:1234"})
+	checkLine(t, audit.String(), `\[AUDIT\] \S+\+05:00 \| OPEN\t\| socks5\t\| 127\.0\.0\.1:1234\t.*`)
+}
+
+func TestLevelWriters(t *testing.T) {
+	var logs, errs, audit bytes.Buffer
+	l := NewMetaLogger(&logs, &errs, &audit)
+
+	l.Info("info line")
+	l.Error("error line")
+	l.Debug("debug line")
+	if !strings.Contains(logs.String(), "[INFO]") || strings.Contains(logs.String(), "[ERROR]") {
+		t.Fatalf("unexpected log writer output %q", logs.String())
+	}
+	if !strings.Contains(errs.String(), "[ERROR]") || strings.Contains(errs.String(), "[INFO]") {
+		t.Fatalf("unexpected error writer output %q", errs.String())
+	}
+	if strings.Contains(logs.String(), "debug line") {
+		t.Fatal("debug line logged at normal level")
+	}
+
+	// Changing the level keeps the destination of each level
+	logs.Reset()
+	errs.Reset()
+	l.SetLogLevel(LogLevelVerbose)
+	l.Debug("debug line")
+	l.Errorf("error %v", "line")
+	if !strings.Contains(logs.String(), "[DEBUG]") || strings.Contains(logs.String(), "[ERROR]") || !strings.Contains(errs.String(), "[ERROR] ") {
+		t.Fatalf("unexpected outputs %q and %q at verbose level", logs.String(), errs.String())
+	}
+
+	logs.Reset()
+	errs.Reset()
+	l.SetLogLevel(LogLevelQuiet)
+	l.Info("info line")
+	l.Error("error line")
+	if logs.Len() != 0 || errs.Len() != 0 {
+		t.Fatalf("unexpected outputs %q and %q at quiet level", logs.String(), errs.String())
+	}
+	if audit.Len() != 0 {
+		t.Fatalf("logs written to the audit writer: %q", audit.String())
+	}
+}
+
+func TestSetLevelsWhileLogging(t *testing.T) {
+	l := NewMetaLogger(io.Discard, io.Discard, io.Discard)
+
+	// Levels can be changed while other goroutines are logging
+	done := make(chan struct{})
+	for range 4 {
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					l.Debug("debug")
+					l.Info("info")
+					l.Audit("trace")
+				}
+			}
+		}()
+	}
+	for i := range 100 {
+		l.SetLogLevel(LogLevel(i % 3))
+		l.SetAuditLevel(AuditLevel(i % 2))
+		l.SetTimestampFormat("", i%2 == 0, false)
+	}
+	close(done)
+
+	l.SetLogLevel(LogLevelQuiet)
+	l.SetAuditLevel(AuditLevelNo)
+	if l.LogLevel() != LogLevelQuiet || l.AuditLevel() != AuditLevelNo {
+		t.Errorf("levels %v and %v instead of quiet and no", l.LogLevel(), l.AuditLevel())
+	}
+}
+
+func TestSetLogLevel(t *testing.T) {
+	var logs, audit bytes.Buffer
+	l := NewMetaLogger(&logs, &logs, &audit)
+
+	l.Debug("hidden")
+	l.SetLogLevel(LogLevelVerbose)
+	l.Debug("shown")
+	l.SetLogLevel(LogLevelQuiet)
+	l.Error("quiet")
+	checkLine(t, logs.String(), `\[DEBUG\] [\d/: ]+ shown`)
+}
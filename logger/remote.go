@@ -0,0 +1,144 @@
+package logger
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"time"
+)
+
+// remoteDialTimeout bounds each connection attempt to the collector, and each write to it
+const remoteDialTimeout = 5 * time.Second
+
+// remoteRetryMin and remoteRetryMax bound the delay between two connection attempts to an unreachable collector, doubled after each failed attempt
+const (
+	remoteRetryMin = 1 * time.Second
+	remoteRetryMax = 1 * time.Minute
+)
+
+// RemoteWriter is an io.Writer sending each written buffer to a remote collector over TCP or UDP.
+// Writes never block: buffers are queued and sent by a background goroutine, which reconnects on failures with a jittered exponential backoff.
+type RemoteWriter struct {
+	network  string
+	address  string
+	queue    chan []byte
+	dropped  atomic.Uint64                 // buffers dropped because the queue was full, since startup
+	reported uint64                        // value of dropped when the drops were last reported, only used by run
+	warn     func(format string, v ...any) // reports dropped buffers, may be nil
+}
+
+// NewRemoteWriter returns a RemoteWriter sending to the collector described by remote, of format tcp://host:port or udp://host:port.
+// At most queueSize buffers are kept while the collector is unreachable, the oldest ones are dropped beyond it and reported with warn, if not nil, once the collector is reachable again.
+func NewRemoteWriter(remote string, queueSize int, warn func(format string, v ...any)) (*RemoteWriter, error) {
+	u, err := url.Parse(remote)
+	if err != nil {
+		err = fmt.Errorf("error parsing remote collector %v: %v", remote, err)
+		return nil, err
+	}
+
+	if u.Scheme != "tcp" && u.Scheme != "udp" {
+		err = fmt.Errorf("unsupported remote collector protocol %v, must be tcp or udp", u.Scheme)
+		return nil, err
+	}
+
+	_, _, err = net.SplitHostPort(u.Host)
+	if err != nil {
+		err = fmt.Errorf("error parsing remote collector address %v: %v", u.Host, err)
+		return nil, err
+	}
+
+	if queueSize < 1 {
+		err = fmt.Errorf("remote collector buffer size must be at least 1")
+		return nil, err
+	}
+
+	w := &RemoteWriter{
+		network: u.Scheme,
+		address: u.Host,
+		queue:   make(chan []byte, queueSize),
+		warn:    warn,
+	}
+	go w.run()
+
+	return w, nil
+}
+
+// Write queues a copy of p to be sent to the collector. If the queue is full, the oldest buffer is dropped.
+func (w *RemoteWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	for {
+		select {
+		case w.queue <- data:
+			return len(p), nil
+		default:
+			// Queue full, drop the oldest buffer to make room
+			select {
+			case <-w.queue:
+				w.dropped.Add(1)
+			default:
+			}
+		}
+	}
+}
+
+// Dropped returns the number of buffers dropped since startup because the collector was unreachable for too long
+func (w *RemoteWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// run sends the queued buffers to the collector, connecting and reconnecting as needed.
+// A buffer whose sending fails is sent again on the next connection.
+func (w *RemoteWriter) run() {
+	var conn net.Conn
+	var pending []byte
+	delay := remoteRetryMin
+
+	for {
+		if pending == nil {
+			pending = <-w.queue
+		}
+
+		if conn == nil {
+			var err error
+			conn, err = net.DialTimeout(w.network, w.address, remoteDialTimeout)
+			if err != nil {
+				conn = nil
+				time.Sleep(jitter(delay))
+				delay = min(2*delay, remoteRetryMax)
+				continue
+			}
+			delay = remoteRetryMin
+			w.reportDropped()
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(remoteDialTimeout))
+		_, err := conn.Write(pending)
+		if err != nil {
+			conn.Close()
+			conn = nil
+			continue
+		}
+		pending = nil
+	}
+}
+
+// reportDropped warns about the buffers dropped since the last report, if any
+func (w *RemoteWriter) reportDropped() {
+	dropped := w.dropped.Load()
+	if dropped == w.reported {
+		return
+	}
+	if w.warn != nil {
+		w.warn("%v audit traces dropped while remote collector %v://%v was unreachable (%v since startup)", dropped-w.reported, w.network, w.address, dropped)
+	}
+	w.reported = dropped
+}
+
+// jitter returns a random duration between half of delay and delay, so that writers do not reconnect in lockstep
+func jitter(delay time.Duration) time.Duration {
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,218 @@
+package logger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a local TCP listener capturing the lines sent by a RemoteWriter
+type collector struct {
+	ln    net.Listener
+	lines chan string
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startCollector(t *testing.T, address string) *collector {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &collector{ln: ln, lines: make(chan string, 100)}
+	t.Cleanup(c.close)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.mu.Lock()
+			c.conns = append(c.conns, conn)
+			c.mu.Unlock()
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					c.lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	return c
+}
+
+// close stops the collector, closing the connections it accepted
+func (c *collector) close() {
+	c.ln.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// expect checks the next lines received by the collector are lines, in order
+func (c *collector) expect(t *testing.T, lines ...string) {
+	t.Helper()
+
+	for _, want := range lines {
+		select {
+		case got := <-c.lines:
+			if got != want {
+				t.Fatalf("collector received %q instead of %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("collector did not receive %q", want)
+		}
+	}
+}
+
+func TestRemoteWriterTCP(t *testing.T) {
+	c := startCollector(t, "127.0.0.1:0")
+
+	w, err := NewRemoteWriter("tcp://"+c.ln.Addr().String(), 16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l := NewMetaLogger(io.Discard, io.Discard, w)
+	l.SetAuditFormat(AuditFormatJSON)
+	l.AuditEvent(AuditEvent{Event: "OPEN", Handler: "socks5", Client: "127.0.0.1:1234", Chain: "direct", Dest: "example.com:443"})
+	l.AuditEvent(AuditEvent{Event: "CLOSE", Handler: "socks5", Client: "127.0.0.1:1234", Chain: "direct", Dest: "example.com:443", BytesUp: 1, BytesDown: 2})
+
+	for _, event := range []string{"OPEN", "CLOSE"} {
+		select {
+		case line := <-c.lines:
+			if !strings.Contains(line, `"event":"`+event+`"`) || !strings.Contains(line, `"dest":"example.com:443"`) {
+				t.Errorf("unexpected %v audit trace %q", event, line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("collector did not receive the %v audit trace", event)
+		}
+	}
+}
+
+func TestRemoteWriterUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	w, err := NewRemoteWriter("udp://"+pc.LocalAddr().String(), 16, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("trace\n"))
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "trace\n" {
+		t.Errorf("collector received %q instead of %q", buf[:n], "trace\n")
+	}
+}
+
+func TestRemoteWriterReconnects(t *testing.T) {
+	c := startCollector(t, "127.0.0.1:0")
+	address := c.ln.Addr().String()
+
+	var mu sync.Mutex
+	var warnings []string
+	warn := func(format string, v ...any) {
+		mu.Lock()
+		defer mu.Unlock()
+		warnings = append(warnings, fmt.Sprintf(format, v...))
+	}
+
+	w, err := NewRemoteWriter("tcp://"+address, 2, warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("first\n"))
+	c.expect(t, "first")
+
+	// Stop the collector, writes made while it is down must not block, and drop the oldest traces once the buffer is full
+	c.close()
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; w.Dropped() == 0; i++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("no audit trace dropped while the collector was down")
+		}
+		start := time.Now()
+		w.Write([]byte(fmt.Sprintf("down %v\n", i)))
+		if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+			t.Fatalf("write blocked for %v while the collector was down", elapsed)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.Write([]byte("last\n"))
+
+	// The most recent traces are sent once the collector is back, the one being sent when the collector went down included
+	c = startCollector(t, address)
+	var received []string
+	for len(received) == 0 || received[len(received)-1] != "last" {
+		select {
+		case line := <-c.lines:
+			received = append(received, line)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("collector did not receive the last trace, only %q", received)
+		}
+	}
+	if len(received) > 3 {
+		t.Errorf("collector received %q, more traces than buffered", received)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "dropped while remote collector tcp://"+address+" was unreachable") {
+		t.Errorf("unexpected warnings %q", warnings)
+	}
+}
+
+func TestNewRemoteWriterErrors(t *testing.T) {
+	for _, remote := range []string{"http://127.0.0.1:1234", "tcp://127.0.0.1", "udp://", "127.0.0.1:1234"} {
+		_, err := NewRemoteWriter(remote, 16, nil)
+		if err == nil {
+			t.Errorf("remote collector %q accepted", remote)
+		}
+	}
+
+	_, err := NewRemoteWriter("tcp://127.0.0.1:1234", 0, nil)
+	if err == nil {
+		t.Errorf("empty buffer accepted")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	// Delays are spread between half of the backoff delay and the delay itself, so that writers do not reconnect in lockstep
+	seen := make(map[time.Duration]bool)
+	for _, delay := range []time.Duration{remoteRetryMin, 8 * time.Second, remoteRetryMax} {
+		for i := 0; i < 100; i++ {
+			d := jitter(delay)
+			if d < delay/2 || d > delay {
+				t.Fatalf("jittered delay %v out of [%v, %v]", d, delay/2, delay)
+			}
+			seen[d] = true
+		}
+	}
+	if len(seen) < 100 {
+		t.Errorf("only %v distinct jittered delays", len(seen))
+	}
+	if jitter(0) != 0 {
+		t.Errorf("jittered delay %v for a zero delay", jitter(0))
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"errors"
 	"io"
+	"io/fs"
 	"maps"
+	"net"
 	"os"
 	"os/signal"
 	"slices"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -15,9 +20,11 @@ import (
 var gChainsConf chainsConf
 var gRoutingConf routingConf
 var gServerConf serverConf
-var gHosts hostMap
 var gMetaLogger *logger.MetaLogger
 
+// gConfigGeneration is the number of configurations successfully loaded since startup
+var gConfigGeneration atomic.Uint64
+
 func main() {
 
 	// Parse the command line arguments
@@ -27,6 +34,7 @@ func main() {
 
 	var auditFile *os.File = nil
 	var logFile *os.File = nil
+	var errorLogFile *os.File = nil
 
 	if gArgAuditPath != "" {
 		var err error
@@ -46,7 +54,19 @@ func main() {
 		defer logFile.Close()
 	}
 
+	if gArgErrorLogPath != "" {
+		var err error
+		errorLogFile, err = os.OpenFile(gArgErrorLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0755)
+		if err != nil {
+			panic(err)
+		}
+		defer errorLogFile.Close()
+	} else {
+		errorLogFile = logFile
+	}
+
 	var logWriter io.Writer = os.Stdout
+	var errorWriter io.Writer = os.Stderr
 	var auditWriter io.Writer = os.Stdout
 
 	if auditFile != nil {
@@ -57,6 +77,22 @@ func main() {
 		}
 	}
 
+	// The remote collector receives audit traces in addition to the audit file, or instead of STDOUT unless -audit-both is set
+	if gArgAuditRemote != "" {
+		remoteWriter, err := logger.NewRemoteWriter(gArgAuditRemote, gArgAuditRemoteBuffer, func(format string, v ...any) { gMetaLogger.Errorf(format, v...) })
+		if err != nil {
+			cmdlineError(err)
+		}
+
+		if auditFile != nil {
+			auditWriter = io.MultiWriter(auditWriter, remoteWriter)
+		} else if gArgAuditBoth {
+			auditWriter = io.MultiWriter(os.Stdout, remoteWriter)
+		} else {
+			auditWriter = remoteWriter
+		}
+	}
+
 	if logFile != nil {
 		if gArgLogBoth {
 			logWriter = io.MultiWriter(os.Stdout, logFile)
@@ -65,7 +101,16 @@ func main() {
 		}
 	}
 
-	gMetaLogger = logger.NewMetaLogger(logWriter, auditWriter)
+	if errorLogFile != nil {
+		if gArgLogBoth {
+			errorWriter = io.MultiWriter(os.Stderr, errorLogFile)
+		} else {
+			errorWriter = errorLogFile
+		}
+	}
+
+	gMetaLogger = logger.NewMetaLogger(logWriter, errorWriter, auditWriter)
+	gMetaLogger.SetTimestampFormat(gArgLogTimeFormat, gArgLogUTCBool, gArgLogMicroBool)
 
 	if gArgQuietBool {
 		gMetaLogger.SetLogLevel(logger.LogLevelQuiet)
@@ -81,26 +126,107 @@ func main() {
 		gMetaLogger.SetAuditLevel(logger.AuditLevelYes)
 	}
 
+	if gArgAuditFormat == "json" {
+		gMetaLogger.SetAuditFormat(logger.AuditFormatJSON)
+	} else {
+		gMetaLogger.SetAuditFormat(logger.AuditFormatText)
+	}
+
 	// ***** END Logs setup *****
 
+	gMetaLogger.Infof("Starting %v", versionString())
+
+	if gArgOTelEndpoint != "" {
+		shutdown, err := initTracing(gArgOTelEndpoint)
+		if err != nil {
+			gMetaLogger.Fatalf("error initializing tracing: %v", err)
+		}
+		defer shutdown()
+		gMetaLogger.Infof("Exporting tracing spans to %v", gArgOTelEndpoint)
+	}
+
+	// Write the PID file used by process supervisors, removed on clean shutdown. It is written after the setup steps which may exit, as exiting with Fatal skips its removal
+	if gArgPIDFilePath != "" {
+		err := writePIDFile(gArgPIDFilePath)
+		if err != nil {
+			gMetaLogger.Fatalf("error writing PID file: %v", err)
+		}
+		defer removePIDFile(gArgPIDFilePath)
+	}
+
+	if gArgDebugAddr != "" {
+		go runDebugServer(gArgDebugAddr)
+	}
+
+	if gArgHealthAddr != "" {
+		go runHealthServer(gArgHealthAddr)
+	}
+
 	// ***** BEGIN Configuration files loading *****
 
 	// Output PID needed to hot reload configuration files
 	gMetaLogger.Infof("bbs PID: %v. Use the following to reload configuration:", os.Getpid())
 	gMetaLogger.Infof("kill -HUP %v", os.Getpid())
+	if len(userSignals()) > 0 {
+		gMetaLogger.Infof("Use the following to engage or release the kill switch:")
+		gMetaLogger.Infof("kill -USR2 %v", os.Getpid())
+
+		gMetaLogger.Infof("Use the following to describe active connections and servers:")
+		gMetaLogger.Infof("kill -USR1 %v", os.Getpid())
+	}
 
-	// Setup a notification channel listening on SIGHUP, used to hot reload configuration files
+	// Setup a notification channel listening on SIGHUP, used to hot reload configuration files, on the user signals (see signals_unix.go),
+	// used to describe active connections and to toggle the kill switch, and on SIGINT and SIGTERM, used to shutdown cleanly
 	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, syscall.SIGHUP)
+	signal.Notify(signalCh, append([]os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}, userSignals()...)...)
+
+	// Whether the first configuration has been successfully loaded, used to notify supervisors once
+	ready := false
+
+	// Whether the initial configuration loading has been attempted, and whether the last loading was the initial one
+	attempted := false
+	initialLoad := false
 
 	// Send a SIGHUP to trigger initial configuration loading
 	signalCh <- syscall.SIGHUP
 
 	// Wait for data on the previously created channel to reload configuration files
 	for {
+		// On initial loading failure, nothing is served until a valid configuration is loaded: report it prominently, and exit if -exit-on-initial-failure is set
+		if initialLoad && !ready {
+			gMetaLogger.Errorf("INITIAL CONFIGURATION LOADING FAILED, bbs is not serving anything. Fix %v and reload it with: kill -HUP %v", gArgConfigPath, os.Getpid())
+			if gArgExitOnInitialFailureBool {
+				if gArgPIDFilePath != "" {
+					removePIDFile(gArgPIDFilePath)
+				}
+				gMetaLogger.Fatal("exiting on initial configuration loading failure (-exit-on-initial-failure)")
+			}
+		}
+		initialLoad = false
+
 		sig := <-signalCh
+
+		switch sig {
+		case syscall.SIGINT, syscall.SIGTERM:
+			gMetaLogger.Infof("Signal %v received, shutting down", sig)
+			return
+		case sigDescribe:
+			gMetaLogger.Infof("Signal %v received, describing active connections", sig)
+			gConnRegistry.describe()
+			describeServerCounts()
+			describeRouteMatches()
+			continue
+		case sigKillSwitch:
+			gMetaLogger.Infof("Signal %v received, toggling kill switch", sig)
+			gKillSwitch.toggle(gArgKillActiveBool)
+			continue
+		}
+
 		gMetaLogger.Infof("Signal %v received, reloading configurations", sig)
 
+		initialLoad = !attempted
+		attempted = true
+
 		gMetaLogger.Debug("Describing gServerConf.servers : ")
 		describeServers(gServerConf.servers)
 
@@ -108,25 +234,30 @@ func main() {
 		config, err := parseMainConfig(gArgConfigPath)
 		if err != nil {
 			gMetaLogger.Errorf("error parsing main config : %v", err)
+			if errors.Is(err, fs.ErrNotExist) {
+				gMetaLogger.Errorf("configuration file %v does not exist, use -c <path> to choose the configuration file", gArgConfigPath)
+			}
 			continue
 		}
 		gMetaLogger.Info("JSON configuration file parsed. Checking for errors.")
 		gMetaLogger.Debugf("Parsed main config : %v", config)
 
-		// Create the implicit single proxy chains associated with each declared proxy
+		// Create the implicit single proxy chains associated with each declared proxy, unless disabled in the defaults section
 		duplicateName := false
 		definedChains := slices.Collect(maps.Keys(config.Chains))
 		for proxyName, _ := range config.Proxies {
+			if !config.Defaults.ImplicitChains {
+				gMetaLogger.Debug("implicit single proxy chains are disabled")
+				break
+			}
+
 			if slices.Contains(definedChains, proxyName) {
 				gMetaLogger.Errorf("chain %v cannot be named as proxy %v", proxyName, proxyName)
 				duplicateName = true
 				break
 			}
 
-			var implicitChain proxyChainDesc
-			implicitChain.ProxyDns = true
-			implicitChain.TcpConnectTimeout = 1000
-			implicitChain.TcpReadTimeout = 2000
+			implicitChain := config.Defaults.chainDesc()
 			implicitChain.Proxies = []string{proxyName}
 
 			config.Chains[proxyName] = implicitChain
@@ -135,36 +266,121 @@ func main() {
 			continue
 		}
 
-		// Check that all proxies used in all chains of chains section correspond to an existing proxy in the proxies section
+		// Resolve the chains referenced in chains of chains section (nested chains) into flat lists of proxies,
+		// and check that all proxies used correspond to an existing proxy in the proxies section
 		allExist := true
-		definedProxies := slices.Collect(maps.Keys(config.Proxies))
+		flatChains := make(chainMap)
 		for chainName, chainDesc := range config.Chains {
-			for index, proxyName := range chainDesc.Proxies {
-				if !slices.Contains(definedProxies, proxyName) {
-					gMetaLogger.Errorf("proxy %v used at index %v of chain %v is not part of the defined proxies in proxies section (%v)", proxyName, index, chainName, definedProxies)
-					allExist = false
-				}
+			proxies, err := config.Chains.flatten(chainName, config.Proxies, nil)
+			if err != nil {
+				gMetaLogger.Errorf("error resolving chain %v: %v", chainName, err)
+				allExist = false
+				continue
 			}
+			chainDesc.Proxies = proxies
+			flatChains[chainName] = chainDesc
 		}
 		if !allExist {
 			continue
 		}
+		config.Chains = flatChains
+
+		// Check that the direct chain of the bypass list does not shadow a defined chain
+		if _, ok := config.Chains[bypassRoute]; ok && config.Bypass != nil {
+			gMetaLogger.Errorf("chain %v cannot be defined along with a bypass list, which uses this name for its direct chain", bypassRoute)
+			continue
+		}
+
+		// Check that no two servers of the servers section listen on conflicting addresses, as all servers rely on TCP listeners
+		duplicateAddr := false
+		for i, s1 := range config.Servers {
+			for j, s2 := range config.Servers[:i] {
+				if !s1.options.disable && !s2.options.disable && listenConflict(s1, s2) {
+					gMetaLogger.Errorf("server number %v (%v) conflicts with server number %v (%v): cannot listen twice on the same address", i, s1.address(), j, s2.address())
+					duplicateAddr = true
+				}
+			}
+		}
+		if duplicateAddr {
+			continue
+		}
+
+		// Check that the user groups used by servers are defined, and that the credentials of user groups are valid and override routing with existing routing tables or chains
+		validUsers := true
+		for index, server := range config.Servers {
+			if _, ok := config.Users[server.group]; server.group != "" && !ok {
+				gMetaLogger.Errorf("user group %v used by server number %v is not defined in the users section", server.group, index)
+				validUsers = false
+			}
+		}
+		for groupName, group := range config.Users {
+			for userName, user := range group {
+				switch {
+				case userName == "" || user.Pass == "" || len(userName) > 255 || len(user.Pass) > 255:
+					gMetaLogger.Errorf("user %v of user group %v must have a user name and a password of 1 to 255 bytes", userName, groupName)
+					validUsers = false
+				case user.Table != "" && user.Chain != "":
+					gMetaLogger.Errorf("user %v of user group %v cannot override both the routing table and the chain", userName, groupName)
+					validUsers = false
+				case user.Table != "" && gArgPACPath != "":
+					gMetaLogger.Errorf("user %v of user group %v overrides the routing table, which is not supported with -pac", userName, groupName)
+					validUsers = false
+				case user.Table != "" && !slices.Contains(slices.Collect(maps.Keys(config.Routes)), user.Table):
+					gMetaLogger.Errorf("routing table %v used by user %v of user group %v is not part of the defined routing tables in section routes", user.Table, userName, groupName)
+					validUsers = false
+				case user.Chain != "" && !isSpecialRoute(user.Chain) && !slices.Contains(slices.Collect(maps.Keys(config.Chains)), user.Chain):
+					gMetaLogger.Errorf("chain %v used by user %v of user group %v is not part of the defined chains in the chains section", user.Chain, userName, groupName)
+					validUsers = false
+				}
+			}
+		}
+		if !validUsers {
+			continue
+		}
 
 		// If -pac is not defined, perform consistency checks on routing configuration
 		if gArgPACPath == "" {
 
-			// Check that all routes defined in routes section correspond to an existing chain in the chains section
+			// Check that all routes defined in routes section correspond to an existing chain in the chains section,
+			// or to an existing routing table for fallthrough routes
 			allExist = true
 			definedChains := slices.Collect(maps.Keys(config.Chains))
 			for routingTableName, routingTable := range config.Routes {
 				for index, ruleBlock := range routingTable {
 
-					if ruleBlock.Route != "drop" && !slices.Contains(definedChains, ruleBlock.Route) {
+					if next, ok := strings.CutPrefix(ruleBlock.Route, tableRoutePrefix); ok {
+						if _, ok := config.Routes[next]; !ok {
+							gMetaLogger.Errorf("route %v defined in ruleBlock number %v of routingTable %v falls through to undefined routing table %v", ruleBlock.Route, index, routingTableName, next)
+							allExist = false
+						}
+						continue
+					}
+
+					if !isSpecialRoute(ruleBlock.Route) && !slices.Contains(definedChains, ruleBlock.Route) {
 						gMetaLogger.Errorf("route %v defined in ruleBlock number %v of routingTable %v is not part of the defined chains in the chains section (%v)", ruleBlock.Route, index, routingTableName, definedChains)
 						allExist = false
 					}
 				}
 			}
+
+			// Check that the default route exists as well
+			if config.DefaultRoute != "" && !isSpecialRoute(config.DefaultRoute) && !slices.Contains(definedChains, config.DefaultRoute) {
+				gMetaLogger.Errorf("route %v defined by defaultRoute is not part of the defined chains in the chains section (%v)", config.DefaultRoute, definedChains)
+				allExist = false
+			}
+
+			// Check that the route used on rule evaluation errors exists as well
+			if gArgRouteErrorPolicy == "default" {
+				if next, ok := strings.CutPrefix(gArgRouteErrorDefault, tableRoutePrefix); ok {
+					if _, ok := config.Routes[next]; !ok {
+						gMetaLogger.Errorf("route %v defined by -route-error-default falls through to undefined routing table %v", gArgRouteErrorDefault, next)
+						allExist = false
+					}
+				} else if !isSpecialRoute(gArgRouteErrorDefault) && !slices.Contains(definedChains, gArgRouteErrorDefault) {
+					gMetaLogger.Errorf("route %v defined by -route-error-default is not part of the defined chains in the chains section (%v)", gArgRouteErrorDefault, definedChains)
+					allExist = false
+				}
+			}
 			if !allExist {
 				continue
 			}
@@ -173,6 +389,14 @@ func main() {
 			allExist = true
 			definedRoutingTables := slices.Collect(maps.Keys(config.Routes))
 			for index, server := range config.Servers {
+				if server.options.disable {
+					continue
+				}
+				if slices.Contains(config.disabledRoutes, server.table) {
+					gMetaLogger.Errorf("table %v used by server number %v is disabled", server.table, index)
+					allExist = false
+					continue
+				}
 				if !slices.Contains(definedRoutingTables, server.table) {
 					gMetaLogger.Errorf("table %v used by server number %v is not part of the defined routing tables in section routes (%v)", server.table, index, definedRoutingTables)
 					allExist = false
@@ -182,7 +406,20 @@ func main() {
 				continue
 			}
 
-		} else { // Otherwise, load PAC file and do not perform consistency checks
+		} else { // Otherwise, load PAC file and do not perform consistency checks on routes
+
+			// Check that the chains the PAC script may return with -pac-allow are defined
+			allExist = true
+			for _, chain := range gPACAllowList {
+				if !isSpecialRoute(chain) && !slices.Contains(slices.Collect(maps.Keys(config.Chains)), chain) {
+					gMetaLogger.Errorf("chain %v allowed by -pac-allow is not part of the defined chains in the chains section", chain)
+					allExist = false
+				}
+			}
+			if !allExist {
+				continue
+			}
+
 			err := reloadPACConf(gArgPACPath)
 			if err != nil {
 				gMetaLogger.Errorf("error reloading pac file: %v", err)
@@ -194,20 +431,52 @@ func main() {
 		// At this point, the defined configuration should be consistent, so we can update the globals
 		gMetaLogger.Info("No errors detected. Updating global configurations.")
 
-		// Build a proxyChain object from the proxyChainDesc parsed in JSON file
+		// Build a proxyChain object from the proxyChainDesc parsed in JSON file.
+		// All chains are built again from the proxies of the new configuration, so that they always use the current proxy definitions:
+		// a proxy whose definition changed (e.g. its credentials) is used with its new definition by the new connections of all chains referencing it.
+
+		if changed := changedProxies(gProxies, config.Proxies); len(changed) != 0 {
+			gMetaLogger.Infof("Proxies %v changed, the chains using them now use their new definitions", changed)
+		}
+		gProxies = config.Proxies
+
+		// The destinations of the bypass list use a chain without proxies, with the default chain options
+		if config.Bypass != nil {
+			config.Chains[bypassRoute] = config.Defaults.chainDesc()
+		}
 
 		proxychains := make(map[string]proxyChain)
+		var pools []*prewarmPool
 
 		for chainName, chainDesc := range config.Chains {
 			var proxychain proxyChain
+			proxychain.name = chainName
 			proxychain.proxyDns = chainDesc.ProxyDns
 			proxychain.tcpConnectTimeout = chainDesc.TcpConnectTimeout
 			proxychain.tcpReadTimeout = chainDesc.TcpReadTimeout
+			proxychain.firstDataTimeout = chainDesc.FirstDataTimeout
+			proxychain.maxLifetime = chainDesc.MaxLifetime
+			proxychain.idleTimeout = chainDesc.IdleTimeout
+			proxychain.hopTimeout = chainDesc.HopTimeout
+			proxychain.noDelay = chainDesc.NoDelay
+			proxychain.keepAlive = chainDesc.KeepAlive
+			proxychain.directFallback = chainDesc.DirectFallback
+			proxychain.verify = chainDesc.Verify
+			proxychain.udpOverTcp = chainDesc.UdpOverTcp
+			proxychain.order = chainDesc.Order
+			proxychain.sourceAddr = net.ParseIP(chainDesc.SourceAddr)
+			proxychain.fwmark = chainDesc.Fwmark
+			proxychain.retry = chainDesc.Retry
 
 			for _, proxyName := range chainDesc.Proxies {
 				proxychain.proxies = append(proxychain.proxies, config.Proxies[proxyName])
 			}
 
+			if chainDesc.Prewarm > 0 && len(proxychain.proxies) != 0 {
+				proxychain.prewarm = newPrewarmPool(proxychain, chainDesc.Prewarm, time.Duration(chainDesc.PrewarmIdle)*time.Millisecond)
+				pools = append(pools, proxychain.prewarm)
+			}
+
 			proxychains[chainName] = proxychain
 
 		}
@@ -215,32 +484,63 @@ func main() {
 		gChainsConf.proxychains = proxychains
 		gChainsConf.valid = true
 		gChainsConf.mu.Unlock()
+		gPrewarmPools.replace(pools)
 		gMetaLogger.Info("Global chains configuration updated")
 		gMetaLogger.Debugf("-> %v", gChainsConf.proxychains)
 
-		gHosts = config.Hosts
+		gBypassConf.mu.Lock()
+		gBypassConf.list = config.Bypass
+		gBypassConf.mu.Unlock()
+
+		gHostsConf.mu.Lock()
+		gHostsConf.hosts = config.Hosts
+		gHostsConf.mu.Unlock()
+
+		gUsersConf.mu.Lock()
+		gUsersConf.groups = config.Users
+		gUsersConf.mu.Unlock()
 		gMetaLogger.Info("Global hosts configuration updated")
-		gMetaLogger.Debugf("-> %v", gHosts)
+		gMetaLogger.Debugf("-> %v", config.Hosts)
 
 		if gArgPACPath == "" {
 			gRoutingConf.mu.Lock()
 			gRoutingConf.routing = config.Routes
+			gRoutingConf.defaultRoute = config.DefaultRoute
+			gRoutingConf.noMatch = newNoMatchCounters(config.Routes)
 			gRoutingConf.valid = true
 			gRoutingConf.mu.Unlock()
 			gMetaLogger.Info("Global routing configuration updated")
 			gMetaLogger.Debugf("-> %v", gRoutingConf.routing)
 		}
 
-		// Update global servers variable, stop old ones and start new ones
+		// Update global servers variable, stop old ones and start new ones.
+		// Disabled servers are left out, so that they are stopped if they were running
+		enabledServers := make([]server, 0, len(config.Servers))
+		for index, server := range config.Servers {
+			if server.options.disable {
+				gMetaLogger.Infof("server number %v (%v) is disabled, not starting it", index, server.address())
+				continue
+			}
+			enabledServers = append(enabledServers, server)
+		}
+		config.Servers = enabledServers
 
 		// Stoping running servers that are not defined in the new configuration
 		gMetaLogger.Debug("Describing servers : ")
-		describeServers(config.Servers)
+		gMetaLogger.Debugf("-> %v", config.Servers)
 		gServerConf.mu.Lock()
 		j := 0
 		for i := range gServerConf.servers {
 			i_fixed := i - j
-			stillExists := slices.ContainsFunc(config.Servers, func(s server) bool { return compare(s, gServerConf.servers[i_fixed]) })
+
+			// Servers whose listening parameters are unchanged but whose routing table changed keep their listener and active connections, only the table is swapped
+			k := slices.IndexFunc(config.Servers, func(s server) bool { return sameListener(s, *gServerConf.servers[i_fixed]) })
+			if k != -1 && config.Servers[k].table != gServerConf.servers[i_fixed].table {
+				gMetaLogger.Debugf("Server %v only changed its routing table to %v, swapping it", gServerConf.servers[i_fixed], config.Servers[k].table)
+				gServerConf.servers[i_fixed].table = config.Servers[k].table
+			}
+
+			stillExists := slices.ContainsFunc(config.Servers, func(s server) bool { return compare(s, *gServerConf.servers[i_fixed]) })
 			if stillExists {
 				gMetaLogger.Debugf("Server %v still exists in new loaded servers, keeping it", gServerConf.servers[i_fixed])
 			} else {
@@ -252,9 +552,10 @@ func main() {
 		}
 
 		for i := range config.Servers {
-			alreadyExists := slices.ContainsFunc(gServerConf.servers, func(s server) bool { return compare(s, config.Servers[i]) })
+			alreadyExists := slices.ContainsFunc(gServerConf.servers, func(s *server) bool { return compare(*s, config.Servers[i]) })
 			if !alreadyExists {
-				gServerConf.servers = append(gServerConf.servers, config.Servers[i])
+				srv := config.Servers[i]
+				gServerConf.servers = append(gServerConf.servers, &srv)
 			}
 		}
 
@@ -264,18 +565,57 @@ func main() {
 		gMetaLogger.Debug("Describing gServerConf.servers : ")
 		describeServers(gServerConf.servers)
 
-		// Start all servers that are not running
+		// Start all servers that are not running, spaced out by -server-start-interval if set.
+		// Each server is waited for until its listeners are bound, so that the servers are listening once the reload is over
+		// Servers that could not be bound are reported, and started again on next reload
+		started := 0
+		var failed []string
 		for i := 0; i < len(gServerConf.servers); i++ {
 			if !gServerConf.servers[i].running {
-				gMetaLogger.Debugf("myServer %v(%p) is not running, running it", gServerConf.servers[i], &gServerConf.servers[i])
-				time.Sleep(1 * time.Second)
-				go (gServerConf.servers[i]).run()
-				gMetaLogger.Debugf("myServer %v(%p) is running", gServerConf.servers[i], &gServerConf.servers[i])
+				gMetaLogger.Debugf("myServer %v(%p) is not running, running it", gServerConf.servers[i], gServerConf.servers[i])
+				if started > 0 && gArgServerStartInterval > 0 {
+					time.Sleep(gArgServerStartInterval)
+				}
+				started++
+				bound := make(chan error, 1)
+				go gServerConf.servers[i].run(bound)
+				err := <-bound
+
+				gServerConf.mu.Lock()
+				gServerConf.servers[i].running = err == nil
+				gServerConf.servers[i].bindErr = err
+				gServerConf.mu.Unlock()
+				if err != nil {
+					failed = append(failed, gServerConf.servers[i].prot+"://"+gServerConf.servers[i].address())
+					continue
+				}
+				gMetaLogger.Debugf("myServer %v(%p) is running", gServerConf.servers[i], gServerConf.servers[i])
+			}
+		}
+		if started > 0 {
+			if len(failed) > 0 {
+				gMetaLogger.Errorf("%v of %v servers started, failed to start: %v", started-len(failed), started, strings.Join(failed, ", "))
+			} else {
+				gMetaLogger.Infof("%v servers started", started)
 			}
 		}
 
 		gMetaLogger.Debug("Describing gServerConf.servers : ")
 		describeServers(gServerConf.servers)
 
+		gConfigGeneration.Add(1)
+
+		gServerConf.mu.RLock()
+		emitBanner(newBanner(gServerConf.servers, config.Proxies, proxychains, config.Routes))
+		gServerConf.mu.RUnlock()
+
+		if !ready {
+			ready = true
+			err = sdNotify("READY=1")
+			if err != nil {
+				gMetaLogger.Errorf("error notifying readiness to systemd: %v", err)
+			}
+		}
+
 	}
 }
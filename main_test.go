@@ -0,0 +1,555 @@
+package main
+
+// Defines the setup and the helpers shared by the tests: test servers and clients, captured audit traces, and bbs processes run from the test binary
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/synacktiv/bbs/logger"
+)
+
+// testMainEnv is set in the environment of the bbs processes started by the tests, which run the test binary as bbs
+const testMainEnv = "BBS_TEST_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(testMainEnv) == "1" {
+		main()
+		os.Exit(0)
+	}
+
+	// Command line arguments are parsed to set their default values, test flags are registered along with them
+	parseArgs()
+	gMetaLogger = logger.NewMetaLogger(&gTestLogs, &gTestLogs, &gTestAudit)
+	gMetaLogger.SetLogLevel(logger.LogLevelVerbose)
+	gMetaLogger.SetAuditLevel(logger.AuditLevelYes)
+	gMetaLogger.SetAuditFormat(logger.AuditFormatJSON)
+
+	os.Exit(m.Run())
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use, written by loggers and read by tests
+type syncBuffer struct {
+	buf bytes.Buffer
+	mu  sync.Mutex
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+// testWriter is an io.Writer whose destination can be replaced while it is written to, discarding data without destination
+type testWriter struct {
+	dst io.Writer
+	mu  sync.Mutex
+}
+
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.dst == nil {
+		return len(p), nil
+	}
+	return w.dst.Write(p)
+}
+
+// setDestination replaces the destination of w by dst
+func (w *testWriter) setDestination(dst io.Writer) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dst = dst
+}
+
+// gTestLogs and gTestAudit are the destinations of the logs and of the JSON audit traces of the global logger during the tests.
+// The global logger is never replaced, as it is used by the goroutines which outlive the tests.
+var gTestLogs, gTestAudit testWriter
+
+// captureLogs writes the logs and the JSON audit traces of the global logger to the returned buffers for the duration of the test
+func captureLogs(t *testing.T) (logs *syncBuffer, audit *syncBuffer) {
+	t.Helper()
+
+	logs, audit = new(syncBuffer), new(syncBuffer)
+	gTestLogs.setDestination(logs)
+	gTestAudit.setDestination(audit)
+	t.Cleanup(func() {
+		gTestLogs.setDestination(nil)
+		gTestAudit.setDestination(nil)
+	})
+
+	return logs, audit
+}
+
+// auditEvents returns the JSON audit traces written to audit, following their prefix and timestamp
+func auditEvents(t *testing.T, audit *syncBuffer) []logger.AuditEvent {
+	t.Helper()
+
+	var events []logger.AuditEvent
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var event logger.AuditEvent
+		_, trace, _ := strings.Cut(line, "{")
+		err := json.Unmarshal([]byte("{"+trace), &event)
+		if err != nil {
+			t.Fatalf("invalid audit trace %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+// waitFor polls cond until it returns true, and fails the test if it does not within timeout
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// setArg sets the command line argument variable arg to value for the duration of the test
+func setArg[T any](t *testing.T, arg *T, value T) {
+	t.Helper()
+
+	previous := *arg
+	*arg = value
+	t.Cleanup(func() { *arg = previous })
+}
+
+// listenTCP returns a listener on a free port of the loopback interface, closed at the end of the test
+func listenTCP(t *testing.T) net.Listener {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// freePort returns a port of the loopback interface which was free when it was returned
+func freePort(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+// freePorts returns n distinct ports of the loopback interface which were free when they were returned, which successive calls to freePort do not guarantee
+func freePorts(t *testing.T, n int) []string {
+	t.Helper()
+
+	ports := make([]string, n)
+	for i := range ports {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		_, ports[i], _ = net.SplitHostPort(l.Addr().String())
+	}
+	return ports
+}
+
+// startEchoServer starts a TCP server sending back the data it receives, and returns its address
+func startEchoServer(t *testing.T) string {
+	t.Helper()
+
+	l := listenTCP(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// testChain returns a chain named name through proxies, with the default parameters of the chains of the configuration
+func testChain(name string, proxies ...proxy) proxyChain {
+	desc := builtinChainDefaults().chainDesc()
+	return proxyChain{
+		name:              name,
+		proxyDns:          desc.ProxyDns,
+		tcpConnectTimeout: desc.TcpConnectTimeout,
+		tcpReadTimeout:    desc.TcpReadTimeout,
+		noDelay:           desc.NoDelay,
+		order:             desc.Order,
+		retry:             desc.Retry,
+		proxies:           proxies,
+	}
+}
+
+// setChains replaces the chains of the configuration by chains for the duration of the test
+func setChains(t *testing.T, chains ...proxyChain) {
+	t.Helper()
+
+	proxychains := make(map[string]proxyChain)
+	for _, chain := range chains {
+		proxychains[chain.name] = chain
+	}
+
+	gChainsConf.mu.Lock()
+	previous := gChainsConf.proxychains
+	gChainsConf.proxychains = proxychains
+	gChainsConf.valid = true
+	gChainsConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gChainsConf.mu.Lock()
+		gChainsConf.proxychains = previous
+		gChainsConf.mu.Unlock()
+	})
+}
+
+// parseRouting returns the routing tables of the JSON routes section routes
+func parseRouting(t *testing.T, routes string) routing {
+	t.Helper()
+
+	var r routing
+	err := json.Unmarshal([]byte(routes), &r)
+	if err != nil {
+		t.Fatalf("invalid routes %v: %v", routes, err)
+	}
+	return r
+}
+
+// setRouting replaces the routing configuration by the JSON routes section routes and defaultRoute for the duration of the test
+func setRouting(t *testing.T, routes string, defaultRoute string) routing {
+	t.Helper()
+
+	r := parseRouting(t, routes)
+
+	gRoutingConf.mu.Lock()
+	previous := gRoutingConf.routing
+	previousDefault := gRoutingConf.defaultRoute
+	previousNoMatch := gRoutingConf.noMatch
+	gRoutingConf.routing = r
+	gRoutingConf.defaultRoute = defaultRoute
+	gRoutingConf.noMatch = newNoMatchCounters(r)
+	gRoutingConf.valid = true
+	gRoutingConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gRoutingConf.mu.Lock()
+		gRoutingConf.routing = previous
+		gRoutingConf.defaultRoute = previousDefault
+		gRoutingConf.noMatch = previousNoMatch
+		gRoutingConf.mu.Unlock()
+	})
+
+	return r
+}
+
+// startServer starts the server described by the server string srvString, and stops it at the end of the test
+func startServer(t *testing.T, srvString string) *server {
+	t.Helper()
+
+	s, err := newServerFromString(srvString)
+	if err != nil {
+		t.Fatalf("invalid server %v: %v", srvString, err)
+	}
+
+	bound := make(chan error, 1)
+	go s.run(bound)
+	err = <-bound
+	if err != nil {
+		t.Fatalf("server %v could not be started: %v", srvString, err)
+	}
+	s.running = true
+	t.Cleanup(s.stop)
+
+	return s
+}
+
+// startRouteServer starts a server of protocol prot routing every destination to route, which can be a chain without proxies named direct, and returns its address
+func startRouteServer(t *testing.T, prot string, route string) string {
+	t.Helper()
+
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "`+route+`"}]}`, "")
+	s := startServer(t, prot+"://127.0.0.1:"+freePort(t)+":table")
+	return s.address()
+}
+
+// startDirectServer starts a SOCKS5 server routing every destination through a chain without proxies, and returns its address
+func startDirectServer(t *testing.T) string {
+	t.Helper()
+
+	return startRouteServer(t, "socks5", "direct")
+}
+
+// socks5Greet performs the method negotiation of a SOCKS5 client on conn, offering methods, and returns the method selected by the server
+func socks5Greet(t *testing.T, conn net.Conn, methods ...byte) byte {
+	t.Helper()
+
+	_, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		t.Fatalf("error reading SOCKS5 method selection: %v", err)
+	}
+	return resp[1]
+}
+
+// socks5Request sends a SOCKS5 request with command cmd for address on conn, and returns the reply code and the bound address of the reply
+func socks5Request(t *testing.T, conn net.Conn, cmd byte, address string) (byte, string) {
+	t.Helper()
+
+	addrBytes, atyp, err := stringToAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write(append([]byte{5, cmd, 0, atyp}, addrBytes...))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return socks5ReadReply(t, conn)
+}
+
+// socks5ReadReply reads a SOCKS5 reply on conn, and returns its reply code and its bound address
+func socks5ReadReply(t *testing.T, conn net.Conn) (byte, string) {
+	t.Helper()
+
+	header := make([]byte, 4)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		t.Fatalf("error reading SOCKS5 reply: %v", err)
+	}
+	bound, err := addrToString(conn, header[3])
+	if err != nil {
+		t.Fatalf("error reading SOCKS5 reply bound address: %v", err)
+	}
+	return header[1], bound
+}
+
+// socks5Connect connects to the SOCKS5 server at serverAddr without authentication, requests a connection to address,
+// and returns the connection to the server along with the reply code
+func socks5Connect(t *testing.T, serverAddr string, address string) (net.Conn, byte) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", serverAddr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	method := socks5Greet(t, conn, 0)
+	if method != 0 {
+		t.Fatalf("SOCKS5 server selected method %v instead of no authentication", method)
+	}
+
+	rep, _ := socks5Request(t, conn, cmdConnect, address)
+	return conn, rep
+}
+
+// checkEcho sends data on conn, connected to an echo server, and checks that it is sent back
+func checkEcho(t *testing.T, conn net.Conn, data string) {
+	t.Helper()
+
+	_, err := conn.Write([]byte(data))
+	if err != nil {
+		t.Fatalf("error writing to relayed connection: %v", err)
+	}
+
+	buff := make([]byte, len(data))
+	_, err = io.ReadFull(conn, buff)
+	if err != nil {
+		t.Fatalf("error reading from relayed connection: %v", err)
+	}
+	if string(buff) != data {
+		t.Fatalf("relayed connection sent back %q instead of %q", buff, data)
+	}
+}
+
+// isClosed reports whether the peer of conn closed it, waiting at most timeout for data or for the end of the connection
+func isClosed(conn net.Conn, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	_, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != nil
+}
+
+// udpHeader returns the SOCKS5 UDP request header of a datagram to address, with fragment number frag
+func udpHeader(t *testing.T, address string, frag byte) []byte {
+	t.Helper()
+
+	addrBytes, atyp, err := stringToAddr(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append([]byte{0, 0, frag, atyp}, addrBytes...)
+}
+
+// uint16Bytes returns the big endian representation of n
+func uint16Bytes(n uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, n)
+}
+
+// tcpPair returns both ends of a TCP connection on the loopback interface, closed at the end of the test
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+
+	l := listenTCP(t)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c
+	}()
+
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2, ok := <-accepted
+	if !ok {
+		t.Fatal("error accepting connection")
+	}
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	return c1, c2
+}
+
+// relayResult is the outcome of a relay run in the background
+type relayResult struct {
+	up, down int64
+	duration time.Duration
+}
+
+// startRelay relays, in the background, a client connection and a target connection, and returns the ends of these connections used by
+// the client and by the target, along with a channel receiving the outcome of the relay once it ended
+func startRelay(t *testing.T, ctx context.Context, firstDataTimeout time.Duration, idleTimeout time.Duration) (client net.Conn, target net.Conn, result <-chan relayResult) {
+	t.Helper()
+
+	client, clientSide := tcpPair(t)
+	targetSide, target := tcpPair(t)
+
+	done := make(chan relayResult, 1)
+	go func() {
+		start := time.Now()
+		up, down := relay(ctx, clientSide, targetSide, firstDataTimeout, idleTimeout)
+		done <- relayResult{up: up, down: down, duration: time.Since(start)}
+	}()
+
+	return client, target, done
+}
+
+// waitRelay waits at most timeout for the end of the relay whose outcome is received on result
+func waitRelay(t *testing.T, result <-chan relayResult, timeout time.Duration) relayResult {
+	t.Helper()
+
+	select {
+	case r := <-result:
+		return r
+	case <-time.After(timeout):
+		t.Fatalf("relay did not end within %v", timeout)
+		return relayResult{}
+	}
+}
+
+// setHosts replaces the hosts section of the configuration by hosts for the duration of the test
+func setHosts(t *testing.T, hosts hostMap) {
+	t.Helper()
+
+	gHostsConf.mu.Lock()
+	previous := gHostsConf.hosts
+	gHostsConf.hosts = hosts
+	gHostsConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gHostsConf.mu.Lock()
+		gHostsConf.hosts = previous
+		gHostsConf.mu.Unlock()
+	})
+}
+
+func TestLogOutputSplitting(t *testing.T) {
+	// Without log files, errors are written to STDERR and other logs to STDOUT
+	cmd := exec.Command(os.Args[0], "-c", filepath.Join(t.TempDir(), "missing.json"), "-exit-on-initial-failure")
+	cmd.Env = append(os.Environ(), testMainEnv+"=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Run()
+
+	if !strings.Contains(stdout.String(), "[INFO]") || strings.Contains(stdout.String(), "[ERROR]") {
+		t.Fatalf("unexpected STDOUT output:\n%v", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "[ERROR]") || strings.Contains(stderr.String(), "[INFO]") {
+		t.Fatalf("unexpected STDERR output:\n%v", stderr.String())
+	}
+
+	// With log files, errors are written to the error log file, or to the log file if there is none
+	dir := t.TempDir()
+	logFile, errorFile := filepath.Join(dir, "bbs.log"), filepath.Join(dir, "error.log")
+	cmd = exec.Command(os.Args[0], "-c", filepath.Join(dir, "missing.json"), "-exit-on-initial-failure", "-log-file", logFile, "-error-file", errorFile)
+	cmd.Env = append(os.Environ(), testMainEnv+"=1")
+	cmd.Run()
+
+	logs, _ := os.ReadFile(logFile)
+	errs, _ := os.ReadFile(errorFile)
+	if !strings.Contains(string(logs), "[INFO]") || strings.Contains(string(logs), "[ERROR]") {
+		t.Fatalf("unexpected log file content:\n%s", logs)
+	}
+	if !strings.Contains(string(errs), "[ERROR]") || strings.Contains(string(errs), "[INFO]") {
+		t.Fatalf("unexpected error log file content:\n%s", errs)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+var gFwmarkSupported bool = false
+
+// fwmarkControl returns a net.Dialer Control function failing, as firewall marks are only supported on Linux
+func fwmarkControl(mark uint32) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		err := fmt.Errorf("firewall marks are only supported on Linux")
+		return err
+	}
+}
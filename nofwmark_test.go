@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFwmarkUnsupported(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"fwmark": 42}`), &desc)
+	if err == nil {
+		t.Fatal("fwmark accepted on a platform without firewall marks")
+	}
+
+	err = fwmarkControl(42)("tcp", "127.0.0.1:80", nil)
+	if err == nil {
+		t.Fatal("fwmark control succeeded on a platform without firewall marks")
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var gReusePortSupported bool = false
+
+// listenControl keeps the platform default options of listening sockets
+func listenControl(network string, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// setListenBacklog is not supported on this platform, listening sockets keep the default backlog
+func setListenBacklog(l net.Listener, backlog int) error {
+	return fmt.Errorf("setting the listen backlog is not supported on this platform")
+}
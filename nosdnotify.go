@@ -0,0 +1,7 @@
+//go:build !systemd
+
+package main
+
+func sdNotify(state string) error {
+	return nil
+}
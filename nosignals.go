@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// User signals do not exist on this platform: active connections cannot be described and the kill switch cannot be toggled.
+// A nil signal is never received, so the corresponding cases of the signal loop are never selected.
+var (
+	sigDescribe   os.Signal = nil
+	sigKillSwitch os.Signal = nil
+)
+
+// userSignals returns no signal, as user signals are not supported on this platform
+func userSignals() []os.Signal {
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build !otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var gOTelCompiled bool = false
+
+type noopSpan struct{}
+
+func (s noopSpan) setAttribute(key string, value any) {}
+
+func (s noopSpan) recordError(err error) {}
+
+func (s noopSpan) end() {}
+
+func initTracing(endpoint string) (func(), error) {
+	err := fmt.Errorf("bbs compiled without OpenTelemetry support")
+	return nil, err
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, traceSpan) {
+	return ctx, noopSpan{}
+}
@@ -0,0 +1,14 @@
+//go:build !(linux && transparent)
+
+package main
+
+import (
+	"fmt"
+)
+
+var gTransparentCompiled bool = false
+
+func newTransparentHandler() (connHandler, error) {
+	err := fmt.Errorf("bbs compiled without transparent server support")
+	return nil, err
+}
@@ -0,0 +1,14 @@
+//go:build !(linux && transparent)
+
+package main
+
+import (
+	"testing"
+)
+
+func TestTransparentUnsupported(t *testing.T) {
+	_, err := newServerFromString("transparent://127.0.0.1:1080:table")
+	if err == nil {
+		t.Fatal("transparent server accepted without transparent support")
+	}
+}
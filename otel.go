@@ -0,0 +1,77 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var gOTelCompiled bool = true
+
+// gTracer creates spans with the global tracer provider, a no-op one until initTracing is called
+var gTracer = otel.Tracer("github.com/synacktiv/bbs")
+
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) setAttribute(key string, value any) {
+	switch v := value.(type) {
+	case string:
+		s.span.SetAttributes(attribute.String(key, v))
+	case int:
+		s.span.SetAttributes(attribute.Int(key, v))
+	case int64:
+		s.span.SetAttributes(attribute.Int64(key, v))
+	case bool:
+		s.span.SetAttributes(attribute.Bool(key, v))
+	default:
+		s.span.SetAttributes(attribute.String(key, fmt.Sprint(v)))
+	}
+}
+
+func (s otelSpan) recordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s otelSpan) end() {
+	s.span.End()
+}
+
+// initTracing sets up the export of spans with OTLP over gRPC to endpoint (host:port), and returns the function flushing and stopping the export
+func initTracing(endpoint string) (func(), error) {
+	exporter, err := otlptracegrpc.New(context.Background(), otlptracegrpc.WithEndpoint(endpoint), otlptracegrpc.WithInsecure())
+	if err != nil {
+		err = fmt.Errorf("error creating OTLP exporter to %v: %v", endpoint, err)
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "bbs"))),
+	)
+	otel.SetTracerProvider(provider)
+
+	shutdown := func() {
+		err := provider.Shutdown(context.Background())
+		if err != nil {
+			gMetaLogger.Errorf("error shutting down OpenTelemetry tracing: %v", err)
+		}
+	}
+	return shutdown, nil
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, traceSpan) {
+	ctx, span := gTracer.Start(ctx, name)
+	return ctx, otelSpan{span: span}
+}
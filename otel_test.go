@@ -0,0 +1,134 @@
+//go:build otel
+
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+var (
+	gTestSpansOnce sync.Once
+	gTestSpans     *tracetest.SpanRecorder
+)
+
+// recordSpans installs, once per test binary since gTracer keeps delegating to the first provider set, a tracer provider recording the spans in memory
+func recordSpans() *tracetest.SpanRecorder {
+	gTestSpansOnce.Do(func() {
+		gTestSpans = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(gTestSpans)))
+	})
+	return gTestSpans
+}
+
+// endedSpans returns the ended spans named name with the attribute key=value
+func endedSpans(recorder *tracetest.SpanRecorder, name string, key string, value string) []sdktrace.ReadOnlySpan {
+	var spans []sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Name() == name && spanAttribute(s, key).Emit() == value {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// spanAttribute returns the value of the attribute key of span s, an empty value if it is not set
+func spanAttribute(s sdktrace.ReadOnlySpan, key string) attribute.Value {
+	for _, a := range s.Attributes() {
+		if string(a.Key) == key {
+			return a.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestSessionSpans(t *testing.T) {
+	recorder := recordSpans()
+	echo := startEchoServer(t)
+
+	// The front server relays through a chain whose single proxy is the upstream server, relaying directly
+	upstream := "127.0.0.1:" + freePort(t)
+	p, err := newProxy("socks5", "127.0.0.1", strings.TrimPrefix(upstream, "127.0.0.1:"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setChains(t, testChain("direct"), testChain("via", p))
+	setRouting(t, `{"up": [{"rules": {"rule": "true"}, "route": "direct"}], "front": [{"rules": {"rule": "true"}, "route": "via"}]}`, "")
+	startServer(t, "socks5://"+upstream+":up")
+	front := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":front").address()
+
+	conn, rep := socks5Connect(t, front, echo)
+	if rep != 0 {
+		t.Fatalf("connection failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "traced")
+	conn.Close()
+
+	var session sdktrace.ReadOnlySpan
+	waitFor(t, time.Second, "session span ended", func() bool {
+		// The upstream server records a session span to the same target, through the direct chain
+		for _, s := range endedSpans(recorder, "socks5.session", "target", echo) {
+			if spanAttribute(s, "chain").Emit() == "via" {
+				session = s
+				return true
+			}
+		}
+		return false
+	})
+	if spanAttribute(session, "client").Emit() != conn.LocalAddr().String() {
+		t.Errorf("unexpected session span attributes %v", session.Attributes())
+	}
+	if spanAttribute(session, "bytesUp").AsInt64() != 6 || spanAttribute(session, "bytesDown").AsInt64() != 6 {
+		t.Errorf("session span counts %v bytes up and %v down instead of 6", spanAttribute(session, "bytesUp").Emit(), spanAttribute(session, "bytesDown").Emit())
+	}
+	if session.Status().Code == codes.Error {
+		t.Errorf("session span marked failed: %v", session.Status().Description)
+	}
+
+	// The routing decision and the handshake with the proxy are children of the session span
+	var route, handshake sdktrace.ReadOnlySpan
+	for _, s := range recorder.Ended() {
+		if s.Parent().SpanID() != session.SpanContext().SpanID() {
+			continue
+		}
+		switch s.Name() {
+		case "route":
+			route = s
+		case "handshake":
+			handshake = s
+		}
+	}
+	if route == nil || spanAttribute(route, "chain").Emit() != "via" || spanAttribute(route, "target").Emit() != echo {
+		t.Errorf("missing or unexpected route span %v", route)
+	}
+	if handshake == nil || spanAttribute(handshake, "proxy").Emit() != upstream || spanAttribute(handshake, "target").Emit() != echo {
+		t.Errorf("missing or unexpected handshake span %v", handshake)
+	}
+}
+
+func TestSessionSpanError(t *testing.T) {
+	recorder := recordSpans()
+	srv := startDirectServer(t)
+
+	// Nothing listens on the destination, the connection fails
+	dest := "127.0.0.1:" + freePort(t)
+	_, rep := socks5Connect(t, srv, dest)
+	if rep == 0 {
+		t.Fatalf("connection to a closed port succeeded")
+	}
+
+	waitFor(t, time.Second, "failed session span ended", func() bool {
+		for _, s := range endedSpans(recorder, "socks5.session", "target", dest) {
+			return s.Status().Code == codes.Error && len(s.Events()) > 0
+		}
+		return false
+	})
+}
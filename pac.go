@@ -3,22 +3,360 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/darren/gpac"
+	"github.com/dop251/goja"
+	"github.com/synacktiv/bbs/logger"
 )
 
 type pacConf struct {
-	pac *gpac.Parser
+	pac *pacParser
 	mu  sync.RWMutex
 }
 
 var gPACConf pacConf
 var gPACcompiled bool = true
 
+// pacParser holds a PAC script loaded in a JavaScript VM, along with the standard PAC functions and the bbs implementations of the native ones
+type pacParser struct {
+	vm              *goja.Runtime
+	findProxyForURL goja.Callable
+	evalCtx         context.Context // context of the evaluation in progress, bounded by -pac-eval-timeout, used by the native functions
+	mu              sync.Mutex      // the VM must not be used concurrently
+	cache           *pacCache       // nil if results are not cached
+}
+
+// pacLookupIP returns the addresses of host for the native PAC functions. It can be replaced to control the addresses returned, e.g. with a stub resolver.
+var pacLookupIP = net.DefaultResolver.LookupIP
+
+// errPACEvalTimeout interrupts the evaluations of the PAC script exceeding -pac-eval-timeout
+var errPACEvalTimeout = errors.New("PAC script evaluation timeout reached")
+
+// pacCacheEntry is a result of the PAC script cached until expires
+type pacCacheEntry struct {
+	result  string
+	expires time.Time
+}
+
+// pacCache holds at most size results of the PAC script, keyed by URL, each during ttl
+type pacCache struct {
+	entries map[string]pacCacheEntry
+	size    int
+	ttl     time.Duration
+	mu      sync.Mutex
+}
+
+// get returns the cached result for url, if any and not expired
+func (c *pacCache) get(url string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[url]
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.result, true
+}
+
+// put caches result for url. When the cache is full, expired entries are removed, and an arbitrary entry if none has expired.
+func (c *pacCache) put(url string, result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := c.entries[url]; !ok && len(c.entries) >= c.size {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+
+	c.entries[url] = pacCacheEntry{result: result, expires: now.Add(c.ttl)}
+}
+
+// pacUncacheableRegexp matches the calls to PAC functions whose result depends on the time or on the local host, making the results of the script not cacheable
+var pacUncacheableRegexp = regexp.MustCompile(`\b(timeRange|dateRange|weekdayRange|myIpAddress|myIpAddressEx)\b`)
+
+// newPACParser loads the PAC script src in a new JavaScript VM, in which the native PAC functions are registered before running the script
+func newPACParser(src string) (*pacParser, error) {
+	vm := goja.New()
+	p := &pacParser{vm: vm, evalCtx: context.Background()}
+
+	vm.Set("dnsResolve", pacDNSResolve(p))
+	vm.Set("myIpAddress", pacMyIPAddress(vm))
+	vm.Set("dnsResolveEx", pacDNSResolveEx(p))
+	vm.Set("myIpAddressEx", pacMyIPAddressEx(vm))
+
+	_, err := vm.RunString(pacUtilsJS)
+	if err != nil {
+		err = fmt.Errorf("error loading PAC functions: %v", err)
+		return nil, err
+	}
+
+	_, err = vm.RunString(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Scripts written for the IPv6-aware PAC extensions define FindProxyForURLEx, which is preferred if defined
+	findProxyForURL, ok := goja.AssertFunction(vm.Get("FindProxyForURLEx"))
+	if !ok {
+		findProxyForURL, ok = goja.AssertFunction(vm.Get("FindProxyForURL"))
+	}
+	if !ok {
+		err = fmt.Errorf("PAC script does not define the FindProxyForURL or FindProxyForURLEx function")
+		return nil, err
+	}
+
+	p.findProxyForURL = findProxyForURL
+
+	// Results are cached unless they may change for a same destination
+	switch {
+	case gArgPACCacheSize <= 0:
+	case pacUncacheableRegexp.MatchString(src):
+		gMetaLogger.Infof("PAC script depends on the time or on the local addresses (%v), its results are not cached", pacUncacheableRegexp.FindString(src))
+	default:
+		p.cache = &pacCache{entries: make(map[string]pacCacheEntry), size: gArgPACCacheSize, ttl: gArgPACCacheTTL}
+	}
+
+	return p, nil
+}
+
+// FindProxyForURL returns the result of the FindProxyForURL function of the PAC script for rawURL, from the cache if it holds it.
+// As the VM is locked during the evaluation, including the DNS resolutions of the script, the evaluation is bounded by -pac-eval-timeout: resolutions are
+// no longer attempted once it is elapsed, and the script is interrupted.
+func (p *pacParser) FindProxyForURL(rawURL string) (string, error) {
+	if p.cache != nil {
+		if result, ok := p.cache.get(rawURL); ok {
+			return result, nil
+		}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), gArgPACEvalTimeout)
+	p.evalCtx = ctx
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		p.vm.Interrupt(errPACEvalTimeout)
+		close(interrupted)
+	})
+
+	result, err := p.findProxyForURL(goja.Undefined(), p.vm.ToValue(rawURL), p.vm.ToValue(u.Hostname()))
+
+	// The interruption must not affect the next evaluation if it happened after the end of this one
+	if !stop() {
+		<-interrupted
+		p.vm.ClearInterrupt()
+	}
+	cancel()
+	p.evalCtx = context.Background()
+	p.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if p.cache != nil {
+		p.cache.put(rawURL, result.String())
+	}
+
+	return result.String(), nil
+}
+
+// pacDNSResolve returns the dnsResolve native PAC function of p, returning the first address host resolves to, or null if the resolution fails
+func pacDNSResolve(p *pacParser) func(call goja.FunctionCall) goja.Value {
+	vm := p.vm
+	return func(call goja.FunctionCall) goja.Value {
+		arg := call.Argument(0)
+		if goja.IsUndefined(arg) || goja.IsNull(arg) {
+			return goja.Null()
+		}
+
+		ips, err := pacLookup(p.evalCtx, arg.String())
+		if err != nil {
+			gMetaLogger.Errorf("PAC dnsResolve: %v", err)
+			return goja.Null()
+		}
+
+		return vm.ToValue(ips[0].String())
+	}
+}
+
+// pacMyIPAddress returns the myIpAddress native PAC function of vm, returning the first global unicast address of the local interfaces which are up, or null if there is none
+func pacMyIPAddress(vm *goja.Runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		ifs, err := net.Interfaces()
+		if err != nil {
+			return goja.Null()
+		}
+
+		for _, ifn := range ifs {
+			if ifn.Flags&net.FlagUp != net.FlagUp {
+				continue
+			}
+
+			addrs, err := ifn.Addrs()
+			if err != nil {
+				continue
+			}
+
+			for _, addr := range addrs {
+				ip, ok := addr.(*net.IPNet)
+				if ok && ip.IP.IsGlobalUnicast() {
+					return vm.ToValue(ip.IP.String())
+				}
+			}
+		}
+		return goja.Null()
+	}
+}
+
+// pacDNSResolveEx returns the dnsResolveEx native PAC function of p, returning the semicolon-separated list of the IPv4 and IPv6 addresses host resolves to, or an empty string if the resolution fails
+func pacDNSResolveEx(p *pacParser) func(call goja.FunctionCall) goja.Value {
+	vm := p.vm
+	return func(call goja.FunctionCall) goja.Value {
+		arg := call.Argument(0)
+		if goja.IsUndefined(arg) || goja.IsNull(arg) {
+			return vm.ToValue("")
+		}
+
+		ips, err := pacLookup(p.evalCtx, arg.String())
+		if err != nil {
+			gMetaLogger.Errorf("PAC dnsResolveEx: %v", err)
+			return vm.ToValue("")
+		}
+
+		return vm.ToValue(joinIPs(ips))
+	}
+}
+
+// pacMyIPAddressEx returns the myIpAddressEx native PAC function of vm, returning the semicolon-separated list of the global unicast IPv4 and IPv6 addresses of the local interfaces which are up,
+// or an empty string if there is none
+func pacMyIPAddressEx(vm *goja.Runtime) func(call goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		ifs, err := net.Interfaces()
+		if err != nil {
+			return vm.ToValue("")
+		}
+
+		var ips []net.IP
+		for _, ifn := range ifs {
+			if ifn.Flags&net.FlagUp != net.FlagUp {
+				continue
+			}
+
+			addrs, err := ifn.Addrs()
+			if err != nil {
+				continue
+			}
+
+			for _, addr := range addrs {
+				ip, ok := addr.(*net.IPNet)
+				if ok && ip.IP.IsGlobalUnicast() {
+					ips = append(ips, ip.IP)
+				}
+			}
+		}
+		return vm.ToValue(joinIPs(ips))
+	}
+}
+
+// joinIPs returns the semicolon-separated list of ips, as returned by the IPv6-aware PAC functions
+func joinIPs(ips []net.IP) string {
+	strs := make([]string, len(ips))
+	for i, ip := range ips {
+		strs[i] = ip.String()
+	}
+	return strings.Join(strs, ";")
+}
+
+// pacLookup resolves host for the native PAC functions. Custom hosts of the hosts section are used first, like for the connections through chains.
+// Each attempt is bounded by -pac-dns-timeout and the DNS resolutions limiter, and failed resolutions are attempted again up to -pac-dns-retries times, unless the host does not exist
+// or ctx, the context of the evaluation of the script, is done.
+func pacLookup(ctx context.Context, host string) ([]net.IP, error) {
+	if resolved, ok := currentHosts()[host]; ok {
+		ip := net.ParseIP(resolved)
+		if ip == nil {
+			err := fmt.Errorf("custom host %v resolves to %v, which is not an IP address", host, resolved)
+			return nil, err
+		}
+		return []net.IP{ip}, nil
+	}
+
+	var err error
+	for attempt := 0; attempt <= gArgPACDNSRetries; attempt++ {
+		var ips []net.IP
+		ips, err = pacLookupOnce(ctx, host)
+		if err == nil {
+			return ips, nil
+		}
+
+		var dnsErr *net.DNSError
+		if (errors.As(err, &dnsErr) && dnsErr.IsNotFound) || ctx.Err() != nil {
+			break
+		}
+		gMetaLogger.Debugf("PAC resolution attempt %v/%v of %v failed: %v", attempt+1, gArgPACDNSRetries+1, host, err)
+	}
+
+	return nil, err
+}
+
+// pacLookupOnce performs a single resolution of host, bounded by -pac-dns-timeout and by ctx
+func pacLookupOnce(ctx context.Context, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, gArgPACDNSTimeout)
+	defer cancel()
+
+	err := gDNSLimiter.acquire(ctx)
+	if err != nil {
+		err = fmt.Errorf("lookup on %v not performed: %w", host, err)
+		return nil, err
+	}
+	ips, err := pacLookupIP(ctx, "ip", host)
+	gDNSLimiter.release()
+	if err != nil {
+		err = fmt.Errorf("lookup on %v failed: %w", host, err)
+		return nil, err
+	}
+
+	if len(ips) == 0 {
+		err = fmt.Errorf("no IP returned from DNS resolution of %v", host)
+		return nil, err
+	}
+
+	return ips, nil
+}
+
 func reloadPACConf(path string) error {
-	pac, err := gpac.FromFile(gArgPACPath)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		err = fmt.Errorf("error reading PAC configuration: %v", err)
+		return err
+	}
+
+	pac, err := newPACParser(string(src))
 	if err != nil {
 		err = fmt.Errorf("error parsing PAC configuration: %v", err)
 		return err
@@ -31,14 +369,55 @@ func reloadPACConf(path string) error {
 	return nil
 }
 
+// gPACRoundRobin counts the routes selected with -pac-select roundrobin
+var gPACRoundRobin atomic.Uint64
+
 func getRouteWithPAC(addr string) (string, error) {
 	gPACConf.mu.RLock()
-	chainStr, err := gPACConf.pac.FindProxyForURL("rand://" + addr)
+	result, err := gPACConf.pac.FindProxyForURL("rand://" + addr)
 	gPACConf.mu.RUnlock()
 
 	if err != nil {
 		return "", err
 	}
 
-	return chainStr, nil
+	chain, err := selectPACChain(result, gArgPACSelect)
+	if err != nil {
+		return "", err
+	}
+
+	// With -pac-allow, chains outside of the allowlist are dropped. Special routes only restrict connections, they are always allowed
+	if len(gPACAllowList) != 0 && !isSpecialRoute(chain) && !slices.Contains(gPACAllowList, chain) {
+		gMetaLogger.Errorf("PAC script returned chain %v for %v, which is not allowed by -pac-allow, dropping the connection", chain, addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "DENIED", Chain: chain, Dest: addr, Detail: "chain not allowed by -pac-allow"})
+		return "drop", nil
+	}
+
+	return chain, nil
+}
+
+// selectPACChain returns the chain to use among the semicolon-separated list of chains result returned by the PAC script, according to mode:
+// "first" selects the first chain, "random" a random one and "roundrobin" each chain in turn. With random, chains listed several times are selected more often.
+func selectPACChain(result string, mode string) (string, error) {
+	var chains []string
+	for _, chain := range strings.Split(result, ";") {
+		chain = strings.TrimSpace(chain)
+		if chain != "" {
+			chains = append(chains, chain)
+		}
+	}
+
+	if len(chains) == 0 {
+		err := fmt.Errorf("PAC script returned no chain (%q)", result)
+		return "", err
+	}
+
+	switch mode {
+	case "random":
+		return chains[rand.Intn(len(chains))], nil
+	case "roundrobin":
+		return chains[(gPACRoundRobin.Add(1)-1)%uint64(len(chains))], nil
+	default:
+		return chains[0], nil
+	}
 }
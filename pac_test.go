@@ -0,0 +1,531 @@
+//go:build pac
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubResolver answers the lookups of the native PAC functions once installed with setResolver
+type stubResolver struct {
+	hosts    map[string][]net.IP // addresses of each host, the hosts missing do not exist
+	failures int                 // number of lookups failing before the hosts are resolved
+	delay    time.Duration       // delay before each answer
+
+	lookups atomic.Int32
+}
+
+// setResolver replaces the resolver of the native PAC functions by s until the end of the test
+func setResolver(t *testing.T, s *stubResolver) {
+	t.Helper()
+
+	setArg(t, &pacLookupIP, s.lookupIP)
+}
+
+// attempts returns the number of lookups received by s
+func (s *stubResolver) attempts() int {
+	return int(s.lookups.Load())
+}
+
+func (s *stubResolver) lookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	n := s.lookups.Add(1)
+
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, &net.DNSError{Err: ctx.Err().Error(), Name: host, IsTimeout: true}
+	}
+
+	if int(n) <= s.failures {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+	ips, ok := s.hosts[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// pacResult loads the PAC script src and returns its result for host
+func pacResult(t *testing.T, src string, host string) (string, error) {
+	t.Helper()
+
+	p, err := newPACParser(src)
+	if err != nil {
+		t.Fatalf("invalid PAC script: %v", err)
+	}
+	return p.FindProxyForURL("rand://" + net.JoinHostPort(host, "80"))
+}
+
+// setPAC loads the PAC script src as the current PAC configuration until the end of the test
+func setPAC(t *testing.T, src string) {
+	t.Helper()
+
+	p, err := newPACParser(src)
+	if err != nil {
+		t.Fatalf("invalid PAC script: %v", err)
+	}
+
+	gPACConf.mu.Lock()
+	previous := gPACConf.pac
+	gPACConf.pac = p
+	gPACConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gPACConf.mu.Lock()
+		gPACConf.pac = previous
+		gPACConf.mu.Unlock()
+	})
+}
+
+// pacResolveScript returns the result of dnsResolve for the host, or "null" if the resolution fails
+const pacResolveScript = `function FindProxyForURL(url, host) { return String(dnsResolve(host)); }`
+
+func TestPACDNSResolve(t *testing.T) {
+	s := &stubResolver{hosts: map[string][]net.IP{"stub.test": {net.ParseIP("192.0.2.1")}}}
+	setResolver(t, s)
+
+	result, err := pacResult(t, pacResolveScript, "stub.test")
+	if err != nil || result != "192.0.2.1" {
+		t.Errorf("dnsResolve returned %q (%v) instead of 192.0.2.1", result, err)
+	}
+
+	// Custom hosts are used without DNS resolution
+	setHosts(t, hostMap{"custom.test": "192.0.2.2"})
+	result, err = pacResult(t, pacResolveScript, "custom.test")
+	if err != nil || result != "192.0.2.2" {
+		t.Errorf("dnsResolve returned %q (%v) for a custom host instead of 192.0.2.2", result, err)
+	}
+	if s.attempts() != 1 {
+		t.Errorf("custom host resolved with DNS")
+	}
+}
+
+func TestPACDNSRetries(t *testing.T) {
+	setArg(t, &gArgPACDNSTimeout, time.Second)
+
+	tests := []struct {
+		failures int
+		retries  int
+		result   string
+		attempts int
+	}{
+		{failures: 0, retries: 0, result: "192.0.2.1", attempts: 1},
+		{failures: 1, retries: 0, result: "null", attempts: 1},
+		{failures: 2, retries: 2, result: "192.0.2.1", attempts: 3},
+		{failures: 2, retries: 1, result: "null", attempts: 2},
+	}
+
+	for _, test := range tests {
+		setArg(t, &gArgPACDNSRetries, test.retries)
+		s := &stubResolver{hosts: map[string][]net.IP{"stub.test": {net.ParseIP("192.0.2.1")}}, failures: test.failures}
+		setResolver(t, s)
+
+		result, err := pacResult(t, pacResolveScript, "stub.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != test.result || s.attempts() != test.attempts {
+			t.Errorf("%v failures with %v retries: dnsResolve returned %v after %v attempts instead of %v after %v attempts",
+				test.failures, test.retries, result, s.attempts(), test.result, test.attempts)
+		}
+	}
+}
+
+func TestPACDNSTimeout(t *testing.T) {
+	setArg(t, &gArgPACDNSTimeout, 100*time.Millisecond)
+	setArg(t, &gArgPACDNSRetries, 1)
+	s := &stubResolver{hosts: map[string][]net.IP{"stub.test": {net.ParseIP("192.0.2.1")}}, delay: 5 * time.Second}
+	setResolver(t, s)
+
+	// Each of the 2 attempts is given up after the timeout
+	start := time.Now()
+	result, err := pacResult(t, pacResolveScript, "stub.test")
+	elapsed := time.Since(start)
+	if err != nil || result != "null" {
+		t.Errorf("dnsResolve returned %q (%v) for a slow resolver instead of null", result, err)
+	}
+	if s.attempts() != 2 {
+		t.Errorf("%v attempts instead of 2", s.attempts())
+	}
+	if elapsed < 200*time.Millisecond || elapsed > time.Second {
+		t.Errorf("dnsResolve returned after %v instead of about 200ms", elapsed)
+	}
+}
+
+func TestPACDNSNotFound(t *testing.T) {
+	setArg(t, &gArgPACDNSRetries, 3)
+	s := &stubResolver{}
+	setResolver(t, s)
+
+	// Hosts which do not exist are not attempted again
+	result, err := pacResult(t, pacResolveScript, "missing.test")
+	if err != nil || result != "null" {
+		t.Errorf("dnsResolve returned %q (%v) for a missing host instead of null", result, err)
+	}
+	if s.attempts() != 1 {
+		t.Errorf("missing host resolved in %v attempts instead of 1", s.attempts())
+	}
+}
+
+func TestPACEvalTimeout(t *testing.T) {
+	setArg(t, &gArgPACDNSTimeout, 100*time.Millisecond)
+	setArg(t, &gArgPACDNSRetries, 100)
+	setArg(t, &gArgPACEvalTimeout, 300*time.Millisecond)
+	s := &stubResolver{hosts: map[string][]net.IP{"stub.test": {net.ParseIP("192.0.2.1")}}, delay: 5 * time.Second}
+	setResolver(t, s)
+
+	// Resolutions are no longer attempted once the evaluation timeout is reached
+	start := time.Now()
+	pacResult(t, pacResolveScript, "stub.test")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("evaluation ended after %v with a timeout of 300ms", elapsed)
+	}
+	if s.attempts() > 4 {
+		t.Errorf("%v resolutions attempted during an evaluation of 300ms with a timeout of 100ms each", s.attempts())
+	}
+
+	// The script itself is interrupted
+	_, err := pacResult(t, `function FindProxyForURL(url, host) { for (;;) {} }`, "stub.test")
+	if err == nil {
+		t.Errorf("endless evaluation did not fail")
+	}
+}
+
+func TestPACDNSResolveEx(t *testing.T) {
+	setResolver(t, &stubResolver{hosts: map[string][]net.IP{
+		"dual.test": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		"v6.test":   {net.ParseIP("2001:db8::2")},
+	}})
+	src := `function FindProxyForURL(url, host) { return dnsResolveEx(host); }`
+
+	tests := []struct {
+		host string
+		ips  []string
+	}{
+		{"dual.test", []string{"192.0.2.1", "2001:db8::1"}},
+		{"v6.test", []string{"2001:db8::2"}},
+		{"missing.test", nil},
+	}
+	for _, test := range tests {
+		result, err := pacResult(t, src, test.host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ips []string
+		if result != "" {
+			ips = strings.Split(result, ";")
+		}
+		slices.Sort(ips)
+		if !slices.Equal(ips, test.ips) {
+			t.Errorf("dnsResolveEx returned %q for %v instead of the addresses %v", result, test.host, test.ips)
+		}
+	}
+}
+
+func TestPACMyIPAddressEx(t *testing.T) {
+	result, err := pacResult(t, `function FindProxyForURL(url, host) { return myIpAddressEx(); }`, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every global unicast address of the interfaces which are up is listed, IPv4 and IPv6 ones alike
+	var want []string
+	ifs, err := net.Interfaces()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifn := range ifs {
+		addrs, _ := ifn.Addrs()
+		for _, addr := range addrs {
+			if ip, ok := addr.(*net.IPNet); ok && ifn.Flags&net.FlagUp != 0 && ip.IP.IsGlobalUnicast() {
+				want = append(want, ip.IP.String())
+			}
+		}
+	}
+	var got []string
+	if result != "" {
+		got = strings.Split(result, ";")
+	}
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("myIpAddressEx returned %q instead of the addresses %v", result, want)
+	}
+}
+
+func TestPACRouteIPv6(t *testing.T) {
+	setResolver(t, &stubResolver{hosts: map[string][]net.IP{
+		"dual.test": {net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")},
+		"v4.test":   {net.ParseIP("192.0.2.2")},
+	}})
+
+	// FindProxyForURLEx is preferred to FindProxyForURL
+	setPAC(t, `
+function FindProxyForURL(url, host) { return "legacy"; }
+function FindProxyForURLEx(url, host) {
+  var addrs = dnsResolveEx(host).split(";");
+  for (var i = 0; i < addrs.length; i++) {
+    if (shExpMatch(addrs[i], "2001:db8:*")) {
+      return "v6";
+    }
+  }
+  return "v4";
+}`)
+
+	tests := map[string]string{
+		"dual.test:443":     "v6",
+		"v4.test:443":       "v4",
+		"[2001:db8::5]:443": "v6",
+		"192.0.2.5:443":     "v4",
+	}
+	for addr, want := range tests {
+		chain, err := getRouteWithPAC(addr)
+		if err != nil || chain != want {
+			t.Errorf("PAC route of %v is %v (%v) instead of %v", addr, chain, err, want)
+		}
+	}
+}
+
+// pacCountingScript returns a PAC script returning result, which counts its evaluations in the runs variable of the VM
+func pacCountingScript(result string) string {
+	return fmt.Sprintf(`var runs = 0; function FindProxyForURL(url, host) { runs++; return %q; }`, result)
+}
+
+// pacRuns returns the number of evaluations of the PAC script p, loaded from pacCountingScript
+func pacRuns(p *pacParser) int64 {
+	return p.vm.Get("runs").ToInteger()
+}
+
+func TestPACCache(t *testing.T) {
+	p, err := newPACParser(pacCountingScript("cached"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second result for a same destination is the cached one, other destinations are evaluated
+	for _, url := range []string{"rand://example.com:80", "rand://example.com:80", "rand://example.org:80"} {
+		if result, err := p.FindProxyForURL(url); err != nil || result != "cached" {
+			t.Fatalf("PAC script returned %q (%v) for %v", result, err, url)
+		}
+	}
+	if runs := pacRuns(p); runs != 2 {
+		t.Errorf("PAC script evaluated %v times for 2 destinations", runs)
+	}
+}
+
+func TestPACCacheTTL(t *testing.T) {
+	setArg(t, &gArgPACCacheTTL, 100*time.Millisecond)
+	p, err := newPACParser(pacCountingScript("cached"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.FindProxyForURL("rand://example.com:80")
+	time.Sleep(150 * time.Millisecond)
+	p.FindProxyForURL("rand://example.com:80")
+	if runs := pacRuns(p); runs != 2 {
+		t.Errorf("expired result used, PAC script evaluated %v times instead of 2", runs)
+	}
+}
+
+func TestPACCacheSize(t *testing.T) {
+	setArg(t, &gArgPACCacheSize, 2)
+	p, err := newPACParser(pacCountingScript("cached"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"a.test", "b.test", "c.test", "d.test"} {
+		p.FindProxyForURL("rand://" + host + ":80")
+	}
+	if len(p.cache.entries) != 2 {
+		t.Errorf("%v results cached with a cache size of 2", len(p.cache.entries))
+	}
+}
+
+func TestPACCacheDisabled(t *testing.T) {
+	tests := []struct {
+		describe string
+		src      string
+		size     int
+	}{
+		{"-pac-cache-size 0", pacCountingScript("uncached"), 0},
+		{"time dependent script", `var runs = 0; function FindProxyForURL(url, host) { runs++; timeRange(0, 23); return "uncached"; }`, 1024},
+		{"local address dependent script", `var runs = 0; function FindProxyForURL(url, host) { runs++; myIpAddress(); return "uncached"; }`, 1024},
+	}
+
+	for _, test := range tests {
+		setArg(t, &gArgPACCacheSize, test.size)
+		p, err := newPACParser(test.src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.FindProxyForURL("rand://example.com:80")
+		p.FindProxyForURL("rand://example.com:80")
+		if runs := pacRuns(p); runs != 2 {
+			t.Errorf("%v: PAC script evaluated %v times instead of 2", test.describe, runs)
+		}
+	}
+}
+
+func TestPACCacheReload(t *testing.T) {
+	setPAC(t, pacCountingScript("before"))
+	path := filepath.Join(t.TempDir(), "proxy.pac")
+
+	if err := os.WriteFile(path, []byte(pacCountingScript("before")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadPACConf(path); err != nil {
+		t.Fatal(err)
+	}
+	getRouteWithPAC("example.com:80")
+	getRouteWithPAC("example.com:80")
+	if runs := pacRuns(gPACConf.pac); runs != 1 {
+		t.Errorf("PAC script evaluated %v times for a same destination", runs)
+	}
+
+	// Results of the previous script are not used after a reload
+	if err := os.WriteFile(path, []byte(pacCountingScript("after")), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadPACConf(path); err != nil {
+		t.Fatal(err)
+	}
+	if chain, err := getRouteWithPAC("example.com:80"); err != nil || chain != "after" {
+		t.Errorf("PAC route %v (%v) after reload instead of after", chain, err)
+	}
+}
+
+func TestSelectPACChain(t *testing.T) {
+	// The first chain is selected by default, blanks and empty entries are ignored
+	for _, result := range []string{"a;b;c", " a ; b ;c", ";a;b"} {
+		chain, err := selectPACChain(result, "first")
+		if err != nil || chain != "a" {
+			t.Errorf("%q: selected %v (%v) instead of a", result, chain, err)
+		}
+	}
+
+	for _, result := range []string{"", " ; ;"} {
+		if _, err := selectPACChain(result, "first"); err == nil {
+			t.Errorf("%q: chain selected among no chain", result)
+		}
+	}
+}
+
+func TestPACSelectDistribution(t *testing.T) {
+	setPAC(t, `function FindProxyForURL(url, host) { return "egress1; egress2; egress3"; }`)
+
+	// selectionCounts returns the number of times each chain is selected for n connections
+	selectionCounts := func(n int) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i < n; i++ {
+			chain, err := getRouteWithPAC("example.com:443")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[chain]++
+		}
+		return counts
+	}
+
+	setArg(t, &gArgPACSelect, "first")
+	if counts := selectionCounts(30); counts["egress1"] != 30 {
+		t.Errorf("first selection spread connections: %v", counts)
+	}
+
+	// Round robin selects each chain in turn
+	setArg(t, &gArgPACSelect, "roundrobin")
+	if counts := selectionCounts(30); counts["egress1"] != 10 || counts["egress2"] != 10 || counts["egress3"] != 10 {
+		t.Errorf("round robin selection not even: %v", counts)
+	}
+
+	// Random selects every chain, each about a third of the times
+	setArg(t, &gArgPACSelect, "random")
+	counts := selectionCounts(3000)
+	if len(counts) != 3 {
+		t.Errorf("random selection of %v chains out of 3", len(counts))
+	}
+	for chain, count := range counts {
+		if count < 800 || count > 1200 {
+			t.Errorf("random selection of %v %v times out of 3000", chain, count)
+		}
+	}
+}
+
+func TestPACSelectWeights(t *testing.T) {
+	// Chains listed several times are selected more often
+	counts := make(map[string]int)
+	for i := 0; i < 4000; i++ {
+		chain, err := selectPACChain("heavy;heavy;heavy;light", "random")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[chain]++
+	}
+	if counts["heavy"] < 2700 || counts["heavy"] > 3300 || counts["light"] == 0 {
+		t.Errorf("weighted random selection %v instead of about 3000 heavy and 1000 light", counts)
+	}
+}
+
+func TestPACAllow(t *testing.T) {
+	setPAC(t, `
+function FindProxyForURL(url, host) {
+  if (host == "allowed.test") return "egress1";
+  if (host == "direct.test") return "DIRECT";
+  if (host == "rejected.test") return "reject";
+  return "egress2";
+}`)
+
+	// Without -pac-allow, any chain returned is used
+	chain, err := getRouteWithPAC("other.test:443")
+	if err != nil || chain != "egress2" {
+		t.Fatalf("PAC route without allowlist is %v (%v) instead of egress2", chain, err)
+	}
+
+	// With it, chains outside of the allowlist are dropped, DIRECT being allowed like any chain, and special routes always
+	setArg(t, &gPACAllowList, []string{"egress1", "DIRECT"})
+	_, audit := captureLogs(t)
+	tests := map[string]string{
+		"allowed.test:443":  "egress1",
+		"direct.test:443":   "DIRECT",
+		"rejected.test:443": "reject",
+		"other.test:443":    "drop",
+	}
+	for addr, want := range tests {
+		chain, err := getRouteWithPAC(addr)
+		if err != nil || chain != want {
+			t.Errorf("PAC route of %v is %v (%v) instead of %v", addr, chain, err, want)
+		}
+	}
+
+	// Dropped connections are audited with the chain returned
+	var denied []string
+	for _, event := range auditEvents(t, audit) {
+		if event.Event == "DENIED" {
+			denied = append(denied, event.Dest+" "+event.Chain)
+		}
+	}
+	if !slices.Equal(denied, []string{"other.test:443 egress2"}) {
+		t.Errorf("DENIED audit traces for %v instead of other.test:443 with chain egress2", denied)
+	}
+
+	// DIRECT is not allowed unless listed
+	setArg(t, &gPACAllowList, []string{"egress1"})
+	chain, err = getRouteWithPAC("direct.test:443")
+	if err != nil || chain != "drop" {
+		t.Errorf("PAC route of direct.test:443 is %v (%v) instead of drop", chain, err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+// Defines functions to write and remove the PID file used by process supervisors
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writePIDFile atomically writes the current process PID to path: the PID is written to a temporary file in the same directory, which is then renamed to path
+func writePIDFile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		err = fmt.Errorf("error creating temporary PID file: %v", err)
+		return err
+	}
+
+	_, err = fmt.Fprintf(tmp, "%d\n", os.Getpid())
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		err = fmt.Errorf("error writing temporary PID file %v: %v", tmp.Name(), err)
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		os.Remove(tmp.Name())
+		err = fmt.Errorf("error renaming temporary PID file to %v: %v", path, err)
+		return err
+	}
+
+	return nil
+}
+
+// removePIDFile removes the PID file at path
+func removePIDFile(path string) {
+	err := os.Remove(path)
+	if err != nil {
+		gMetaLogger.Errorf("error removing PID file %v: %v", path, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWritePIDFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bbs.pid")
+
+	// An existing PID file, left by a process which did not shut down cleanly, is replaced
+	err := os.WriteFile(path, []byte("1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = writePIDFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != fmt.Sprintf("%d\n", os.Getpid()) {
+		t.Fatalf("PID file contains %q instead of the PID %v", content, os.Getpid())
+	}
+
+	// The temporary file is renamed to the PID file
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("temporary PID file left in the directory: %v", entries)
+	}
+
+	removePIDFile(path)
+	_, err = os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("PID file not removed: %v", err)
+	}
+}
+
+func TestWritePIDFileMissingDirectory(t *testing.T) {
+	err := writePIDFile(filepath.Join(t.TempDir(), "missing", "bbs.pid"))
+	if err == nil {
+		t.Fatal("PID file written in a missing directory")
+	}
+}
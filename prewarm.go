@@ -0,0 +1,164 @@
+package main
+
+// Defines the pools of prewarmed connections of chains defining prewarm: idle connections to the first proxy, kept ready to cut the latency of new connections
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// prewarmDefaultIdle is the duration after which idle prewarmed connections are replaced, if the chain does not define prewarmIdle
+const prewarmDefaultIdle = 30 * time.Second
+
+// prewarmRetryDelay is the delay before dialing the first proxy again after a failure
+const prewarmRetryDelay = 1 * time.Second
+
+// prewarmedConn is an idle connection to the first proxy of a chain, dialed at dialed
+type prewarmedConn struct {
+	conn   net.Conn
+	dialed time.Time
+}
+
+// prewarmPool maintains size idle connections to the first proxy of a chain, replaced once idle for idle
+type prewarmPool struct {
+	chain   string // name of the chain, for logging
+	address string // address of the first proxy
+	dialer  net.Dialer
+	timeout time.Duration // timeout of each dial
+	size    int
+	idle    time.Duration
+	conns   chan prewarmedConn
+	taken   chan struct{} // wakes up the maintaining goroutine when a connection is taken
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// newPrewarmPool returns a pool of size connections to the first proxy of chain, in declaration order, and starts maintaining it.
+// Connections idle for idle are replaced, after prewarmDefaultIdle if idle is 0.
+func newPrewarmPool(chain proxyChain, size int, idle time.Duration) *prewarmPool {
+	if idle == 0 {
+		idle = prewarmDefaultIdle
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &prewarmPool{
+		chain:   chain.name,
+		address: chain.proxies[0].address(),
+		dialer:  chain.dialer(),
+		timeout: time.Duration(chain.tcpConnectTimeout) * time.Millisecond,
+		size:    size,
+		idle:    idle,
+		conns:   make(chan prewarmedConn, size),
+		taken:   make(chan struct{}, 1),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	go p.run()
+
+	return p
+}
+
+// take returns a prewarmed connection to address, or nil if the pool has none available or is not a pool of connections to address
+func (p *prewarmPool) take(address string) net.Conn {
+	if p == nil || address != p.address {
+		return nil
+	}
+
+	defer func() {
+		select {
+		case p.taken <- struct{}{}:
+		default:
+		}
+	}()
+
+	for {
+		select {
+		case c := <-p.conns:
+			if time.Since(c.dialed) > p.idle {
+				c.conn.Close()
+				continue
+			}
+			gMetaLogger.Debugf("using prewarmed connection to %v for chain %v", p.address, p.chain)
+			return c.conn
+		default:
+			return nil
+		}
+	}
+}
+
+// run dials the first proxy until the pool is full, and replaces the expired connections, until the pool is stopped
+func (p *prewarmPool) run() {
+	for {
+		p.expire()
+
+		wait := p.idle / 2
+		for len(p.conns) < p.size {
+			ctx, cancel := context.WithTimeout(p.ctx, p.timeout)
+			conn, err := p.dialer.DialContext(ctx, "tcp", p.address)
+			cancel()
+			if err != nil {
+				gMetaLogger.Debugf("could not prewarm connection to %v for chain %v: %v", p.address, p.chain, err)
+				wait = prewarmRetryDelay
+				break
+			}
+			p.conns <- prewarmedConn{conn: conn, dialed: time.Now()}
+		}
+
+		select {
+		case <-p.ctx.Done():
+			p.drain()
+			return
+		case <-p.taken:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// expire closes the connections idle for more than p.idle, so that they are dialed again
+func (p *prewarmPool) expire() {
+	for range len(p.conns) {
+		select {
+		case c := <-p.conns:
+			if time.Since(c.dialed) > p.idle {
+				c.conn.Close()
+				continue
+			}
+			p.conns <- c
+		default:
+			return
+		}
+	}
+}
+
+// drain closes the idle connections of the pool
+func (p *prewarmPool) drain() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// prewarmPools is the type used to hold the pools of the current chains configuration
+type prewarmPools struct {
+	pools []*prewarmPool
+	mu    sync.Mutex
+}
+
+var gPrewarmPools prewarmPools
+
+// replace stops the pools of the previous chains configuration, closing their idle connections, and holds pools instead
+func (r *prewarmPools) replace(pools []*prewarmPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, p := range r.pools {
+		p.cancel()
+	}
+	r.pools = pools
+}
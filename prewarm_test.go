@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// prewarmProxy returns a proxy listening on a local port which only accepts connections, and the channel of the connections accepted
+func prewarmProxy(t *testing.T) (proxy, <-chan net.Conn) {
+	t.Helper()
+
+	l := listenTCP(t)
+	accepted := make(chan net.Conn, 16)
+	t.Cleanup(func() {
+		for {
+			select {
+			case conn := <-accepted:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, accepted
+}
+
+// nextAccepted returns the next connection accepted by a prewarmProxy, failing the test if none is accepted within timeout
+func nextAccepted(t *testing.T, accepted <-chan net.Conn, timeout time.Duration) net.Conn {
+	t.Helper()
+
+	select {
+	case conn := <-accepted:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(timeout):
+		t.Fatal("timeout waiting for a prewarmed connection")
+		return nil
+	}
+}
+
+func TestPrewarmPool(t *testing.T) {
+	p, accepted := prewarmProxy(t)
+	pool := newPrewarmPool(testChain("warm", p), 2, time.Hour)
+	t.Cleanup(pool.cancel)
+
+	// The pool is filled in the background
+	first := nextAccepted(t, accepted, 2*time.Second)
+	nextAccepted(t, accepted, 2*time.Second)
+
+	if conn := pool.take("127.0.0.1:1"); conn != nil {
+		t.Error("prewarmed connection taken for another address")
+	}
+	var none *prewarmPool
+	if conn := none.take(p.address()); conn != nil {
+		t.Error("connection taken from a nil pool")
+	}
+
+	// A connection taken is one of those dialed, and is replaced
+	conn := pool.take(p.address())
+	if conn == nil {
+		t.Fatal("no prewarmed connection available")
+	}
+	if conn.LocalAddr().String() != first.RemoteAddr().String() {
+		t.Errorf("connection from %v taken instead of the first one prewarmed, from %v", conn.LocalAddr(), first.RemoteAddr())
+	}
+	nextAccepted(t, accepted, 2*time.Second)
+
+	select {
+	case extra := <-accepted:
+		extra.Close()
+		t.Errorf("pool of 2 connections dialed an extra connection from %v", extra.RemoteAddr())
+	case <-time.After(100 * time.Millisecond):
+	}
+	conn.Close()
+}
+
+func TestPrewarmPoolExpiry(t *testing.T) {
+	p, accepted := prewarmProxy(t)
+	pool := newPrewarmPool(testChain("warm", p), 1, 100*time.Millisecond)
+	t.Cleanup(pool.cancel)
+
+	// An idle connection is closed and replaced once expired
+	first := nextAccepted(t, accepted, 2*time.Second)
+	nextAccepted(t, accepted, 2*time.Second)
+	if !isClosed(first, time.Second) {
+		t.Error("expired prewarmed connection not closed")
+	}
+
+	// An expired connection is closed instead of being taken
+	expired, peer := tcpPair(t)
+	stopped := &prewarmPool{address: p.address(), idle: 100 * time.Millisecond, conns: make(chan prewarmedConn, 1), taken: make(chan struct{}, 1)}
+	stopped.conns <- prewarmedConn{conn: expired, dialed: time.Now().Add(-time.Second)}
+	if conn := stopped.take(p.address()); conn != nil {
+		t.Error("expired prewarmed connection taken")
+	}
+	if !isClosed(peer, time.Second) {
+		t.Error("expired prewarmed connection not closed when taken")
+	}
+}
+
+func TestPrewarmPoolsReplace(t *testing.T) {
+	p, accepted := prewarmProxy(t)
+	gPrewarmPools.replace([]*prewarmPool{newPrewarmPool(testChain("warm", p), 2, time.Hour)})
+	t.Cleanup(func() { gPrewarmPools.replace(nil) })
+
+	conns := []net.Conn{nextAccepted(t, accepted, 2*time.Second), nextAccepted(t, accepted, 2*time.Second)}
+
+	// The pools of the previous configuration are stopped and their idle connections closed
+	gPrewarmPools.replace(nil)
+	for _, conn := range conns {
+		if !isClosed(conn, time.Second) {
+			t.Errorf("prewarmed connection from %v not closed by the new configuration", conn.RemoteAddr())
+		}
+	}
+}
+
+func TestPrewarmChain(t *testing.T) {
+	echo := startEchoServer(t)
+	p, dialed := flakyProxy(t, startDirectServer(t), 0)
+
+	chain := testChain("warm", p)
+	chain.prewarm = newPrewarmPool(chain, 1, time.Hour)
+	t.Cleanup(chain.prewarm.cancel)
+	waitFor(t, 2*time.Second, "prewarmed connection", func() bool { return dialed.Load() == 1 })
+
+	// The connection goes through the prewarmed connection, which is replaced
+	conn, _, err := chain.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn, "prewarmed")
+	conn.Close()
+	waitFor(t, 2*time.Second, "replaced prewarmed connection", func() bool { return dialed.Load() == 2 })
+
+	// Without available prewarmed connections, the first proxy is dialed
+	chain.prewarm.cancel()
+	waitFor(t, 2*time.Second, "stopped pool", func() bool { return len(chain.prewarm.conns) == 0 })
+	conn, _, err = chain.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn, "dialed")
+	conn.Close()
+	if n := dialed.Load(); n != 3 {
+		t.Errorf("%v connections to the first proxy instead of 3", n)
+	}
+}
+
+func TestChainDescPrewarm(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"prewarm": 2, "prewarmIdle": 5000}`), &desc)
+	if err != nil || desc.Prewarm != 2 || desc.PrewarmIdle != 5000 {
+		t.Fatalf("prewarm %v and prewarmIdle %v parsed (%v)", desc.Prewarm, desc.PrewarmIdle, err)
+	}
+
+	for _, invalid := range []string{`{"prewarm": -1}`, `{"prewarm": 1, "prewarmIdle": -1}`} {
+		err = json.Unmarshal([]byte(invalid), &desc)
+		if err == nil {
+			t.Errorf("%v accepted", invalid)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+// Defines the ranges of private and reserved addresses refused to the connections of servers with the blockPrivate option, preventing the use of an exposed bbs
+// to reach internal services or the host itself
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// errPrivateDestination is returned when connecting to a destination in a blocked range
+var errPrivateDestination = errors.New("destination in a private or reserved range")
+
+// defaultBlockedRanges returns the loopback, private, shared, link-local and unspecified ranges, refused to servers with the blockPrivate option
+func defaultBlockedRanges() []netip.Prefix {
+	return []netip.Prefix{
+		netip.MustParsePrefix("0.0.0.0/8"),
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("100.64.0.0/10"),
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("169.254.0.0/16"),
+		netip.MustParsePrefix("172.16.0.0/12"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("::/128"),
+		netip.MustParsePrefix("::1/128"),
+		netip.MustParsePrefix("fc00::/7"),
+		netip.MustParsePrefix("fe80::/10"),
+	}
+}
+
+// gBlockedRanges holds the default blocked ranges, and those added with -private-ranges
+var gBlockedRanges = defaultBlockedRanges()
+
+// blockedRange returns the blocked range containing ip, if any. IPv4-mapped IPv6 addresses are checked as IPv4 addresses.
+func blockedRange(ip netip.Addr) (netip.Prefix, bool) {
+	ip = ip.Unmap().WithZone("")
+	for _, prefix := range gBlockedRanges {
+		if prefix.Contains(ip) {
+			return prefix, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// checkDestination returns an error wrapping errPrivateDestination if the host of address (format host:port) is an IP address in a blocked range.
+// Hostnames are not checked, they must be resolved beforehand.
+func checkDestination(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		err = fmt.Errorf("could not split host from %v : %w", address, err)
+		return err
+	}
+
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+
+	prefix, blocked := blockedRange(ip)
+	if blocked {
+		err = socks5ReplyError{rep: repNotAllowed, err: fmt.Errorf("%w: %v is in %v", errPrivateDestination, host, prefix)}
+		return err
+	}
+	return nil
+}
+
+// guardPrivate returns chain set to refuse the destinations in blocked ranges if blockPrivate, the blockPrivate option of the server, is set.
+// Hostnames are then resolved locally whatever the chain's proxyDns parameter, so that the address actually connected to is checked.
+func guardPrivate(chain proxyChain, blockPrivate bool) proxyChain {
+	if blockPrivate {
+		chain.blockPrivate = true
+		chain.proxyDns = false
+	}
+	return chain
+}
+
+// connectErrorEvent returns the audit event of a connection which failed with err: DENIED if its destination is in a blocked range, ERROR otherwise
+func connectErrorEvent(err error) string {
+	if errors.Is(err, errPrivateDestination) {
+		return "DENIED"
+	}
+	return "ERROR"
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestCheckDestination(t *testing.T) {
+	blocked := []string{"127.0.0.1:80", "127.1.2.3:80", "10.1.2.3:443", "172.16.0.1:22", "192.168.1.1:80", "169.254.169.254:80", "100.64.0.1:80", "0.0.0.0:80",
+		"[::1]:80", "[fe80::1%eth0]:80", "[fd00::1]:80", "[::ffff:127.0.0.1]:80", "[::ffff:10.0.0.1]:80"}
+	for _, addr := range blocked {
+		err := checkDestination(addr)
+		if !errors.Is(err, errPrivateDestination) {
+			t.Errorf("destination %v not refused: %v", addr, err)
+		}
+	}
+
+	// Public addresses, and hostnames which must be resolved beforehand, pass
+	allowed := []string{"8.8.8.8:53", "93.184.216.34:443", "172.32.0.1:80", "[2606:4700::1111]:443", "example.com:80"}
+	for _, addr := range allowed {
+		err := checkDestination(addr)
+		if err != nil {
+			t.Errorf("destination %v refused: %v", addr, err)
+		}
+	}
+}
+
+func TestCheckDestinationAddedRanges(t *testing.T) {
+	setArg(t, &gBlockedRanges, append(defaultBlockedRanges(), netip.MustParsePrefix("192.0.2.0/24")))
+
+	err := checkDestination("192.0.2.10:80")
+	if !errors.Is(err, errPrivateDestination) {
+		t.Fatalf("destination in an added range not refused: %v", err)
+	}
+	if connectErrorEvent(err) != "DENIED" || connectErrorEvent(errors.New("connection refused")) != "ERROR" {
+		t.Fatal("unexpected audit events of connection errors")
+	}
+}
+
+func TestBlockPrivateSocks5(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+	setHosts(t, hostMap{"internal.example": "127.0.0.1"})
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table?blockPrivate=true").address()
+
+	// Loopback destinations are refused, whether given as an address, a hostname resolved locally, or a custom host
+	for _, dest := range []string{echo, "localhost:" + echoPort, "internal.example:" + echoPort} {
+		_, rep := socks5Connect(t, srv, dest)
+		if rep != repNotAllowed {
+			t.Errorf("connection to %v answered with reply %v instead of %v", dest, rep, repNotAllowed)
+		}
+	}
+
+	denied := 0
+	for _, event := range auditEvents(t, audit) {
+		if event.Event == "DENIED" {
+			denied++
+		}
+	}
+	if denied != 3 {
+		t.Fatalf("%v DENIED audit traces instead of 3", denied)
+	}
+}
+
+func TestBlockPrivateHTTP(t *testing.T) {
+	echo := startEchoServer(t)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+	srv := startServer(t, "http://127.0.0.1:"+freePort(t)+":table?blockPrivate=true").address()
+
+	conn, err := net.DialTimeout("tcp", srv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte("CONNECT " + echo + " HTTP/1.1\r\nHost: " + echo + "\r\n\r\n"))
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("connection to %v answered with status %v instead of 403", echo, resp.StatusCode)
+	}
+}
+
+func TestBlockPrivateUDP(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startUDPEchoServer(t)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table?blockPrivate=true").address()
+	udpConn := socks5UDPAssociate(t, srv)
+
+	// Datagrams to loopback destinations are dropped, and audited once
+	for i := 0; i < 3; i++ {
+		udpConn.Write(append(udpHeader(t, echo, 0), "ping"...))
+	}
+	if _, data, ok := readUDPReply(t, udpConn, 300*time.Millisecond); ok {
+		t.Fatalf("datagram to a loopback destination relayed (answer %q)", data)
+	}
+
+	denied := 0
+	for _, event := range auditEvents(t, audit) {
+		if event.Event == "DENIED" {
+			denied++
+		}
+	}
+	if denied != 1 {
+		t.Fatalf("%v DENIED audit traces instead of 1", denied)
+	}
+}
+
+func TestBlockPrivateOptions(t *testing.T) {
+	for _, srvString := range []string{
+		"socks5://127.0.0.1:1080:table?blockPrivate=yes",
+		"socks5://127.0.0.1:1080:table?blockPrivate=true&proxyDns=true",
+	} {
+		_, err := newServerFromString(srvString)
+		if err == nil {
+			t.Errorf("invalid server %v accepted", srvString)
+		}
+	}
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"net"
+	"slices"
 	"strings"
 	"time"
 )
@@ -18,6 +22,14 @@ type proxy interface {
 	address() string
 }
 
+// Interface implemented by proxies supporting the SOCKS5 BIND command (see RFC 1928), i.e. SOCKS5 proxies, which can be the last proxy of chains used for BIND requests.
+type binder interface {
+	// bind takes net.Conn connected to the proxy and the address of the expected peer, and returns the address the proxy listens on for the peer
+	bind(net.Conn, string) (string, error)
+	// acceptBind waits on net.Conn, on which bind succeeded, for the connection of the peer and returns its address
+	acceptBind(net.Conn) (string, error)
+}
+
 type baseProxy struct {
 	prot string
 	host string
@@ -28,11 +40,21 @@ type baseProxy struct {
 
 type proxyMap map[string]proxy
 
+// credential maps an entry of the credentials section of the configuration, referenced by proxies with credsRef
+type credential struct {
+	User string
+	Pass string
+}
+
+// gCredentials holds the credentials section of the configuration being parsed, used to resolve the credsRef of proxies
+var gCredentials map[string]credential
+
 func (p *baseProxy) UnmarshalJSON(b []byte) error {
 	type tmpBaseProxy struct {
 		ConnString string
 		User       string
 		Pass       string
+		CredsRef   string // name of an entry of the credentials section, replacing User and Pass
 	}
 
 	var tmp tmpBaseProxy
@@ -43,6 +65,19 @@ func (p *baseProxy) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
+	if tmp.CredsRef != "" {
+		if tmp.User != "" || tmp.Pass != "" {
+			err = fmt.Errorf("proxy %v cannot define both credsRef and user/pass", tmp.ConnString)
+			return err
+		}
+		creds, ok := gCredentials[tmp.CredsRef]
+		if !ok {
+			err = fmt.Errorf("proxy %v references credentials %v, which are not defined in the credentials section", tmp.ConnString, tmp.CredsRef)
+			return err
+		}
+		tmp.User, tmp.Pass = creds.User, creds.Pass
+	}
+
 	tmp2, err := newBaseProxyFromString(tmp.ConnString, tmp.User, tmp.Pass)
 	if err != nil {
 		err = fmt.Errorf("error creating new server from string: %v", err)
@@ -71,7 +106,7 @@ func (p *proxyMap) UnmarshalJSON(b []byte) error {
 	for k, v := range tmp {
 		(*p)[k], err = newProxy(v.prot, v.host, v.port, v.user, v.pass)
 		if err != nil {
-			err = fmt.Errorf("error creating new proxy from baseProxy %v", v)
+			err = fmt.Errorf("error creating new proxy %v: %v", k, err)
 			return err
 		}
 	}
@@ -79,6 +114,21 @@ func (p *proxyMap) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+// gProxies holds the proxies of the current configuration, from which the chains are built
+var gProxies proxyMap
+
+// changedProxies returns the sorted names of the proxies defined in both old and new, whose definition differs
+func changedProxies(old proxyMap, new proxyMap) []string {
+	var changed []string
+	for name, p := range new {
+		if previous, ok := old[name]; ok && previous != p {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+	return changed
+}
+
 func newBaseProxyFromString(connString string, user string, pass string) (*baseProxy, error) {
 	gMetaLogger.Debugf("Entering newBaseProxyFromString()")
 	defer gMetaLogger.Debugf("Leaving newBaseProxyFromString()")
@@ -90,20 +140,22 @@ func newBaseProxyFromString(connString string, user string, pass string) (*baseP
 	prot := s1[0]
 	s2 := s1[1]
 
-	s3 := strings.Split(s2, ":")
-	if len(s3) != 2 {
-		return nil, fmt.Errorf("wrong connection string format")
+	// IPv6 addresses must be enclosed in brackets, e.g. "socks5://[::1]:1080"
+	host, port, err := net.SplitHostPort(s2)
+	if err != nil {
+		return nil, fmt.Errorf("wrong connection string format: %v", err)
 	}
 
-	host := s3[0]
-	port := s3[1]
-
 	return &baseProxy{prot: prot, host: host, port: port, user: user, pass: pass}, nil
 }
 
 func newProxy(prot string, host string, port string, user string, pass string) (proxy, error) {
 	switch prot {
 	case "socks5":
+		if len(user) > 255 || len(pass) > 255 {
+			err := fmt.Errorf("user and password of SOCKS5 proxy %v must be at most 255 bytes long", net.JoinHostPort(host, port))
+			return nil, err
+		}
 		return socks5{baseProxy{prot: prot, host: host, port: port, user: user, pass: pass}}, nil
 	case "httpconnect", "http":
 		return httpConnect{baseProxy{prot: prot, host: host, port: port, user: user, pass: pass}}, nil
@@ -118,50 +170,312 @@ func newProxy(prot string, host string, port string, user string, pass string) (
 
 type proxyChain struct {
 	proxyDns          bool  // if false, hostnames are resolved locally and IP addresses are used in proxies' handshakes. If true, hostnames are passed to proxies as is.
+	blockPrivate      bool  // if true, connections to destinations in private or reserved ranges are refused (set by the blockPrivate server option)
 	tcpConnectTimeout int64 // not used for now. TODO: implement it
 	tcpReadTimeout    int64
-	proxies           []proxy // ordered list of proxies to connect through
+	firstDataTimeout  int64        // if not 0, connections are closed if neither the client nor the target sends data within firstDataTimeout milliseconds after the relay starts
+	maxLifetime       int64        // if not 0, connections are closed maxLifetime milliseconds after the relay starts, whatever their activity
+	idleTimeout       int64        // if not 0, connections are closed once no data is transferred in either direction during idleTimeout milliseconds
+	hopTimeout        int64        // if not 0, maximum duration in milliseconds of each hop of the connection (dial of the first proxy, or handshake), within the tcpReadTimeout budget
+	noDelay           bool         // if true (default), Nagle's algorithm is disabled (TCP_NODELAY) on both ends of the relay
+	keepAlive         int64        // if positive, TCP keep-alive period in milliseconds on both ends of the relay, if negative keep-alives are disabled, if 0 the system defaults are kept
+	order             string       // how proxies are traversed: "fixed" (declaration order), "reverse" or "shuffle" (new order for each connection)
+	sourceAddr        net.IP       // if not nil, local address outbound connections (to the first proxy, or to the destination for direct chains) are bound to
+	name              string       // name of the chain in the configuration, identifying its usage counters
+	fwmark            uint32       // if not 0, firewall mark (SO_MARK) set on outbound connections, Linux only
+	retry             retryPolicy  // how the connection through the chain is retried on retryable errors
+	directFallback    bool         // if true, connections failing through the proxies are attempted again directly to the destination
+	verify            *chainVerify // if not nil, probe verifying that the chain works before connections through it are declared established
+	udpOverTcp        string       // if not empty, address (host:port) of the cooperating endpoint SOCKS5 UDP datagrams are tunneled to through the chain
+	prewarm           *prewarmPool // if not nil, idle connections to the first proxy, used by connectN instead of dialing it
+	proxies           []proxy      // ordered list of proxies to connect through
 }
 
 type proxyChainDesc struct {
 	ProxyDns          bool
 	TcpConnectTimeout int64
 	TcpReadTimeout    int64
+	FirstDataTimeout  int64
+	MaxLifetime       int64
+	IdleTimeout       int64
+	HopTimeout        int64
+	NoDelay           bool
+	KeepAlive         int64
+	Order             string
+	SourceAddr        string
+	Fwmark            uint32
+	Retry             retryPolicy
+	DirectFallback    bool
+	Verify            *chainVerify
+	UdpOverTcp        string
+	Prewarm           int   // number of idle connections to the first proxy kept ready
+	PrewarmIdle       int64 // milliseconds after which idle prewarmed connections are replaced
 	Proxies           []string
 }
 
+// chainDefaults maps the defaults section of the configuration: the parameters of the implicit single proxy chains, and the default parameters of the explicit chains omitting them
+type chainDefaults struct {
+	ProxyDns          bool
+	TcpConnectTimeout int64
+	TcpReadTimeout    int64
+	ImplicitChains    bool // whether an implicit single proxy chain is created for each proxy
+}
+
+// gChainDefaults holds the defaults section of the configuration being parsed, applied when unmarshalling chains
+var gChainDefaults = builtinChainDefaults()
+
+// builtinChainDefaults returns the chain defaults used when the configuration has no defaults section
+func builtinChainDefaults() chainDefaults {
+	return chainDefaults{ProxyDns: true, TcpConnectTimeout: 1000, TcpReadTimeout: 2000, ImplicitChains: true}
+}
+
+// chainDesc returns the description of a chain without proxies, with the default parameters d
+func (d chainDefaults) chainDesc() proxyChainDesc {
+	return proxyChainDesc{ProxyDns: d.ProxyDns, TcpConnectTimeout: d.TcpConnectTimeout, TcpReadTimeout: d.TcpReadTimeout, NoDelay: true, Order: "fixed", Retry: defaultRetryPolicy()}
+}
+
+func (d *chainDefaults) UnmarshalJSON(b []byte) error {
+	type defaults chainDefaults
+
+	tmp := defaults(builtinChainDefaults())
+
+	err := json.Unmarshal(b, &tmp)
+	if err != nil {
+		err = fmt.Errorf("error unmarshalling '%s' in chainDefaults : %v", b, err)
+		return err
+	}
+
+	if tmp.TcpConnectTimeout <= 0 || tmp.TcpReadTimeout <= 0 {
+		err = fmt.Errorf("invalid timeouts in chainDefaults, tcpConnectTimeout and tcpReadTimeout must be positive")
+		return err
+	}
+	*d = chainDefaults(tmp)
+
+	return nil
+}
+
+// retryPolicy describes how the establishment of a connection through a chain is retried on retryable errors
+type retryPolicy struct {
+	MaxAttempts int     // maximum number of attempts, 1 disables retries
+	BaseDelay   int64   // delay before the second attempt, in milliseconds
+	Factor      float64 // factor applied to the delay after each attempt
+	Jitter      float64 // ratio of the delay randomly added or removed, between 0 and 1
+}
+
+// defaultRetryPolicy returns the retry policy of chains not defining one, which does not retry
+func defaultRetryPolicy() retryPolicy {
+	return retryPolicy{MaxAttempts: 1, BaseDelay: 100, Factor: 2, Jitter: 0}
+}
+
+// delay returns the delay to wait before the attempt following attempt number attempt (starting at 1)
+func (r retryPolicy) delay(attempt int) time.Duration {
+	delay := float64(r.BaseDelay) * math.Pow(r.Factor, float64(attempt-1))
+	delay += delay * r.Jitter * (2*rand.Float64() - 1)
+	return time.Duration(delay * float64(time.Millisecond))
+}
+
+// refusalError is returned by proxies' handshakes when the proxy explicitly refused the request, so that it is not retried
+type refusalError struct {
+	msg string
+}
+
+func (e refusalError) Error() string {
+	return e.msg
+}
+
+// isRetryable reports whether a connection through a chain which failed with err can be retried
+func isRetryable(err error) bool {
+	var refusal refusalError
+	return !errors.As(err, &refusal)
+}
+
 func (p *proxyChainDesc) UnmarshalJSON(b []byte) error {
 	type defaults proxyChainDesc
 
-	tmp := defaults{ProxyDns: true, TcpConnectTimeout: 1000, TcpReadTimeout: 2000}
+	tmp := defaults(gChainDefaults.chainDesc())
 
 	err := json.Unmarshal(b, &tmp)
 	if err != nil {
 		err = fmt.Errorf("error unmarshalling '%s' in proxyChainDesc : %v", b, err)
 		return err
 	}
+
+	switch tmp.Order {
+	case "fixed", "reverse", "shuffle":
+	default:
+		err = fmt.Errorf("unknown proxies order '%v' in proxyChainDesc, must be fixed, reverse or shuffle", tmp.Order)
+		return err
+	}
+	if tmp.SourceAddr != "" {
+		err = checkLocalAddr(tmp.SourceAddr)
+		if err != nil {
+			err = fmt.Errorf("invalid sourceAddr in proxyChainDesc : %v", err)
+			return err
+		}
+	}
+	if tmp.Retry.MaxAttempts < 1 || tmp.Retry.BaseDelay < 0 || tmp.Retry.Factor < 1 || tmp.Retry.Jitter < 0 || tmp.Retry.Jitter > 1 {
+		err = fmt.Errorf("invalid retry in proxyChainDesc, maxAttempts must be at least 1, baseDelay positive, factor at least 1 and jitter between 0 and 1")
+		return err
+	}
+
+	if tmp.FirstDataTimeout < 0 {
+		err = fmt.Errorf("invalid firstDataTimeout in proxyChainDesc, must not be negative")
+		return err
+	}
+
+	if tmp.MaxLifetime < 0 {
+		err = fmt.Errorf("invalid maxLifetime in proxyChainDesc, must not be negative")
+		return err
+	}
+
+	if tmp.IdleTimeout < 0 {
+		err = fmt.Errorf("invalid idleTimeout in proxyChainDesc, must not be negative")
+		return err
+	}
+
+	if tmp.HopTimeout < 0 {
+		err = fmt.Errorf("invalid hopTimeout in proxyChainDesc, must not be negative")
+		return err
+	}
+
+	if tmp.Verify != nil {
+		_, _, err = net.SplitHostPort(tmp.Verify.Address)
+		if err != nil || tmp.Verify.Interval < 0 {
+			err = fmt.Errorf("invalid verify in proxyChainDesc, address must be host:port and interval must not be negative")
+			return err
+		}
+	}
+
+	if tmp.Prewarm < 0 || tmp.PrewarmIdle < 0 {
+		err = fmt.Errorf("invalid prewarm in proxyChainDesc, prewarm and prewarmIdle must not be negative")
+		return err
+	}
+
+	if tmp.UdpOverTcp != "" {
+		_, _, err = net.SplitHostPort(tmp.UdpOverTcp)
+		if err != nil {
+			err = fmt.Errorf("invalid udpOverTcp in proxyChainDesc, must be host:port : %v", err)
+			return err
+		}
+	}
+
+	if tmp.Fwmark != 0 && !gFwmarkSupported {
+		err = fmt.Errorf("fwmark in proxyChainDesc is only supported on Linux")
+		return err
+	}
 	*p = proxyChainDesc(tmp)
 
 	return nil
 }
 
+// checkLocalAddr returns an error if addr is not an IP address assigned to a local interface
+func checkLocalAddr(addr string) error {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		err := fmt.Errorf("%v is not an IP address", addr)
+		return err
+	}
+
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		err = fmt.Errorf("error listing local addresses : %v", err)
+		return err
+	}
+
+	for _, ifAddr := range ifAddrs {
+		ipNet, ok := ifAddr.(*net.IPNet)
+		if ok && ipNet.IP.Equal(ip) {
+			return nil
+		}
+	}
+
+	err = fmt.Errorf("%v is not assigned to a local interface", addr)
+	return err
+}
+
 type chainMap map[string]proxyChainDesc
 
+// flatten returns the ordered list of proxy names of chain name, where references to other chains are recursively replaced by their proxies.
+// Names are looked up in proxies first, so that implicit single proxy chains resolve to their proxy. path holds the chains being expanded, to detect cyclic references.
+func (chains chainMap) flatten(name string, proxies proxyMap, path []string) ([]string, error) {
+	if slices.Contains(path, name) {
+		err := fmt.Errorf("cyclic chain reference %v", strings.Join(append(path, name), " -> "))
+		return nil, err
+	}
+
+	desc, ok := chains[name]
+	if !ok {
+		err := fmt.Errorf("chain %v is not defined", name)
+		return nil, err
+	}
+
+	path = append(slices.Clone(path), name)
+	var flat []string
+
+	for index, proxyName := range desc.Proxies {
+		if _, ok := proxies[proxyName]; ok {
+			flat = append(flat, proxyName)
+			continue
+		}
+
+		if _, ok := chains[proxyName]; ok {
+			subProxies, err := chains.flatten(proxyName, proxies, path)
+			if err != nil {
+				return nil, err
+			}
+			flat = append(flat, subProxies...)
+			continue
+		}
+
+		err := fmt.Errorf("%v used at index %v of chain %v is not part of the defined proxies in proxies section nor of the defined chains in chains section", proxyName, index, name)
+		return nil, err
+	}
+
+	return flat, nil
+}
+
+// orderedProxies returns a copy of proxies in the order they must be traversed, according to order
+func orderedProxies(proxies []proxy, order string) []proxy {
+	proxies = slices.Clone(proxies)
+
+	switch order {
+	case "reverse":
+		slices.Reverse(proxies)
+	case "shuffle":
+		rand.Shuffle(len(proxies), func(i, j int) { proxies[i], proxies[j] = proxies[j], proxies[i] })
+	}
+
+	return proxies
+}
+
 // connect takes a destination address string (format host:port) and returns a net.Conn connected to this address through the chain of proxies.
-func (chain proxyChain) connect(ctx context.Context, address string) (net.Conn, string, error) {
+func (chain proxyChain) connect(ctx context.Context, address string) (conn net.Conn, repr string, err error) {
+
+	// Account the connection attempt in the chain's usage counters, the end of established connections is recorded by the handlers with closed
+	counters := chain.stats()
+	counters.total.Add(1)
+	defer func() {
+		if err != nil {
+			counters.errors.Add(1)
+		} else {
+			counters.active.Add(1)
+		}
+	}()
 
 	// If custom hosts are provided in the hosts section of the configuration, the matching hostnames are replaced by their hardcoded IP address.
 	// This overrides proxyDns: matching hostnames will be replaces by their IP address even if proxyDns=true.
-	if len(gHosts) != 0 {
+	hosts := currentHosts()
+	if len(hosts) != 0 {
 		host, port, err := net.SplitHostPort(address)
 		if err != nil {
 			werr := fmt.Errorf("could not split host from %v : %w", address, err)
 			return nil, "", werr
 		}
 
-		resolved, ok := gHosts[host]
+		resolved, ok := hosts[host]
 		if ok {
 			gMetaLogger.Debugf("%v appears in custom hosts file, resolving it to %v", host, resolved)
+			annotateConn(ctx, "resolved", resolved)
 			address = net.JoinHostPort(resolved, port)
 		}
 	}
@@ -178,7 +492,13 @@ func (chain proxyChain) connect(ctx context.Context, address string) (net.Conn,
 
 		if net.ParseIP(host) == nil { // host does not have an IP address format
 			gMetaLogger.Debugf("Chain is configured with proxyDns=false. Performing local DNS resolution of %v", host)
+			err = gDNSLimiter.acquire(ctx)
+			if err != nil {
+				werr := fmt.Errorf("lookup on %v not performed: %w", host, err)
+				return nil, "", werr
+			}
 			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+			gDNSLimiter.release()
 			if err != nil {
 				werr := fmt.Errorf("lookup on %v failed: %w", host, err)
 				return nil, "", werr
@@ -190,37 +510,230 @@ func (chain proxyChain) connect(ctx context.Context, address string) (net.Conn,
 			}
 
 			gMetaLogger.Debugf("Found IP address: %v", ips[0])
+			annotateConn(ctx, "resolved", ips[0].String())
 			address = net.JoinHostPort(ips[0].String(), port) // use the first IP address returned instead of the hostname in address
 		}
 
 	}
+
+	// Destinations in private or reserved ranges are refused once their address is known, after custom hosts and local DNS resolution
+	if chain.blockPrivate {
+		err := checkDestination(address)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
 	gMetaLogger.Debugf("Initiate connection to %v", address)
 
+	conn, repr, err = chain.connectWithRetries(ctx, address)
+
+	// With directFallback, a failed connection through the proxies is attempted again directly, with a new timeout, unless the client went away
+	if err != nil && chain.directFallback && len(chain.proxies) != 0 && ctx.Err() == nil {
+		gMetaLogger.Infof("connection to %v through chain %v failed (%v), falling back to a direct connection", address, chain.name, err)
+		annotateConn(ctx, "fallback", "direct")
+
+		direct := chain
+		direct.proxies = nil
+		direct.verify = nil
+		var directRepr string
+		conn, directRepr, err = direct.connectWithRetries(ctx, address)
+		repr = fmt.Sprintf("%v | direct fallback %v", repr, directRepr)
+	}
+
+	return conn, repr, err
+}
+
+// connectWithRetries connects to address through the chain's proxies within chain.tcpReadTimeout, attempting the connection again according to the chain's retry policy on retryable errors
+func (chain proxyChain) connectWithRetries(ctx context.Context, address string) (net.Conn, string, error) {
 	// timeout context used to stop the connection through the proxy chain after chain.tcpReadTimeout millisecond
 	gMetaLogger.Debugf("timeout : %v", chain.tcpReadTimeout)
 	ctx, cancel := context.WithTimeout(ctx, time.Duration(chain.tcpReadTimeout)*time.Millisecond)
 	defer cancel()
 
-	// Start connectN
-	conn, repr, err := chain.connectN(ctx, len(chain.proxies), address)
-	gMetaLogger.Debugf("connectN returned before timeout")
-	return conn, repr, err
+	// Start connectN, with the proxies ordered according to the chain's order setting.
+	// On retryable errors, the connection is attempted again according to the chain's retry policy, within the same timeout.
+	proxies := chain.proxies
+	for attempt := 1; ; attempt++ {
+		chain.proxies = orderedProxies(proxies, chain.order)
+		conn, repr, err := chain.connectN(ctx, len(chain.proxies), address)
+		gMetaLogger.Debugf("connectN returned before timeout")
+
+		// With verify, the chain must also pass its verification probe, otherwise the attempt fails like a connection failure
+		if err == nil && chain.verify != nil {
+			err = chain.verifyChain(ctx)
+			if err != nil {
+				conn.Close()
+				conn = nil
+				repr += fmt.Sprintf(" (%v)", err)
+			}
+		}
+
+		if err == nil || attempt >= chain.retry.MaxAttempts || !isRetryable(err) {
+			return conn, repr, err
+		}
+
+		delay := chain.retry.delay(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			gMetaLogger.Debugf("not retrying connection to %v, timeout expires before %v", address, delay)
+			return conn, repr, err
+		}
+
+		gMetaLogger.Debugf("attempt %v/%v of connection to %v failed (%v), retrying in %v", attempt, chain.retry.MaxAttempts, address, err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return conn, repr, err
+		}
+	}
 
 }
 
+// bind takes the address of a peer expected to connect and returns a net.Conn to the chain's last proxy, on which a BIND request for this address succeeded,
+// the last proxy, which must support BIND, and the address it listens on for the peer. The connection of the peer is then waited for with the acceptBind method of the last proxy.
+func (chain proxyChain) bind(ctx context.Context, address string) (conn net.Conn, last binder, bound string, repr string, err error) {
+
+	// Account the bind attempt in the chain's usage counters, the end of established connections is recorded by the handlers with closed
+	counters := chain.stats()
+	counters.total.Add(1)
+	defer func() {
+		if err != nil {
+			counters.errors.Add(1)
+		} else {
+			counters.active.Add(1)
+		}
+	}()
+
+	proxies := orderedProxies(chain.proxies, chain.order)
+	if len(proxies) == 0 {
+		err = fmt.Errorf("BIND is not supported through chains without proxies")
+		return
+	}
+
+	last, ok := proxies[len(proxies)-1].(binder)
+	if !ok {
+		err = fmt.Errorf("BIND is not supported by proxy %v", proxies[len(proxies)-1].address())
+		return
+	}
+
+	// timeout context used to stop the connection to the last proxy and the BIND request after chain.tcpReadTimeout millisecond
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(chain.tcpReadTimeout)*time.Millisecond)
+	defer cancel()
+
+	chain.proxies = proxies
+	conn, repr, err = chain.connectN(ctx, len(proxies)-1, proxies[len(proxies)-1].address())
+	if err != nil {
+		return
+	}
+
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	bound, err = last.bind(conn, address)
+	if !stop() {
+		err = fmt.Errorf("timeout during bind()")
+	}
+
+	if err != nil {
+		conn.Close()
+		conn = nil
+		last = nil
+		repr += fmt.Sprintf(" =X=> BIND %v (%v)", address, err.Error())
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	repr += fmt.Sprintf(" ===> BIND %v (%v)", address, bound)
+
+	return
+}
+
+// setSocketOptions applies the TCP options of the chain (noDelay and keepAlive) to conns, the client and target sockets of a relay.
+// Sockets which are not TCP sockets are left untouched.
+func (chain proxyChain) setSocketOptions(conns ...net.Conn) {
+	for _, conn := range conns {
+		// Wrapped connections (e.g. with data replayed before the relay) expose their underlying connection with NetConn
+		for {
+			wrapper, ok := conn.(interface{ NetConn() net.Conn })
+			if !ok {
+				break
+			}
+			conn = wrapper.NetConn()
+		}
+
+		tcpConn, ok := conn.(*net.TCPConn)
+		if !ok {
+			continue
+		}
+
+		err := tcpConn.SetNoDelay(chain.noDelay)
+		if err != nil {
+			gMetaLogger.Errorf("could not set TCP_NODELAY to %v on %v: %v", chain.noDelay, conn.RemoteAddr(), err)
+		}
+
+		switch {
+		case chain.keepAlive > 0:
+			err = tcpConn.SetKeepAlive(true)
+			if err == nil {
+				err = tcpConn.SetKeepAlivePeriod(time.Duration(chain.keepAlive) * time.Millisecond)
+			}
+		case chain.keepAlive < 0:
+			err = tcpConn.SetKeepAlive(false)
+		}
+		if err != nil {
+			gMetaLogger.Errorf("could not set TCP keep-alive on %v: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
+
+// stats returns the usage counters of the chain
+func (chain proxyChain) stats() *chainCounters {
+	return gChainStats.get(chain.name)
+}
+
+// dialer returns the dialer of the outbound connections of the chain, to the first proxy or to the destination for direct chains
+func (chain proxyChain) dialer() net.Dialer {
+	var d net.Dialer
+	if chain.sourceAddr != nil {
+		d.LocalAddr = &net.TCPAddr{IP: chain.sourceAddr}
+	}
+	if chain.fwmark != 0 {
+		d.Control = fwmarkControl(chain.fwmark)
+	}
+	return d
+}
+
+// hopContext returns the context bounding a hop of the connection through the chain (a dial or a handshake): ctx, limited to chain.hopTimeout if set.
+// As it derives from ctx, the hop timeout never extends the timeout of the whole connection, and a slow hop only consumes the remaining budget.
+func (chain proxyChain) hopContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if chain.hopTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(chain.hopTimeout)*time.Millisecond)
+}
+
+// observeDial records the duration d of a successful TCP dial to address, in the latency histograms of the hop proxy of the chain
+func (chain proxyChain) observeDial(proxy string, address string, d time.Duration) {
+	gHopLatencies.get(chain.name, proxy).dial.observe(d)
+	gMetaLogger.Debugf("dial to %v took %v (chain %v)", address, d, chain.name)
+}
+
 // connectN is a recursive function returning a net.Conn (representing a TCP socket) connected to address through the subchain made of the n first proxies of the proxy chain.
 // It takes ctx context parameter for timeout implementation.
 func (chain proxyChain) connectN(ctx context.Context, n int, address string) (conn net.Conn, repr string, err error) {
-	var d net.Dialer
+	d := chain.dialer()
 
 	repr = ""
 
 	if n == 0 { // If the subchain contains no proxy, directly connect to the provided address
 		gMetaLogger.Debugf("connectN called with n=0. Connect to %v directly.", address)
-		conn, err = d.DialContext(ctx, "tcp", address)
+		hopCtx, cancel := chain.hopContext(ctx)
+		start := time.Now()
+		conn, err = d.DialContext(hopCtx, "tcp", address)
+		cancel()
 		if err != nil {
 			repr += fmt.Sprintf("-X-> %v (%v)", address, err.Error())
 		} else {
+			chain.observeDial("direct", address, time.Since(start))
 			repr += fmt.Sprintf("---> %v", address)
 		}
 		return
@@ -228,7 +741,17 @@ func (chain proxyChain) connectN(ctx context.Context, n int, address string) (co
 
 		if n == 1 { // If the subchain contains only one proxy, establish a direct TCP connection to the proxy and obtain net.Conn with net.Dial
 			gMetaLogger.Debugf("connectN called with n=1. Connect to the only proxy %v", (chain.proxies[n-1]).address())
-			conn, err = d.DialContext(ctx, "tcp", (chain.proxies[n-1]).address())
+			// A prewarmed connection to the proxy is used if one is available
+			conn = chain.prewarm.take((chain.proxies[n-1]).address())
+			if conn == nil {
+				hopCtx, cancel := chain.hopContext(ctx)
+				start := time.Now()
+				conn, err = d.DialContext(hopCtx, "tcp", (chain.proxies[n-1]).address())
+				cancel()
+				if err == nil {
+					chain.observeDial((chain.proxies[n-1]).address(), (chain.proxies[n-1]).address(), time.Since(start))
+				}
+			}
 			if err != nil {
 				repr += fmt.Sprintf("-X-> %v (%v)", (chain.proxies[n-1]).address(), err.Error())
 				return
@@ -240,15 +763,28 @@ func (chain proxyChain) connectN(ctx context.Context, n int, address string) (co
 
 			conn, repr, err = chain.connectN(ctx, n-1, (chain.proxies[n-1]).address())
 			if err != nil {
+				// The reply code of a SOCKS5 proxy failing to reach the next proxy does not concern the destination, it is not relayed to clients
+				var replyErr socks5ReplyError
+				if errors.As(err, &replyErr) {
+					err = replyErr.err
+				}
 				return
 			}
 		}
 
-		// Once we have a connection to the subchain's last proxy, proceed to the subchain's last proxy's handshake to connect to provided address
-		// TODO: implement a timeout on the handshake
+		// Once we have a connection to the subchain's last proxy, proceed to the subchain's last proxy's handshake to connect to provided address,
+		// within the hop timeout and the remaining time of the whole connection
+		hopCtx, cancel := chain.hopContext(ctx)
+		defer cancel()
 		gMetaLogger.Debugf("Establishing connection to %v through proxy %v", address, (chain.proxies[n-1]).address())
-		resultCh := make(chan error)
-
+		_, span := startSpan(ctx, "handshake")
+		span.setAttribute("proxy", (chain.proxies[n-1]).address())
+		span.setAttribute("target", address)
+		// Buffered so that the handshake goroutine returns even when its result is no longer awaited
+		resultCh := make(chan error, 1)
+
+		// The duration is measured on success only, without bounding the handshake any further than hopCtx
+		start := time.Now()
 		go func() {
 			resultCh <- (chain.proxies[n-1]).handshake(conn, address)
 			close(resultCh)
@@ -258,13 +794,31 @@ func (chain proxyChain) connectN(ctx context.Context, n int, address string) (co
 		case result := <-resultCh:
 			gMetaLogger.Debugf("handshake returned before timeout")
 			err = result
-		case <-ctx.Done():
-			gMetaLogger.Errorf("timeout during handshake with %v for %v", chain.proxies[n-1].address(), address)
-			err = fmt.Errorf("timeout during handshake()")
+			if err == nil {
+				elapsed := time.Since(start)
+				gHopLatencies.get(chain.name, (chain.proxies[n-1]).address()).handshake.observe(elapsed)
+				gMetaLogger.Debugf("handshake with %v for %v took %v (chain %v)", (chain.proxies[n-1]).address(), address, elapsed, chain.name)
+			}
+		case <-hopCtx.Done():
+			// Only the hop timeout and the timeout of the whole connection are timeouts, the connection may also be cancelled, e.g. when the client hangs up
+			switch {
+			case ctx.Err() == nil:
+				err = fmt.Errorf("hop timeout of %vms reached during handshake()", chain.hopTimeout)
+			case errors.Is(ctx.Err(), context.DeadlineExceeded):
+				err = fmt.Errorf("timeout during handshake()")
+			default:
+				err = fmt.Errorf("handshake() cancelled: %w", context.Cause(ctx))
+			}
+			gMetaLogger.Errorf("handshake with %v for %v interrupted: %v", chain.proxies[n-1].address(), address, err)
+		}
+
+		if err != nil {
+			span.recordError(err)
 		}
+		span.end()
 
 		if err != nil {
-			conn.Close() // Should cancel any read or write operation on conn in handshake() in case ctx is Done
+			conn.Close() // Cancels any read or write operation on conn in handshake() in case hopCtx is Done, so that its goroutine returns
 			conn = nil
 			repr += fmt.Sprintf(" =X=> %v (%v)", address, err.Error())
 			return
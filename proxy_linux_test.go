@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// socketOption returns the value of the socket option opt at level of the socket of conn
+func socketOption(t *testing.T, conn net.Conn, level int, opt int) int {
+	t.Helper()
+
+	c, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var sockErr error
+	err = c.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return value
+}
+
+func TestSetSocketOptions(t *testing.T) {
+	tests := []struct {
+		noDelay      bool
+		keepAlive    int64
+		nodelayOpt   int
+		keepAliveOpt int
+	}{
+		{noDelay: true, keepAlive: 30000, nodelayOpt: 1, keepAliveOpt: 1},
+		{noDelay: false, keepAlive: -1, nodelayOpt: 0, keepAliveOpt: 0},
+	}
+
+	for _, test := range tests {
+		chain := testChain("options")
+		chain.noDelay = test.noDelay
+		chain.keepAlive = test.keepAlive
+
+		// Both ends of the relay are set
+		client, target := tcpPair(t)
+		chain.setSocketOptions(client, target)
+		for _, conn := range []net.Conn{client, target} {
+			if v := socketOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); v != test.nodelayOpt {
+				t.Errorf("noDelay %v: TCP_NODELAY is %v", test.noDelay, v)
+			}
+			if v := socketOption(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); v != test.keepAliveOpt {
+				t.Errorf("keepAlive %v: SO_KEEPALIVE is %v", test.keepAlive, v)
+			}
+			if test.keepAlive > 0 {
+				if v := socketOption(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); v != int(test.keepAlive/1000) {
+					t.Errorf("keepAlive %v: TCP_KEEPIDLE is %vs", test.keepAlive, v)
+				}
+			}
+		}
+	}
+}
+
+func TestSetSocketOptionsDefaultKeepAlive(t *testing.T) {
+	// Without keepAlive, the keep-alive settings of the sockets are kept
+	client, target := tcpPair(t)
+	before := socketOption(t, target, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE)
+	testChain("options").setSocketOptions(client, target)
+	if after := socketOption(t, target, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); after != before {
+		t.Errorf("SO_KEEPALIVE changed from %v to %v without keepAlive", before, after)
+	}
+
+	// Other connections are left untouched
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	testChain("options").setSocketOptions(c1, c2)
+}
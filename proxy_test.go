@@ -0,0 +1,851 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testProxies returns n proxies, named by their index in their address
+func testProxies(t *testing.T, n int) []proxy {
+	t.Helper()
+
+	var proxies []proxy
+	for i := 0; i < n; i++ {
+		p, err := newProxy("socks5", "127.0.0.1", fmt.Sprint(10000+i), "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+// proxyAddresses returns the addresses of proxies, in their order
+func proxyAddresses(proxies []proxy) []string {
+	var addresses []string
+	for _, p := range proxies {
+		addresses = append(addresses, p.address())
+	}
+	return addresses
+}
+
+func TestOrderedProxiesFixed(t *testing.T) {
+	proxies := testProxies(t, 5)
+
+	ordered := orderedProxies(proxies, "fixed")
+	if !slices.Equal(proxyAddresses(ordered), proxyAddresses(proxies)) {
+		t.Fatalf("fixed order changed the order of the proxies: %v", proxyAddresses(ordered))
+	}
+}
+
+func TestOrderedProxiesReverse(t *testing.T) {
+	proxies := testProxies(t, 5)
+	expected := proxyAddresses(proxies)
+	slices.Reverse(expected)
+
+	for i := 0; i < 10; i++ {
+		ordered := orderedProxies(proxies, "reverse")
+		if !slices.Equal(proxyAddresses(ordered), expected) {
+			t.Fatalf("reverse order is %v instead of %v", proxyAddresses(ordered), expected)
+		}
+	}
+
+	// The proxies of the chain are left untouched
+	if proxies[0].address() != "127.0.0.1:10000" {
+		t.Fatal("reverse order modified the proxies of the chain")
+	}
+}
+
+func TestOrderedProxiesShuffle(t *testing.T) {
+	proxies := testProxies(t, 5)
+	original := proxyAddresses(proxies)
+	sorted := slices.Sorted(slices.Values(original))
+
+	orders := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ordered := proxyAddresses(orderedProxies(proxies, "shuffle"))
+		if !slices.Equal(slices.Sorted(slices.Values(ordered)), sorted) {
+			t.Fatalf("shuffled order %v is not a permutation of the proxies", ordered)
+		}
+		orders[fmt.Sprint(ordered)] = true
+	}
+
+	// 100 shuffles of 5 proxies all giving the same order has a negligible probability
+	if len(orders) < 2 {
+		t.Fatal("shuffle always produced the same order")
+	}
+	if !slices.Equal(proxyAddresses(proxies), original) {
+		t.Fatal("shuffle modified the proxies of the chain")
+	}
+}
+
+func TestChainDescOrder(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"proxies": []}`), &desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc.Order != "fixed" {
+		t.Fatalf("default order is %v instead of fixed", desc.Order)
+	}
+
+	for _, order := range []string{"fixed", "reverse", "shuffle"} {
+		err = json.Unmarshal([]byte(`{"order": "`+order+`"}`), &desc)
+		if err != nil {
+			t.Errorf("order %v rejected: %v", order, err)
+		}
+	}
+
+	err = json.Unmarshal([]byte(`{"order": "random"}`), &desc)
+	if err == nil {
+		t.Fatal("unknown order accepted")
+	}
+}
+
+func TestChainDescFirstDataTimeout(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"firstDataTimeout": 500}`), &desc)
+	if err != nil || desc.FirstDataTimeout != 500 {
+		t.Fatalf("firstDataTimeout not parsed: %v", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"firstDataTimeout": -1}`), &desc)
+	if err == nil {
+		t.Fatal("negative firstDataTimeout accepted")
+	}
+}
+
+// testProxyMap returns proxies named after their index in names
+func testProxyMap(t *testing.T, names ...string) proxyMap {
+	t.Helper()
+
+	proxies := make(proxyMap)
+	for i, p := range testProxies(t, len(names)) {
+		proxies[names[i]] = p
+	}
+	return proxies
+}
+
+func TestFlattenNestedChains(t *testing.T) {
+	proxies := testProxyMap(t, "p1", "p2", "p3", "p4")
+	chains := chainMap{
+		"entry":    {Proxies: []string{"p1", "p2"}},
+		"exit":     {Proxies: []string{"p4"}},
+		"composed": {Proxies: []string{"entry", "p3", "exit"}},
+		"outer":    {Proxies: []string{"composed", "entry"}},
+	}
+
+	flat, err := chains.flatten("composed", proxies, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(flat, []string{"p1", "p2", "p3", "p4"}) {
+		t.Fatalf("composed chain flattened to %v", flat)
+	}
+
+	// References are resolved transitively, and a sub-chain can be used several times
+	flat, err = chains.flatten("outer", proxies, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(flat, []string{"p1", "p2", "p3", "p4", "p1", "p2"}) {
+		t.Fatalf("outer chain flattened to %v", flat)
+	}
+}
+
+func TestFlattenProxyShadowsChain(t *testing.T) {
+	// Implicit single proxy chains are named as their proxy, which is used directly
+	proxies := testProxyMap(t, "p1")
+	chains := chainMap{
+		"p1":    {Proxies: []string{"p1"}},
+		"chain": {Proxies: []string{"p1"}},
+	}
+
+	flat, err := chains.flatten("chain", proxies, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(flat, []string{"p1"}) {
+		t.Fatalf("chain flattened to %v", flat)
+	}
+}
+
+func TestFlattenCyclicChains(t *testing.T) {
+	proxies := testProxyMap(t, "p1")
+	chains := chainMap{
+		"a":    {Proxies: []string{"p1", "b"}},
+		"b":    {Proxies: []string{"c"}},
+		"c":    {Proxies: []string{"a"}},
+		"self": {Proxies: []string{"self"}},
+	}
+
+	_, err := chains.flatten("a", proxies, nil)
+	if err == nil || !strings.Contains(err.Error(), "cyclic chain reference a -> b -> c -> a") {
+		t.Fatalf("cyclic reference not rejected: %v", err)
+	}
+
+	_, err = chains.flatten("self", proxies, nil)
+	if err == nil || !strings.Contains(err.Error(), "cyclic chain reference self -> self") {
+		t.Fatalf("chain referencing itself not rejected: %v", err)
+	}
+}
+
+func TestFlattenUndefinedReference(t *testing.T) {
+	proxies := testProxyMap(t, "p1")
+	chains := chainMap{"chain": {Proxies: []string{"p1", "missing"}}}
+
+	_, err := chains.flatten("chain", proxies, nil)
+	if err == nil || !strings.Contains(err.Error(), "missing used at index 1 of chain chain") {
+		t.Fatalf("undefined reference not rejected: %v", err)
+	}
+}
+
+// sourceAddr returns a local IPv4 address to bind outbound connections to, other than the loopback one if the host has any
+func sourceAddr(t *testing.T) net.IP {
+	t.Helper()
+
+	ifAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ifAddr := range ifAddrs {
+		ipNet, ok := ifAddr.(*net.IPNet)
+		if ok && ipNet.IP.To4() != nil && !ipNet.IP.IsLoopback() {
+			return ipNet.IP
+		}
+	}
+	return net.IPv4(127, 0, 0, 1)
+}
+
+// acceptedFrom returns a listener on all interfaces and a channel receiving the remote IP address of the connections it accepts
+func acceptedFrom(t *testing.T) (net.Listener, <-chan string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	remotes := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			remotes <- host
+			conn.Close()
+		}
+	}()
+	return l, remotes
+}
+
+func TestCheckLocalAddr(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1", sourceAddr(t).String()} {
+		err := checkLocalAddr(addr)
+		if err != nil {
+			t.Errorf("local address %v rejected: %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"198.51.100.1", "localhost", ""} {
+		err := checkLocalAddr(addr)
+		if err == nil {
+			t.Errorf("address %q accepted", addr)
+		}
+	}
+}
+
+func TestChainDescSourceAddr(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"sourceAddr": "127.0.0.1"}`), &desc)
+	if err != nil || desc.SourceAddr != "127.0.0.1" {
+		t.Fatalf("sourceAddr not parsed: %v", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"sourceAddr": "198.51.100.1"}`), &desc)
+	if err == nil {
+		t.Fatal("non local sourceAddr accepted")
+	}
+}
+
+func TestSourceAddr(t *testing.T) {
+	source := sourceAddr(t)
+	l, remotes := acceptedFrom(t)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	target := net.JoinHostPort("127.0.0.1", port)
+
+	// Direct chains bind the connection to the destination, chains with proxies the connection to the first proxy
+	direct := testChain("direct")
+	direct.sourceAddr = source
+	p, err := newProxy("socks5", "127.0.0.1", port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied := testChain("proxied", p)
+	proxied.sourceAddr = source
+
+	for _, chain := range []proxyChain{direct, proxied} {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		conn, _, err := chain.connect(ctx, target)
+		cancel()
+		if err == nil {
+			conn.Close()
+		}
+
+		select {
+		case remote := <-remotes:
+			if remote != source.String() {
+				t.Errorf("outbound connection of chain %v from %v instead of %v", chain.name, remote, source)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no outbound connection of chain %v", chain.name)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	r := retryPolicy{MaxAttempts: 4, BaseDelay: 100, Factor: 2}
+	for attempt, expected := range []time.Duration{100, 200, 400} {
+		if d := r.delay(attempt + 1); d != expected*time.Millisecond {
+			t.Errorf("delay after attempt %v is %v instead of %v", attempt+1, d, expected*time.Millisecond)
+		}
+	}
+
+	r.Jitter = 0.5
+	for range 100 {
+		if d := r.delay(2); d < 100*time.Millisecond || d > 300*time.Millisecond {
+			t.Fatalf("delay %v out of the jitter range of 200ms", d)
+		}
+	}
+}
+
+func TestChainDescRetry(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"retry": {"maxAttempts": 3, "baseDelay": 50, "factor": 1.5, "jitter": 0.2}}`), &desc)
+	if err != nil || desc.Retry != (retryPolicy{MaxAttempts: 3, BaseDelay: 50, Factor: 1.5, Jitter: 0.2}) {
+		t.Fatalf("retry not parsed: %+v (%v)", desc.Retry, err)
+	}
+
+	err = json.Unmarshal([]byte(`{}`), &desc)
+	if err != nil || desc.Retry.MaxAttempts != 1 {
+		t.Fatalf("chains retry by default: %+v (%v)", desc.Retry, err)
+	}
+
+	for _, retry := range []string{`{"maxAttempts": 0}`, `{"maxAttempts": 2, "factor": 0.5}`, `{"maxAttempts": 2, "jitter": 2}`, `{"maxAttempts": 2, "baseDelay": -1}`} {
+		err = json.Unmarshal([]byte(`{"retry": `+retry+`}`), &desc)
+		if err == nil {
+			t.Errorf("invalid retry %v accepted", retry)
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	if !isRetryable(fmt.Errorf("connection refused")) {
+		t.Error("connection failure not retryable")
+	}
+	if isRetryable(socks5ReplyError{rep: repNotAllowed, err: refusalError{"connection not allowed by ruleset"}}) {
+		t.Error("refusal retryable")
+	}
+}
+
+// flakyProxy starts a TCP forwarder to upstream closing the failures first connections it accepts, and returns it as a SOCKS5 proxy
+// along with the number of connections it accepted
+func flakyProxy(t *testing.T, upstream string, failures int) (proxy, *atomic.Int32) {
+	t.Helper()
+
+	l := listenTCP(t)
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if accepted.Add(1) <= int32(failures) {
+				conn.Close()
+				continue
+			}
+			go func() {
+				defer conn.Close()
+				target, err := net.Dial("tcp", upstream)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, &accepted
+}
+
+func TestConnectRetries(t *testing.T) {
+	echo := startEchoServer(t)
+	p, accepted := flakyProxy(t, startDirectServer(t), 1)
+
+	chain := testChain("flaky", p)
+	chain.retry = retryPolicy{MaxAttempts: 3, BaseDelay: 10, Factor: 2}
+	conn, _, err := chain.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatalf("connection failed after %v attempts: %v", accepted.Load(), err)
+	}
+	checkEcho(t, conn, "retried")
+	conn.Close()
+	if accepted.Load() != 2 {
+		t.Errorf("connection established after %v attempts instead of 2", accepted.Load())
+	}
+
+	// Without retries, the first failure is returned
+	p, accepted = flakyProxy(t, startDirectServer(t), 1)
+	_, _, err = testChain("flaky", p).connect(context.Background(), echo)
+	if err == nil || accepted.Load() != 1 {
+		t.Errorf("connection attempted %v times without retries (%v)", accepted.Load(), err)
+	}
+}
+
+func TestConnectRetriesRefusal(t *testing.T) {
+	p, accepted := flakyProxy(t, startRouteServer(t, "socks5", "reject"), 0)
+
+	chain := testChain("refusing", p)
+	chain.retry = retryPolicy{MaxAttempts: 3, BaseDelay: 10, Factor: 2}
+	_, _, err := chain.connect(context.Background(), "127.0.0.1:1")
+	if replyCode(err) != repNotAllowed {
+		t.Fatalf("refusal not returned: %v", err)
+	}
+	if accepted.Load() != 1 {
+		t.Errorf("refused connection attempted %v times", accepted.Load())
+	}
+}
+
+func TestConnectRetriesDeadline(t *testing.T) {
+	p, accepted := flakyProxy(t, startDirectServer(t), 10)
+
+	// The next attempt would start after the connection timeout, the failure is returned at once
+	chain := testChain("flaky", p)
+	chain.tcpReadTimeout = 500
+	chain.retry = retryPolicy{MaxAttempts: 3, BaseDelay: 1000, Factor: 2}
+	start := time.Now()
+	_, _, err := chain.connect(context.Background(), "127.0.0.1:1")
+	if err == nil {
+		t.Fatal("connection through a failing proxy succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond || accepted.Load() != 1 {
+		t.Errorf("connection failed after %v and %v attempts", elapsed, accepted.Load())
+	}
+}
+
+func TestChainDescMaxLifetime(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"maxLifetime": 60000}`), &desc)
+	if err != nil || desc.MaxLifetime != 60000 {
+		t.Fatalf("maxLifetime not parsed: %v", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"maxLifetime": -1}`), &desc)
+	if err == nil {
+		t.Fatal("negative maxLifetime accepted")
+	}
+}
+
+func TestChainDescSocketOptions(t *testing.T) {
+	// Nagle's algorithm is disabled by default, and keep-alives are left to the system defaults
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{}`), &desc)
+	if err != nil || !desc.NoDelay || desc.KeepAlive != 0 {
+		t.Fatalf("default noDelay %v and keepAlive %v (%v)", desc.NoDelay, desc.KeepAlive, err)
+	}
+
+	err = json.Unmarshal([]byte(`{"noDelay": false, "keepAlive": 30000}`), &desc)
+	if err != nil || desc.NoDelay || desc.KeepAlive != 30000 {
+		t.Fatalf("noDelay %v and keepAlive %v parsed (%v)", desc.NoDelay, desc.KeepAlive, err)
+	}
+}
+
+// downProxy returns a SOCKS5 proxy on a port of the loopback interface on which nothing listens
+func downProxy(t *testing.T) proxy {
+	t.Helper()
+
+	p, err := newProxy("socks5", "127.0.0.1", freePort(t), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestDirectFallback(t *testing.T) {
+	echo := startEchoServer(t)
+
+	// Without directFallback, the connection through the proxy which is down fails
+	chain := testChain("fallback", downProxy(t))
+	if _, _, err := chain.connect(context.Background(), echo); err == nil {
+		t.Fatal("connection through a proxy which is down succeeded")
+	}
+
+	// With directFallback, the destination is connected to directly
+	chain.directFallback = true
+	conn, repr, err := chain.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatalf("direct fallback failed: %v", err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn, "fallback")
+	if !strings.Contains(repr, "direct fallback") {
+		t.Errorf("fallback not described in chain representation %q", repr)
+	}
+
+	// The fallback fails if the destination is not reachable either
+	if _, _, err := chain.connect(context.Background(), "127.0.0.1:"+freePort(t)); err == nil {
+		t.Error("direct fallback to a closed port succeeded")
+	}
+
+	// Cancelled connections do not fall back
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if conn, _, err := chain.connect(ctx, echo); err == nil {
+		conn.Close()
+		t.Error("cancelled connection fell back")
+	}
+
+	var desc proxyChainDesc
+	err = json.Unmarshal([]byte(`{"directFallback": true}`), &desc)
+	if err != nil || !desc.DirectFallback {
+		t.Errorf("directFallback not parsed: %v", err)
+	}
+}
+
+func TestDirectFallbackAudit(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startEchoServer(t)
+
+	chain := testChain("fallback", downProxy(t))
+	chain.directFallback = true
+	setChains(t, chain)
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "fallback"}]}`, "")
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table").address()
+
+	conn, rep := socks5Connect(t, srv, echo)
+	if rep != repSucceeded {
+		t.Fatalf("connection with direct fallback failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "fallback")
+
+	// The fallback is visible on the live connection and in the audit trace
+	info, ok := connOf(conn)
+	if !ok || info.getAnnotations()["fallback"] != "direct" {
+		t.Error("fallback not annotated on the live connection")
+	}
+	client := conn.LocalAddr().String()
+	conn.Close()
+	if event := findAudit(t, audit, "CLOSE", client); !strings.Contains(event.ChainRepr, "direct fallback") {
+		t.Errorf("fallback not recorded in the CLOSE audit trace %+v", event)
+	}
+}
+
+func TestCredsRef(t *testing.T) {
+	setArg(t, &gCredentials, nil)
+
+	// The credentials section applies to the proxies wherever it appears in the file
+	config, err := parseConfig(t, `{
+  "proxies": {
+    "proxy1": {"connstring": "socks5://10.0.0.1:1080", "credsRef": "account"},
+    "proxy2": {"connstring": "http://10.0.0.2:8080", "credsRef": "account"},
+    "proxy3": {"connstring": "socks5://10.0.0.3:1080", "user": "other", "pass": "secret"}
+  },
+  "chains": {"chain": {"proxies": ["proxy1", "proxy2", "proxy3"]}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "chain"}]},
+  "credentials": {"account": {"user": "alice", "pass": "s3cret"}}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string][2]string{"proxy1": {"alice", "s3cret"}, "proxy2": {"alice", "s3cret"}, "proxy3": {"other", "secret"}} {
+		var user, pass string
+		switch p := config.Proxies[name].(type) {
+		case socks5:
+			user, pass = p.user, p.pass
+		case httpConnect:
+			user, pass = p.user, p.pass
+		default:
+			t.Fatalf("proxy %v is a %T", name, p)
+		}
+		if user != want[0] || pass != want[1] {
+			t.Errorf("proxy %v has credentials %v:%v instead of %v:%v", name, user, pass, want[0], want[1])
+		}
+	}
+}
+
+func TestCredsRefErrors(t *testing.T) {
+	setArg(t, &gCredentials, nil)
+
+	for _, tc := range []struct {
+		proxy string
+		err   string
+	}{
+		{`{"connstring": "socks5://10.0.0.1:1080", "credsRef": "missing"}`, "references credentials missing, which are not defined"},
+		{`{"connstring": "socks5://10.0.0.1:1080", "credsRef": "account", "user": "bob"}`, "cannot define both credsRef and user/pass"},
+		{`{"connstring": "socks5://10.0.0.1:1080", "credsRef": "account", "pass": "pwd"}`, "cannot define both credsRef and user/pass"},
+		{`{"connstring": "socks5://10.0.0.1:1080", "credsRef": "long"}`, "at most 255 bytes long"},
+	} {
+		_, err := parseConfig(t, `{
+  "credentials": {"account": {"user": "alice", "pass": "s3cret"}, "long": {"user": "`+strings.Repeat("u", 256)+`", "pass": "p"}},
+  "proxies": {"proxy": `+tc.proxy+`},
+  "chains": {"chain": {"proxies": ["proxy"]}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "chain"}]}
+}`)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("proxy %v: error %v instead of %q", tc.proxy, err, tc.err)
+		}
+	}
+}
+
+func TestConnStringIPv6(t *testing.T) {
+	for connString, want := range map[string]string{
+		"socks5://[2001:db8::1]:1080":   "[2001:db8::1]:1080",
+		"http://[::1]:8080":             "[::1]:8080",
+		"socks5://192.0.2.1:1080":       "192.0.2.1:1080",
+		"httpconnect://proxy.test:3128": "proxy.test:3128",
+	} {
+		b, err := newBaseProxyFromString(connString, "", "")
+		if err != nil {
+			t.Errorf("connection string %v refused: %v", connString, err)
+			continue
+		}
+		p, err := newProxy(b.prot, b.host, b.port, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.address() != want {
+			t.Errorf("proxy %v has address %v instead of %v", connString, p.address(), want)
+		}
+	}
+
+	// IPv6 addresses must be bracketed
+	for _, connString := range []string{"socks5://2001:db8::1:1080", "socks5://::1", "socks5://192.0.2.1"} {
+		if _, err := newBaseProxyFromString(connString, "", ""); err == nil {
+			t.Errorf("connection string %v accepted", connString)
+		}
+	}
+}
+
+func TestChangedProxies(t *testing.T) {
+	proxy := func(host string, user string) proxy {
+		p, err := newProxy("socks5", host, "1080", user, "pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	old := proxyMap{"same": proxy("10.0.0.1", "u"), "creds": proxy("10.0.0.2", "u"), "addr": proxy("10.0.0.3", "u"), "removed": proxy("10.0.0.4", "u")}
+	new := proxyMap{"same": proxy("10.0.0.1", "u"), "creds": proxy("10.0.0.2", "v"), "addr": proxy("10.0.0.5", "u"), "added": proxy("10.0.0.6", "u")}
+
+	if changed := changedProxies(old, new); !slices.Equal(changed, []string{"addr", "creds"}) {
+		t.Errorf("changed proxies %v instead of [addr creds]", changed)
+	}
+	if changed := changedProxies(nil, new); changed != nil {
+		t.Errorf("proxies %v changed on initial load", changed)
+	}
+}
+
+func TestCancelledHandshakeGoroutines(t *testing.T) {
+	// A proxy holding connections without reply until they are closed
+	l := listenTCP(t)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain("stalled", p)
+	chain.tcpReadTimeout = 10000
+
+	// The handshakes abandoned when their connection is cancelled do not leave goroutines behind
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		if conn, _, err := chain.connect(ctx, "192.0.2.1:80"); err == nil {
+			conn.Close()
+			t.Fatal("connection through a stalled proxy succeeded")
+		}
+	}
+	waitFor(t, 2*time.Second, "goroutines of the cancelled handshakes to return", func() bool {
+		return runtime.NumGoroutine() <= before
+	})
+}
+
+// slowProxy returns a proxy relaying connections to upstream after delay, or holding them without reply if upstream is empty, and the number of connections it accepted
+func slowProxy(t *testing.T, upstream string, delay time.Duration) (proxy, *atomic.Int32) {
+	t.Helper()
+
+	l := listenTCP(t)
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				if upstream == "" {
+					<-done
+					return
+				}
+				time.Sleep(delay)
+				target, err := net.Dial("tcp", upstream)
+				if err != nil {
+					return
+				}
+				defer target.Close()
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, &accepted
+}
+
+func TestHopTimeout(t *testing.T) {
+	echo := startEchoServer(t)
+	first, _ := slowProxy(t, startDirectServer(t), 0)
+	last, _ := slowProxy(t, startDirectServer(t), 0)
+	stalled, _ := slowProxy(t, "", 0)
+
+	// A stalled middle hop fails after the hop timeout instead of the timeout of the whole connection
+	chain := testChain("stalled", first, stalled, last)
+	chain.tcpReadTimeout = 2000
+	chain.hopTimeout = 200
+	start := time.Now()
+	_, _, err := chain.connect(context.Background(), echo)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stalled hop failed after %v with a hop timeout of 200ms", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), "hop timeout of 200ms reached during handshake()") {
+		t.Errorf("stalled hop failed with %v", err)
+	}
+
+	// Without hop timeout, it consumes the timeout of the whole connection
+	chain.tcpReadTimeout = 500
+	chain.hopTimeout = 0
+	start = time.Now()
+	_, _, err = chain.connect(context.Background(), echo)
+	if elapsed := time.Since(start); err == nil || elapsed < 500*time.Millisecond || strings.Contains(err.Error(), "hop timeout") {
+		t.Errorf("stalled hop without hop timeout failed after %v with %v", elapsed, err)
+	}
+
+	// The hop timeout never extends the timeout of the whole connection
+	chain.tcpReadTimeout = 300
+	chain.hopTimeout = 5000
+	start = time.Now()
+	_, _, err = chain.connect(context.Background(), echo)
+	if elapsed := time.Since(start); err == nil || elapsed > time.Second || strings.Contains(err.Error(), "hop timeout") {
+		t.Errorf("stalled hop with a longer hop timeout failed after %v with %v", elapsed, err)
+	}
+
+	// A connection cancelled during a hop reports the cause of its cancellation instead of a timeout
+	chain.tcpReadTimeout = 2000
+	chain.hopTimeout = 1000
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() { cancel(errors.New("client hung up")) })
+	_, _, err = chain.connect(ctx, echo)
+	if err == nil || !strings.Contains(err.Error(), "handshake() cancelled: client hung up") {
+		t.Errorf("cancelled hop failed with %v", err)
+	}
+}
+
+func TestHopTimeoutSlowHop(t *testing.T) {
+	echo := startEchoServer(t)
+	first, _ := slowProxy(t, startDirectServer(t), 0)
+	middle, _ := slowProxy(t, startDirectServer(t), 150*time.Millisecond)
+	last, _ := slowProxy(t, startDirectServer(t), 0)
+
+	// A slow hop within the hop timeout only adds its own delay to the connection
+	chain := testChain("slow", first, middle, last)
+	chain.tcpReadTimeout = 1000
+	chain.hopTimeout = 400
+	start := time.Now()
+	conn, _, err := chain.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > 700*time.Millisecond {
+		t.Errorf("3-hop chain with a 150ms hop connected in %v", elapsed)
+	}
+	checkEcho(t, conn, "slow hop")
+	conn.Close()
+}
+
+func TestHopTimeoutRetries(t *testing.T) {
+	echo := startEchoServer(t)
+	first, _ := slowProxy(t, startDirectServer(t), 0)
+	stalled, accepted := slowProxy(t, "", 0)
+
+	// Each attempt fails after the hop timeout, leaving the rest of the budget for retries
+	chain := testChain("stalled", first, stalled)
+	chain.tcpReadTimeout = 1500
+	chain.hopTimeout = 100
+	chain.retry = retryPolicy{MaxAttempts: 3, BaseDelay: 10, Factor: 1}
+	start := time.Now()
+	_, _, err := chain.connect(context.Background(), echo)
+	if err == nil {
+		t.Fatal("connection through a stalled proxy succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("3 attempts failed after %v with a hop timeout of 100ms", elapsed)
+	}
+	if n := accepted.Load(); n != 3 {
+		t.Errorf("stalled proxy reached %v times instead of 3", n)
+	}
+}
+
+func TestChainDescHopTimeout(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"hopTimeout": 500}`), &desc)
+	if err != nil || desc.HopTimeout != 500 {
+		t.Fatalf("hopTimeout not parsed: %v", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"hopTimeout": -1}`), &desc)
+	if err == nil {
+		t.Fatal("negative hopTimeout accepted")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+// Defines the reverse DNS lookups performed by ptr rules, cached so that a destination is only looked up once per -ptr-cache-ttl
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ptrLookup returns the PTR names of addr. It can be replaced to control the names returned, e.g. with a stub resolver.
+var ptrLookup = net.DefaultResolver.LookupAddr
+
+// ptrCacheEntry holds the PTR names of an address, or the error of its lookup, until expires
+type ptrCacheEntry struct {
+	names   []string
+	err     error
+	expires time.Time
+}
+
+// ptrCacheMax is the number of cached addresses above which expired entries are removed
+const ptrCacheMax = 4096
+
+// ptrCache is the type used to hold the results of the reverse lookups, by IP address
+type ptrCache struct {
+	entries map[string]ptrCacheEntry
+	mu      sync.Mutex
+}
+
+var gPTRCache = ptrCache{entries: make(map[string]ptrCacheEntry)}
+
+// lookup returns the PTR names of the IP address ip, without trailing dot and in lower case, from the cache if it holds them.
+// Lookups are bounded by -ptr-timeout and the DNS resolutions limiter, and their results, including failures, are cached during -ptr-cache-ttl.
+func (c *ptrCache) lookup(ip string) ([]string, error) {
+	c.mu.Lock()
+	entry, ok := c.entries[ip]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry.names, entry.err
+	}
+
+	names, err := lookupPTROnce(ip)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if len(c.entries) >= ptrCacheMax {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if gArgPTRCacheTTL > 0 && len(c.entries) < ptrCacheMax {
+		c.entries[ip] = ptrCacheEntry{names: names, err: err, expires: now.Add(gArgPTRCacheTTL)}
+	}
+
+	return names, err
+}
+
+// lookupPTROnce performs the reverse lookup of ip, bounded by -ptr-timeout
+func lookupPTROnce(ip string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gArgPTRTimeout)
+	defer cancel()
+
+	err := gDNSLimiter.acquire(ctx)
+	if err != nil {
+		err = fmt.Errorf("reverse lookup on %v not performed: %w", ip, err)
+		return nil, err
+	}
+	names, err := ptrLookup(ctx, ip)
+	gDNSLimiter.release()
+	if err != nil {
+		err = fmt.Errorf("reverse lookup on %v failed: %w", ip, err)
+		return nil, err
+	}
+
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(strings.ToLower(name), ".")
+	}
+
+	return names, nil
+}
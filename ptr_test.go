@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// setPTRRecords replaces the reverse lookups of ptr rules by a stub resolver returning the PTR records of records, with an empty cache, until the end of the test.
+// Addresses missing from records have no PTR record. It returns the number of lookups received by the stub resolver.
+func setPTRRecords(t *testing.T, records map[string][]string) *atomic.Int32 {
+	t.Helper()
+
+	lookups := new(atomic.Int32)
+	setArg(t, &ptrLookup, func(ctx context.Context, addr string) ([]string, error) {
+		lookups.Add(1)
+		names, ok := records[addr]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+		}
+		return append([]string{}, names...), nil
+	})
+
+	gPTRCache.mu.Lock()
+	previous := gPTRCache.entries
+	gPTRCache.entries = make(map[string]ptrCacheEntry)
+	gPTRCache.mu.Unlock()
+	t.Cleanup(func() {
+		gPTRCache.mu.Lock()
+		gPTRCache.entries = previous
+		gPTRCache.mu.Unlock()
+	})
+
+	return lookups
+}
+
+func TestPTRRule(t *testing.T) {
+	lookups := setPTRRecords(t, map[string][]string{
+		"192.0.2.1":   {"ec2-192-0-2-1.compute-1.AMAZONAWS.com."},
+		"192.0.2.2":   {"host.example.org.", "alias.s3.amazonaws.com."},
+		"2001:db8::1": {"v6.compute.amazonaws.com."},
+		"192.0.2.3":   {"host.example.org."},
+	})
+	r := parseRouting(t, `{"table": [
+  {"rules": {"rule": "ptr", "content": "\\.amazonaws\\.com$"}, "route": "aws"},
+  {"rules": {"rule": "true"}, "route": "other"}
+]}`)
+
+	// Names are matched in lower case without trailing dot, addresses match if any of their names matches
+	checkRoutes(t, r, "table", map[string]string{
+		"192.0.2.1:443":     "aws",
+		"192.0.2.2:443":     "aws",
+		"[2001:db8::1]:443": "aws",
+		"192.0.2.3:443":     "other",
+		"192.0.2.4:443":     "other",
+	})
+
+	// Hostnames are not looked up, they match no ptr rule
+	before := lookups.Load()
+	checkRoutes(t, r, "table", map[string]string{"ec2.amazonaws.com:443": "other"})
+	if lookups.Load() != before {
+		t.Error("hostname reverse looked up")
+	}
+
+	var negated rule
+	err := json.Unmarshal([]byte(`{"rule": "ptr", "content": "\\.amazonaws\\.com$", "negate": true}`), &negated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if matched, err := negated.evaluate("192.0.2.3:443", ""); err != nil || !matched {
+		t.Errorf("negated ptr rule did not match an address without matching name (%v)", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"rule": "ptr", "content": "("}`), &negated)
+	if err == nil {
+		t.Error("ptr rule with invalid regexp accepted")
+	}
+}
+
+func TestPTRCache(t *testing.T) {
+	setArg(t, &gArgPTRCacheTTL, 100*time.Millisecond)
+	lookups := setPTRRecords(t, map[string][]string{"192.0.2.1": {"host.example.org."}})
+
+	// Results, including failures, are looked up once per TTL
+	for i := 0; i < 3; i++ {
+		names, err := gPTRCache.lookup("192.0.2.1")
+		if err != nil || len(names) != 1 || names[0] != "host.example.org" {
+			t.Fatalf("lookup returned %v (%v)", names, err)
+		}
+		if _, err := gPTRCache.lookup("192.0.2.2"); err == nil {
+			t.Fatal("lookup of an address without PTR record succeeded")
+		}
+	}
+	if lookups.Load() != 2 {
+		t.Errorf("%v reverse lookups for 2 addresses", lookups.Load())
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	gPTRCache.lookup("192.0.2.1")
+	if lookups.Load() != 3 {
+		t.Errorf("expired result used")
+	}
+
+	// A TTL of 0 disables the cache
+	setArg(t, &gArgPTRCacheTTL, 0)
+	lookups = setPTRRecords(t, map[string][]string{"192.0.2.1": {"host.example.org."}})
+	gPTRCache.lookup("192.0.2.1")
+	gPTRCache.lookup("192.0.2.1")
+	if lookups.Load() != 2 {
+		t.Errorf("%v reverse lookups with the cache disabled instead of 2", lookups.Load())
+	}
+}
+
+func TestPTRTimeout(t *testing.T) {
+	setArg(t, &gArgPTRTimeout, 100*time.Millisecond)
+	setPTRRecords(t, nil)
+	setArg(t, &ptrLookup, func(ctx context.Context, addr string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	// Slow lookups are given up, the address does not match
+	var r rule
+	err := json.Unmarshal([]byte(`{"rule": "ptr", "content": "."}`), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	matched, err := r.evaluate("192.0.2.1:443", "")
+	if err != nil || matched {
+		t.Errorf("ptr rule evaluated to %v (%v) on a lookup timeout", matched, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("lookup given up after %v with a timeout of 100ms", elapsed)
+	}
+	if _, err := gPTRCache.lookup("192.0.2.1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lookup failure %v cached instead of the timeout", err)
+	}
+}
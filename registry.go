@@ -0,0 +1,179 @@
+package main
+
+// Defines the registry of active client connections, and the annotations attached to them during their lifetime
+
+import (
+	"cmp"
+	"context"
+	"maps"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// connInfo holds the description of an active client connection and the annotations attached to it by handlers
+type connInfo struct {
+	id          uint64
+	client      net.Addr  // address of the client
+	server      string    // address of the input server which accepted the connection
+	listener    string    // identity of the input server matched by listener rules: its label, or its address if it has none
+	start       time.Time // date at which the connection was accepted
+	annotations map[string]string
+	mu          sync.Mutex
+}
+
+// connRegistry is the type used to hold and access the active client connections
+type connRegistry struct {
+	conns  map[uint64]*connInfo
+	nextID uint64
+	mu     sync.RWMutex
+}
+
+var gConnRegistry = connRegistry{conns: make(map[uint64]*connInfo)}
+
+// connInfoKey is the context key under which the connInfo of a client connection is stored
+type connInfoKey struct{}
+
+// register adds the client connection accepted by server, identified by listener, to the registry and returns its connInfo
+func (r *connRegistry) register(client net.Conn, server string, listener string) *connInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.nextID++
+	info := &connInfo{
+		id:          r.nextID,
+		client:      client.RemoteAddr(),
+		server:      server,
+		listener:    listener,
+		start:       time.Now(),
+		annotations: make(map[string]string),
+	}
+	r.conns[info.id] = info
+
+	return info
+}
+
+// unregister removes the connection described by info from the registry, its annotations are discarded
+func (r *connRegistry) unregister(info *connInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, info.id)
+}
+
+// get returns the active connection of id id, if any
+func (r *connRegistry) get(id uint64) (*connInfo, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	info, ok := r.conns[id]
+	return info, ok
+}
+
+// list returns the active connections, sorted by id
+func (r *connRegistry) list() []*connInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	infos := slices.Collect(maps.Values(r.conns))
+	slices.SortFunc(infos, func(a, b *connInfo) int { return cmp.Compare(a.id, b.id) })
+	return infos
+}
+
+// total returns the number of connections registered since startup
+func (r *connRegistry) total() uint64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.nextID
+}
+
+// describe logs the active connections and their annotations
+func (r *connRegistry) describe() {
+	infos := r.list()
+	gMetaLogger.Infof("%v active connections, %v scans detected", len(infos), gScanDetector.alertCount())
+	for _, info := range infos {
+		gMetaLogger.Infof("connection %v from %v on %v since %v: %v", info.id, info.client, info.server, info.start.Format(time.DateTime), info.getAnnotations())
+	}
+}
+
+// countByServer returns the number of active connections accepted by each input server, keyed by server address
+func (r *connRegistry) countByServer() map[string]int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[string]int)
+	for _, info := range r.conns {
+		counts[info.server]++
+	}
+	return counts
+}
+
+// describeServerCounts logs the number of active connections of each server of the global servers configuration, and the totals
+func describeServerCounts() {
+	counts := gConnRegistry.countByServer()
+
+	gServerConf.mu.RLock()
+	defer gServerConf.mu.RUnlock()
+
+	running := 0
+	for _, s := range gServerConf.servers {
+		if s.running {
+			running++
+		}
+		gMetaLogger.Infof("server %v://%v (table %v, running: %v): %v active connections", s.prot, s.address(), s.table, s.running, counts[s.address()])
+	}
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	gMetaLogger.Infof("%v/%v servers running, %v active connections, %v connections since startup", running, len(gServerConf.servers), total, gConnRegistry.total())
+}
+
+// annotate attaches the annotation key=value to the connection, overriding any previous value of key
+func (c *connInfo) annotate(key string, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.annotations[key] = value
+}
+
+// getAnnotations returns a copy of the annotations attached to the connection
+func (c *connInfo) getAnnotations() map[string]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return maps.Clone(c.annotations)
+}
+
+// listenerOf returns the identity of the input server which accepted the connection whose connInfo is stored in ctx, or an empty string if there is none
+func listenerOf(ctx context.Context) string {
+	info, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return ""
+	}
+	return info.listener
+}
+
+// annotationOf returns the annotation key of the connection whose connInfo is stored in ctx, or an empty string if there is none
+func annotationOf(ctx context.Context, key string) string {
+	info, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return ""
+	}
+
+	info.mu.Lock()
+	defer info.mu.Unlock()
+
+	return info.annotations[key]
+}
+
+// annotateConn attaches the annotation key=value to the connection whose connInfo is stored in ctx, if any
+func annotateConn(ctx context.Context, key string, value string) {
+	info, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if ok {
+		info.annotate(key, value)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connOf returns the active connection of the registry whose client is the local address of conn, if any
+func connOf(conn net.Conn) (*connInfo, bool) {
+	for _, info := range gConnRegistry.list() {
+		if info.client.String() == conn.LocalAddr().String() {
+			return info, true
+		}
+	}
+	return nil, false
+}
+
+func TestAnnotateConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	info := gConnRegistry.register(server, "127.0.0.1:1080", "label")
+	defer gConnRegistry.unregister(info)
+	ctx := context.WithValue(context.Background(), connInfoKey{}, info)
+
+	annotateConn(ctx, "chain", "chain1")
+	annotateConn(ctx, "tag", "first")
+	annotateConn(ctx, "tag", "second")
+
+	if annotationOf(ctx, "chain") != "chain1" || annotationOf(ctx, "tag") != "second" {
+		t.Fatalf("unexpected annotations %v", info.getAnnotations())
+	}
+	if listenerOf(ctx) != "label" {
+		t.Fatalf("listener is %v instead of label", listenerOf(ctx))
+	}
+
+	// The annotations returned are a copy
+	info.getAnnotations()["chain"] = "modified"
+	if annotationOf(ctx, "chain") != "chain1" {
+		t.Fatal("annotations were modified through their copy")
+	}
+
+	got, ok := gConnRegistry.get(info.id)
+	if !ok || got.getAnnotations()["tag"] != "second" {
+		t.Fatal("annotations are not queryable from the registry")
+	}
+
+	// Contexts without connection are ignored
+	annotateConn(context.Background(), "chain", "chain2")
+	if annotationOf(context.Background(), "chain") != "" {
+		t.Fatal("annotation found without connection")
+	}
+}
+
+func TestLiveConnectionAnnotations(t *testing.T) {
+	echo := startEchoServer(t)
+	srv := startDirectServer(t)
+
+	conn, rep := socks5Connect(t, srv, echo)
+	if rep != 0 {
+		t.Fatalf("connection failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "annotated")
+
+	// The annotations of the handler are visible while the connection is relayed
+	info, ok := connOf(conn)
+	if !ok {
+		t.Fatal("live connection not found in the registry")
+	}
+	annotations := info.getAnnotations()
+	if annotations["target"] != echo || annotations["chain"] != "direct" || annotations["path"] == "" {
+		t.Fatalf("unexpected annotations %v of the live connection", annotations)
+	}
+	if info.server != srv {
+		t.Fatalf("connection registered for server %v instead of %v", info.server, srv)
+	}
+
+	// They are discarded along with the connection once it is closed
+	conn.Close()
+	waitFor(t, 2*time.Second, "the closed connection to be unregistered", func() bool {
+		_, ok := gConnRegistry.get(info.id)
+		return !ok
+	})
+}
+
+func TestDescribeServerCounts(t *testing.T) {
+	running := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table1")
+	stopped, err := newServerFromString("http://127.0.0.1:" + freePort(t) + ":table2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setServers(t, running, stopped)
+
+	// Two connections of the running server, one of the stopped one
+	for _, server := range []string{running.address(), running.address(), stopped.address()} {
+		client, conn := net.Pipe()
+		defer client.Close()
+		info := gConnRegistry.register(conn, server, "")
+		defer gConnRegistry.unregister(info)
+	}
+
+	counts := gConnRegistry.countByServer()
+	if counts[running.address()] != 2 || counts[stopped.address()] != 1 {
+		t.Fatalf("active connections by server %v", counts)
+	}
+
+	logs, _ := captureLogs(t)
+	describeServerCounts()
+	for _, line := range []string{
+		"server socks5://" + running.address() + " (table table1, running: true): 2 active connections",
+		"server http://" + stopped.address() + " (table table2, running: false): 1 active connections",
+		"1/2 servers running, ",
+	} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("%q not logged in %q", line, logs.String())
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+var gReusePortSupported bool = true
+
+// listenControl sets SO_REUSEADDR on listening sockets, so that a restarted server can bind again immediately,
+// and SO_REUSEPORT if -reuseport is set, so that several processes can share the same address
+func listenControl(network string, address string, c syscall.RawConn) error {
+	var sockErr error
+
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+		if sockErr == nil && gArgReusePortBool {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// setListenBacklog sets the maximum length of the queue of pending connections of l to backlog, by calling listen again on its socket,
+// which updates the backlog of listening sockets. The kernel caps it (e.g. to net.core.somaxconn on Linux).
+func setListenBacklog(l net.Listener, backlog int) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		err := fmt.Errorf("listener %v does not expose its socket", l.Addr())
+		return err
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = c.Control(func(fd uintptr) {
+		sockErr = syscall.Listen(int(fd), backlog)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
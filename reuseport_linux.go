@@ -0,0 +1,4 @@
+package main
+
+// soReusePort is the SO_REUSEPORT socket option, not defined by the syscall package on Linux
+const soReusePort = 0xf
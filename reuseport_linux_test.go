@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listeningSockets returns the number of IPv4 TCP sockets listening on port, read from /proc/net/tcp
+func listeningSockets(t *testing.T, port int) int {
+	t.Helper()
+
+	f, err := os.Open("/proc/net/tcp")
+	if err != nil {
+		t.Skipf("cannot list sockets: %v", err)
+	}
+	defer f.Close()
+
+	// Columns: sl local_address rem_address st ..., with addresses as hex IP:port and st 0A for LISTEN
+	count := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 3 && strings.HasSuffix(fields[1], fmt.Sprintf(":%04X", port)) && fields[3] == "0A" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestAcceptLoopsSockets(t *testing.T) {
+	setArg(t, &gArgReusePortBool, true)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+
+	for _, loops := range []int{1, 3} {
+		setArg(t, &gArgAcceptLoops, loops)
+		port, _ := strconv.Atoi(freePort(t))
+		s := startServer(t, fmt.Sprintf("socks5://127.0.0.1:%v:table", port))
+		if n := listeningSockets(t, port); n != loops {
+			t.Errorf("%v listening sockets with %v accept loops", n, loops)
+		}
+		s.stop()
+		if n := listeningSockets(t, port); n != 0 {
+			t.Errorf("%v listening sockets left once the server stopped", n)
+		}
+	}
+}
+
+// establishedConnections dials l up to n times without l accepting them, and returns how many connections were established,
+// connections being dropped by the kernel once the queue of pending connections of l is full
+func establishedConnections(t *testing.T, l net.Listener, n int) int {
+	t.Helper()
+
+	established := 0
+	for i := 0; i < n; i++ {
+		conn, err := net.DialTimeout("tcp", l.Addr().String(), 200*time.Millisecond)
+		if err != nil {
+			break
+		}
+		t.Cleanup(func() { conn.Close() })
+		established++
+	}
+	return established
+}
+
+func TestSetListenBacklog(t *testing.T) {
+	// With the system default backlog, connections queue up
+	l := listenTCP(t)
+	if n := establishedConnections(t, l, 10); n != 10 {
+		t.Fatalf("%v connections queued with the default backlog", n)
+	}
+
+	// With a backlog of 1, the queue is full after a couple of connections (the kernel queues backlog+1 connections)
+	l = listenTCP(t)
+	if err := setListenBacklog(l, 1); err != nil {
+		t.Fatal(err)
+	}
+	if n := establishedConnections(t, l, 10); n > 3 {
+		t.Errorf("%v connections queued with a backlog of 1", n)
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRebindAfterStop(t *testing.T) {
+	echo := startEchoServer(t)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+
+	srvString := "socks5://127.0.0.1:" + freePort(t) + ":table"
+	s := startServer(t, srvString)
+
+	// The connection accepted by the stopped server keeps using its port
+	conn, rep := socks5Connect(t, s.address(), echo)
+	if rep != 0 {
+		t.Fatalf("connection failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "before")
+	s.stop()
+
+	s = startServer(t, srvString)
+	conn2, rep := socks5Connect(t, s.address(), echo)
+	if rep != 0 {
+		t.Fatalf("connection through the restarted server failed with reply %v", rep)
+	}
+	checkEcho(t, conn2, "after")
+	checkEcho(t, conn, "still")
+}
+
+func TestNoReusePort(t *testing.T) {
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+	srvString := "socks5://127.0.0.1:" + freePort(t) + ":table"
+
+	// Without -reuseport, a second listener on the same address fails
+	startServer(t, srvString)
+	s, err := newServerFromString(srvString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound := make(chan error, 1)
+	go s.run(bound)
+	if <-bound == nil {
+		s.running = true
+		s.stop()
+		t.Fatal("second server listened on the same address without -reuseport")
+	}
+}
+
+func TestReusePortShared(t *testing.T) {
+	setArg(t, &gArgReusePortBool, true)
+	echo := startEchoServer(t)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+	srvString := "socks5://127.0.0.1:" + freePort(t) + ":table"
+
+	// With -reuseport, several servers share the address, the remaining one relays once the other stopped
+	s1 := startServer(t, srvString)
+	s2 := startServer(t, srvString)
+	s1.stop()
+
+	conn, rep := socks5Connect(t, s2.address(), echo)
+	if rep != 0 {
+		t.Fatalf("connection through the remaining server failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "shared")
+
+	l, err := net.Listen("tcp4", s2.address())
+	if err == nil {
+		l.Close()
+		t.Error("listener without SO_REUSEPORT bound the address shared with -reuseport")
+	}
+}
+
+func TestAcceptLoops(t *testing.T) {
+	setArg(t, &gArgReusePortBool, true)
+	setArg(t, &gArgAcceptLoops, 4)
+	setArg(t, &gArgListenBacklog, 128)
+	echo := startEchoServer(t)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+
+	// The connections are accepted whichever listening socket the kernel gives them to
+	s := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table")
+	for i := 0; i < 20; i++ {
+		conn, rep := socks5Connect(t, s.address(), echo)
+		if rep != 0 {
+			t.Fatalf("connection %v failed with reply %v", i, rep)
+		}
+		checkEcho(t, conn, "accept loops")
+		conn.Close()
+	}
+
+	// Stopping the server closes all its listening sockets
+	s.stop()
+	l, err := net.Listen("tcp4", s.address())
+	if err != nil {
+		t.Fatalf("address still bound once the server stopped: %v", err)
+	}
+	l.Close()
+}
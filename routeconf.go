@@ -5,17 +5,26 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"net"
+	"net/netip"
 	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 // routingConf is the type used to hold and access a routing configuration (defined in a file)
 type routingConf struct {
-	routing routing
-	valid   bool // whether the current configuration is valid
-	mu      sync.RWMutex
+	routing      routing
+	defaultRoute string                   // if not empty, route used when no block matches, at the end of the fallthrough routing tables
+	noMatch      map[string]*atomic.Int64 // number of destinations for which no block of each routing table matched, including fallthrough tables, since the configuration was loaded
+	valid        bool                     // whether the current configuration is valid
+	mu           sync.RWMutex
 }
 
 type routing map[string]routingTable
@@ -28,7 +37,10 @@ type ruleBlock struct {
 	Comment string
 	Rules   evaluater
 	Route   string
+	Rewrite string // if not empty, destination address (format host:port, host or port may be empty to keep the original one) replacing the original one
 	Disable bool
+	index   int           // index of the block in its routing table, including disabled blocks
+	matches *atomic.Int64 // number of destinations matched by the block since the configuration was loaded
 }
 
 // Maps the JSON fields described in README.md#Configuration##Routing JSON configuration
@@ -44,21 +56,27 @@ type rule struct {
 	Variable string
 	Content  string
 	Negate   bool
+	network  *net.IPNet     // network parsed from Content when the rule is loaded, for subnet rules
+	cidrs    *cidrSet       // subnets loaded from the file at Content when the rule is loaded, for cidrfile rules
+	domains  *domainSet     // domains loaded from the file at Content when the rule is loaded, for domainfile rules
+	ptr      *regexp.Regexp // regexp compiled from Content when the rule is loaded, for ptr rules
+	listener *regexp.Regexp // regexp compiled from Content when the rule is loaded, for listener rules
+	ports    []uint16       // ports of the service named by Content when the rule is loaded, for service rules
 }
 
-// An interface describing routing rule-ish objects that, given a destination address, return a decision (true or false).
+// An interface describing routing rule-ish objects that, given a destination address and the listener which received the connection, return a decision (true or false).
 // Rule and RuleCombo types implement the evaluater interface.
 type evaluater interface {
-	// evaluate reports whether the destination address string addr matches the criteria defined by the Evaluater
-	evaluate(addr string) (bool, error)
+	// evaluate reports whether the destination address string addr, requested through the server identified by listener, matches the criteria defined by the Evaluater
+	evaluate(addr string, listener string) (bool, error)
 }
 
-func (r rule) evaluate(addr string) (bool, error) {
+func (r rule) evaluate(addr string, listener string) (bool, error) {
 
+	// Destinations without port are matched as a host with an empty port, only rules using the port fail on them
 	host, port, err := net.SplitHostPort(addr)
 	if err != nil {
-		err = fmt.Errorf("error spliting host and port : %v", err)
-		return true, err
+		host, port = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), ""
 	}
 
 	switch r.Rule {
@@ -68,6 +86,10 @@ func (r rule) evaluate(addr string) (bool, error) {
 		case "host":
 			variable = host
 		case "port":
+			if port == "" {
+				err = fmt.Errorf("destination %v has no port", addr)
+				return true, err
+			}
 			variable = port
 		case "addr":
 			variable = addr
@@ -84,22 +106,91 @@ func (r rule) evaluate(addr string) (bool, error) {
 		return (r.Negate != matched), nil
 
 	case "subnet":
-		hostIPv4 := net.ParseIP(host).To4()
-		if hostIPv4 == nil {
-			//host is not an IPv4 representation
+		hostIP := net.ParseIP(host)
+		if hostIP == nil {
+			//host is not an IP address representation
 			return false, nil
 		}
-		_, network, err := net.ParseCIDR(r.Content)
-		if err != nil {
-			err = fmt.Errorf("error parsing CIDR : %v", err)
+		if r.network == nil {
+			err = fmt.Errorf("subnet rule %v was not loaded", r.Content)
 			return true, err
 		}
 
-		inSubnet := network.Contains(hostIPv4)
+		// IPv4 addresses only match IPv4 subnets, and IPv6 addresses IPv6 subnets
+		inSubnet := r.network.Contains(hostIP)
 		return (r.Negate != inSubnet), nil
 
-	case "true":
-		return true, nil
+	case "cidrfile":
+		ip, err := netip.ParseAddr(host)
+		if err != nil {
+			//host is not an IP address representation
+			return false, nil
+		}
+		if r.cidrs == nil {
+			err = fmt.Errorf("cidrfile rule %v was not loaded", r.Content)
+			return true, err
+		}
+
+		inSet := r.cidrs.contains(ip)
+		return (r.Negate != inSet), nil
+
+	case "domainfile":
+		if net.ParseIP(host) != nil {
+			//host is an IP address representation
+			return false, nil
+		}
+		if r.domains == nil {
+			err = fmt.Errorf("domainfile rule %v was not loaded", r.Content)
+			return true, err
+		}
+
+		inSet := r.domains.contains(host)
+		return (r.Negate != inSet), nil
+
+	case "ptr":
+		if net.ParseIP(host) == nil {
+			//host is not an IP address representation
+			return false, nil
+		}
+		if r.ptr == nil {
+			err = fmt.Errorf("ptr rule %v was not loaded", r.Content)
+			return true, err
+		}
+
+		// Addresses without PTR record, or whose lookup fails, do not match
+		names, err := gPTRCache.lookup(host)
+		if err != nil {
+			gMetaLogger.Debugf("ptr rule %v does not match %v: %v", r.Content, host, err)
+		}
+		matched := slices.ContainsFunc(names, r.ptr.MatchString)
+		return (r.Negate != matched), nil
+
+	case "listener":
+		if r.listener == nil {
+			err = fmt.Errorf("listener rule %v was not loaded", r.Content)
+			return true, err
+		}
+
+		matched := r.listener.MatchString(listener)
+		return (r.Negate != matched), nil
+
+	case "service":
+		if port == "" {
+			err = fmt.Errorf("destination %v has no port", addr)
+			return true, err
+		}
+
+		// Ports not classified as the service, including ports of no service, do not match
+		portNumber, _ := strconv.ParseUint(port, 10, 16)
+		matched := slices.Contains(r.ports, uint16(portNumber))
+		return (r.Negate != matched), nil
+
+	case "true", "any":
+		return !r.Negate, nil
+
+	case "ref":
+		err = fmt.Errorf("unresolved reference to rule definition %v", r.Content)
+		return true, err
 
 	default:
 		err = fmt.Errorf("unknown rule type : %v", r.Rule)
@@ -108,14 +199,14 @@ func (r rule) evaluate(addr string) (bool, error) {
 
 }
 
-func (r ruleCombo) evaluate(addr string) (bool, error) {
+func (r ruleCombo) evaluate(addr string, listener string) (bool, error) {
 
-	r1, err := r.Rule1.evaluate(addr)
+	r1, err := r.Rule1.evaluate(addr, listener)
 	if err != nil {
 		err = fmt.Errorf("error evaluating rule 1 %v : %v", r.Rule1, err)
 		return true, err
 	}
-	r2, err := r.Rule2.evaluate(addr)
+	r2, err := r.Rule2.evaluate(addr, listener)
 	if err != nil {
 		err = fmt.Errorf("error evaluating rule 2 %v : %v", r.Rule2, err)
 		return true, err
@@ -132,6 +223,85 @@ func (r ruleCombo) evaluate(addr string) (bool, error) {
 	}
 }
 
+// Custom JSON unmarshaller describing how to parse a Rule type. The content of subnet rules is parsed once, and the file of cidrfile and domainfile rules read once on each configuration loading,
+// so that invalid CIDRs make the configuration loading fail.
+func (r *rule) UnmarshalJSON(b []byte) error {
+	type tmpRule rule
+
+	var tmp tmpRule
+
+	err := decodeJSON(b, &tmp)
+	if err != nil {
+		err = fmt.Errorf("error unmarshalling '%s' in tmpRule : %v", b, err)
+		return err
+	}
+
+	*r = rule(tmp)
+
+	if !slices.Contains(ruleTypes, r.Rule) {
+		err = fmt.Errorf("unknown rule type '%v', must be one of %v", r.Rule, strings.Join(ruleTypes, ", "))
+		return err
+	}
+
+	if r.Rule == "subnet" {
+		_, network, err := net.ParseCIDR(r.Content)
+		if err != nil {
+			err = fmt.Errorf("error parsing CIDR of subnet rule : %v", err)
+			return err
+		}
+		r.network = network
+	}
+
+	if r.Rule == "ptr" {
+		ptr, err := regexp.Compile(r.Content)
+		if err != nil {
+			err = fmt.Errorf("error compiling regexp of ptr rule : %v", err)
+			return err
+		}
+		r.ptr = ptr
+	}
+
+	if r.Rule == "listener" {
+		listener, err := regexp.Compile(r.Content)
+		if err != nil {
+			err = fmt.Errorf("error compiling regexp of listener rule : %v", err)
+			return err
+		}
+		r.listener = listener
+	}
+
+	if r.Rule == "service" {
+		ports, ok := gServices[strings.ToLower(r.Content)]
+		if !ok {
+			err = fmt.Errorf("unknown service %v of service rule, not defined in the services section nor built in", r.Content)
+			return err
+		}
+		r.ports = ports
+	}
+
+	if r.Rule == "cidrfile" {
+		cidrs, err := loadCIDRFile(r.Content)
+		if err != nil {
+			err = fmt.Errorf("error loading subnets of cidrfile rule : %v", err)
+			return err
+		}
+		gMetaLogger.Debugf("loaded %v subnet ranges from %v", cidrs.size(), r.Content)
+		r.cidrs = cidrs
+	}
+
+	if r.Rule == "domainfile" {
+		domains, err := loadDomainFile(r.Content)
+		if err != nil {
+			err = fmt.Errorf("error loading domains of domainfile rule : %v", err)
+			return err
+		}
+		gMetaLogger.Debugf("loaded %v domains from %v", domains.size(), r.Content)
+		r.domains = domains
+	}
+
+	return nil
+}
+
 // Custom JSON unmarshaller describing how to parse a RuleCombo type
 func (rCombo *ruleCombo) UnmarshalJSON(b []byte) error {
 	type tmpRuleCombo struct {
@@ -142,9 +312,7 @@ func (rCombo *ruleCombo) UnmarshalJSON(b []byte) error {
 
 	var tmp tmpRuleCombo
 
-	dec := json.NewDecoder(bytes.NewReader(b))
-	dec.DisallowUnknownFields()
-	err := dec.Decode(&tmp)
+	err := decodeJSON(b, &tmp)
 	if err != nil {
 		err = fmt.Errorf("error unmarshalling '%s' in TmpRuleCombo : %v", b, err)
 		return err
@@ -152,57 +320,73 @@ func (rCombo *ruleCombo) UnmarshalJSON(b []byte) error {
 
 	rCombo.Op = tmp.Op
 
-	//Try to unmarshal Rule1 rawmessage into a Rule, if it fails, try into a RuleCombo
-	var rule1 rule
-
-	dec = json.NewDecoder(bytes.NewReader(tmp.Rule1))
-	dec.DisallowUnknownFields()
-	err = dec.Decode(&rule1)
-	if err == nil {
-		//Rule1 is a Rule
-		rCombo.Rule1 = rule1
-	} else {
-		//Rule1 is not a Rule, try to unmarshal it into a RuleCombo
-		var rc ruleCombo
+	rCombo.Rule1, err = decodeEvaluater(tmp.Rule1)
+	if err != nil {
+		err = fmt.Errorf("error unmarshalling rule1 : %w", err)
+		return err
+	}
 
-		dec = json.NewDecoder(bytes.NewReader(tmp.Rule1))
-		dec.DisallowUnknownFields()
-		err2 := dec.Decode(&rc)
-		if err2 != nil {
-			//Rule1 is not a RuleCombo nor a Rule, return an error
-			err = fmt.Errorf("error unmarshalling into Rule (%v) and into RuleCombo (%v)", err, err2)
-			return err
+	rCombo.Rule2, err = decodeEvaluater(tmp.Rule2)
+	if err != nil {
+		err = fmt.Errorf("error unmarshalling rule2 : %w", err)
+		return err
+	}
+
+	return nil
+}
+
+// errEmptyRules is the error of the decoding of a missing, null or empty ({}) Rule or RuleCombo
+var errEmptyRules = errors.New("empty rules")
+
+// ruleTypes are the types of rules, as given in their rule field
+var ruleTypes = []string{"regexp", "subnet", "cidrfile", "domainfile", "ptr", "listener", "service", "true", "any", "ref"}
+
+// decodeEvaluater decodes b into a RuleCombo if it has a rule1, op or rule2 field, and into a Rule otherwise.
+// Malformed shapes are reported explicitly: empty rules, combos without op or without both operands, and rules without rule field.
+func decodeEvaluater(b []byte) (evaluater, error) {
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) == 0 || string(trimmed) == "null" {
+		return nil, errEmptyRules
+	}
+
+	var object map[string]json.RawMessage
+	err := json.Unmarshal(b, &object)
+	if err != nil {
+		err = fmt.Errorf("rules '%s' must be a Rule or RuleCombo object : %v", b, err)
+		return nil, err
+	}
+	if len(object) == 0 {
+		return nil, errEmptyRules
+	}
+
+	fields := make(map[string]bool)
+	for key := range object {
+		fields[strings.ToLower(key)] = true
+	}
+
+	if fields["rule1"] || fields["op"] || fields["rule2"] {
+		if !fields["op"] {
+			err = fmt.Errorf("missing op in RuleCombo '%s'", b)
+			return nil, err
 		}
-		//Rule1 is a RuleCombo
-		rCombo.Rule1 = rc
-	}
-
-	//Try to unmarshal Rule1 rawmessage into a Rule, if it fails, try into a RuleCombo
-	var rule2 rule
-
-	dec = json.NewDecoder(bytes.NewReader(tmp.Rule2))
-	dec.DisallowUnknownFields()
-	err = dec.Decode(&rule2)
-	if err == nil {
-		//Rule2 is a Rule
-		rCombo.Rule2 = rule2
-	} else {
-		//Rule1 is not a Rule, try to unmarshal it into a RuleCombo
-		var rc2 ruleCombo
-
-		dec = json.NewDecoder(bytes.NewReader(tmp.Rule2))
-		dec.DisallowUnknownFields()
-		err2 := dec.Decode(&rc2)
-		if err2 != nil {
-			//Rule2 is not a RuleCombo nor a Rule, return an error
-			err = fmt.Errorf("error unmarshalling into Rule (%v) and into RuleCombo (%v)", err, err2)
-			return err
+		if !fields["rule1"] || !fields["rule2"] {
+			err = fmt.Errorf("missing rule1 or rule2 operand in RuleCombo '%s'", b)
+			return nil, err
 		}
-		//Rule2 is a RuleCombo
-		rCombo.Rule2 = rc2
+
+		var rc ruleCombo
+		err = decodeJSON(b, &rc)
+		return rc, err
 	}
 
-	return nil
+	if !fields["rule"] {
+		err = fmt.Errorf("missing rule field (one of %v) in Rule '%s', or rule1, op and rule2 fields of a RuleCombo", strings.Join(ruleTypes, ", "), b)
+		return nil, err
+	}
+
+	var r rule
+	err = decodeJSON(b, &r)
+	return r, err
 }
 
 // Custom JSON unmarshaller describing how to parse a RuleBlock type
@@ -211,14 +395,13 @@ func (rBlock *ruleBlock) UnmarshalJSON(b []byte) error {
 		Comment string
 		Rules   json.RawMessage
 		Route   string
+		Rewrite string
 		Disable bool
 	}
 
 	var tmp tmpBlock
 
-	dec := json.NewDecoder(bytes.NewReader(b))
-	dec.DisallowUnknownFields()
-	err := dec.Decode(&tmp)
+	err := decodeJSON(b, &tmp)
 	if err != nil {
 		err = fmt.Errorf("error unmarshalling '%s' in TmpBlock : %v", b, err)
 		return err
@@ -226,53 +409,160 @@ func (rBlock *ruleBlock) UnmarshalJSON(b []byte) error {
 
 	rBlock.Comment = tmp.Comment
 	rBlock.Route = tmp.Route
+	rBlock.Rewrite = tmp.Rewrite
 	rBlock.Disable = tmp.Disable
+	rBlock.matches = new(atomic.Int64)
 
-	//Try to unmarshal Rules rawmessage into a Rule, if it fails, try into a RuleCombo
-	var rule rule
-
-	dec = json.NewDecoder(bytes.NewReader(tmp.Rules))
-	dec.DisallowUnknownFields()
-	err = dec.Decode(&rule)
-	if err == nil {
-		//Rules is a Rule
-		rBlock.Rules = rule
-	} else {
-		//Rules is not a Rule, try to unmarshal it into a RuleCombo
-		var rc ruleCombo
+	if rBlock.Rewrite != "" {
+		_, err = rewriteAddress("0.0.0.0:0", rBlock.Rewrite)
+		if err != nil {
+			err = fmt.Errorf("invalid rewrite '%v' : %v", rBlock.Rewrite, err)
+			return err
+		}
+	}
 
-		dec = json.NewDecoder(bytes.NewReader(tmp.Rules))
-		dec.DisallowUnknownFields()
-		err2 := dec.Decode(&rc)
-		if err2 != nil {
-			//Rules is not a RuleCombo nor a Rule, return an error
-			err = fmt.Errorf("error unmarshalling into Rule (%v) and into RuleCombo (%v)", err, err2)
+	rBlock.Rules, err = decodeEvaluater(tmp.Rules)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// ruleDefs maps names to reusable rule definitions (Rule or RuleCombo), referenced in rule blocks by rules of type "ref"
+type ruleDefs map[string]evaluater
+
+// Custom JSON unmarshaller describing how to parse a ruleDefs type
+func (defs *ruleDefs) UnmarshalJSON(b []byte) error {
+	var tmp map[string]json.RawMessage
+
+	err := json.Unmarshal(b, &tmp)
+	if err != nil {
+		err = fmt.Errorf("error unmarshalling '%s' in map[string]json.RawMessage : %v", b, err)
+		return err
+	}
+
+	*defs = make(ruleDefs)
+	for name, raw := range tmp {
+
+		(*defs)[name], err = decodeEvaluater(raw)
+		if err != nil {
+			err = fmt.Errorf("error unmarshalling rule definition %v : %v", name, err)
 			return err
 		}
-		//Rules is a RuleCombo
-		rBlock.Rules = rc
+	}
+
+	return nil
+}
+
+// resolve returns e where rules of type "ref" are recursively replaced by the rule definitions they reference.
+// path holds the definitions being resolved, to detect cyclic references.
+func (defs ruleDefs) resolve(e evaluater, path []string) (evaluater, error) {
+	switch r := e.(type) {
+	case rule:
+		if r.Rule != "ref" {
+			return r, nil
+		}
+
+		if slices.Contains(path, r.Content) {
+			err := fmt.Errorf("cyclic rule definition reference %v", strings.Join(append(path, r.Content), " -> "))
+			return nil, err
+		}
+
+		def, ok := defs[r.Content]
+		if !ok {
+			err := fmt.Errorf("rule definition %v is not defined in ruledefs section", r.Content)
+			return nil, err
+		}
+		if r.Negate {
+			err := fmt.Errorf("reference to rule definition %v cannot be negated", r.Content)
+			return nil, err
+		}
+
+		return defs.resolve(def, append(slices.Clone(path), r.Content))
+
+	case ruleCombo:
+		var err error
+		r.Rule1, err = defs.resolve(r.Rule1, path)
+		if err != nil {
+			return nil, err
+		}
+		r.Rule2, err = defs.resolve(r.Rule2, path)
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+
+	default:
+		return e, nil
+	}
+}
+
+// resolveRefs replaces the references to rule definitions in all the rule blocks of all the routing tables of r by the definitions of defs
+func (r routing) resolveRefs(defs ruleDefs) error {
+	for tableName, table := range r {
+		for index := range table {
+			rules, err := defs.resolve(table[index].Rules, nil)
+			if err != nil {
+				err = fmt.Errorf("error resolving rules of ruleBlock number %v of routingTable %v : %v", index, tableName, err)
+				return err
+			}
+			table[index].Rules = rules
+		}
 	}
 	return nil
 }
 
-// Custom JSON unmarshaller describing how to parse a routingTable type
+// routingTableObject maps the object form of a routing table, which can be disabled as a whole: {"comment": "...", "disable": true, "blocks": [...]}
+type routingTableObject struct {
+	Comment string
+	Disable bool
+	Blocks  routingTable
+}
+
+// isObject reports whether the JSON value b is an object
+func isObject(b []byte) bool {
+	trimmed := bytes.TrimSpace(b)
+	return len(trimmed) != 0 && trimmed[0] == '{'
+}
+
+// tableDisabled reports whether the routing table b is in object form and disabled
+func tableDisabled(b []byte) bool {
+	var tmp struct{ Disable bool }
+	return isObject(b) && json.Unmarshal(b, &tmp) == nil && tmp.Disable
+}
+
+// Custom JSON unmarshaller describing how to parse a routingTable type, from an array of blocks or from a routingTableObject.
+// The blocks of disabled tables are parsed as well, so that they stay valid.
 func (rTable *routingTable) UnmarshalJSON(b []byte) error {
 
-	// First, parse all the blocks in the table
-	type tmpTable []ruleBlock
+	if isObject(b) {
+		var object routingTableObject
+		err := decodeJSON(b, &object)
+		if err != nil {
+			return err
+		}
+		*rTable = object.Blocks
+		return nil
+	}
 
-	var tmp tmpTable
+	// First, parse all the blocks in the table, one by one so that errors name the failing block
+	var tmp []json.RawMessage
 
-	dec := json.NewDecoder(bytes.NewReader(b))
-	dec.DisallowUnknownFields()
-	err := dec.Decode(&tmp)
+	err := decodeJSON(b, &tmp)
 	if err != nil {
-		err = fmt.Errorf("error unmarshalling '%s' in tmpTable : %v", b, err)
+		err = fmt.Errorf("error unmarshalling '%s' in []json.RawMessage : %v", b, err)
 		return err
 	}
 
-	// Then, only keep the blocks that are not disabled (with the '"disable": true' json field)
-	for _, block := range tmp {
+	for index, raw := range tmp {
+		var block ruleBlock
+		err = decodeJSON(raw, &block)
+		if err != nil {
+			return &ruleBlockError{index: index, err: err}
+		}
+
+		// Then, only keep the blocks that are not disabled (with the '"disable": true' json field)
+		block.index = index
 		if !block.Disable {
 			*rTable = append(*rTable, block)
 		}
@@ -281,20 +571,196 @@ func (rTable *routingTable) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
-// getRoute returns in route the chain to use for a given destination address string addr.
+// ruleBlockError is the error of the unmarshalling of a rule block, locating it in the routes section
+type ruleBlockError struct {
+	table string // name of the routing table, empty if unknown
+	index int    // index of the block in the routing table, including disabled blocks
+	err   error
+}
+
+func (e *ruleBlockError) Error() string {
+	if e.err == errEmptyRules {
+		return fmt.Sprintf("ruleBlock number %v of routingTable %v has empty rules", e.index, e.table)
+	}
+	return fmt.Sprintf("error unmarshalling ruleBlock number %v of routingTable %v : %v", e.index, e.table, e.err)
+}
+
+func (e *ruleBlockError) Unwrap() error {
+	return e.err
+}
+
+// Custom JSON unmarshaller describing how to parse a routing type, table by table so that errors name the failing routing table
+func (r *routing) UnmarshalJSON(b []byte) error {
+	var tmp map[string]json.RawMessage
+
+	err := decodeJSON(b, &tmp)
+	if err != nil {
+		err = fmt.Errorf("error unmarshalling '%s' in map[string]json.RawMessage : %v", b, err)
+		return err
+	}
+
+	*r = make(routing)
+	for _, name := range slices.Sorted(maps.Keys(tmp)) {
+		// Disabled tables are left out, after checking them
+		disabled := tableDisabled(tmp[name])
+
+		var table routingTable
+		err = decodeJSON(tmp[name], &table)
+		if err != nil {
+			var blockErr *ruleBlockError
+			if errors.As(err, &blockErr) {
+				blockErr.table = name
+				return blockErr
+			}
+			err = fmt.Errorf("error unmarshalling routingTable %v : %v", name, err)
+			return err
+		}
+		if !disabled {
+			(*r)[name] = table
+		}
+	}
+
+	return nil
+}
+
+// isSpecialRoute reports whether route is a reserved route name, handled by the input servers instead of corresponding to a chain.
+// "reject" refuses the connection with a protocol-level error, "drop" closes it without any reply (blackhole),
+// "tarpit" holds the connection open without data before closing it.
+func isSpecialRoute(route string) bool {
+	switch route {
+	case "reject", "drop", "tarpit":
+		return true
+	default:
+		return false
+	}
+}
+
+// getRoute returns in route the chain to use for a given destination address string addr requested through the server identified by listener, and in rewrite the destination rewrite of the matching block, if any.
 // For each RuleBlock of the routing table, it evaluates addr against the rules and stops at the first evaluation returning true.
-func (table routingTable) getRoute(addr string) (route string, err error) {
+// Evaluation errors are handled according to -route-error-policy: the block is considered as not matching (skip),
+// the evaluation fails (drop), or -route-error-default is returned (default).
+func (table routingTable) getRoute(addr string, listener string) (route string, rewrite string, err error) {
 	for _, rBlock := range table {
-		matched, err := rBlock.Rules.evaluate(addr)
+		matched, err := rBlock.Rules.evaluate(addr, listener)
 		if err != nil {
 			err = fmt.Errorf("error evaluating %v : %v", rBlock.Rules, err)
-			return "", err
+			switch gArgRouteErrorPolicy {
+			case "skip":
+				gMetaLogger.Errorf("skipping ruleBlock %v for address %v: %v", rBlock.Comment, addr, err)
+				continue
+			case "default":
+				gMetaLogger.Errorf("using route %v for address %v: %v", gArgRouteErrorDefault, addr, err)
+				return gArgRouteErrorDefault, "", nil
+			default:
+				return "", "", err
+			}
 		}
 		if matched {
+			rBlock.matches.Add(1)
 			gMetaLogger.Debugf("ruleBlock %v matched for address %v, using route %v", rBlock.Comment, addr, rBlock.Route)
-			return rBlock.Route, nil
+			return rBlock.Route, rBlock.Rewrite, nil
+		}
+	}
+	err = fmt.Errorf("%w for %v", errNoBlockMatched, addr)
+	return "", "", err
+}
+
+// errNoBlockMatched is returned by getRoute when all the blocks of a routing table evaluated to false
+var errNoBlockMatched = errors.New("all blocks evaluated to false")
+
+// tableRoutePrefix is the prefix of routes continuing the evaluation in another routing table (fallthrough), e.g. "table:table2"
+const tableRoutePrefix = "table:"
+
+// getRoute returns the chain and the destination rewrite to use for a given destination address string addr requested through the server identified by listener, starting with routing table tableName.
+// If the matching block's route is a fallthrough route, the evaluation continues in the referenced routing table.
+// noMatch holds the counters of the destinations for which no block matched, by routing table (see newNoMatchCounters), nil if they are not counted.
+// path holds the routing tables already evaluated, to detect fallthrough loops.
+func (r routing) getRoute(tableName string, addr string, listener string, noMatch map[string]*atomic.Int64, path []string) (route string, rewrite string, err error) {
+	if slices.Contains(path, tableName) {
+		err = fmt.Errorf("routing table loop %v", strings.Join(append(path, tableName), " -> "))
+		return "", "", err
+	}
+
+	table, ok := r[tableName]
+	if !ok {
+		err = fmt.Errorf("table %v not defined in routing configuration", tableName)
+		return "", "", err
+	}
+
+	route, rewrite, err = table.getRoute(addr, listener)
+	if err != nil {
+		// The routing table in which no block matched is counted, whether evaluation started in it or fell through to it
+		if counter, ok := noMatch[tableName]; ok && errors.Is(err, errNoBlockMatched) {
+			counter.Add(1)
 		}
+		return "", "", err
 	}
-	err = fmt.Errorf("all blocks evaluated to false for %v", addr)
-	return "", err
+
+	next, ok := strings.CutPrefix(route, tableRoutePrefix)
+	if ok {
+		gMetaLogger.Debugf("routing table %v falls through to routing table %v for address %v", tableName, next, addr)
+		return r.getRoute(next, addr, listener, noMatch, append(slices.Clone(path), tableName))
+	}
+
+	return route, rewrite, nil
+}
+
+// getRouteFor returns the route and the destination rewrite to use for the destination address addr requested through the server identified by listener (see listenerOf),
+// with the PAC script if -pac is defined, and with routing table table otherwise. PAC scripts do not support destination rewrites nor listener identities.
+func getRouteFor(table string, addr string, listener string) (string, string, error) {
+	// Destinations of the bypass list are connected to directly, whatever the PAC script or the routing tables decide
+	if bypassed(addr) {
+		return bypassRoute, "", nil
+	}
+
+	if gArgPACPath != "" {
+		route, err := getRouteWithPAC(addr)
+		return route, "", err
+	}
+
+	gRoutingConf.mu.RLock()
+	defer gRoutingConf.mu.RUnlock()
+
+	// The defaultRoute of the configuration applies when no block matches, after the fallthrough routing tables
+	route, rewrite, err := gRoutingConf.routing.getRoute(table, addr, listener, gRoutingConf.noMatch, nil)
+	if errors.Is(err, errNoBlockMatched) && gRoutingConf.defaultRoute != "" {
+		gMetaLogger.Debugf("no block matched for address %v, using default route %v", addr, gRoutingConf.defaultRoute)
+		return gRoutingConf.defaultRoute, "", nil
+	}
+	return route, rewrite, err
+}
+
+// rewriteAddress returns the destination address string addr (format host:port) rewritten according to rewrite (format host:port).
+// An empty host or port in rewrite keeps the one of addr. The rewritten address is not routed again, so rewrites cannot loop.
+func rewriteAddress(addr string, rewrite string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		err = fmt.Errorf("error spliting host and port of %v : %v", addr, err)
+		return "", err
+	}
+
+	newHost, newPort, err := net.SplitHostPort(rewrite)
+	if err != nil {
+		err = fmt.Errorf("error spliting host and port of %v : %v", rewrite, err)
+		return "", err
+	}
+
+	if newHost == "" && newPort == "" {
+		err = fmt.Errorf("rewrite %v defines neither a host nor a port", rewrite)
+		return "", err
+	}
+
+	if newHost != "" {
+		host = newHost
+	}
+	if newPort != "" {
+		_, err = strconv.ParseUint(newPort, 10, 16)
+		if err != nil {
+			err = fmt.Errorf("invalid port %v : %v", newPort, err)
+			return "", err
+		}
+		port = newPort
+	}
+
+	return net.JoinHostPort(host, port), nil
 }
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRewriteAddress(t *testing.T) {
+	tests := []struct {
+		addr, rewrite, expected string
+	}{
+		{"192.0.2.1:80", "10.0.0.1:8080", "10.0.0.1:8080"},
+		{"192.0.2.1:80", "10.0.0.1:", "10.0.0.1:80"},
+		{"192.0.2.1:80", ":8080", "192.0.2.1:8080"},
+		{"example.com:443", "gateway.internal:", "gateway.internal:443"},
+		{"[2001:db8::1]:80", "[2001:db8::2]:", "[2001:db8::2]:80"},
+	}
+	for _, test := range tests {
+		rewritten, err := rewriteAddress(test.addr, test.rewrite)
+		if err != nil || rewritten != test.expected {
+			t.Errorf("rewriteAddress(%v, %v) = %v, %v instead of %v", test.addr, test.rewrite, rewritten, err, test.expected)
+		}
+	}
+
+	for _, rewrite := range []string{":", "10.0.0.1", ":99999", "10.0.0.1:http"} {
+		_, err := rewriteAddress("192.0.2.1:80", rewrite)
+		if err == nil {
+			t.Errorf("invalid rewrite %v accepted", rewrite)
+		}
+	}
+}
+
+func TestRoutingRewriteValidation(t *testing.T) {
+	var r routing
+	err := json.Unmarshal([]byte(`{"table": [{"rules": {"rule": "true"}, "route": "direct", "rewrite": "10.0.0.1"}]}`), &r)
+	if err == nil {
+		t.Fatal("block with an invalid rewrite accepted")
+	}
+}
+
+func TestRewriteRoute(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startEchoServer(t)
+	_, echoPort, _ := net.SplitHostPort(echo)
+
+	// The second block would match the rewritten destination, which is not routed again
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [
+  {"rules": {"rule": "subnet", "content": "192.0.2.0/24"}, "route": "direct", "rewrite": "127.0.0.1:`+echoPort+`"},
+  {"rules": {"rule": "subnet", "content": "127.0.0.0/8"}, "route": "reject", "rewrite": "127.0.0.2:1"}
+]}`, "")
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table")
+
+	conn, rep := socks5Connect(t, srv.address(), "192.0.2.1:80")
+	if rep != 0 {
+		t.Fatalf("connection to the rewritten destination failed with reply %v", rep)
+	}
+	checkEcho(t, conn, "rewritten")
+
+	// Both the original and the rewritten destinations are audited
+	found := false
+	for _, event := range auditEvents(t, audit) {
+		if event.Event == "REWRITE" {
+			found = true
+			if event.Dest != "192.0.2.1:80" || event.Detail != echo {
+				t.Fatalf("REWRITE trace of %v to %v instead of 192.0.2.1:80 to %v", event.Dest, event.Detail, echo)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("no REWRITE audit trace")
+	}
+}
+
+// parseConfig parses the configuration config as the configuration file
+func parseConfig(t *testing.T, config string) (mainConfig, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "bbs.json")
+	err := os.WriteFile(path, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parseMainConfig(path)
+}
+
+// checkRoutes checks that the destinations of expected are routed to their route by routing table table of r
+func checkRoutes(t *testing.T, r routing, table string, expected map[string]string) {
+	t.Helper()
+
+	for addr, expectedRoute := range expected {
+		route, _, err := r.getRoute(table, addr, "", nil, nil)
+		if err != nil {
+			t.Errorf("error routing %v: %v", addr, err)
+		} else if route != expectedRoute {
+			t.Errorf("%v routed to %v instead of %v", addr, route, expectedRoute)
+		}
+	}
+}
+
+func TestRuleDefsReferences(t *testing.T) {
+	config, err := parseConfig(t, `{
+  "ruledefs": {
+    "internal-nets": {"rule1": {"rule": "subnet", "content": "10.0.0.0/8"}, "op": "OR", "rule2": {"rule": "ref", "content": "lab-net"}},
+    "lab-net": {"rule": "subnet", "content": "192.168.0.0/16"},
+    "web": {"rule": "regexp", "variable": "port", "content": "^(80|443)$"}
+  },
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [
+    {"rules": {"rule1": {"rule": "ref", "content": "internal-nets"}, "op": "AND", "rule2": {"rule": "ref", "content": "web"}}, "route": "direct"},
+    {"rules": {"rule": "ref", "content": "internal-nets"}, "route": "reject"},
+    {"rules": {"rule": "true"}, "route": "drop"}
+  ]}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRoutes(t, config.Routes, "table", map[string]string{
+		"10.1.2.3:443":     "direct",
+		"192.168.1.1:80":   "direct",
+		"10.1.2.3:22":      "reject",
+		"192.168.1.1:22":   "reject",
+		"198.51.100.1:443": "drop",
+	})
+}
+
+func TestRuleDefsInvalidReferences(t *testing.T) {
+	tests := map[string]string{
+		"undefined": `{"routes": {"table": [{"rules": {"rule": "ref", "content": "missing"}, "route": "drop"}]}}`,
+		"cyclic": `{"ruledefs": {"a": {"rule": "ref", "content": "b"}, "b": {"rule": "ref", "content": "a"}},
+  "routes": {"table": [{"rules": {"rule": "ref", "content": "a"}, "route": "drop"}]}}`,
+		"negated": `{"ruledefs": {"a": {"rule": "true"}},
+  "routes": {"table": [{"rules": {"rule": "ref", "content": "a", "negate": true}, "route": "drop"}]}}`,
+	}
+	expected := map[string]string{
+		"undefined": "rule definition missing is not defined",
+		"cyclic":    "cyclic rule definition reference a -> b -> a",
+		"negated":   "cannot be negated",
+	}
+
+	for name, config := range tests {
+		_, err := parseConfig(t, config)
+		if err == nil || !strings.Contains(err.Error(), expected[name]) {
+			t.Errorf("%v reference: configuration not rejected as expected: %v", name, err)
+		}
+	}
+}
+
+func TestFallthroughTables(t *testing.T) {
+	r := parseRouting(t, `{
+  "table1": [
+    {"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain1"},
+    {"rules": {"rule": "true"}, "route": "table:table2"}
+  ],
+  "table2": [
+    {"rules": {"rule": "subnet", "content": "192.168.0.0/16"}, "route": "chain2", "rewrite": ":8080"},
+    {"rules": {"rule": "regexp", "variable": "port", "content": "^22$"}, "route": "drop"}
+  ]
+}`)
+
+	checkRoutes(t, r, "table1", map[string]string{
+		"10.0.0.1:80":     "chain1",
+		"192.168.0.1:80":  "chain2",
+		"198.51.100.1:22": "drop",
+	})
+
+	// The rewrite of the matching block of the table fallen through to applies
+	_, rewrite, err := r.getRoute("table1", "192.168.0.1:80", "", nil, nil)
+	if err != nil || rewrite != ":8080" {
+		t.Fatalf("rewrite of the table fallen through to is %q (%v)", rewrite, err)
+	}
+
+	// No block matches in either table
+	_, _, err = r.getRoute("table1", "198.51.100.1:80", "", nil, nil)
+	if !errors.Is(err, errNoBlockMatched) {
+		t.Fatalf("destination matching no block routed: %v", err)
+	}
+}
+
+func TestFallthroughLoop(t *testing.T) {
+	r := parseRouting(t, `{
+  "table1": [{"rules": {"rule": "true"}, "route": "table:table2"}],
+  "table2": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain2"}, {"rules": {"rule": "true"}, "route": "table:table1"}],
+  "self": [{"rules": {"rule": "true"}, "route": "table:self"}],
+  "undefined": [{"rules": {"rule": "true"}, "route": "table:missing"}]
+}`)
+
+	checkRoutes(t, r, "table1", map[string]string{"10.0.0.1:80": "chain2"})
+
+	_, _, err := r.getRoute("table1", "198.51.100.1:80", "", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "routing table loop table1 -> table2 -> table1") {
+		t.Fatalf("fallthrough loop not detected: %v", err)
+	}
+	_, _, err = r.getRoute("self", "198.51.100.1:80", "", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "routing table loop self -> self") {
+		t.Fatalf("table falling through to itself not detected: %v", err)
+	}
+	_, _, err = r.getRoute("undefined", "198.51.100.1:80", "", nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "table missing not defined") {
+		t.Fatalf("fallthrough to an undefined table not detected: %v", err)
+	}
+}
+
+func TestFallthroughNoMatchCounters(t *testing.T) {
+	setRouting(t, `{"table1": [{"rules": {"rule": "true"}, "route": "chain1"}], "table2": [{"rules": {"rule": "true"}, "route": "chain2"}]}`, "")
+	r := parseRouting(t, `{
+  "table1": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain1"}, {"rules": {"rule": "true"}, "route": "table:table2"}],
+  "table2": [{"rules": {"rule": "subnet", "content": "192.168.0.0/16"}, "route": "chain2"}]
+}`)
+
+	// Destinations matching no block are counted in the counters of the routing evaluated, not in the ones of the current configuration
+	noMatch := newNoMatchCounters(r)
+	_, _, err := r.getRoute("table1", "198.51.100.1:80", "", noMatch, nil)
+	if !errors.Is(err, errNoBlockMatched) {
+		t.Fatalf("destination matching no block routed (%v)", err)
+	}
+	if noMatch["table2"].Load() != 1 || noMatch["table1"].Load() != 0 {
+		t.Errorf("no match counted in table1 %v times and table2 %v times instead of 0 and 1", noMatch["table1"].Load(), noMatch["table2"].Load())
+	}
+	if n := gRoutingConf.noMatch["table2"].Load(); n != 0 {
+		t.Errorf("no match counted %v times in the table2 of the current configuration", n)
+	}
+}
+
+func TestFallthroughDefaultRoute(t *testing.T) {
+	setRouting(t, `{
+  "table1": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain1"}, {"rules": {"rule": "true"}, "route": "table:table2"}],
+  "table2": [{"rules": {"rule": "subnet", "content": "192.168.0.0/16"}, "route": "chain2"}]
+}`, "reject")
+
+	// The default route applies once no block matched, after the tables fallen through to
+	route, _, err := getRouteFor("table1", "198.51.100.1:80", "")
+	if err != nil || route != "reject" {
+		t.Fatalf("destination matching no block routed to %v (%v) instead of the default route", route, err)
+	}
+	route, _, err = getRouteFor("table1", "192.168.0.1:80", "")
+	if err != nil || route != "chain2" {
+		t.Fatalf("destination routed to %v (%v) instead of chain2", route, err)
+	}
+
+	// The table in which no block matched is counted
+	if gRoutingConf.noMatch["table2"].Load() != 1 || gRoutingConf.noMatch["table1"].Load() != 0 {
+		t.Fatalf("no match counted in table1 %v times and table2 %v times instead of 0 and 1", gRoutingConf.noMatch["table1"].Load(), gRoutingConf.noMatch["table2"].Load())
+	}
+}
+
+func TestSubnetRules(t *testing.T) {
+	r := parseRouting(t, `{"table": [
+  {"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "v4"},
+  {"rules": {"rule": "subnet", "content": "2001:db8::/32"}, "route": "v6"},
+  {"rules": {"rule1": {"rule": "subnet", "content": "192.168.0.0/16", "negate": true}, "op": "AND", "rule2": {"rule": "subnet", "content": "fd00::/8", "negate": true}}, "route": "outside"},
+  {"rules": {"rule": "true"}, "route": "inside"}
+]}`)
+
+	// IPv4 addresses only match IPv4 subnets and IPv6 addresses IPv6 subnets, hostnames match no subnet rule, negated or not
+	checkRoutes(t, r, "table", map[string]string{
+		"10.1.2.3:443":          "v4",
+		"[2001:db8::1]:443":     "v6",
+		"[::ffff:10.1.2.3]:443": "v4",
+		"[2001:db9::1]:443":     "outside",
+		"192.168.1.1:80":        "inside",
+		"[fd00::1]:80":          "inside",
+		"198.51.100.1:80":       "outside",
+		"10.example.com:443":    "inside",
+	})
+}
+
+func TestSubnetRulesInvalidCIDR(t *testing.T) {
+	for _, cidr := range []string{"10.0.0.0", "10.0.0.0/33", "2001:db8::/129", "example.com/24", ""} {
+		var r routing
+		err := json.Unmarshal([]byte(`{"table": [{"rules": {"rule": "subnet", "content": "`+cidr+`"}, "route": "direct"}]}`), &r)
+		if err == nil {
+			t.Errorf("subnet rule with CIDR %q accepted", cidr)
+		}
+	}
+
+	// Invalid CIDRs in rule definitions fail the whole configuration
+	_, err := parseConfig(t, `{
+  "ruledefs": {"nets": {"rule": "subnet", "content": "10.0.0.0/42"}},
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [{"rules": {"rule": "ref", "content": "nets"}, "route": "direct"}]}
+}`)
+	if err == nil {
+		t.Error("rule definition with invalid CIDR accepted")
+	}
+}
+
+func TestRouteErrorPolicy(t *testing.T) {
+	// The port rule fails to evaluate for destinations without port
+	r := parseRouting(t, `{"table": [
+  {"rules": {"rule": "regexp", "variable": "port", "content": "^80$"}, "route": "web"},
+  {"rules": {"rule": "true"}, "route": "other"}
+]}`)
+
+	tests := []struct {
+		policy, defaultRoute string
+		route                string
+		fails                bool
+	}{
+		{"drop", "", "", true},
+		{"skip", "", "other", false},
+		{"default", "reject", "reject", false},
+		{"default", "table:other", "table:other", false},
+	}
+	for _, test := range tests {
+		setArg(t, &gArgRouteErrorPolicy, test.policy)
+		setArg(t, &gArgRouteErrorDefault, test.defaultRoute)
+
+		route, _, err := r["table"].getRoute("10.0.0.1", "")
+		if (err != nil) != test.fails || route != test.route {
+			t.Errorf("policy %v routed to %q (%v) instead of %q", test.policy, route, err, test.route)
+		}
+
+		// Destinations whose evaluation succeeds are not affected
+		route, _, err = r["table"].getRoute("10.0.0.1:80", "")
+		if err != nil || route != "web" {
+			t.Errorf("policy %v routed 10.0.0.1:80 to %q (%v) instead of web", test.policy, route, err)
+		}
+	}
+}
+
+func TestRouteErrorPolicyFallthrough(t *testing.T) {
+	setArg(t, &gArgRouteErrorPolicy, "default")
+	setArg(t, &gArgRouteErrorDefault, "table:fallback")
+
+	// The default route of the error policy can fall through to another routing table
+	r := parseRouting(t, `{
+  "table": [{"rules": {"rule": "regexp", "variable": "port", "content": "^80$"}, "route": "web"}],
+  "fallback": [{"rules": {"rule": "true"}, "route": "safe"}]
+}`)
+	route, _, err := r.getRoute("table", "10.0.0.1", "", nil, nil)
+	if err != nil || route != "safe" {
+		t.Errorf("routed to %q (%v) instead of safe", route, err)
+	}
+}
+
+func TestMatchAllRules(t *testing.T) {
+	for _, ruleType := range []string{"true", "any"} {
+		var r rule
+		err := json.Unmarshal([]byte(`{"rule": "`+ruleType+`"}`), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		negated := r
+		negated.Negate = true
+
+		for _, addr := range []string{"10.0.0.1:80", "[2001:db8::1]:443", "example.com:22", "example.com", ""} {
+			matched, err := r.evaluate(addr, "")
+			if err != nil || !matched {
+				t.Errorf("%v rule did not match %q (%v)", ruleType, addr, err)
+			}
+			matched, err = negated.evaluate(addr, "")
+			if err != nil || matched {
+				t.Errorf("negated %v rule matched %q (%v)", ruleType, addr, err)
+			}
+		}
+	}
+}
+
+func TestMatchAllBlocks(t *testing.T) {
+	// Negated match-all rules never match, the last block catches everything else, also when combined
+	r := parseRouting(t, `{"table": [
+  {"rules": {"rule": "any", "negate": true}, "route": "never"},
+  {"rules": {"rule1": {"rule": "subnet", "content": "10.0.0.0/8"}, "op": "AND", "rule2": {"rule": "true", "negate": true}}, "route": "never"},
+  {"rules": {"rule1": {"rule": "subnet", "content": "10.0.0.0/8"}, "op": "OR", "rule2": {"rule": "any", "negate": true}}, "route": "internal"},
+  {"rules": {"rule": "any"}, "route": "default"}
+]}`)
+	checkRoutes(t, r, "table", map[string]string{
+		"10.0.0.1:80":      "internal",
+		"198.51.100.1:443": "default",
+		"example.com:443":  "default",
+	})
+}
+
+func TestPortlessDestinations(t *testing.T) {
+	tests := []struct {
+		rule    string
+		addr    string
+		matched bool
+		fails   bool
+	}{
+		{`{"rule": "regexp", "variable": "host", "content": "^example\\.com$"}`, "example.com", true, false},
+		{`{"rule": "regexp", "variable": "host", "content": "^2001:db8::1$"}`, "[2001:db8::1]", true, false},
+		{`{"rule": "regexp", "variable": "host", "content": "^2001:db8::1$"}`, "2001:db8::1", true, false},
+		{`{"rule": "regexp", "variable": "addr", "content": "^example\\.com$"}`, "example.com", true, false},
+		{`{"rule": "regexp", "variable": "addr", "content": ":443$"}`, "example.com", false, false},
+		{`{"rule": "regexp", "variable": "port", "content": ".*"}`, "example.com", false, true},
+		{`{"rule": "subnet", "content": "10.0.0.0/8"}`, "10.1.2.3", true, false},
+		{`{"rule": "subnet", "content": "2001:db8::/32"}`, "[2001:db8::1]", true, false},
+		{`{"rule": "service", "content": "https"}`, "10.1.2.3", false, true},
+	}
+
+	for _, test := range tests {
+		var r rule
+		err := json.Unmarshal([]byte(test.rule), &r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		matched, err := r.evaluate(test.addr, "")
+		if (err != nil) != test.fails || (!test.fails && matched != test.matched) {
+			t.Errorf("rule %v evaluated on %v: matched %v (%v)", test.rule, test.addr, matched, err)
+		}
+	}
+
+	// Host-only matching routes destinations without port, without aborting the routing
+	r := parseRouting(t, `{"table": [
+  {"rules": {"rule": "regexp", "variable": "host", "content": "\\.internal$"}, "route": "internal"},
+  {"rules": {"rule": "true"}, "route": "default"}
+]}`)
+	checkRoutes(t, r, "table", map[string]string{
+		"db.internal":     "internal",
+		"db.internal:443": "internal",
+		"example.com":     "default",
+	})
+}
+
+func TestDefaultRoute(t *testing.T) {
+	setRouting(t, `{
+  "closed": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain1"}],
+  "open": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain1"}, {"rules": {"rule": "true"}, "route": "chain2"}]
+}`, "drop")
+
+	// The default route applies to tables in which no block matched, tables ending with a true block keep using it
+	checkRoutes(t, gRoutingConf.routing, "open", map[string]string{"10.0.0.1:80": "chain1", "198.51.100.1:80": "chain2"})
+	for table, expected := range map[string]string{"closed": "drop", "open": "chain2"} {
+		route, _, err := getRouteFor(table, "198.51.100.1:80", "")
+		if err != nil || route != expected {
+			t.Errorf("destination matching no block of table %v routed to %v (%v) instead of %v", table, route, err, expected)
+		}
+	}
+
+	// Without default route, the routing fails
+	setRouting(t, `{"closed": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain1"}]}`, "")
+	_, _, err := getRouteFor("closed", "198.51.100.1:80", "")
+	if !errors.Is(err, errNoBlockMatched) {
+		t.Errorf("destination matching no block routed without default route (%v)", err)
+	}
+}
+
+func TestDefaultRouteConfig(t *testing.T) {
+	config, err := parseConfig(t, `{
+  "chains": {"direct": {"proxies": []}},
+  "defaultRoute": "direct",
+  "routes": {"table": [{"rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "drop"}]}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.DefaultRoute != "direct" {
+		t.Errorf("default route %q instead of direct", config.DefaultRoute)
+	}
+}
+
+func TestListenerRules(t *testing.T) {
+	r := parseRouting(t, `{"table": [
+  {"rules": {"rule": "listener", "content": "^internal$"}, "route": "internal"},
+  {"rules": {"rule1": {"rule": "listener", "content": ":1080$"}, "op": "AND", "rule2": {"rule": "subnet", "content": "10.0.0.0/8"}}, "route": "lan"},
+  {"rules": {"rule": "listener", "content": "^(internal|127\\.0\\.0\\.1:1080)$", "negate": true}, "route": "others"},
+  {"rules": {"rule": "true"}, "route": "default"}
+]}`)
+
+	for _, test := range []struct {
+		listener, addr, route string
+	}{
+		{"internal", "198.51.100.1:443", "internal"},
+		{"internal2", "198.51.100.1:443", "others"},
+		{"127.0.0.1:1080", "10.1.2.3:22", "lan"},
+		{"127.0.0.1:1080", "198.51.100.1:443", "default"},
+		{"127.0.0.1:1081", "10.1.2.3:22", "others"},
+		{"", "198.51.100.1:443", "others"},
+	} {
+		route, _, err := r.getRoute("table", test.addr, test.listener, nil, nil)
+		if err != nil || route != test.route {
+			t.Errorf("%v from listener %q routed to %v (%v) instead of %v", test.addr, test.listener, route, err, test.route)
+		}
+	}
+
+	var invalid routing
+	if err := json.Unmarshal([]byte(`{"table": [{"rules": {"rule": "listener", "content": "("}, "route": "direct"}]}`), &invalid); err == nil {
+		t.Error("listener rule with invalid regexp accepted")
+	}
+}
+
+func TestMalformedRules(t *testing.T) {
+	tests := []struct {
+		describe string
+		rules    string
+		err      string
+	}{
+		{"empty rules", `{}`, "ruleBlock number 1 of routingTable table has empty rules"},
+		{"null rules", `null`, "ruleBlock number 1 of routingTable table has empty rules"},
+		{"missing rules", ``, "ruleBlock number 1 of routingTable table has empty rules"},
+		{"rules not an object", `"true"`, "rules '\"true\"' must be a Rule or RuleCombo object"},
+		{"combo without op", `{"rule1": {"rule": "true"}, "rule2": {"rule": "true"}}`, "missing op in RuleCombo"},
+		{"combo without rule2", `{"rule1": {"rule": "true"}, "op": "and"}`, "missing rule1 or rule2 operand in RuleCombo"},
+		{"combo without rule1", `{"op": "or", "rule2": {"rule": "true"}}`, "missing rule1 or rule2 operand in RuleCombo"},
+		{"empty operand", `{"rule1": {}, "op": "and", "rule2": {"rule": "true"}}`, "error unmarshalling rule1 : empty rules"},
+		{"nested incomplete combo", `{"rule1": {"rule": "true"}, "op": "and", "rule2": {"rule1": {"rule": "true"}, "op": "or"}}`, "error unmarshalling rule2 : missing rule1 or rule2 operand"},
+		{"rule without type", `{"content": "10.0.0.0/8"}`, "missing rule field (one of regexp, subnet"},
+		{"unknown rule type", `{"rule": "domain", "content": "example.com"}`, "unknown rule type 'domain', must be one of regexp, subnet"},
+	}
+
+	for _, test := range tests {
+		rules := ""
+		if test.rules != "" {
+			rules = `"rules": ` + test.rules + `, `
+		}
+		var r routing
+		err := json.Unmarshal([]byte(`{"table": [{"rules": {"rule": "true"}, "route": "direct"}, {`+rules+`"route": "direct"}]}`), &r)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%v: error %v instead of %q", test.describe, err, test.err)
+		}
+		if err != nil && strings.Contains(err.Error(), "EOF") {
+			t.Errorf("%v: generic EOF error %v", test.describe, err)
+		}
+	}
+
+	// Malformed rule definitions are reported the same way
+	_, err := parseConfig(t, `{
+  "ruledefs": {"nets": {"rule1": {"rule": "true"}, "op": "and"}},
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [{"rules": {"rule": "ref", "content": "nets"}, "route": "direct"}]}
+}`)
+	if err == nil || !strings.Contains(err.Error(), "missing rule1 or rule2 operand in RuleCombo") {
+		t.Errorf("incomplete rule definition: error %v", err)
+	}
+}
+
+func TestDisabledTables(t *testing.T) {
+	// Tables in object form are kept unless disabled
+	r := parseRouting(t, `{
+  "array": [{"rules": {"rule": "true"}, "route": "direct"}],
+  "object": {"comment": "enabled", "blocks": [{"rules": {"rule": "true"}, "route": "direct"}]},
+  "disabled": {"disable": true, "blocks": [{"rules": {"rule": "true"}, "route": "direct"}]}
+}`)
+	for _, name := range []string{"array", "object"} {
+		if len(r[name]) != 1 {
+			t.Errorf("table %v parsed as %v", name, r[name])
+		}
+	}
+	if _, ok := r["disabled"]; ok {
+		t.Error("disabled table kept")
+	}
+
+	// The blocks of disabled tables must stay valid
+	var invalid routing
+	err := json.Unmarshal([]byte(`{"disabled": {"disable": true, "blocks": [{"rules": {}, "route": "direct"}]}}`), &invalid)
+	if err == nil {
+		t.Error("disabled table with invalid blocks accepted")
+	}
+
+	// Disabled tables are recorded by the configuration
+	config, err := parseConfig(t, `{
+  "chains": {"direct": {"proxies": []}},
+  "routes": {
+    "table": [{"rules": {"rule": "true"}, "route": "direct"}],
+    "disabled": {"disable": true, "blocks": [{"rules": {"rule": "true"}, "route": "direct"}]}
+  }
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(config.disabledRoutes, []string{"disabled"}) {
+		t.Errorf("disabled routes %v instead of [disabled]", config.disabledRoutes)
+	}
+}
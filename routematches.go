@@ -0,0 +1,72 @@
+package main
+
+// Defines the views of the match counters of the routing tables, showing which blocks route the destinations. Counters are reset when the configuration is reloaded.
+
+import (
+	"slices"
+	"sync/atomic"
+)
+
+// blockMatches is a snapshot of the match counter of a rule block
+type blockMatches struct {
+	Index   int    `json:"index"` // index of the block in its routing table, including disabled blocks
+	Comment string `json:"comment,omitempty"`
+	Route   string `json:"route"`
+	Matches int64  `json:"matches"`
+}
+
+// tableMatches is a snapshot of the match counters of a routing table
+type tableMatches struct {
+	Blocks  []blockMatches `json:"blocks"`
+	NoMatch int64          `json:"noMatch"` // destinations for which no block of the table matched, whether evaluation started in it or fell through to it
+}
+
+// newNoMatchCounters returns the counters of the destinations for which no block matched, one per routing table of r
+func newNoMatchCounters(r routing) map[string]*atomic.Int64 {
+	counters := make(map[string]*atomic.Int64, len(r))
+	for name := range r {
+		counters[name] = new(atomic.Int64)
+	}
+	return counters
+}
+
+// routeMatchesSnapshot returns the current value of the match counters of the routing tables of the current configuration, by table name
+func routeMatchesSnapshot() map[string]tableMatches {
+	gRoutingConf.mu.RLock()
+	defer gRoutingConf.mu.RUnlock()
+
+	snapshot := make(map[string]tableMatches, len(gRoutingConf.routing))
+	for name, table := range gRoutingConf.routing {
+		matches := tableMatches{Blocks: make([]blockMatches, 0, len(table))}
+		for _, rBlock := range table {
+			matches.Blocks = append(matches.Blocks, blockMatches{Index: rBlock.index, Comment: rBlock.Comment, Route: rBlock.Route, Matches: rBlock.matches.Load()})
+		}
+		if counter, ok := gRoutingConf.noMatch[name]; ok {
+			matches.NoMatch = counter.Load()
+		}
+		snapshot[name] = matches
+	}
+	return snapshot
+}
+
+// describeRouteMatches logs the match counters of the routing tables of the current configuration, if routing tables are used
+func describeRouteMatches() {
+	if gArgPACPath != "" {
+		return
+	}
+
+	snapshot := routeMatchesSnapshot()
+	names := make([]string, 0, len(snapshot))
+	for name := range snapshot {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		matches := snapshot[name]
+		for _, block := range matches.Blocks {
+			gMetaLogger.Infof("routing table %v, block %v (%v) -> %v: %v matches", name, block.Index, block.Comment, block.Route, block.Matches)
+		}
+		gMetaLogger.Infof("routing table %v: %v destinations matched by no block", name, matches.NoMatch)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRouteMatchCounters(t *testing.T) {
+	setRouting(t, `{
+  "table1": [
+    {"comment": "internal", "rules": {"rule": "subnet", "content": "10.0.0.0/8"}, "route": "chain1"},
+    {"comment": "disabled", "rules": {"rule": "true"}, "route": "drop", "disable": true},
+    {"comment": "web", "rules": {"rule": "regexp", "variable": "port", "content": "^443$"}, "route": "chain2"},
+    {"rules": {"rule": "regexp", "variable": "host", "content": "example"}, "route": "table:table2"}
+  ],
+  "table2": [{"rules": {"rule": "regexp", "variable": "port", "content": "^80$"}, "route": "chain3"}]
+}`, "")
+
+	for _, addr := range []string{"10.0.0.1:80", "10.0.0.2:443", "192.0.2.1:443", "example.com:80", "example.com:22", "192.0.2.1:22", "192.0.2.2:22"} {
+		getRouteFor("table1", addr, "")
+	}
+
+	snapshot := routeMatchesSnapshot()
+
+	// Disabled blocks are left out of the table, the indexes of the other blocks are kept
+	blocks := snapshot["table1"].Blocks
+	expected := []blockMatches{
+		{Index: 0, Comment: "internal", Route: "chain1", Matches: 2},
+		{Index: 2, Comment: "web", Route: "chain2", Matches: 1},
+		{Index: 3, Route: "table:table2", Matches: 2},
+	}
+	if len(blocks) != len(expected) {
+		t.Fatalf("table1 has %v blocks instead of %v: %+v", len(blocks), len(expected), blocks)
+	}
+	for i := range expected {
+		if blocks[i] != expected[i] {
+			t.Errorf("block %+v instead of %+v", blocks[i], expected[i])
+		}
+	}
+	if snapshot["table1"].NoMatch != 2 {
+		t.Errorf("no match counted %v times in table1 instead of 2", snapshot["table1"].NoMatch)
+	}
+
+	// Destinations falling through are counted in the table they fell through to
+	if snapshot["table2"].Blocks[0].Matches != 1 || snapshot["table2"].NoMatch != 1 {
+		t.Errorf("unexpected counters %+v of table2", snapshot["table2"])
+	}
+}
+
+func TestRouteMatchCountersReset(t *testing.T) {
+	routes := `{"table": [{"rules": {"rule": "true"}, "route": "chain1"}]}`
+	setRouting(t, routes, "")
+	getRouteFor("table", "192.0.2.1:80", "")
+	if routeMatchesSnapshot()["table"].Blocks[0].Matches != 1 {
+		t.Fatal("match not counted")
+	}
+
+	// Counters are reset when the configuration is loaded again
+	setRouting(t, routes, "")
+	if routeMatchesSnapshot()["table"].Blocks[0].Matches != 0 {
+		t.Fatal("match counters not reset by a configuration load")
+	}
+}
+
+func TestDescribeRouteMatches(t *testing.T) {
+	logs, _ := captureLogs(t)
+	setRouting(t, `{"table": [{"comment": "all", "rules": {"rule": "true"}, "route": "chain1"}]}`, "")
+	getRouteFor("table", "192.0.2.1:80", "")
+
+	describeRouteMatches()
+	if !strings.Contains(logs.String(), "routing table table, block 0 (all) -> chain1: 1 matches") {
+		t.Fatalf("match counters not described in logs:\n%v", logs)
+	}
+}
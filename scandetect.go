@@ -0,0 +1,93 @@
+package main
+
+// Defines the structure used to detect connection patterns indicative of scanning, i.e. sources connecting to many distinct destinations in a short window
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/synacktiv/bbs/logger"
+)
+
+// scanDetector is the type used to hold the distinct destinations recently requested by each source IP
+type scanDetector struct {
+	destinations map[string]map[string]time.Time // last request date of each destination (host:port), per source IP
+	alerts       uint64                          // number of scans detected since startup
+	lastSweep    time.Time                       // date of the last removal of the expired destinations of all sources
+	mu           sync.Mutex
+}
+
+var gScanDetector = scanDetector{destinations: make(map[string]map[string]time.Time)}
+
+// record records a connection request from the source of addr to the destination address string dest (format host:port).
+// If the source requested gArgScanThreshold distinct destinations within gArgScanWindow, a scan alert is logged and audited,
+// and the source is banned for gArgBanDuration if -scan-ban is set.
+func (d *scanDetector) record(addr net.Addr, dest string) {
+	if gArgScanThreshold <= 0 {
+		return
+	}
+
+	ip := sourceIP(addr)
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Forget the destinations requested by the source before the window, and those of the other sources once per window
+	if now.Sub(d.lastSweep) > gArgScanWindow {
+		d.sweep(now)
+	} else {
+		expireDestinations(d.destinations[ip], now)
+	}
+
+	if d.destinations[ip] == nil {
+		d.destinations[ip] = make(map[string]time.Time)
+	}
+	d.destinations[ip][dest] = now
+
+	count := len(d.destinations[ip])
+	if count < gArgScanThreshold {
+		return
+	}
+
+	// Forget the destinations of the source so that the alert is raised again only if the scan goes on
+	delete(d.destinations, ip)
+	d.alerts++
+
+	gMetaLogger.Infof("source %v requested %v distinct destinations within %v, possible scan (alert %v)", ip, count, gArgScanWindow, d.alerts)
+	gMetaLogger.AuditEvent(logger.AuditEvent{Event: "SCAN", Client: ip, Detail: fmt.Sprintf("%v destinations within %v", count, gArgScanWindow)})
+
+	if gArgScanBan {
+		gBanList.ban(ip)
+	}
+}
+
+// sweep forgets the destinations requested before the window, for all sources. It must be called with d.mu held.
+func (d *scanDetector) sweep(now time.Time) {
+	for source, dests := range d.destinations {
+		expireDestinations(dests, now)
+		if len(dests) == 0 {
+			delete(d.destinations, source)
+		}
+	}
+	d.lastSweep = now
+}
+
+// expireDestinations removes from dests the destinations requested before the window
+func expireDestinations(dests map[string]time.Time, now time.Time) {
+	for dst, date := range dests {
+		if now.Sub(date) > gArgScanWindow {
+			delete(dests, dst)
+		}
+	}
+}
+
+// alertCount returns the number of scans detected since startup
+func (d *scanDetector) alertCount() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.alerts
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestScanDetector() *scanDetector {
+	return &scanDetector{destinations: make(map[string]map[string]time.Time)}
+}
+
+func TestScanDetection(t *testing.T) {
+	_, audit := captureLogs(t)
+	setArg(t, &gArgScanThreshold, 5)
+	setArg(t, &gArgScanWindow, time.Minute)
+
+	d := newTestScanDetector()
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	other := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}
+
+	// Repeated requests to the same destinations, and requests of other sources, are not counted
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 3; j++ {
+			d.record(source, fmt.Sprintf("198.51.100.1:%v", i))
+		}
+		d.record(other, fmt.Sprintf("198.51.100.2:%v", i))
+	}
+	if d.alertCount() != 0 {
+		t.Fatal("scan detected below the threshold")
+	}
+
+	d.record(source, "198.51.100.1:4")
+	if d.alertCount() != 1 {
+		t.Fatal("scan not detected at the threshold")
+	}
+	events := auditEvents(t, audit)
+	if len(events) != 1 || events[0].Event != "SCAN" || events[0].Client != "192.0.2.1" {
+		t.Fatalf("unexpected audit traces %+v", events)
+	}
+
+	// The destinations of the source are forgotten, the alert is raised again only if the scan goes on
+	d.record(source, "198.51.100.1:5")
+	if d.alertCount() != 1 {
+		t.Fatal("scan detected again right after an alert")
+	}
+}
+
+func TestScanDetectionWindow(t *testing.T) {
+	setArg(t, &gArgScanThreshold, 3)
+	setArg(t, &gArgScanWindow, 50*time.Millisecond)
+
+	d := newTestScanDetector()
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+
+	d.record(source, "198.51.100.1:1")
+	d.record(source, "198.51.100.1:2")
+	time.Sleep(100 * time.Millisecond)
+	d.record(source, "198.51.100.1:3")
+	if d.alertCount() != 0 {
+		t.Fatal("scan detected for destinations spread over more than the window")
+	}
+
+	// The destinations of sources which do not connect again are swept
+	d.record(&net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1234}, "198.51.100.1:1")
+	time.Sleep(100 * time.Millisecond)
+	d.record(source, "198.51.100.1:4")
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.destinations["192.0.2.2"]; ok {
+		t.Fatal("expired destinations of an inactive source were not swept")
+	}
+}
+
+func TestScanBan(t *testing.T) {
+	resetBanList(t)
+	setArg(t, &gArgScanThreshold, 5)
+	setArg(t, &gArgScanWindow, time.Minute)
+	setArg(t, &gArgScanBan, true)
+	setArg(t, &gArgBanDuration, time.Minute)
+	srv := startRouteServer(t, "socks5", "reject")
+
+	// A client requests connections to many ports of a host through the server
+	for port := 1; port <= 5; port++ {
+		conn, err := net.DialTimeout("tcp", srv, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		socks5Greet(t, conn, 0)
+		socks5Request(t, conn, cmdConnect, fmt.Sprintf("192.0.2.1:%v", port))
+		conn.Close()
+	}
+
+	if !gBanList.isBanned(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}) {
+		t.Fatal("scanning source not banned")
+	}
+}
@@ -0,0 +1,32 @@
+//go:build systemd
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// sdNotify sends state to the systemd notification socket (see sd_notify(3)). It does nothing if bbs is not started by systemd with Type=notify.
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		err = fmt.Errorf("error connecting to systemd notification socket %v: %v", socketPath, err)
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		err = fmt.Errorf("error writing to systemd notification socket %v: %v", socketPath, err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build systemd
+
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+
+	err = sdNotify("READY=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buff := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buff[:n]) != "READY=1" {
+		t.Fatalf("notification socket received %q instead of READY=1", buff[:n])
+	}
+}
+
+func TestSdNotifyWithoutSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+
+	err := sdNotify("READY=1")
+	if err != nil {
+		t.Fatalf("notification without systemd failed: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+// Defines the classification of destination ports into well-known services, matched by service rules (e.g. "ssh" for port 22)
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// serviceMap maps service names, in lower case, to the destination ports classified as this service
+type serviceMap map[string][]uint16
+
+// builtinServices returns the built-in classification of well-known ports, extended or overridden by the services section
+func builtinServices() serviceMap {
+	return serviceMap{
+		"ftp":        {21},
+		"ssh":        {22},
+		"telnet":     {23},
+		"smtp":       {25, 465, 587},
+		"dns":        {53, 853},
+		"http":       {80, 8080},
+		"kerberos":   {88},
+		"pop3":       {110, 995},
+		"imap":       {143, 993},
+		"ldap":       {389, 636},
+		"https":      {443, 8443},
+		"smb":        {445},
+		"mssql":      {1433},
+		"mysql":      {3306},
+		"rdp":        {3389},
+		"postgresql": {5432},
+		"vnc":        {5900},
+		"winrm":      {5985, 5986},
+	}
+}
+
+// gServices holds the classification of the configuration being parsed: the built-in one, with the services section applied. It is used when unmarshalling service rules
+var gServices = builtinServices()
+
+// UnmarshalJSON parses the services section, mapping service names to lists of ports, e.g. {"ssh": [22, 2222]}. Names are case insensitive.
+func (s *serviceMap) UnmarshalJSON(b []byte) error {
+	var tmp map[string][]uint16
+	err := json.Unmarshal(b, &tmp)
+	if err != nil {
+		return err
+	}
+
+	*s = make(serviceMap)
+	for name, ports := range tmp {
+		if name == "" || len(ports) == 0 {
+			err = fmt.Errorf("service %q must have a name and at least one port", name)
+			return err
+		}
+		for _, port := range ports {
+			if port == 0 {
+				err = fmt.Errorf("invalid port 0 of service %v", name)
+				return err
+			}
+		}
+		(*s)[strings.ToLower(name)] = ports
+	}
+
+	return nil
+}
+
+// withBuiltins returns the built-in classification, in which the services of s replace the built-in services of the same name
+func (s serviceMap) withBuiltins() serviceMap {
+	services := builtinServices()
+	maps.Copy(services, s)
+	return services
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestServiceRules(t *testing.T) {
+	r := parseRouting(t, `{"table": [
+  {"rules": {"rule": "service", "content": "ssh"}, "route": "ssh"},
+  {"rules": {"rule": "service", "content": "HTTPS"}, "route": "web"},
+  {"rules": {"rule": "service", "content": "rdp", "negate": true}, "route": "other"},
+  {"rules": {"rule": "true"}, "route": "rdp"}
+]}`)
+
+	// Ports are classified by the built-in services, case insensitively, ports of no service match no service rule
+	checkRoutes(t, r, "table", map[string]string{
+		"10.0.0.1:22":         "ssh",
+		"example.com:443":     "web",
+		"example.com:8443":    "web",
+		"[2001:db8::1]:443":   "web",
+		"10.0.0.1:3389":       "rdp",
+		"10.0.0.1:2222":       "other",
+		"10.0.0.1:80":         "other",
+		"example.com:65535":   "other",
+		"db.internal:1":       "other",
+		"10.0.0.1:65000":      "other",
+		"[2001:db8::1]:22":    "ssh",
+		"ssh.example.com:443": "web",
+	})
+}
+
+func TestServicesSection(t *testing.T) {
+	setArg(t, &gServices, gServices)
+
+	// The services section defines services, and replaces the ports of built-in ones
+	config, err := parseConfig(t, `{
+  "services": {"SSH": [2222], "git": [9418]},
+  "chains": {"direct": {"proxies": []}},
+  "routes": {"table": [
+    {"rules": {"rule": "service", "content": "ssh"}, "route": "ssh"},
+    {"rules": {"rule": "service", "content": "git"}, "route": "git"},
+    {"rules": {"rule": "service", "content": "https"}, "route": "web"},
+    {"rules": {"rule": "true"}, "route": "direct"}
+  ]}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoutes(t, config.Routes, "table", map[string]string{
+		"10.0.0.1:2222": "ssh",
+		"10.0.0.1:22":   "direct",
+		"10.0.0.1:9418": "git",
+		"10.0.0.1:443":  "web",
+	})
+	if !slices.Equal(gServices["ssh"], []uint16{2222}) || !slices.Equal(gServices["rdp"], []uint16{3389}) {
+		t.Errorf("services ssh %v and rdp %v after the services section", gServices["ssh"], gServices["rdp"])
+	}
+
+	// Services of a previous configuration are not kept
+	_, err = parseConfig(t, `{"routes": {"table": [{"rules": {"rule": "service", "content": "git"}, "route": "git"}]}}`)
+	if err == nil || !strings.Contains(err.Error(), "unknown service git of service rule") {
+		t.Errorf("service of a previous configuration used: %v", err)
+	}
+}
+
+func TestServicesInvalid(t *testing.T) {
+	for _, services := range []string{`{"ssh": []}`, `{"": [22]}`, `{"ssh": [0]}`, `{"ssh": [65536]}`, `{"ssh": 22}`} {
+		var s serviceMap
+		if err := json.Unmarshal([]byte(services), &s); err == nil {
+			t.Errorf("services %v accepted", services)
+		}
+	}
+
+	var r rule
+	if err := json.Unmarshal([]byte(`{"rule": "service", "content": "gopher"}`), &r); err == nil {
+		t.Error("service rule of an unknown service accepted")
+	}
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package main
+
+// Defines the user signals, only available on Unix systems.
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// sigDescribe describes active connections and servers
+	sigDescribe os.Signal = syscall.SIGUSR1
+	// sigKillSwitch engages or releases the kill switch
+	sigKillSwitch os.Signal = syscall.SIGUSR2
+)
+
+// userSignals returns the user signals to listen on
+func userSignals() []os.Signal {
+	return []os.Signal{sigDescribe, sigKillSwitch}
+}
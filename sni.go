@@ -0,0 +1,147 @@
+package main
+
+// Defines the extraction of the server name (SNI) from the TLS ClientHello sent by a client, without terminating TLS
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// tlsMaxRecordSize is the size of the largest TLS record (header included), which must be buffered to peek a ClientHello
+const tlsMaxRecordSize = 5 + 16384
+
+// errNoSNI is returned when the data does not contain a TLS ClientHello with a server name
+var errNoSNI = errors.New("no TLS ClientHello with server name")
+
+// bufferedConn is a net.Conn whose data is read through reader, so that data peeked on reader before the relay is not lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// NetConn returns the underlying connection of c
+func (c bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// peekSNI waits at most timeout for the first TLS record sent by client, and returns the server name of the ClientHello it contains.
+// The peeked data is kept in the returned connection, which must be used instead of client afterwards.
+func peekSNI(client net.Conn, timeout time.Duration) (net.Conn, string, error) {
+	reader := bufio.NewReaderSize(client, tlsMaxRecordSize)
+	conn := bufferedConn{Conn: client, reader: reader}
+
+	client.SetReadDeadline(time.Now().Add(timeout))
+	defer client.SetReadDeadline(time.Time{})
+
+	header, err := reader.Peek(5)
+	if err != nil {
+		err = fmt.Errorf("could not peek TLS record header: %w", err)
+		return conn, "", err
+	}
+	if header[0] != 0x16 { // handshake record
+		return conn, "", errNoSNI
+	}
+
+	length := int(binary.BigEndian.Uint16(header[3:5]))
+	record, err := reader.Peek(5 + length)
+	if err != nil {
+		err = fmt.Errorf("could not peek TLS record: %w", err)
+		return conn, "", err
+	}
+
+	sni, err := parseSNI(record)
+	return conn, sni, err
+}
+
+// parseSNI returns the server name of the TLS ClientHello contained in the TLS record record (see RFC 8446 and RFC 6066)
+func parseSNI(record []byte) (string, error) {
+	// Record header |type|version(2)|length(2)|
+	if len(record) < 5 || record[0] != 0x16 {
+		return "", errNoSNI
+	}
+	data := record[5:]
+
+	// Handshake header |msg_type|length(3)|, msg_type 1 is client_hello
+	if len(data) < 4 || data[0] != 1 {
+		return "", errNoSNI
+	}
+	length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+	if len(data) < 4+length {
+		err := fmt.Errorf("ClientHello spans multiple TLS records")
+		return "", err
+	}
+	data = data[4 : 4+length]
+
+	// Skip legacy_version(2) and random(32)
+	if len(data) < 34 {
+		return "", errNoSNI
+	}
+	data = data[34:]
+
+	// Skip legacy_session_id<0..32>, cipher_suites<2..2^16-2> and legacy_compression_methods<1..2^8-1>
+	for _, lengthSize := range []int{1, 2, 1} {
+		if len(data) < lengthSize {
+			return "", errNoSNI
+		}
+		n := 0
+		for _, b := range data[:lengthSize] {
+			n = n<<8 | int(b)
+		}
+		if len(data) < lengthSize+n {
+			return "", errNoSNI
+		}
+		data = data[lengthSize+n:]
+	}
+
+	// Extensions |extension_type(2)|extension_data<0..2^16-1>|
+	if len(data) < 2 {
+		return "", errNoSNI
+	}
+	extLength := int(binary.BigEndian.Uint16(data[:2]))
+	data = data[2:]
+	if len(data) < extLength {
+		return "", errNoSNI
+	}
+	data = data[:extLength]
+
+	for len(data) >= 4 {
+		extType := binary.BigEndian.Uint16(data[:2])
+		n := int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+n {
+			return "", errNoSNI
+		}
+		ext := data[4 : 4+n]
+		data = data[4+n:]
+
+		if extType != 0 { // server_name
+			continue
+		}
+
+		// ServerNameList |length(2)| then entries |name_type|length(2)|name|, name_type 0 is host_name
+		if len(ext) < 2 {
+			return "", errNoSNI
+		}
+		ext = ext[2:]
+		for len(ext) >= 3 {
+			nameType := ext[0]
+			nameLength := int(binary.BigEndian.Uint16(ext[1:3]))
+			if len(ext) < 3+nameLength {
+				return "", errNoSNI
+			}
+			if nameType == 0 {
+				return string(ext[3 : 3+nameLength]), nil
+			}
+			ext = ext[3+nameLength:]
+		}
+	}
+
+	return "", errNoSNI
+}
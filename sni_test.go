@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first TLS record sent by a TLS client connecting with server name serverName, no server name being sent if it is empty
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		conn := tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		conn.Handshake()
+		client.Close()
+	}()
+
+	header := make([]byte, 5)
+	_, err := io.ReadFull(server, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+int(binary.BigEndian.Uint16(header[3:5])))
+	copy(record, header)
+	_, err = io.ReadFull(server, record[5:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+func TestParseSNI(t *testing.T) {
+	sni, err := parseSNI(clientHello(t, "www.example.com"))
+	if err != nil || sni != "www.example.com" {
+		t.Fatalf("server name %q (%v) instead of www.example.com", sni, err)
+	}
+
+	// Without server name, or with data which is not a ClientHello, there is no SNI
+	_, err = parseSNI(clientHello(t, ""))
+	if !errors.Is(err, errNoSNI) {
+		t.Errorf("server name found in ClientHello without one: %v", err)
+	}
+	for _, data := range [][]byte{[]byte("GET / HTTP/1.1\r\n\r\n"), {0x16, 3, 1, 0, 4, 2, 0, 0, 0}, {}} {
+		_, err = parseSNI(data)
+		if err == nil {
+			t.Errorf("server name found in %q", data)
+		}
+	}
+
+	// Truncated ClientHellos are rejected
+	record := clientHello(t, "www.example.com")
+	for _, n := range []int{6, 9, 50, len(record) - 10} {
+		_, err = parseSNI(record[:n])
+		if err == nil {
+			t.Errorf("server name found in ClientHello truncated to %v bytes", n)
+		}
+	}
+}
+
+func TestPeekSNIReplaysData(t *testing.T) {
+	record := clientHello(t, "www.example.com")
+	client, server := tcpPair(t)
+
+	go client.Write(append(record, []byte("next")...))
+
+	conn, sni, err := peekSNI(server, time.Second)
+	if err != nil || sni != "www.example.com" {
+		t.Fatalf("server name %q (%v) instead of www.example.com", sni, err)
+	}
+
+	// The peeked record is read again from the returned connection, followed by the rest of the data
+	data := make([]byte, len(record)+4)
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data[:len(record)]) != string(record) || string(data[len(record):]) != "next" {
+		t.Errorf("peeked data not replayed")
+	}
+}
+
+func TestPeekSNIFallback(t *testing.T) {
+	// Clients speaking first without TLS keep their data
+	client, server := tcpPair(t)
+	go client.Write([]byte("GET / HTTP/1.1\r\n"))
+
+	conn, _, err := peekSNI(server, time.Second)
+	if !errors.Is(err, errNoSNI) {
+		t.Fatalf("server name found in plain HTTP request: %v", err)
+	}
+	data := make([]byte, 16)
+	_, err = io.ReadFull(conn, data)
+	if err != nil || string(data) != "GET / HTTP/1.1\r\n" {
+		t.Errorf("peeked data not replayed: %q (%v)", data, err)
+	}
+
+	// Clients waiting for the server to speak first are released after the timeout
+	_, server = tcpPair(t)
+	start := time.Now()
+	_, _, err = peekSNI(server, 100*time.Millisecond)
+	if err == nil {
+		t.Fatal("server name found without data")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("peek lasted %v with a timeout of 100ms", elapsed)
+	}
+}
+
+func TestSNIRouting(t *testing.T) {
+	setRouting(t, `{"table": [{"rules": {"rule": "regexp", "variable": "host", "content": "^www\\.example\\.com$"}, "route": "sni"}, {"rules": {"rule": "true"}, "route": "ip"}]}`, "")
+
+	// The route is chosen with the server name of TLS connections, and with the original destination otherwise
+	for serverName, route := range map[string]string{"www.example.com": "sni", "": "ip"} {
+		record := clientHello(t, serverName)
+		client, server := tcpPair(t)
+		go client.Write(record)
+
+		routeAddr := "93.184.216.34:443"
+		_, sni, err := peekSNI(server, time.Second)
+		if err == nil {
+			routeAddr = net.JoinHostPort(sni, "443")
+		}
+		chain, _, err := getRouteFor("table", routeAddr, "")
+		if err != nil || chain != route {
+			t.Errorf("route %q (%v) instead of %q for server name %q", chain, err, route, serverName)
+		}
+	}
+}
@@ -18,7 +18,7 @@ type socks5 struct {
 
 // address returns the address where the SOCKS5 proxy is exposed, i.e. proxy.host:proxy.port
 func (p socks5) address() string {
-	return fmt.Sprintf("%s:%s", p.host, p.port)
+	return net.JoinHostPort(p.host, p.port)
 }
 
 // handshake takes net.Conn (representing a TCP socket) and an address and returns the same net.Conn connected to the provided address through the SOCKS5 proxy
@@ -34,6 +34,52 @@ func (p socks5) handshake(conn net.Conn, address string) (err error) {
 
 	reader := bufio.NewReader(conn)
 
+	err = p.negotiate(conn, reader)
+	if err != nil {
+		return
+	}
+
+	err = p.request(conn, cmdConnect, address)
+	if err != nil {
+		return
+	}
+
+	_, err = p.readReply(reader)
+	return
+}
+
+// bind takes net.Conn (representing a TCP socket) connected to the SOCKS5 proxy and the address of the peer expected to connect,
+// sends a BIND request and returns the address the proxy listens on for the peer, received in the first BIND reply (see RFC 1928)
+func (p socks5) bind(conn net.Conn, address string) (bound string, err error) {
+	gMetaLogger.Debugf("Entering SOCKS5 bind(%v, %v)", conn, address)
+	defer func() { gMetaLogger.Debugf("Exiting SOCKS5 bind(%v, %v)", conn, address) }()
+
+	if conn == nil {
+		err = fmt.Errorf("nil conn was provided")
+		return
+	}
+
+	// Replies are read without buffering, so that no data sent by the peer after the second reply is lost
+	err = p.negotiate(conn, conn)
+	if err != nil {
+		return
+	}
+
+	err = p.request(conn, cmdBind, address)
+	if err != nil {
+		return
+	}
+
+	return p.readReply(conn)
+}
+
+// acceptBind waits on conn, on which bind succeeded, for the second BIND reply, sent by the SOCKS5 proxy when the peer connects, and returns the address of the peer
+func (p socks5) acceptBind(conn net.Conn) (peer string, err error) {
+	return p.readReply(conn)
+}
+
+// negotiate sends the authentication methods supported on conn and checks the one selected by the SOCKS5 proxy, read from reader
+func (p socks5) negotiate(conn net.Conn, reader io.Reader) (err error) {
 	if p.user != "" {
 		//Means that user/password authentication method (0x02) is supported
 		_, err = conn.Write([]byte{5, 2, 0, 2})
@@ -65,16 +111,56 @@ func (p socks5) handshake(conn net.Conn, address string) (err error) {
 	case 0:
 
 	case 2:
-		err = fmt.Errorf("user/password method not yet implemented")
-		return
+		if p.user == "" {
+			err = refusalError{"user/password method selected while no credentials were offered"}
+			return
+		}
+		err = p.authenticate(conn, reader)
 	default:
-		err = fmt.Errorf("unsupported authentication mechanism")
+		err = refusalError{"unsupported authentication mechanism"}
+	}
+
+	return
+}
+
+// authenticate performs the user/password authentication (see RFC 1929) on conn, reading the proxy's response from reader
+func (p socks5) authenticate(conn net.Conn, reader io.Reader) (err error) {
+	//Send the request |VER|ULEN|UNAME|PLEN|PASSWD|, with lengths checked when the proxy is loaded
+	buff := make([]byte, 0, 3+len(p.user)+len(p.pass))
+	buff = append(buff, 1, byte(len(p.user)))
+	buff = append(buff, p.user...)
+	buff = append(buff, byte(len(p.pass)))
+	buff = append(buff, p.pass...)
+
+	_, err = conn.Write(buff)
+	if err != nil {
 		return
 	}
 
-	buff = make([]byte, 4, 260)
+	//Read server response containing |VER|STATUS|
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(reader, resp)
+	if err != nil {
+		err = fmt.Errorf("error reading SOCKS5 authentication response: %w", err)
+		return
+	}
+
+	if resp[0] != byte(1) {
+		err = fmt.Errorf("SOCKS5 server's user/password authentication version != 1")
+		return
+	}
+	if resp[1] != byte(0) {
+		err = refusalError{"user/password authentication failed"}
+	}
+
+	return
+}
+
+// request sends on conn a SOCKS5 request with command cmd for address
+func (p socks5) request(conn net.Conn, cmd byte, address string) (err error) {
+	buff := make([]byte, 4, 260)
 	buff[0] = byte(5)
-	buff[1] = byte(1)
+	buff[1] = cmd
 	buff[2] = byte(0)
 
 	addrBytes, atyp, err := stringToAddr(address)
@@ -90,8 +176,12 @@ func (p socks5) handshake(conn net.Conn, address string) (err error) {
 		return
 	}
 	gMetaLogger.Debugf("sent the following SOCKS request: %v", buff)
+	return
+}
 
-	buff = make([]byte, 4)
+// readReply reads a SOCKS5 reply from reader and returns its bound address, or an error describing the reply code if the request failed
+func (p socks5) readReply(reader io.Reader) (bound string, err error) {
+	buff := make([]byte, 4)
 	_, err = io.ReadFull(reader, buff)
 	if err != nil {
 		err = fmt.Errorf("error reading SOCKS response: %w", err)
@@ -104,7 +194,7 @@ func (p socks5) handshake(conn net.Conn, address string) (err error) {
 		case 0x01:
 			err = fmt.Errorf("general SOCKS server failure")
 		case 0x02:
-			err = fmt.Errorf("connection not allowed by ruleset")
+			err = refusalError{"connection not allowed by ruleset"}
 		case 0x03:
 			err = fmt.Errorf("network unreachable")
 		case 0x04:
@@ -114,19 +204,47 @@ func (p socks5) handshake(conn net.Conn, address string) (err error) {
 		case 0x06:
 			err = fmt.Errorf("TTL expired")
 		case 0x07:
-			err = fmt.Errorf("command not supported")
+			err = refusalError{"command not supported"}
 		case 0x08:
 			err = fmt.Errorf("address type not supported")
 		default:
 			err = fmt.Errorf("custom SOCKS5 error byte %v", rep)
 		}
+		// The reply code is kept along with the error, to be relayed to SOCKS5 clients
+		err = socks5ReplyError{rep: rep, err: err}
 		return
 	}
 
-	err = nil
+	bound, err = addrToString(reader, buff[3])
+	if err != nil {
+		err = fmt.Errorf("error reading SOCKS response bound address: %w", err)
+	}
 	return
 }
 
+// socks5ReplyError is returned by the SOCKS5 proxies' handshakes when the proxy replied with a failure code rep, described by err, and when a destination is refused with code rep
+type socks5ReplyError struct {
+	rep byte
+	err error
+}
+
+func (e socks5ReplyError) Error() string {
+	return e.err.Error()
+}
+
+func (e socks5ReplyError) Unwrap() error {
+	return e.err
+}
+
+// replyCode returns the SOCKS5 reply code to send to clients whose request failed with err: the failure code of the upstream proxy if err is a socks5ReplyError, and general failure otherwise
+func replyCode(err error) byte {
+	var replyErr socks5ReplyError
+	if errors.As(err, &replyErr) {
+		return replyErr.rep
+	}
+	return repGeneralFailure
+}
+
 // stringToAddr takes a address string (format host:port) and returns the SOCKS5 defined address type atyp and the address bytes data in the SOCKS5 format (see RFC 1928)
 func stringToAddr(addr string) (data []byte, atyp byte, err error) {
 	host, port, err := net.SplitHostPort(addr)
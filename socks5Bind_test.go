@@ -0,0 +1,176 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startBindUpstream starts a SOCKS5 proxy only supporting BIND, which listens for the peer on the loopback interface and relays its connection,
+// and returns it along with a channel receiving the peer address of each BIND request
+func startBindUpstream(t *testing.T) (proxy, <-chan string) {
+	t.Helper()
+
+	l := listenTCP(t)
+	requests := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+
+				// Method selection, then BIND request
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(conn, req); err != nil || req[1] != cmdBind {
+					return
+				}
+				peer, err := addrToString(conn, req[3])
+				if err != nil {
+					return
+				}
+				requests <- peer
+
+				peerListener, err := net.Listen("tcp4", "127.0.0.1:0")
+				if err != nil {
+					return
+				}
+				defer peerListener.Close()
+				writeSocks5AddrReply(conn, repSucceeded, peerListener.Addr().String())
+
+				peerConn, err := peerListener.Accept()
+				if err != nil {
+					return
+				}
+				defer peerConn.Close()
+				writeSocks5AddrReply(conn, repSucceeded, peerConn.RemoteAddr().String())
+
+				go io.Copy(peerConn, conn)
+				io.Copy(conn, peerConn)
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, requests
+}
+
+// startBindServer starts a SOCKS5 server relaying through chain, and returns its address
+func startBindServer(t *testing.T, chain proxyChain) string {
+	t.Helper()
+
+	setChains(t, chain)
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "`+chain.name+`"}]}`, "")
+	return startServer(t, "socks5://127.0.0.1:"+freePort(t)+":table").address()
+}
+
+// socks5Bind connects to the SOCKS5 server at srv and sends a BIND request for peer, and returns the connection to the server along with the first reply
+func socks5Bind(t *testing.T, srv string, peer string) (net.Conn, byte, string) {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", srv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if socks5Greet(t, conn, 0) != 0 {
+		t.Fatal("no authentication method refused")
+	}
+	rep, bound := socks5Request(t, conn, cmdBind, peer)
+	return conn, rep, bound
+}
+
+func TestSocks5Bind(t *testing.T) {
+	upstream, requests := startBindUpstream(t)
+	srv := startBindServer(t, testChain("bind", upstream))
+
+	conn, rep, bound := socks5Bind(t, srv, "127.0.0.1:4321")
+	if rep != repSucceeded {
+		t.Fatalf("BIND failed with reply %v", rep)
+	}
+	select {
+	case peer := <-requests:
+		if peer != "127.0.0.1:4321" {
+			t.Errorf("upstream received BIND request for %v instead of 127.0.0.1:4321", peer)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upstream received no BIND request")
+	}
+
+	// The peer connects to the address of the first reply, whose address is sent in the second reply
+	peerConn, err := net.DialTimeout("tcp", bound, time.Second)
+	if err != nil {
+		t.Fatalf("error connecting to the bound address %v: %v", bound, err)
+	}
+	defer peerConn.Close()
+	rep, connected := socks5ReadReply(t, conn)
+	if rep != repSucceeded || connected != peerConn.LocalAddr().String() {
+		t.Fatalf("second BIND reply %v with peer %v instead of %v", rep, connected, peerConn.LocalAddr())
+	}
+
+	// Data is relayed both ways between the client and the peer
+	conn.Write([]byte("to peer"))
+	if got := readN(t, peerConn, 7); got != "to peer" {
+		t.Errorf("peer received %q", got)
+	}
+	peerConn.Write([]byte("to client"))
+	if got := readN(t, conn, 9); got != "to client" {
+		t.Errorf("client received %q", got)
+	}
+}
+
+func TestSocks5BindTimeout(t *testing.T) {
+	setArg(t, &gArgBindTimeout, 200*time.Millisecond)
+	upstream, _ := startBindUpstream(t)
+	srv := startBindServer(t, testChain("bind", upstream))
+
+	conn, rep, _ := socks5Bind(t, srv, "127.0.0.1:4321")
+	if rep != repSucceeded {
+		t.Fatalf("BIND failed with reply %v", rep)
+	}
+
+	// Without peer connecting, the second reply is a failure
+	start := time.Now()
+	rep, _ = socks5ReadReply(t, conn)
+	if rep == repSucceeded {
+		t.Fatal("second BIND reply succeeded without peer")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("second BIND reply sent after %v with a timeout of 200ms", elapsed)
+	}
+}
+
+func TestSocks5BindUnsupported(t *testing.T) {
+	// Chains without proxies cannot bind, and HTTP proxies do not support BIND
+	http, err := newProxy("http", "127.0.0.1", "1", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chain := range []proxyChain{testChain("direct"), testChain("http", http)} {
+		srv := startBindServer(t, chain)
+		conn, rep, _ := socks5Bind(t, srv, "127.0.0.1:4321")
+		if rep == repSucceeded {
+			t.Errorf("BIND through chain %v succeeded", chain.name)
+		}
+		if !isClosed(conn, time.Second) {
+			t.Errorf("connection kept after BIND through chain %v failed", chain.name)
+		}
+	}
+}
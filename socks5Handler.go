@@ -3,11 +3,30 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/subtle"
+	"fmt"
 	"io"
 	"net"
+	"time"
+
+	"github.com/synacktiv/bbs/logger"
 )
 
-type socks5Handler struct{}
+type socks5Handler struct {
+	user  string // if not empty, clients must authenticate with the user/password method (see RFC 1929) with user and pass
+	pass  string
+	group string // if not empty, clients must authenticate with the user/password method with a credential of this user group
+
+	replyAddr string // bound address of success replies: "ipv4" or empty (IPv4 zero address), "ipv6" (IPv6 zero address) or "local" (local address of the connection to the target)
+
+	handshakeTimeout time.Duration // maximum time clients have to complete the negotiation, 0 to disable
+	proxyDns         string        // if "true" or "false", overrides the proxyDns parameter of the chains used
+	blockPrivate     bool          // if true, connections to destinations in private or reserved ranges are refused
+}
+
+func (h socks5Handler) String() string {
+	return fmt.Sprintf("socks5Handler{auth:%v, group:%v, replyAddr:%v, handshakeTimeout:%v, proxyDns:%v, blockPrivate:%v}", h.user != "", h.group, h.replyAddr, h.handshakeTimeout, h.proxyDns, h.blockPrivate)
+}
 
 // connHandle handles the connection of a client on the input SOCKS5 listener.
 // It parses the SOCKS command, establishes a connection to the requested host through the right chain (found in routingtable table),
@@ -18,10 +37,18 @@ func (h socks5Handler) connHandle(client net.Conn, table string, ctx context.Con
 
 	defer client.Close()
 
+	// Span covering the whole session, parent of the routing decision and proxy handshakes spans
+	ctx, span := startSpan(ctx, "socks5.session")
+	defer span.end()
+	span.setAttribute("client", client.RemoteAddr().String())
+
 	// ***** BEGIN SOCKS5 input parsing *****
 
 	// Parse SOCKS5 input to retrieve command, target host and target port (see RFC 1928)
 
+	// Clients must complete the negotiation within the server's clientHandshakeTimeout
+	setNegotiationDeadline(client, h.handshakeTimeout)
+
 	reader := bufio.NewReader(client)
 
 	// Read version and number of methods
@@ -29,11 +56,13 @@ func (h socks5Handler) connHandle(client net.Conn, table string, ctx context.Con
 	_, err := io.ReadFull(reader, buff)
 	if err != nil {
 		gMetaLogger.Errorf("could not read on client socket: %v", err)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
 	if buff[0] != 5 {
 		gMetaLogger.Error("only SOCKS5 is supported")
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
@@ -44,19 +73,28 @@ func (h socks5Handler) connHandle(client net.Conn, table string, ctx context.Con
 	_, err = io.ReadFull(reader, buff)
 	if err != nil {
 		gMetaLogger.Errorf("could not read on client socket: %v", err)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 	gMetaLogger.Debugf("Following methods are proposed: %v", buff)
 
-	method := byte(255)
+	// If credentials are configured, only the user/password method (0x02) is accepted, otherwise only the no authentication method (0x00) is
+	accepted := byte(0)
+	if h.user != "" || h.group != "" {
+		accepted = 2
+	}
+
+	method := methodNoAcceptable
 	for _, m := range buff {
-		if m == 0 {
-			method = 0
+		if m == accepted {
+			method = accepted
 		}
 	}
 
-	if method == 255 {
+	if method == methodNoAcceptable {
 		gMetaLogger.Error("no accepted methods proposed by the client")
+		client.Write([]byte{5, methodNoAcceptable})
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
@@ -64,126 +102,357 @@ func (h socks5Handler) connHandle(client net.Conn, table string, ctx context.Con
 	_, err = client.Write([]byte{5, method})
 	if err != nil {
 		gMetaLogger.Error(err)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 	gMetaLogger.Debugf("sending SOCKS answer, accepting method %v", method)
 
+	// Chain used for all the connections of the client, without routing, if overridden by its credential
+	var chainOverride string
+
+	if method == 2 {
+		user, desc, err := h.authenticate(client, reader)
+		if err != nil {
+			gMetaLogger.Errorf("authentication of client %v failed: %v", client.RemoteAddr(), err)
+			gBanList.fail(client.RemoteAddr())
+			return
+		}
+		annotateConn(ctx, "user", user)
+		span.setAttribute("user", user)
+
+		if desc.Table != "" {
+			gMetaLogger.Debugf("user %v overrides routing table %v with %v", user, table, desc.Table)
+			table = desc.Table
+		}
+		chainOverride = desc.Chain
+	}
+
 	// Read version, cmd, rsv and atyp
 	buff = make([]byte, 4)
 	_, err = io.ReadFull(reader, buff)
 	if err != nil {
 		gMetaLogger.Error(err)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
 	cmd := buff[1]
 	atyp := buff[3]
 
-	// Only connect command is supported
-	if cmd != cmdConnect {
-		gMetaLogger.Errorf("only CONNECT (0x01) SOCKS command is supported, not 0x0%v", cmd)
-		client.Write([]byte{5, 7})
+	// Only connect, bind and UDP associate commands are supported
+	if cmd != cmdConnect && cmd != cmdBind && cmd != cmdUDPAssociate {
+		gMetaLogger.Errorf("only CONNECT (0x01), BIND (0x02) and UDP ASSOCIATE (0x03) SOCKS commands are supported, not 0x0%v", cmd)
+		writeSocks5Reply(client, repCmdNotSupported)
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
 	addr, err := addrToString(reader, atyp)
 	if err != nil {
 		gMetaLogger.Error(err)
-		client.Write([]byte{5, 1})
+		if atyp != atypIPV4 && atyp != atypDomain && atyp != atypIPV6 {
+			writeSocks5Reply(client, repAtypNotSupported)
+		} else {
+			writeSocks5Reply(client, repGeneralFailure)
+		}
+		gBanList.fail(client.RemoteAddr())
 		return
 	}
 
 	gMetaLogger.Debugf("received SOCKS CMD packet : cmd=%v - atype=%v - addr=%s\n", cmd, atyp, addr)
 
+	clearNegotiationDeadline(client, h.handshakeTimeout)
+
+	if cmd == cmdUDPAssociate {
+		h.udpAssociate(client, table, chainOverride, ctx)
+		return
+	}
+
 	// ***** END SOCKS5 input parsing *****
 
+	annotateConn(ctx, "target", addr)
+	span.setAttribute("target", addr)
+	gScanDetector.record(client.RemoteAddr(), addr)
+
 	// ***** BEGIN Routing decision *****
 
 	// Decide which chain to use based on the target address
 
+	_, routeSpan := startSpan(ctx, "route")
+	routeSpan.setAttribute("target", addr)
+
 	var chainStr string
+	var rewrite string
 
-	if gArgPACPath != "" {
-		// -pac flag defined, use PAC to find the chain
-		chainStr, err = getRouteWithPAC(addr)
-
-		if err != nil {
-			gMetaLogger.Errorf("error getting route PAC: %v", err)
-			client.Write([]byte{5, 1})
-			return
-		}
+	if chainOverride != "" {
+		// the client's credential defines the chain to use
+		chainStr = chainOverride
 
 	} else {
-		// use JSON config to find the chain
-		gRoutingConf.mu.RLock()
-		table, ok := gRoutingConf.routing[table]
-		if !ok {
-			gMetaLogger.Errorf("table %v not defined in routing configuration", table)
-			client.Write([]byte{5, 1})
-			gRoutingConf.mu.RUnlock()
-			return
-		}
-		chainStr, err = table.getRoute(addr)
-		gRoutingConf.mu.RUnlock()
+		// use the PAC script if -pac is defined, and the JSON config starting with routing table table otherwise
+		chainStr, rewrite, err = getRouteFor(table, addr, listenerOf(ctx))
 
 		if err != nil {
-			gMetaLogger.Errorf("error getting route with JSON conf: %v", err)
-			client.Write([]byte{5, 1})
+			gMetaLogger.Errorf("error getting route: %v", err)
+			gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "socks5", Client: client.RemoteAddr().String(), Dest: addr, Detail: err.Error()})
+			writeSocks5Reply(client, repGeneralFailure)
+			routeSpan.recordError(err)
+			routeSpan.end()
+			span.recordError(err)
 			return
 		}
 	}
 
 	gMetaLogger.Debugf("chain to use for %v: %v\n", addr, chainStr)
+	annotateConn(ctx, "chain", chainStr)
+	routeSpan.setAttribute("chain", chainStr)
+	routeSpan.end()
+	span.setAttribute("chain", chainStr)
+
+	if chainStr == bypassRoute {
+		gMetaLogger.Debugf("%v is in the bypass list, connecting directly", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "BYPASS", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+	}
+
+	if chainStr == "reject" {
+		gMetaLogger.Debugf("rejecting connection to %v", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "REJECTED", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+		writeSocks5Reply(client, repNotAllowed)
+		return
+	}
 
 	if chainStr == "drop" {
 		gMetaLogger.Debugf("dropping connection to %v", addr)
-		gMetaLogger.Auditf("| DROPPED\t| %v\t| %v\t| %v\n", &client, chainStr, addr)
-		client.Write([]byte{5, 2})
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "DROPPED", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+		return
+	}
+
+	if chainStr == "tarpit" {
+		gMetaLogger.Debugf("tarpitting connection to %v", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "TARPIT", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+		tarpit(ctx, client)
 		return
 	}
 
+	// Rewrite the destination address if required by the matching block, the rewritten address is not routed again
+	if rewrite != "" {
+		rewritten, err := rewriteAddress(addr, rewrite)
+		if err != nil {
+			gMetaLogger.Errorf("error rewriting destination %v: %v", addr, err)
+			gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: err.Error()})
+			writeSocks5Reply(client, repGeneralFailure)
+			return
+		}
+		gMetaLogger.Debugf("rewriting destination %v to %v", addr, rewritten)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "REWRITE", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: rewritten})
+		annotateConn(ctx, "rewritten", rewritten)
+		addr = rewritten
+	}
+
 	gChainsConf.mu.RLock()
 	chain, ok := gChainsConf.proxychains[chainStr]
 	gChainsConf.mu.RUnlock()
 
 	if !ok {
 		gMetaLogger.Errorf("chain '%v' is not declared in configuration", chainStr)
-		client.Write([]byte{5, 1})
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: "chain not declared"})
+		writeSocks5Reply(client, repGeneralFailure)
 		return
 	}
 
+	// The server's proxyDns option takes precedence over the chain's one
+	chain = overrideProxyDns(chain, h.proxyDns)
+	chain = guardPrivate(chain, h.blockPrivate)
+
 	// ***** END Routing decision *****
 
 	// ***** BEGIN Connection to target host  *****
 
-	//Connect to chain
-	target, chainRepresentation, err := chain.connect(ctx, addr)
+	//Connect to chain, or wait for the connection of the peer through the chain for BIND requests
+	// A client hanging up meanwhile aborts the connection establishment
+	var target net.Conn
+	var chainRepresentation string
+	stopWatch := watchClient(client, cancel)
+	if cmd == cmdBind {
+		target, chainRepresentation, err = h.bind(client, chain, addr, ctx)
+	} else {
+		target, chainRepresentation, err = chain.connect(ctx, addr)
+	}
+	client = stopWatch()
+	annotateConn(ctx, "path", chainRepresentation)
+	// Address the requested hostname was resolved to locally (proxyDns=false or custom hosts), if any, recorded along with it in audit traces
+	resolved := annotationOf(ctx, "resolved")
 
 	if err != nil {
 		gMetaLogger.Error(err)
-		gMetaLogger.Auditf("| ERROR\t| %v\t| %v\t| %v\t| %v\n", &client, chainStr, addr, chainRepresentation)
-		client.Write([]byte{5, 1})
+		span.recordError(err)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: connectErrorEvent(err), Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation, Detail: err.Error()})
+		// The failure code of the last proxy, if it is a SOCKS5 one, is relayed to the client
+		writeSocks5Reply(client, replyCode(err))
 		return
 	}
 	defer target.Close()
 
-	gMetaLogger.Debugf("Client %v connected to host %v through chain %v", client, addr, chainStr)
+	gMetaLogger.Debugf("Client %v connected to host %v through chain %v", client.RemoteAddr(), addr, chainStr)
 
 	// Create auditing trace for connection opening and defering closing trace
 
-	gMetaLogger.Auditf("| OPEN\t| %v\t| %v\t| %v\t| %v\n", &client, chainStr, addr, chainRepresentation)
-	defer gMetaLogger.Auditf("| CLOSE\t| %v\t| %v\t| %v\t| %v\n", &client, chainStr, addr, chainRepresentation)
+	gMetaLogger.AuditEvent(logger.AuditEvent{Event: "OPEN", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation})
+	start := time.Now()
+	var bytesUp, bytesDown int64
+	defer func() {
+		span.setAttribute("bytesUp", bytesUp)
+		span.setAttribute("bytesDown", bytesDown)
+		chain.stats().closed(bytesUp, bytesDown)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "CLOSE", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation, BytesUp: bytesUp, BytesDown: bytesDown, DurationMs: time.Since(start).Milliseconds()})
+	}()
+
+	//Terminate SOCKS5 handshake with client, BIND replies are already sent
+	if cmd == cmdConnect {
+		err = h.writeSuccessReply(client, target)
+		if err != nil {
+			gMetaLogger.Error(err)
+			return
+		}
+		gMetaLogger.Debugf("sent SOCKS success response")
+	}
 
-	//Terminate SOCKS5 handshake with client
-	_, err = client.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	// ***** END Connection to target host  *****
+
+	// Apply the chain's TCP options to both ends of the relay
+	chain.setSocketOptions(client, target)
+
+	// Tear down the connection once the chain's maximum lifetime is reached, whatever its activity
+	relayCtx, lifetimeReached := lifetimeContext(ctx, time.Duration(chain.maxLifetime)*time.Millisecond)
+
+	bytesUp, bytesDown = relay(relayCtx, client, target, time.Duration(chain.firstDataTimeout)*time.Millisecond, time.Duration(chain.idleTimeout)*time.Millisecond)
+
+	if lifetimeReached() {
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "LIFETIME", Handler: "socks5", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, ChainRepr: chainRepresentation, Detail: fmt.Sprintf("maximum lifetime of %vms reached", chain.maxLifetime)})
+	}
+
+}
+
+// bind handles a SOCKS5 BIND request for peer received on client (see RFC 1928). It asks the last proxy of chain to listen for the connection of peer,
+// sends to client the first reply with the address the proxy listens on, waits during at most -bind-timeout for the peer to connect and sends the second reply with its address.
+// It returns a net.Conn relaying the connection of the peer.
+func (h socks5Handler) bind(client net.Conn, chain proxyChain, peer string, ctx context.Context) (net.Conn, string, error) {
+	conn, last, bound, repr, err := chain.bind(ctx, peer)
 	if err != nil {
-		gMetaLogger.Error(err)
-		return
+		return nil, repr, err
 	}
-	gMetaLogger.Debugf("sent SOCKS success response")
 
-	// ***** END Connection to target host  *****
+	err = writeSocks5AddrReply(client, repSucceeded, bound)
+	if err != nil {
+		conn.Close()
+		return nil, repr, err
+	}
+	gMetaLogger.Debugf("sent first SOCKS BIND response, waiting for %v on %v", peer, bound)
+
+	// Waiting for the peer is interrupted by the timeout, or when the server is stopped
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if gArgBindTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(gArgBindTimeout))
+	}
+
+	connected, err := last.acceptBind(conn)
+	if err != nil {
+		conn.Close()
+		err = fmt.Errorf("error waiting for the connection of %v on %v: %w", peer, bound, err)
+		return nil, repr, err
+	}
+	conn.SetReadDeadline(time.Time{})
+	repr += fmt.Sprintf(" <=== %v", connected)
+
+	err = writeSocks5AddrReply(client, repSucceeded, connected)
+	if err != nil {
+		conn.Close()
+		return nil, repr, err
+	}
+	gMetaLogger.Debugf("sent second SOCKS BIND response, %v connected", connected)
+
+	return conn, repr, nil
+}
+
+// writeSocks5Reply sends to client a SOCKS5 reply with code rep and an empty IPv4 bound address (see RFC 1928)
+func writeSocks5Reply(client net.Conn, rep byte) error {
+	_, err := client.Write([]byte{5, rep, 0, atypIPV4, 0, 0, 0, 0, 0, 0})
+	return err
+}
 
-	relay(client, target)
+// writeSuccessReply sends to client a SOCKS5 succeeded reply to a CONNECT request, whose bound address is represented according to the server's replyAddr option.
+// The "local" representation uses the local address of target, the connection to the target host (or to the first proxy of the chain).
+func (h socks5Handler) writeSuccessReply(client net.Conn, target net.Conn) error {
+	switch h.replyAddr {
+	case "ipv6":
+		_, err := client.Write(append([]byte{5, repSucceeded, 0, atypIPV6}, make([]byte, net.IPv6len+2)...))
+		return err
+	case "local":
+		return writeSocks5AddrReply(client, repSucceeded, target.LocalAddr().String())
+	default:
+		return writeSocks5Reply(client, repSucceeded)
+	}
+}
+
+// writeSocks5AddrReply sends to client a SOCKS5 reply with code rep and bound address addr (format host:port, see RFC 1928)
+func writeSocks5AddrReply(client net.Conn, rep byte, addr string) error {
+	bndAddr, atyp, err := stringToAddr(addr)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.Write(append([]byte{5, rep, 0, atyp}, bndAddr...))
+	return err
+}
+
+// authenticate performs the user/password sub-negotiation (see RFC 1929) with client, reading from reader, and reports an error if the credentials do not match the configured ones.
+// It returns the authenticated user, and its credential description if the server authenticates clients with a user group.
+func (h socks5Handler) authenticate(client net.Conn, reader *bufio.Reader) (string, userDesc, error) {
+	// Read version and user length
+	buff := make([]byte, 2)
+	_, err := io.ReadFull(reader, buff)
+	if err != nil {
+		return "", userDesc{}, err
+	}
+
+	if buff[0] != 1 {
+		client.Write([]byte{1, 1})
+		return "", userDesc{}, fmt.Errorf("unsupported user/password sub-negotiation version %v", buff[0])
+	}
+
+	// Read user and password length
+	user := make([]byte, int(buff[1])+1)
+	_, err = io.ReadFull(reader, user)
+	if err != nil {
+		return "", userDesc{}, err
+	}
+
+	pass := make([]byte, user[len(user)-1])
+	user = user[:len(user)-1]
+	_, err = io.ReadFull(reader, pass)
+	if err != nil {
+		return "", userDesc{}, err
+	}
+
+	// Credentials are either the server's ones, or the ones of the user in the server's user group
+	expectedUser, expectedPass := h.user, h.pass
+	var desc userDesc
+	if h.group != "" {
+		var ok bool
+		desc, ok = gUsersConf.lookup(h.group, string(user))
+		if ok {
+			expectedUser, expectedPass = string(user), desc.Pass
+		}
+	}
+
+	userOk := subtle.ConstantTimeCompare(user, []byte(expectedUser))
+	passOk := subtle.ConstantTimeCompare(pass, []byte(expectedPass))
+	if userOk&passOk != 1 || expectedPass == "" {
+		client.Write([]byte{1, 1})
+		return "", userDesc{}, fmt.Errorf("wrong credentials for user %q", user)
+	}
 
+	_, err = client.Write([]byte{1, 0})
+	return string(user), desc, err
 }
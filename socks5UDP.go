@@ -0,0 +1,300 @@
+package main
+
+// Defines the handling of the SOCKS5 UDP ASSOCIATE command on the SOCKS5 input server (see RFC 1928).
+// As upstream proxies are only used over TCP, datagrams can only be relayed through chains without proxies (direct chains),
+// or over a TCP tunnel to a cooperating endpoint through chains defining udpOverTcp (see udptunnel.go).
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/synacktiv/bbs/logger"
+)
+
+// udpFragTimeout is the reassembly timer of fragmented datagrams (RFC 1928 requires no less than 5 seconds)
+const udpFragTimeout = 5 * time.Second
+
+// udpReassembly is the reassembly queue of a fragmented SOCKS5 UDP datagram (see RFC 1928, section 7)
+type udpReassembly struct {
+	addr     string // destination of the datagram being reassembled
+	lastFrag byte   // position of the last fragment added to the queue
+	data     []byte // nil if no datagram is being reassembled
+	start    time.Time
+}
+
+// reset abandons the datagram being reassembled
+func (q *udpReassembly) reset() {
+	q.data = nil
+	q.lastFrag = 0
+}
+
+// add adds the fragment data of a datagram to addr, with SOCKS5 FRAG field frag, to the queue.
+// It returns the reassembled datagram when the fragment is the last one of the sequence, nil otherwise.
+func (q *udpReassembly) add(frag byte, addr string, data []byte) []byte {
+	position := frag & 0x7f
+	end := (frag & 0x80) != 0
+
+	// The queue is abandoned if the timer expired or if a fragment with a lower position than the last one is received
+	if q.data != nil && (position <= q.lastFrag || addr != q.addr || time.Since(q.start) > udpFragTimeout) {
+		gMetaLogger.Debugf("abandoning reassembly of datagram to %v", q.addr)
+		q.reset()
+	}
+
+	if q.data == nil {
+		q.addr = addr
+		q.start = time.Now()
+		q.data = []byte{}
+	}
+
+	q.lastFrag = position
+	q.data = append(q.data, data...)
+
+	if end {
+		datagram := q.data
+		q.reset()
+		return datagram
+	}
+	return nil
+}
+
+// udpAssociate handles a SOCKS5 UDP ASSOCIATE request received on client. It opens a UDP socket, sends its address to the client,
+// and relays datagrams between the client and their destinations (routed with routing table table, or through chain if not empty) until client is closed or ctx is done.
+func (h socks5Handler) udpAssociate(client net.Conn, table string, chain string, ctx context.Context) {
+	gMetaLogger.Debugf("Entering socks5Handler udpAssociate for connection %v", &client)
+	defer func() { gMetaLogger.Debugf("Leaving socks5Handler udpAssociate for connection %v", &client) }()
+
+	clientAddr, ok := client.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		gMetaLogger.Errorf("client address %v is not a TCP address", client.RemoteAddr())
+		writeSocks5Reply(client, repGeneralFailure)
+		return
+	}
+
+	localAddr, ok := client.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		gMetaLogger.Errorf("server address %v is not a TCP address", client.LocalAddr())
+		writeSocks5Reply(client, repGeneralFailure)
+		return
+	}
+
+	// Open the UDP socket used to relay datagrams, on the same address as the server
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP})
+	if err != nil {
+		gMetaLogger.Errorf("could not open UDP socket: %v", err)
+		writeSocks5Reply(client, repGeneralFailure)
+		return
+	}
+	defer udpConn.Close()
+
+	bndAddr, atyp, err := stringToAddr(udpConn.LocalAddr().String())
+	if err != nil {
+		gMetaLogger.Error(err)
+		writeSocks5Reply(client, repGeneralFailure)
+		return
+	}
+
+	_, err = client.Write(append([]byte{5, 0, 0, atyp}, bndAddr...))
+	if err != nil {
+		gMetaLogger.Error(err)
+		return
+	}
+	gMetaLogger.Debugf("sent SOCKS success response, relaying datagrams on %v", udpConn.LocalAddr())
+
+	gMetaLogger.AuditEvent(logger.AuditEvent{Event: "OPEN", Handler: "socks5udp", Client: client.RemoteAddr().String(), Detail: udpConn.LocalAddr().String()})
+	start := time.Now()
+	defer func() {
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "CLOSE", Handler: "socks5udp", Client: client.RemoteAddr().String(), DurationMs: time.Since(start).Milliseconds(), Detail: udpConn.LocalAddr().String()})
+	}()
+
+	// The association terminates when the client TCP connection is closed, or when the server is stopped
+	stop := context.AfterFunc(ctx, func() { udpConn.Close() })
+	defer stop()
+	go func() {
+		io.Copy(io.Discard, client)
+		udpConn.Close()
+	}()
+
+	var clientUDPAddr *net.UDPAddr // address datagrams are received from on the client side, learnt from the first datagram sent by the client IP
+	peers := make(map[string]bool) // destinations datagrams were relayed to (true), whose answers are relayed to the client, or refused by blockPrivate (false)
+	// Tunnels still being opened when the association terminates are abandoned
+	tunnelsCtx, cancelTunnels := context.WithCancel(ctx)
+	defer cancelTunnels()
+	tunnels := &udpTunnels{ctx: tunnelsCtx, udpConn: udpConn, byChain: make(map[string]*udpTunnel)}
+	defer tunnels.close()
+	var queue udpReassembly
+	buff := make([]byte, 65535)
+
+	for {
+		n, src, err := udpConn.ReadFromUDP(buff)
+		if err != nil {
+			gMetaLogger.Debugf("UDP association of client %v terminated: %v", client.RemoteAddr(), err)
+			return
+		}
+
+		if clientUDPAddr == nil && src.IP.Equal(clientAddr.IP) {
+			clientUDPAddr = src
+			tunnels.clientAddr = src
+		}
+
+		switch {
+		case clientUDPAddr != nil && src.String() == clientUDPAddr.String():
+			h.udpFromClient(udpConn, buff[:n], table, listenerOf(ctx), chain, peers, tunnels, &queue, &client)
+
+		case clientUDPAddr != nil && peers[src.String()]:
+			// Encapsulate the datagram received from a destination in a SOCKS5 UDP request header and relay it to the client
+			srcAddr, srcAtyp, err := stringToAddr(src.String())
+			if err != nil {
+				gMetaLogger.Error(err)
+				continue
+			}
+			header := append([]byte{0, 0, 0, srcAtyp}, srcAddr...)
+			_, err = udpConn.WriteToUDP(append(header, buff[:n]...), clientUDPAddr)
+			if err != nil {
+				gMetaLogger.Debugf("could not relay datagram from %v to client %v: %v", src, clientUDPAddr, err)
+			}
+
+		default:
+			gMetaLogger.Debugf("dropping datagram from unexpected source %v", src)
+		}
+	}
+}
+
+// udpFromClient parses a datagram received from the client, and relays its data to its destination if it is routed (with routing table table, for the server identified by listener) through a direct chain,
+// or through the UDP-over-TCP tunnel of its chain, opened in tunnels, if the chain defines udpOverTcp.
+// Relayed destinations are added to peers, as well as refused ones so that they are audited once. Fragmented datagrams are handled according to -socks5-udp-frag, with queue as reassembly queue.
+func (h socks5Handler) udpFromClient(udpConn *net.UDPConn, datagram []byte, table string, listener string, chainOverride string, peers map[string]bool, tunnels *udpTunnels, queue *udpReassembly, client *net.Conn) {
+
+	// Parse the SOCKS5 UDP request header |RSV|FRAG|ATYP|DST.ADDR|DST.PORT|
+	if len(datagram) < 4 {
+		gMetaLogger.Debugf("dropping datagram too short to contain a SOCKS5 UDP request header")
+		return
+	}
+	frag := datagram[2]
+	atyp := datagram[3]
+
+	reader := bytes.NewReader(datagram[4:])
+	addr, err := addrToString(reader, atyp)
+	if err != nil {
+		gMetaLogger.Debugf("dropping datagram with invalid SOCKS5 UDP request header: %v", err)
+		return
+	}
+	data := datagram[len(datagram)-reader.Len():]
+
+	if frag != 0 {
+		switch gArgUDPFragPolicy {
+		case "reassemble":
+			data = queue.add(frag, addr, data)
+			if data == nil {
+				return
+			}
+			gMetaLogger.Debugf("datagram to %v reassembled (%v bytes)", addr, len(data))
+		default:
+			gMetaLogger.Debugf("dropping fragmented datagram to %v (FRAG=%v)", addr, frag)
+			return
+		}
+	}
+
+	// Routing decision, unless the chain is overridden by the client's credential. Only direct chains and chains defining udpOverTcp can be used for datagrams
+	chainStr, rewrite := chainOverride, ""
+	if chainStr == "" {
+		var err error
+		chainStr, rewrite, err = getRouteFor(table, addr, listener)
+		if err != nil {
+			gMetaLogger.Errorf("error getting route for datagram: %v", err)
+			return
+		}
+	}
+
+	if isSpecialRoute(chainStr) {
+		gMetaLogger.Debugf("dropping datagram to %v routed to %v", addr, chainStr)
+		return
+	}
+
+	gChainsConf.mu.RLock()
+	chain, ok := gChainsConf.proxychains[chainStr]
+	gChainsConf.mu.RUnlock()
+
+	if !ok {
+		gMetaLogger.Errorf("chain '%v' is not declared in configuration", chainStr)
+		return
+	}
+
+	if len(chain.proxies) != 0 && chain.udpOverTcp == "" {
+		gMetaLogger.Errorf("dropping datagram to %v: chain '%v' is not a direct chain and does not define udpOverTcp, UDP can only be relayed without proxies", addr, chainStr)
+		return
+	}
+
+	// Apply the destination rewrite of the matching block, custom hosts, then resolve the destination locally
+	dstAddr := addr
+	if rewrite != "" {
+		dstAddr, err = rewriteAddress(addr, rewrite)
+		if err != nil {
+			gMetaLogger.Errorf("error rewriting datagram destination %v: %v", addr, err)
+			return
+		}
+	}
+
+	// Datagrams of chains with proxies are framed over the chain's tunnel to dest
+	sendTunneled := func(dest string) {
+		clientAddr := (*client).RemoteAddr().String()
+		err := tunnels.send(chain, dest, data, func(chainRepr string) {
+			gMetaLogger.AuditEvent(logger.AuditEvent{Event: "RELAY", Handler: "socks5udp", Client: clientAddr, Chain: chainStr, Dest: addr, ChainRepr: chainRepr, Detail: "udpOverTcp"})
+		})
+		if err != nil {
+			gMetaLogger.Error(err)
+		}
+	}
+
+	// The cooperating endpoint resolves the destination of tunneled datagrams, unless blockPrivate is set: it is then resolved and checked locally first,
+	// and the datagram is framed with the resolved address, as the address resolved by the endpoint could be in a blocked range
+	if len(chain.proxies) != 0 && !h.blockPrivate {
+		sendTunneled(dstAddr)
+		return
+	}
+
+	host, port, err := net.SplitHostPort(dstAddr)
+	if err != nil {
+		gMetaLogger.Error(err)
+		return
+	}
+	if resolved, ok := currentHosts()[host]; ok {
+		host = resolved
+	}
+
+	dst, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, port))
+	if err != nil {
+		gMetaLogger.Errorf("could not resolve datagram destination %v: %v", addr, err)
+		return
+	}
+
+	if h.blockPrivate {
+		err = checkDestination(dst.String())
+		if err != nil {
+			gMetaLogger.Debugf("dropping datagram to %v: %v", addr, err)
+			if _, seen := peers[dst.String()]; !seen {
+				peers[dst.String()] = false
+				gMetaLogger.AuditEvent(logger.AuditEvent{Event: "DENIED", Handler: "socks5udp", Client: (*client).RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: dst.IP.String(), Detail: err.Error()})
+			}
+			return
+		}
+	}
+
+	if len(chain.proxies) != 0 {
+		sendTunneled(dst.String())
+		return
+	}
+
+	if !peers[dst.String()] {
+		peers[dst.String()] = true
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "RELAY", Handler: "socks5udp", Client: (*client).RemoteAddr().String(), Chain: chainStr, Dest: addr, ChainRepr: fmt.Sprintf("---> %v", dst)})
+	}
+
+	_, err = udpConn.WriteToUDP(data, dst)
+	if err != nil {
+		gMetaLogger.Debugf("could not relay datagram to %v: %v", dst, err)
+	}
+}
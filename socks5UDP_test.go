@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// startUDPEchoServer starts a UDP server sending back the datagrams it receives, and returns its address
+func startUDPEchoServer(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buff := make([]byte, 65535)
+		for {
+			n, src, err := conn.ReadFromUDP(buff)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buff[:n], src)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// socks5UDPAssociate requests a UDP association to the SOCKS5 server at srv, and returns a UDP socket connected to the relay of the association.
+// The association lasts until the end of the test.
+func socks5UDPAssociate(t *testing.T, srv string) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", srv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	socks5Greet(t, conn, 0)
+	rep, relayAddr := socks5Request(t, conn, cmdUDPAssociate, "0.0.0.0:0")
+	if rep != 0 {
+		t.Fatalf("UDP association failed with reply %v", rep)
+	}
+	conn.SetDeadline(time.Time{})
+
+	raddr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { udpConn.Close() })
+	return udpConn
+}
+
+// readUDPReply reads a datagram relayed to the client on udpConn within timeout, and returns its source and data, or false if none is received
+func readUDPReply(t *testing.T, udpConn *net.UDPConn, timeout time.Duration) (string, []byte, bool) {
+	t.Helper()
+
+	buff := make([]byte, 65535)
+	udpConn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := udpConn.Read(buff)
+	if err != nil {
+		return "", nil, false
+	}
+
+	if n < 4 || buff[2] != 0 {
+		t.Fatalf("invalid SOCKS5 UDP header in relayed datagram %v", buff[:n])
+	}
+	reader := bytes.NewReader(buff[4:n])
+	src, err := addrToString(reader, buff[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return src, buff[n-reader.Len() : n], true
+}
+
+func TestUDPReassembly(t *testing.T) {
+	var q udpReassembly
+
+	if q.add(1, "192.0.2.1:53", []byte("ab")) != nil || q.add(2, "192.0.2.1:53", []byte("cd")) != nil {
+		t.Fatal("datagram returned before its last fragment")
+	}
+	datagram := q.add(3|0x80, "192.0.2.1:53", []byte("ef"))
+	if string(datagram) != "abcdef" {
+		t.Fatalf("reassembled datagram is %q instead of abcdef", datagram)
+	}
+
+	// A fragment with a lower position than the last one abandons the datagram being reassembled
+	q.add(1, "192.0.2.1:53", []byte("ab"))
+	q.add(2, "192.0.2.1:53", []byte("cd"))
+	datagram = q.add(1|0x80, "192.0.2.1:53", []byte("xy"))
+	if string(datagram) != "xy" {
+		t.Fatalf("reassembled datagram is %q instead of xy", datagram)
+	}
+
+	// So does a fragment to another destination
+	q.add(1, "192.0.2.1:53", []byte("ab"))
+	datagram = q.add(2|0x80, "192.0.2.2:53", []byte("cd"))
+	if string(datagram) != "cd" {
+		t.Fatalf("reassembled datagram is %q instead of cd", datagram)
+	}
+}
+
+func TestUDPAssociateRelay(t *testing.T) {
+	echo := startUDPEchoServer(t)
+	udpConn := socks5UDPAssociate(t, startDirectServer(t))
+
+	_, err := udpConn.Write(append(udpHeader(t, echo, 0), "ping"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, data, ok := readUDPReply(t, udpConn, 2*time.Second)
+	if !ok {
+		t.Fatal("no answer relayed")
+	}
+	if src != echo || string(data) != "ping" {
+		t.Fatalf("relayed answer %q from %v instead of ping from %v", data, src, echo)
+	}
+}
+
+func TestUDPFragmentsDropped(t *testing.T) {
+	setArg(t, &gArgUDPFragPolicy, "drop")
+	echo := startUDPEchoServer(t)
+	udpConn := socks5UDPAssociate(t, startDirectServer(t))
+
+	udpConn.Write(append(udpHeader(t, echo, 1), "frag"...))
+	udpConn.Write(append(udpHeader(t, echo, 2|0x80), "ment"...))
+	if _, data, ok := readUDPReply(t, udpConn, 300*time.Millisecond); ok {
+		t.Fatalf("fragmented datagram relayed (answer %q)", data)
+	}
+
+	// Unfragmented datagrams are still relayed
+	udpConn.Write(append(udpHeader(t, echo, 0), "whole"...))
+	if _, data, ok := readUDPReply(t, udpConn, 2*time.Second); !ok || string(data) != "whole" {
+		t.Fatalf("unfragmented datagram not relayed (answer %q)", data)
+	}
+}
+
+func TestUDPFragmentsReassembled(t *testing.T) {
+	setArg(t, &gArgUDPFragPolicy, "reassemble")
+	echo := startUDPEchoServer(t)
+	udpConn := socks5UDPAssociate(t, startDirectServer(t))
+
+	udpConn.Write(append(udpHeader(t, echo, 1), "frag"...))
+	udpConn.Write(append(udpHeader(t, echo, 2|0x80), "ment"...))
+	_, data, ok := readUDPReply(t, udpConn, 2*time.Second)
+	if !ok || string(data) != "fragment" {
+		t.Fatalf("reassembled datagram not relayed (answer %q)", data)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+// Defines the interface of the tracing spans recorded per connection. Spans are exported with OpenTelemetry if bbs is built with the otel tag (see otel.go), and discarded otherwise.
+
+// traceSpan is a span covering an operation of the handling of a connection (session, routing decision, proxy handshake)
+type traceSpan interface {
+	// setAttribute attaches the attribute key=value to the span
+	setAttribute(key string, value any)
+	// recordError records err on the span and marks it as failed
+	recordError(err error)
+	// end ends the span
+	end()
+}
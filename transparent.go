@@ -0,0 +1,281 @@
+//go:build linux && transparent
+
+package main
+
+// Defines the transparent input server, handling connections redirected by iptables/nftables (REDIRECT, DNAT or TPROXY) without any SOCKS5 or HTTP layer.
+// The destination of a connection is its original destination, retrieved with SO_ORIGINAL_DST, or its local address for TPROXY.
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/synacktiv/bbs/logger"
+)
+
+var gTransparentCompiled bool = true
+
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST netfilter socket option (linux/netfilter_ipv4.h)
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST netfilter socket option (linux/netfilter_ipv6/ip6_tables.h)
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT socket option (linux/in6.h)
+)
+
+type transparentHandler struct{}
+
+func newTransparentHandler() (connHandler, error) {
+	return new(transparentHandler), nil
+}
+
+// listenControl sets IP_TRANSPARENT (or IPV6_TRANSPARENT) on the listening socket, so that it can accept connections redirected with TPROXY.
+// Setting it requires the CAP_NET_ADMIN capability.
+func (h transparentHandler) listenControl(network string, address string, c syscall.RawConn) error {
+	var sockErr error
+
+	err := c.Control(func(fd uintptr) {
+		if network == "tcp4" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+		if sockErr == nil && network == "tcp" {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		sockErr = fmt.Errorf("error setting transparent socket option: %v", sockErr)
+	}
+	return sockErr
+}
+
+// parseOrigDst returns the address string (format host:port) of the sockaddr_in or sockaddr_in6 structure sa returned by SO_ORIGINAL_DST
+func parseOrigDst(sa []byte) (string, error) {
+	if len(sa) < 2 {
+		err := fmt.Errorf("sockaddr too short (%v bytes)", len(sa))
+		return "", err
+	}
+
+	family := binary.NativeEndian.Uint16(sa[0:2])
+	switch {
+	case family == syscall.AF_INET && len(sa) >= 8:
+		port := binary.BigEndian.Uint16(sa[2:4])
+		return net.JoinHostPort(net.IP(sa[4:8]).String(), strconv.Itoa(int(port))), nil
+	case family == syscall.AF_INET6 && len(sa) >= 24:
+		port := binary.BigEndian.Uint16(sa[2:4])
+		return net.JoinHostPort(net.IP(sa[8:24]).String(), strconv.Itoa(int(port))), nil
+	default:
+		err := fmt.Errorf("unsupported sockaddr family %v or length %v", family, len(sa))
+		return "", err
+	}
+}
+
+// originalDst returns the original destination of the redirected client connection, with SO_ORIGINAL_DST.
+// If the connection was not NATed (TPROXY), its local address is its original destination.
+func originalDst(client net.Conn) (string, error) {
+	tcpConn, ok := client.(*net.TCPConn)
+	if !ok {
+		err := fmt.Errorf("connection %v is not a TCP connection", client)
+		return "", err
+	}
+
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	level, opt := syscall.SOL_IP, soOriginalDst
+	if local, ok := client.LocalAddr().(*net.TCPAddr); ok && local.IP.To4() == nil {
+		level, opt = syscall.SOL_IPV6, ip6tSoOriginalDst
+	}
+
+	sa := make([]byte, syscall.SizeofSockaddrInet6)
+	saLen := uint32(len(sa))
+	var errno syscall.Errno
+
+	err = rawConn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), uintptr(opt), uintptr(unsafe.Pointer(&sa[0])), uintptr(unsafe.Pointer(&saLen)), 0)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if errno != 0 {
+		gMetaLogger.Debugf("SO_ORIGINAL_DST failed for %v (%v), using local address as original destination", client, errno)
+		return client.LocalAddr().String(), nil
+	}
+
+	return parseOrigDst(sa[:saLen])
+}
+
+// isServerAddr reports whether addr is the address of the server which accepted the connection whose connInfo is stored in ctx,
+// i.e. whether the client connected directly to the transparent server instead of being redirected.
+func isServerAddr(ctx context.Context, addr string) bool {
+	info, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return false
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	_, serverPort, err := net.SplitHostPort(info.server)
+	if err != nil || port != serverPort {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || checkLocalAddr(host) == nil)
+}
+
+// connHandle handles the connection of a client redirected to the transparent input listener.
+// It retrieves the original destination of the connection, establishes a connection to it through the right chain (found in routingtable table),
+// and transfers data between the established connection socket and the client socket.
+func (h transparentHandler) connHandle(client net.Conn, table string, ctx context.Context, cancel context.CancelFunc) {
+	gMetaLogger.Debugf("Entering transparentHandler connHandle for connection %v", &client)
+	defer func() { gMetaLogger.Debugf("Leaving transparentHandler connHandle for connection %v", &client) }()
+
+	defer client.Close()
+
+	ctx, span := startSpan(ctx, "transparent.session")
+	defer span.end()
+	span.setAttribute("client", client.RemoteAddr().String())
+
+	addr, err := originalDst(client)
+	if err != nil {
+		gMetaLogger.Errorf("could not retrieve original destination of %v: %v", client, err)
+		span.recordError(err)
+		return
+	}
+
+	// Connections which were not redirected would be relayed to the server itself
+	if isServerAddr(ctx, addr) {
+		gMetaLogger.Errorf("connection from %v was not redirected to the transparent server, dropping it", client.RemoteAddr())
+		return
+	}
+
+	annotateConn(ctx, "target", addr)
+	span.setAttribute("target", addr)
+	gScanDetector.record(client.RemoteAddr(), addr)
+
+	// If -sni-peek-timeout is set, the server name of TLS connections is used as host for routing instead of the original destination IP.
+	// The connection is still opened to the original destination.
+	routeAddr := addr
+	if gArgSNIPeekTimeout > 0 {
+		var sni string
+		client, sni, err = peekSNI(client, gArgSNIPeekTimeout)
+		if err != nil {
+			gMetaLogger.Debugf("no server name found for connection to %v, routing with original destination: %v", addr, err)
+		} else {
+			_, port, _ := net.SplitHostPort(addr)
+			routeAddr = net.JoinHostPort(sni, port)
+			gMetaLogger.Debugf("server name %v found for connection to %v", sni, addr)
+			annotateConn(ctx, "sni", sni)
+			span.setAttribute("sni", sni)
+		}
+	}
+
+	// ***** BEGIN Routing decision *****
+
+	chainStr, rewrite, err := getRouteFor(table, routeAddr, listenerOf(ctx))
+	if err != nil {
+		gMetaLogger.Errorf("error getting route: %v", err)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "transparent", Client: client.RemoteAddr().String(), Dest: addr, Detail: err.Error()})
+		span.recordError(err)
+		return
+	}
+
+	gMetaLogger.Debugf("chain to use for %v: %v\n", addr, chainStr)
+	annotateConn(ctx, "chain", chainStr)
+	span.setAttribute("chain", chainStr)
+
+	if chainStr == bypassRoute {
+		gMetaLogger.Debugf("%v is in the bypass list, connecting directly", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "BYPASS", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+	}
+
+	// There is no protocol to send a refusal with, rejected connections are closed as dropped ones
+	if chainStr == "reject" || chainStr == "drop" {
+		gMetaLogger.Debugf("dropping connection to %v", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "DROPPED", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+		return
+	}
+
+	if chainStr == "tarpit" {
+		gMetaLogger.Debugf("tarpitting connection to %v", addr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "TARPIT", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr})
+		tarpit(ctx, client)
+		return
+	}
+
+	if rewrite != "" {
+		rewritten, err := rewriteAddress(addr, rewrite)
+		if err != nil {
+			gMetaLogger.Errorf("error rewriting destination %v: %v", addr, err)
+			gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: err.Error()})
+			return
+		}
+		gMetaLogger.Debugf("rewriting destination %v to %v", addr, rewritten)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "REWRITE", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: rewritten})
+		annotateConn(ctx, "rewritten", rewritten)
+		addr = rewritten
+	}
+
+	gChainsConf.mu.RLock()
+	chain, ok := gChainsConf.proxychains[chainStr]
+	gChainsConf.mu.RUnlock()
+
+	if !ok {
+		gMetaLogger.Errorf("chain '%v' is not declared in configuration", chainStr)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Detail: "chain not declared"})
+		return
+	}
+
+	// ***** END Routing decision *****
+
+	// A client hanging up meanwhile aborts the connection establishment
+	stopWatch := watchClient(client, cancel)
+	target, chainRepresentation, err := chain.connect(ctx, addr)
+	client = stopWatch()
+	annotateConn(ctx, "path", chainRepresentation)
+	// Address the requested hostname was resolved to locally (proxyDns=false or custom hosts), if any, recorded along with it in audit traces
+	resolved := annotationOf(ctx, "resolved")
+
+	if err != nil {
+		gMetaLogger.Error(err)
+		span.recordError(err)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "ERROR", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation, Detail: err.Error()})
+		return
+	}
+	defer target.Close()
+
+	gMetaLogger.AuditEvent(logger.AuditEvent{Event: "OPEN", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation})
+	start := time.Now()
+	var bytesUp, bytesDown int64
+	defer func() {
+		span.setAttribute("bytesUp", bytesUp)
+		span.setAttribute("bytesDown", bytesDown)
+		chain.stats().closed(bytesUp, bytesDown)
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "CLOSE", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, Resolved: resolved, ChainRepr: chainRepresentation, BytesUp: bytesUp, BytesDown: bytesDown, DurationMs: time.Since(start).Milliseconds()})
+	}()
+
+	// Apply the chain's TCP options to both ends of the relay
+	chain.setSocketOptions(client, target)
+
+	// Tear down the connection once the chain's maximum lifetime is reached, whatever its activity
+	relayCtx, lifetimeReached := lifetimeContext(ctx, time.Duration(chain.maxLifetime)*time.Millisecond)
+
+	bytesUp, bytesDown = relay(relayCtx, client, target, time.Duration(chain.firstDataTimeout)*time.Millisecond, time.Duration(chain.idleTimeout)*time.Millisecond)
+
+	if lifetimeReached() {
+		gMetaLogger.AuditEvent(logger.AuditEvent{Event: "LIFETIME", Handler: "transparent", Client: client.RemoteAddr().String(), Chain: chainStr, Dest: addr, ChainRepr: chainRepresentation, Detail: fmt.Sprintf("maximum lifetime of %vms reached", chain.maxLifetime)})
+	}
+}
@@ -0,0 +1,129 @@
+//go:build linux && transparent
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sockaddr returns a sockaddr_in or sockaddr_in6 structure as returned by SO_ORIGINAL_DST, for ip and port
+func sockaddr(ip net.IP, port uint16) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		sa := make([]byte, syscall.SizeofSockaddrInet4)
+		binary.NativeEndian.PutUint16(sa[0:2], syscall.AF_INET)
+		binary.BigEndian.PutUint16(sa[2:4], port)
+		copy(sa[4:8], ip4)
+		return sa
+	}
+
+	sa := make([]byte, syscall.SizeofSockaddrInet6)
+	binary.NativeEndian.PutUint16(sa[0:2], syscall.AF_INET6)
+	binary.BigEndian.PutUint16(sa[2:4], port)
+	copy(sa[8:24], ip.To16())
+	return sa
+}
+
+func TestParseOrigDst(t *testing.T) {
+	tests := []struct {
+		sa       []byte
+		expected string
+	}{
+		{sockaddr(net.ParseIP("93.184.216.34"), 443), "93.184.216.34:443"},
+		{sockaddr(net.ParseIP("10.0.0.1"), 65535), "10.0.0.1:65535"},
+		{sockaddr(net.ParseIP("2001:db8::1"), 80), "[2001:db8::1]:80"},
+	}
+	for _, test := range tests {
+		addr, err := parseOrigDst(test.sa)
+		if err != nil || addr != test.expected {
+			t.Errorf("original destination %q (%v) instead of %q", addr, err, test.expected)
+		}
+	}
+
+	// Truncated structures and unknown families are rejected
+	for _, sa := range [][]byte{{}, {2}, sockaddr(net.ParseIP("10.0.0.1"), 80)[:6], sockaddr(net.ParseIP("2001:db8::1"), 80)[:16]} {
+		_, err := parseOrigDst(sa)
+		if err == nil {
+			t.Errorf("invalid sockaddr %v accepted", sa)
+		}
+	}
+	sa := sockaddr(net.ParseIP("10.0.0.1"), 80)
+	binary.NativeEndian.PutUint16(sa[0:2], syscall.AF_UNIX)
+	_, err := parseOrigDst(sa)
+	if err == nil {
+		t.Errorf("sockaddr of family AF_UNIX accepted")
+	}
+}
+
+func TestOriginalDstNotNATed(t *testing.T) {
+	_, server := tcpPair(t)
+
+	// Without netfilter redirection, SO_ORIGINAL_DST fails and the local address is the original destination, as with TPROXY
+	addr, err := originalDst(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != server.LocalAddr().String() {
+		t.Errorf("original destination %v instead of local address %v", addr, server.LocalAddr())
+	}
+}
+
+func TestIsServerAddr(t *testing.T) {
+	_, server := tcpPair(t)
+
+	info := gConnRegistry.register(server, "0.0.0.0:12345", "0.0.0.0:12345")
+	defer gConnRegistry.unregister(info)
+	ctx := context.WithValue(context.Background(), connInfoKey{}, info)
+
+	tests := map[string]bool{
+		"127.0.0.1:12345":                 true,
+		"127.0.0.1:443":                   false,
+		"198.51.100.1:12345":              false,
+		"example.com:12345":               false,
+		sourceAddr(t).String() + ":12345": true,
+	}
+	for addr, expected := range tests {
+		if isServerAddr(ctx, addr) != expected {
+			t.Errorf("isServerAddr(%v) is not %v", addr, expected)
+		}
+	}
+
+	if isServerAddr(context.Background(), "127.0.0.1:12345") {
+		t.Errorf("address considered the server's without connection information")
+	}
+}
+
+func TestTransparentServerDropsDirectConnections(t *testing.T) {
+	logs, _ := captureLogs(t)
+	setChains(t, testChain("direct"))
+	setRouting(t, `{"table": [{"rules": {"rule": "true"}, "route": "direct"}]}`, "")
+
+	s, err := newServerFromString("transparent://127.0.0.1:" + freePort(t) + ":table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound := make(chan error, 1)
+	go s.run(bound)
+	err = <-bound
+	if err != nil {
+		t.Skipf("transparent server could not be started, CAP_NET_ADMIN is required: %v", err)
+	}
+	s.running = true
+	t.Cleanup(s.stop)
+
+	// A client connecting directly to the server would be relayed to the server itself
+	conn, err := net.DialTimeout("tcp", s.address(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !isClosed(conn, time.Second) {
+		t.Fatal("direct connection to the transparent server not closed")
+	}
+	waitFor(t, time.Second, "drop logged", func() bool { return strings.Contains(logs.String(), "was not redirected to the transparent server") })
+}
@@ -0,0 +1,217 @@
+package main
+
+// Defines the transport of SOCKS5 UDP datagrams over a TCP connection established through a chain (UDP-over-TCP), to a cooperating endpoint relaying them.
+// Each datagram is framed as |LEN|ATYP|ADDR|PORT|DATA|, where LEN (2 bytes, big endian) is the length of the rest of the frame, and ATYP, ADDR and PORT
+// encode the destination of the datagram (source for the datagrams sent back by the endpoint) as in SOCKS5 requests.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// udpFrameMax is the maximum length of a frame, after its length prefix
+const udpFrameMax = 65535
+
+// writeUDPFrame writes to w the frame of the datagram data exchanged with address addr (format host:port)
+func writeUDPFrame(w io.Writer, addr string, data []byte) error {
+	addrBytes, atyp, err := stringToAddr(addr)
+	if err != nil {
+		err = fmt.Errorf("invalid datagram address %v: %v", addr, err)
+		return err
+	}
+
+	length := 1 + len(addrBytes) + len(data)
+	if length > udpFrameMax {
+		err = fmt.Errorf("datagram to %v too large to be framed (%v bytes)", addr, len(data))
+		return err
+	}
+
+	frame := make([]byte, 0, 2+length)
+	frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	frame = append(frame, atyp)
+	frame = append(frame, addrBytes...)
+	frame = append(frame, data...)
+
+	_, err = w.Write(frame)
+	return err
+}
+
+// readUDPFrame reads a frame from r and returns the address and the data of its datagram
+func readUDPFrame(r io.Reader) (addr string, data []byte, err error) {
+	var length uint16
+	err = binary.Read(r, binary.BigEndian, &length)
+	if err != nil {
+		return "", nil, err
+	}
+
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if len(frame) < 1 {
+		err = fmt.Errorf("empty UDP-over-TCP frame")
+		return "", nil, err
+	}
+
+	reader := bytes.NewReader(frame[1:])
+	addr, err = addrToString(reader, frame[0])
+	if err != nil {
+		err = fmt.Errorf("invalid address in UDP-over-TCP frame: %v", err)
+		return "", nil, err
+	}
+
+	return addr, frame[len(frame)-reader.Len():], nil
+}
+
+// udpTunnelQueueMax is the maximum number of frames queued for a tunnel while it is being opened, frames sent beyond are dropped
+const udpTunnelQueueMax = 64
+
+// udpTunnel is the UDP-over-TCP tunnel of a chain. It is opened in the background, the frames sent meanwhile are queued until it is ready.
+type udpTunnel struct {
+	conn    net.Conn // nil while the tunnel is being opened
+	pending [][]byte // frames queued while the tunnel is being opened
+}
+
+// udpTunnels holds the UDP-over-TCP tunnels of a UDP association, one per chain, and relays the datagrams they receive to the client
+type udpTunnels struct {
+	ctx        context.Context
+	udpConn    *net.UDPConn // socket of the association, through which datagrams are relayed to the client
+	clientAddr *net.UDPAddr // address of the client on the UDP side, set before the first tunnel is opened
+	byChain    map[string]*udpTunnel
+	closed     bool // set once the association is over, tunnels opened afterwards are closed at once
+	mu         sync.Mutex
+}
+
+// send sends the datagram data to addr through the tunnel of chain, opened on first use to the cooperating endpoint chain.udpOverTcp.
+// The tunnel is opened in the background so that a slow chain does not delay the datagrams of the other ones: opened is then called with the representation
+// of the tunnel's path once the connection through the chain is established or failed, and the datagrams sent until then are queued.
+// Tunnels are accounted in the usage counters of their chain until they are closed, with the bytes of the frames sent and received.
+func (t *udpTunnels) send(chain proxyChain, addr string, data []byte, opened func(chainRepr string)) error {
+	var frame bytes.Buffer
+	err := writeUDPFrame(&frame, addr, data)
+	if err != nil {
+		err = fmt.Errorf("error framing datagram to %v for UDP-over-TCP tunnel of chain %v: %v", addr, chain.name, err)
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tunnel, ok := t.byChain[chain.name]
+	if !ok {
+		if t.closed {
+			err = fmt.Errorf("dropping datagram to %v: UDP association terminated", addr)
+			return err
+		}
+		tunnel = &udpTunnel{pending: [][]byte{frame.Bytes()}}
+		t.byChain[chain.name] = tunnel
+		go t.open(chain, tunnel, opened)
+		return nil
+	}
+
+	if tunnel.conn == nil {
+		if len(tunnel.pending) >= udpTunnelQueueMax {
+			err = fmt.Errorf("dropping datagram to %v: UDP-over-TCP tunnel of chain %v still being opened with %v datagrams queued", addr, chain.name, len(tunnel.pending))
+			return err
+		}
+		tunnel.pending = append(tunnel.pending, frame.Bytes())
+		return nil
+	}
+
+	_, err = tunnel.conn.Write(frame.Bytes())
+	if err != nil {
+		tunnel.conn.Close()
+		delete(t.byChain, chain.name)
+		err = fmt.Errorf("error sending datagram to %v over UDP-over-TCP tunnel of chain %v: %v", addr, chain.name, err)
+		return err
+	}
+
+	return nil
+}
+
+// open opens tunnel, registered by send for chain, sends the frames queued meanwhile and starts relaying the datagrams it receives. The datagrams queued are dropped if it cannot be opened.
+func (t *udpTunnels) open(chain proxyChain, tunnel *udpTunnel, opened func(chainRepr string)) {
+	conn, repr, err := chain.connect(t.ctx, chain.udpOverTcp)
+	opened(repr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		if err == nil {
+			conn.Close()
+		}
+		return
+	}
+	if err != nil {
+		gMetaLogger.Errorf("error opening UDP-over-TCP tunnel to %v through chain %v, %v datagrams dropped: %v", chain.udpOverTcp, chain.name, len(tunnel.pending), err)
+		delete(t.byChain, chain.name)
+		return
+	}
+
+	counted := &countedConn{Conn: conn, counters: chain.stats()}
+	for _, frame := range tunnel.pending {
+		_, err = counted.Write(frame)
+		if err != nil {
+			gMetaLogger.Errorf("error sending datagrams over UDP-over-TCP tunnel of chain %v: %v", chain.name, err)
+			counted.Close()
+			delete(t.byChain, chain.name)
+			return
+		}
+	}
+	tunnel.conn, tunnel.pending = counted, nil
+	go t.receive(chain.name, tunnel)
+}
+
+// receive relays the datagrams received on the tunnel of chain name to the client, encapsulated in a SOCKS5 UDP request header, until the tunnel is closed
+func (t *udpTunnels) receive(name string, tunnel *udpTunnel) {
+	reader := bufio.NewReader(tunnel.conn)
+	for {
+		src, data, err := readUDPFrame(reader)
+		if err != nil {
+			gMetaLogger.Debugf("UDP-over-TCP tunnel of chain %v terminated: %v", name, err)
+			break
+		}
+
+		srcAddr, srcAtyp, err := stringToAddr(src)
+		if err != nil {
+			gMetaLogger.Error(err)
+			continue
+		}
+		header := append([]byte{0, 0, 0, srcAtyp}, srcAddr...)
+		_, err = t.udpConn.WriteToUDP(append(header, data...), t.clientAddr)
+		if err != nil {
+			gMetaLogger.Debugf("could not relay datagram from %v to client %v: %v", src, t.clientAddr, err)
+		}
+	}
+
+	// The tunnel is opened again on the next datagram routed to the chain
+	tunnel.conn.Close()
+	t.mu.Lock()
+	if t.byChain[name] == tunnel {
+		delete(t.byChain, name)
+	}
+	t.mu.Unlock()
+}
+
+// close closes all the tunnels, those still being opened are closed once their connection is established
+func (t *udpTunnels) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.closed = true
+	for name, tunnel := range t.byChain {
+		if tunnel.conn != nil {
+			tunnel.conn.Close()
+		}
+		delete(t.byChain, name)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUDPFrameRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		addr string
+		data []byte
+	}{
+		{"192.0.2.1:53", []byte("query")},
+		{"[2001:db8::1]:443", []byte{0, 1, 2, 255}},
+		{"example.com:123", nil},
+		{"192.0.2.1:53", bytes.Repeat([]byte("x"), udpFrameMax-7)},
+	} {
+		var buff bytes.Buffer
+		if err := writeUDPFrame(&buff, test.addr, test.data); err != nil {
+			t.Fatalf("framing datagram to %v failed: %v", test.addr, err)
+		}
+		addr, data, err := readUDPFrame(&buff)
+		if err != nil || addr != test.addr || !bytes.Equal(data, test.data) {
+			t.Errorf("frame of %v bytes to %v read as %v bytes to %v (%v)", len(test.data), test.addr, len(data), addr, err)
+		}
+		if buff.Len() != 0 {
+			t.Errorf("%v bytes left after reading frame to %v", buff.Len(), test.addr)
+		}
+	}
+
+	// |LEN|ATYP|ADDR|PORT|DATA|, with LEN the length of the rest of the frame
+	var buff bytes.Buffer
+	writeUDPFrame(&buff, "192.0.2.1:53", []byte("hi"))
+	if want := []byte{0, 9, atypIPV4, 192, 0, 2, 1, 0, 53, 'h', 'i'}; !bytes.Equal(buff.Bytes(), want) {
+		t.Errorf("frame %v instead of %v", buff.Bytes(), want)
+	}
+
+	// Frames follow each other on the stream
+	buff.Reset()
+	writeUDPFrame(&buff, "192.0.2.1:53", []byte("first"))
+	writeUDPFrame(&buff, "example.com:53", []byte("second"))
+	for _, want := range []string{"first", "second"} {
+		if _, data, err := readUDPFrame(&buff); err != nil || string(data) != want {
+			t.Errorf("frame %q read instead of %q (%v)", data, want, err)
+		}
+	}
+}
+
+func TestUDPFrameErrors(t *testing.T) {
+	if err := writeUDPFrame(new(bytes.Buffer), "192.0.2.1:53", make([]byte, udpFrameMax-6)); err == nil {
+		t.Error("datagram too large to be framed accepted")
+	}
+	if err := writeUDPFrame(new(bytes.Buffer), "192.0.2.1", []byte("data")); err == nil {
+		t.Error("datagram to an address without port framed")
+	}
+
+	for _, frame := range [][]byte{
+		{0, 0},
+		{0, 9, atypIPV4, 192, 0, 2},
+		{0, 3, 0x09, 0, 0},
+		{0, 3, atypIPV4, 192, 0},
+		{0},
+	} {
+		if _, _, err := readUDPFrame(bytes.NewReader(frame)); err == nil {
+			t.Errorf("invalid frame %v read", frame)
+		}
+	}
+}
+
+// udpFrame is a datagram received by the endpoint started by startUDPEndpoint
+type udpFrame struct {
+	addr string
+	data string
+}
+
+// startUDPEndpoint starts a cooperating UDP-over-TCP endpoint answering each datagram with the datagram prefixed by "re:", from its destination,
+// and returns its address along with the datagrams it receives
+func startUDPEndpoint(t *testing.T) (string, <-chan udpFrame) {
+	t.Helper()
+
+	l := listenTCP(t)
+	frames := make(chan udpFrame, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					addr, data, err := readUDPFrame(reader)
+					if err != nil {
+						return
+					}
+					frames <- udpFrame{addr, string(data)}
+					writeUDPFrame(conn, addr, append([]byte("re:"), data...))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), frames
+}
+
+func TestUDPOverTCP(t *testing.T) {
+	endpoint, frames := startUDPEndpoint(t)
+
+	// The datagrams are tunneled through an HTTP CONNECT proxy
+	host, port, _ := net.SplitHostPort(startServer(t, "http://127.0.0.1:"+freePort(t)+":upstream").address())
+	p, err := newProxy("http", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneled := testChain("udp-tunneled", p)
+	tunneled.udpOverTcp = endpoint
+	setChains(t, testChain("direct"), tunneled)
+	setRouting(t, `{
+  "front": [{"rules": {"rule": "true"}, "route": "udp-tunneled"}],
+  "upstream": [{"rules": {"rule": "true"}, "route": "direct"}]
+}`, "")
+	srv := startServer(t, "socks5://127.0.0.1:"+freePort(t)+":front").address()
+	before := gChainStats.snapshot()["udp-tunneled"]
+
+	conn, err := net.DialTimeout("tcp", srv, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	socks5Greet(t, conn, 0)
+	rep, relayAddr := socks5Request(t, conn, cmdUDPAssociate, "0.0.0.0:0")
+	if rep != repSucceeded {
+		t.Fatalf("UDP association failed with reply %v", rep)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", relayAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := net.DialUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	// Datagrams reach the endpoint with their destination, hostnames unresolved, and the answers are relayed to the client from their source
+	for _, dest := range []string{"192.0.2.1:53", "dns.example.com:53"} {
+		if _, err = udpConn.Write(append(udpHeader(t, dest, 0), "ping"...)); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case frame := <-frames:
+			if frame != (udpFrame{dest, "ping"}) {
+				t.Errorf("endpoint received %+v instead of ping to %v", frame, dest)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("endpoint received no datagram to %v", dest)
+		}
+		src, data, ok := readUDPReply(t, udpConn, 2*time.Second)
+		if !ok || src != dest || string(data) != "re:ping" {
+			t.Errorf("answer %q from %v relayed instead of re:ping from %v", data, src, dest)
+		}
+	}
+
+	// One tunnel is opened for the association, and counted with the bytes of its frames once closed
+	stats := gChainStats.snapshot()["udp-tunneled"]
+	if stats.Active != before.Active+1 || stats.Total != before.Total+1 {
+		t.Errorf("tunnel not counted as an active connection: %+v", stats)
+	}
+	conn.Close()
+	waitFor(t, 2*time.Second, "tunnel to be closed with the association", func() bool {
+		return gChainStats.snapshot()["udp-tunneled"].Active == before.Active
+	})
+	stats = gChainStats.snapshot()["udp-tunneled"]
+	up := (2 + 1 + 4 + 2 + 4) + (2 + 1 + 1 + len("dns.example.com") + 2 + 4)
+	down := up + 2*len("re:")
+	if stats.BytesUp != before.BytesUp+int64(up) || stats.BytesDown != before.BytesDown+int64(down) {
+		t.Errorf("frames counted as %v bytes up and %v bytes down instead of %v and %v", stats.BytesUp-before.BytesUp, stats.BytesDown-before.BytesDown, up, down)
+	}
+}
+
+func TestUDPOverTCPBlackholedTunnel(t *testing.T) {
+	endpoint, frames := startUDPEndpoint(t)
+
+	// The tunnel of the first chain is opened through a proxy never answering, the one of the second chain through an HTTP CONNECT proxy
+	stalled, _ := slowProxy(t, "", 0)
+	blackholed := testChain("udp-blackholed", stalled)
+	blackholed.udpOverTcp = endpoint
+	blackholed.tcpReadTimeout = 5000
+	host, port, _ := net.SplitHostPort(startServer(t, "http://127.0.0.1:"+freePort(t)+":upstream").address())
+	p, err := newProxy("http", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneled := testChain("udp-tunneled", p)
+	tunneled.udpOverTcp = endpoint
+	setChains(t, testChain("direct"), blackholed, tunneled)
+	setRouting(t, `{
+  "front": [
+    {"rules": {"rule": "regexp", "variable": "host", "content": "^192\\.0\\.2\\.1$"}, "route": "udp-blackholed"},
+    {"rules": {"rule": "true"}, "route": "udp-tunneled"}
+  ],
+  "upstream": [{"rules": {"rule": "true"}, "route": "direct"}]
+}`, "")
+	udpConn := socks5UDPAssociate(t, startServer(t, "socks5://127.0.0.1:"+freePort(t)+":front").address())
+
+	// The datagrams of the second chain are relayed while the tunnel of the first one is still being opened
+	for _, dest := range []string{"192.0.2.1:53", "192.0.2.1:53", "192.0.2.2:53"} {
+		if _, err = udpConn.Write(append(udpHeader(t, dest, 0), "ping"...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case frame := <-frames:
+		if frame != (udpFrame{"192.0.2.2:53", "ping"}) {
+			t.Errorf("endpoint received %+v instead of ping to 192.0.2.2:53", frame)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("datagram of the second chain delayed by the tunnel of the first one")
+	}
+	src, data, ok := readUDPReply(t, udpConn, time.Second)
+	if !ok || src != "192.0.2.2:53" || string(data) != "re:ping" {
+		t.Errorf("answer %q from %v relayed instead of re:ping from 192.0.2.2:53", data, src)
+	}
+}
+
+func TestChainDescUDPOverTCP(t *testing.T) {
+	config, err := parseConfig(t, `{
+  "proxies": {"proxy": {"connstring": "http://10.0.0.1:8080"}},
+  "chains": {"tunneled": {"proxies": ["proxy"], "udpOverTcp": "udp-endpoint.example.com:4000"}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "tunneled"}]}
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Chains["tunneled"].UdpOverTcp != "udp-endpoint.example.com:4000" {
+		t.Errorf("udpOverTcp not parsed: %+v", config.Chains["tunneled"])
+	}
+
+	_, err = parseConfig(t, `{
+  "chains": {"tunneled": {"proxies": [], "udpOverTcp": "no-port"}},
+  "routes": {"table": [{"rules": {"rule": "true"}, "route": "tunneled"}]}
+}`)
+	if err == nil || !strings.Contains(err.Error(), "udpOverTcp") {
+		t.Errorf("invalid udpOverTcp accepted: %v", err)
+	}
+}
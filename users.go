@@ -0,0 +1,34 @@
+package main
+
+// Defines the groups of credentials SOCKS5 servers can authenticate clients with, and the route overrides associated to each credential
+
+import (
+	"sync"
+)
+
+// userDesc describes a credential of a user group, and optionally the routing table or the chain used for the connections authenticated with it
+type userDesc struct {
+	Pass  string
+	Table string // if not empty, routing table used instead of the server's one
+	Chain string // if not empty, chain used without evaluating any routing table
+}
+
+// userGroups maps user group names to the credentials of the group, by user name
+type userGroups map[string]map[string]userDesc
+
+// usersConf is the type used to hold and access the user groups configuration (defined in a file)
+type usersConf struct {
+	groups userGroups
+	mu     sync.RWMutex
+}
+
+var gUsersConf usersConf
+
+// lookup returns the credential of user in user group group, and whether it exists
+func (c *usersConf) lookup(group string, user string) (userDesc, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	desc, ok := c.groups[group][user]
+	return desc, ok
+}
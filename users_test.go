@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// setUsers replaces the user groups configuration by groups for the duration of the test
+func setUsers(t *testing.T, groups userGroups) {
+	t.Helper()
+
+	gUsersConf.mu.Lock()
+	previous := gUsersConf.groups
+	gUsersConf.groups = groups
+	gUsersConf.mu.Unlock()
+
+	t.Cleanup(func() {
+		gUsersConf.mu.Lock()
+		gUsersConf.groups = previous
+		gUsersConf.mu.Unlock()
+	})
+}
+
+func TestUserGroupChains(t *testing.T) {
+	_, audit := captureLogs(t)
+	echo := startEchoServer(t)
+	setChains(t, testChain("default"), testChain("eu"), testChain("us"))
+	setRouting(t, `{
+  "table": [{"rules": {"rule": "true"}, "route": "default"}],
+  "ustable": [{"rules": {"rule": "true"}, "route": "us"}]
+}`, "")
+	setUsers(t, userGroups{"clients": {
+		"eu":    {Pass: "eupass", Chain: "eu"},
+		"us":    {Pass: "uspass", Table: "ustable"},
+		"plain": {Pass: "plainpass"},
+	}})
+	srv := startServer(t, "socks5://clients@127.0.0.1:"+freePort(t)+":table").address()
+
+	// Users of the same server are routed according to their own override, or to the server's routing table without one
+	for _, test := range []struct{ user, pass, chain string }{{"eu", "eupass", "eu"}, {"us", "uspass", "us"}, {"plain", "plainpass", "default"}} {
+		conn, err := net.DialTimeout("tcp", srv, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		socks5Greet(t, conn, 2)
+		if status := socks5Auth(t, conn, test.user, test.pass); status != 0 {
+			t.Fatalf("credentials of user %v refused with status %v", test.user, status)
+		}
+		if rep, _ := socks5Request(t, conn, cmdConnect, echo); rep != 0 {
+			t.Fatalf("connection of user %v failed with reply %v", test.user, rep)
+		}
+		checkEcho(t, conn, test.user)
+
+		if open := findAudit(t, audit, "OPEN", conn.LocalAddr().String()); open.Chain != test.chain {
+			t.Errorf("user %v connected through chain %v instead of %v", test.user, open.Chain, test.chain)
+		}
+	}
+
+	// Users are authenticated with their own password only
+	for _, creds := range [][2]string{{"eu", "uspass"}, {"unknown", "eupass"}, {"eu", ""}} {
+		conn, err := net.DialTimeout("tcp", srv, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		socks5Greet(t, conn, 2)
+		if status := socks5Auth(t, conn, creds[0], creds[1]); status == 0 {
+			t.Errorf("credentials %q:%q accepted", creds[0], creds[1])
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+// Defines the verification probe of chains, checking that an HTTP service answers through the chain before declaring connections established
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// chainVerify maps the verify object of chains: the HTTP service probed through the chain, and how often
+type chainVerify struct {
+	Address      string // HTTP service (host:port) to which a HEAD request is sent through the chain
+	Interval     int64  // milliseconds during which a successful verification is reused, 0 to verify before each connection
+	ExpectStatus int    // if not 0, status code the response must have, otherwise any response other than a 5xx one is accepted
+}
+
+// verificationRegistry is the type used to hold the date of the last successful verification of chains, by chain name
+type verificationRegistry struct {
+	verified map[string]time.Time
+	mu       sync.Mutex
+}
+
+var gVerifications = verificationRegistry{verified: make(map[string]time.Time)}
+
+// fresh reports whether chain name was successfully verified less than interval ago
+func (r *verificationRegistry) fresh(name string, interval time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last, ok := r.verified[name]
+	return ok && time.Since(last) < interval
+}
+
+// succeeded records a successful verification of chain name
+func (r *verificationRegistry) succeeded(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.verified[name] = time.Now()
+}
+
+// failed forgets the last successful verification of chain name, so that the next connection verifies it again
+func (r *verificationRegistry) failed(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.verified, name)
+}
+
+// verifyChain sends a HEAD request to chain.verify.Address through the chain, on a connection of its own, and returns an error if no acceptable HTTP response is received before ctx is done.
+// It does nothing if the chain was successfully verified less than chain.verify.Interval milliseconds ago.
+func (chain proxyChain) verifyChain(ctx context.Context) error {
+	if gVerifications.fresh(chain.name, time.Duration(chain.verify.Interval)*time.Millisecond) {
+		return nil
+	}
+
+	err := chain.probe(ctx)
+	if err != nil {
+		gVerifications.failed(chain.name)
+		err = fmt.Errorf("verification of chain %v with %v failed: %w", chain.name, chain.verify.Address, err)
+		return err
+	}
+
+	gMetaLogger.Debugf("chain %v verified with %v", chain.name, chain.verify.Address)
+	gVerifications.succeeded(chain.name)
+	return nil
+}
+
+// probe performs the HEAD request of verifyChain
+func (chain proxyChain) probe(ctx context.Context) error {
+	conn, _, err := chain.connectN(ctx, len(chain.proxies), chain.verify.Address)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	host, _, _ := net.SplitHostPort(chain.verify.Address)
+	_, err = fmt.Fprintf(conn, "HEAD / HTTP/1.1\r\nHost: %v\r\nConnection: close\r\n\r\n", host)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "HEAD"})
+	if err != nil {
+		err = fmt.Errorf("invalid HTTP response: %v", err)
+		return err
+	}
+	response.Body.Close()
+
+	if chain.verify.ExpectStatus != 0 && response.StatusCode != chain.verify.ExpectStatus {
+		err = fmt.Errorf("status %v received, %v expected", response.StatusCode, chain.verify.ExpectStatus)
+		return err
+	}
+	if chain.verify.ExpectStatus == 0 && response.StatusCode >= 500 {
+		err = fmt.Errorf("status %v received", response.StatusCode)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// garbageProxy starts a SOCKS5 proxy accepting every request, then answering garbage instead of relaying, like a captive portal,
+// and returns it along with the number of connections it accepted
+func garbageProxy(t *testing.T) (proxy, *atomic.Int32) {
+	t.Helper()
+
+	l := listenTCP(t)
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			go func() {
+				defer conn.Close()
+				if _, _, err := fakeSocks5(conn, 0, 0); err != nil {
+					return
+				}
+				conn.Write([]byte("\x00garbage injected by the proxy\r\n\r\n"))
+			}()
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, &accepted
+}
+
+// startHTTPService starts an HTTP server answering status, and returns its address along with the number of requests it received
+func startHTTPService(t *testing.T, status int) (string, *atomic.Int32) {
+	t.Helper()
+
+	var requests atomic.Int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+	return s.Listener.Addr().String(), &requests
+}
+
+// verifiedChain returns a chain named name through the proxy of a direct server, verified with the HTTP service at address
+func verifiedChain(t *testing.T, name string, address string, interval int64, expectStatus int) proxyChain {
+	t.Helper()
+
+	host, port, _ := net.SplitHostPort(startDirectServer(t))
+	p, err := newProxy("socks5", host, port, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain(name, p)
+	chain.verify = &chainVerify{Address: address, Interval: interval, ExpectStatus: expectStatus}
+	t.Cleanup(func() { gVerifications.failed(name) })
+	return chain
+}
+
+func TestVerifyChain(t *testing.T) {
+	echo := startEchoServer(t)
+	service, requests := startHTTPService(t, http.StatusNoContent)
+
+	// A working chain is verified before each connection
+	chain := verifiedChain(t, "verified", service, 0, 0)
+	for i := 1; i <= 2; i++ {
+		conn, _, err := chain.connect(context.Background(), echo)
+		if err != nil {
+			t.Fatalf("connection through a working verified chain failed: %v", err)
+		}
+		checkEcho(t, conn, "verified")
+		conn.Close()
+		if requests.Load() != int32(i) {
+			t.Fatalf("%v verification requests after %v connections", requests.Load(), i)
+		}
+	}
+
+	// A successful verification is reused during the interval
+	requests.Store(0)
+	chain = verifiedChain(t, "cached", service, 60000, http.StatusNoContent)
+	for i := 0; i < 3; i++ {
+		conn, _, err := chain.connect(context.Background(), echo)
+		if err != nil {
+			t.Fatalf("connection through a working verified chain failed: %v", err)
+		}
+		conn.Close()
+	}
+	if requests.Load() != 1 {
+		t.Errorf("%v verification requests within the interval instead of 1", requests.Load())
+	}
+}
+
+func TestVerifyChainStatus(t *testing.T) {
+	echo := startEchoServer(t)
+	failing, _ := startHTTPService(t, http.StatusBadGateway)
+	redirecting, _ := startHTTPService(t, http.StatusFound)
+
+	for _, test := range []struct {
+		describe     string
+		service      string
+		expectStatus int
+		success      bool
+	}{
+		{"5xx status", failing, 0, false},
+		{"unexpected status", redirecting, http.StatusOK, false},
+		{"any non 5xx status", redirecting, 0, true},
+		{"expected status", redirecting, http.StatusFound, true},
+	} {
+		chain := verifiedChain(t, "status", test.service, 0, test.expectStatus)
+		conn, repr, err := chain.connect(context.Background(), echo)
+		if test.success != (err == nil) {
+			t.Errorf("%v: connection error %v", test.describe, err)
+		}
+		if err == nil {
+			conn.Close()
+		} else if !strings.Contains(repr, "verification of chain status") {
+			t.Errorf("%v: verification failure not described in chain representation %q", test.describe, repr)
+		}
+	}
+}
+
+func TestVerifyChainGarbage(t *testing.T) {
+	echo := startEchoServer(t)
+	service, _ := startHTTPService(t, http.StatusOK)
+	p, accepted := garbageProxy(t)
+
+	// The proxy accepts the connection, but the verification through it fails
+	chain := testChain("captive", p)
+	chain.verify = &chainVerify{Address: service}
+	t.Cleanup(func() { gVerifications.failed("captive") })
+	_, _, err := chain.connect(context.Background(), echo)
+	if err == nil || !strings.Contains(err.Error(), "invalid HTTP response") {
+		t.Fatalf("connection through a proxy answering garbage returned %v", err)
+	}
+
+	// Failed verifications are retried like connection failures
+	accepted.Store(0)
+	chain.retry = retryPolicy{MaxAttempts: 3, BaseDelay: 10, Factor: 1}
+	if _, _, err = chain.connect(context.Background(), echo); err == nil {
+		t.Fatal("connection through a proxy answering garbage succeeded")
+	}
+	if accepted.Load() != 6 {
+		t.Errorf("%v connections to the proxy instead of 3 attempts and their verifications", accepted.Load())
+	}
+
+	// Then fall back to a direct connection
+	chain.directFallback = true
+	conn, repr, err := chain.connect(context.Background(), echo)
+	if err != nil {
+		t.Fatalf("direct fallback after failed verifications failed: %v", err)
+	}
+	defer conn.Close()
+	checkEcho(t, conn, "fallback")
+	if !strings.Contains(repr, "verification of chain captive") || !strings.Contains(repr, "direct fallback") {
+		t.Errorf("failed verification and fallback not described in chain representation %q", repr)
+	}
+}
+
+func TestChainDescVerify(t *testing.T) {
+	var desc proxyChainDesc
+	err := json.Unmarshal([]byte(`{"verify": {"address": "www.example.com:80", "interval": 60000, "expectStatus": 200}}`), &desc)
+	if err != nil || desc.Verify == nil || *desc.Verify != (chainVerify{Address: "www.example.com:80", Interval: 60000, ExpectStatus: 200}) {
+		t.Fatalf("verify not parsed: %+v (%v)", desc.Verify, err)
+	}
+
+	for _, verify := range []string{`{"address": "www.example.com"}`, `{}`, `{"address": "www.example.com:80", "interval": -1}`} {
+		desc = proxyChainDesc{}
+		if err = json.Unmarshal([]byte(`{"verify": `+verify+`}`), &desc); err == nil {
+			t.Errorf("invalid verify %v accepted", verify)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package main
+
+// Defines the build metadata, populated at build time with:
+// go build -ldflags "-X main.gVersion=<version> -X main.gCommit=<commit> -X main.gBuildDate=<date>"
+
+import (
+	"fmt"
+)
+
+var gVersion string = "dev"
+var gCommit string = "unknown"
+var gBuildDate string = "unknown"
+
+// versionString returns a description of the build, including the optional build tags support
+func versionString() string {
+	return fmt.Sprintf("bbs %v (commit %v, built %v, PAC support: %v, OpenTelemetry support: %v, transparent server support: %v)", gVersion, gCommit, gBuildDate, gPACcompiled, gOTelCompiled, gTransparentCompiled)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	setArg(t, &gVersion, "1.2.3")
+	setArg(t, &gCommit, "abcdef0")
+	setArg(t, &gBuildDate, "2024-01-02")
+
+	version := versionString()
+	for _, expected := range []string{"bbs 1.2.3", "commit abcdef0", "built 2024-01-02", fmt.Sprintf("PAC support: %v", gPACcompiled)} {
+		if !strings.Contains(version, expected) {
+			t.Errorf("version string %q does not contain %q", version, expected)
+		}
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-version")
+	cmd.Env = append(os.Environ(), testMainEnv+"=1")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("bbs -version failed: %v\n%s", err, output)
+	}
+
+	if strings.TrimSpace(string(output)) != versionString() {
+		t.Fatalf("bbs -version printed %q instead of %q", output, versionString())
+	}
+}